@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudldap/cloudldap/repo"
+	"github.com/cloudldap/cloudldap/server"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// runVerifyCache sends the verify cache extended operation to the running server, then prints the result.
+// The exit code is 0 if no differences, 1 if the differences remain and 2 if failed.
+func runVerifyCache(args []string) int {
+	fs := flag.NewFlagSet("verify-cache", flag.ExitOnError)
+	ldapURL := fs.String("H", "ldap://127.0.0.1:8389", "LDAP URL of the server (ldap:// or ldaps://)")
+	bindDN := fs.String("D", "", "Root DN to bind")
+	bindPW := fs.String("w", "", "Password of the root DN")
+	repair := fs.Bool("repair", false, "Cache the different entries again")
+	jsonOutput := fs.Bool("json", false, "Print the result in JSON")
+	insecure := fs.Bool("insecure-skip-verify", false, "Skip verifying the server certificate of ldaps://")
+	timeout := fs.Duration("timeout", 10*time.Minute, "Timeout of the verification")
+	fs.Usage = func() {
+		_, exe := filepath.Split(os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nUsage:\n\n  %s verify-cache [options]\n\nCompare the cache of the running server with DB.\n\nOptions:\n\n", exe)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	result, err := verifyCache(*ldapURL, *bindDN, *bindPW, &server.VerifyCacheRequest{Repair: *repair}, *insecure, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	} else {
+		for _, d := range result.Diffs {
+			line := fmt.Sprintf("%s\tid: %d", d.Kind, d.ID)
+			if len(d.Fields) > 0 {
+				line += fmt.Sprintf("\tfields: %s", strings.Join(d.Fields, ","))
+			}
+			if d.Repaired {
+				line += "\trepaired"
+			}
+			fmt.Println(line)
+		}
+		fmt.Printf("checked: %d, diffs: %d, repaired: %d\n", result.Checked, len(result.Diffs), result.Repaired)
+	}
+
+	if len(result.Diffs) > result.Repaired {
+		return 1
+	}
+	return 0
+}
+
+func verifyCache(ldapURL, bindDN, bindPW string, req *server.VerifyCacheRequest, insecure bool, timeout time.Duration) (*repo.CacheVerifyResult, error) {
+	u, err := url.Parse(ldapURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL: %s, err: %w", ldapURL, err)
+	}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		conn, err = net.DialTimeout("tcp", u.Host, 10*time.Second)
+	case "ldaps":
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", u.Host, &tls.Config{
+			InsecureSkipVerify: insecure,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URL: %s", ldapURL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %s, err: %w", ldapURL, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// Simple bind
+	bind := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(0), nil, "Bind Request")
+	bind.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	bind.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, bindDN, "User Name"))
+	bind.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, bindPW, "Password"))
+
+	if _, err := ldapRequest(conn, 1, bind); err != nil {
+		return nil, fmt.Errorf("failed to bind: %s, err: %w", bindDN, err)
+	}
+
+	// Extended operation
+	value, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	ext := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(23), nil, "Extended Request")
+	ext.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, server.VerifyCacheExtendedOID, "Request Name"))
+	ext.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, string(value), "Request Value"))
+
+	res, err := ldapRequest(conn, 2, ext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify cache: %w", err)
+	}
+
+	var result repo.CacheVerifyResult
+	for _, child := range res.Children {
+		// responseValue [11] OCTET STRING
+		if child.ClassType == ber.ClassContext && child.Tag == 11 {
+			if err := json.Unmarshal(child.Data.Bytes(), &result); err != nil {
+				return nil, fmt.Errorf("invalid response value: %s, err: %w", child.Data.String(), err)
+			}
+			return &result, nil
+		}
+	}
+	return nil, fmt.Errorf("no response value")
+}
+
+// ldapRequest sends the LDAP message, then returns the protocol op of the response if it succeeded.
+func ldapRequest(conn net.Conn, messageID int64, op *ber.Packet) (*ber.Packet, error) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(op)
+
+	if _, err := conn.Write(packet.Bytes()); err != nil {
+		return nil, err
+	}
+
+	res, err := ber.ReadPacket(conn)
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("connection closed")
+		}
+		return nil, err
+	}
+	if len(res.Children) < 2 || len(res.Children[1].Children) < 3 {
+		return nil, fmt.Errorf("unexpected response")
+	}
+
+	// LDAPResult ::= SEQUENCE { resultCode ENUMERATED, matchedDN LDAPDN, diagnosticMessage LDAPString, ... }
+	result := res.Children[1]
+	code, ok := result.Children[0].Value.(int64)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result code: %v", result.Children[0].Value)
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("result code: %d, message: %s", code, result.Children[2].Data.String())
+	}
+	return result, nil
+}
@@ -0,0 +1,196 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/xerrors"
+)
+
+// BindAttempt is the state of the failed bind attempts for the key
+// (e.g. the source IP, the bind DN or global).
+type BindAttempt struct {
+	Key             string       `db:"key"`
+	Failures        int          `db:"failures"`
+	LastFailureTime time.Time    `db:"last_failure_time"`
+	BannedUntil     sql.NullTime `db:"banned_until"`
+}
+
+// IsBanned returns true if the key is banned at the time.
+func (b *BindAttempt) IsBanned(now time.Time) bool {
+	return b.BannedUntil.Valid && now.Before(b.BannedUntil.Time)
+}
+
+// BindAttemptStore stores the state of the failed bind attempts.
+// This is used for the rate limiting of BIND operation.
+type BindAttemptStore interface {
+	// Find returns the state by the key. It returns nil if no failure is recorded.
+	Find(ctx context.Context, key string) (*BindAttempt, error)
+
+	// RecordFailure increments the failure count of the key then returns the current state.
+	// The failure count is restarted from 1 if the last failure is older than windowStart.
+	RecordFailure(ctx context.Context, key string, now, windowStart time.Time) (*BindAttempt, error)
+
+	// Ban bans the key until the time.
+	Ban(ctx context.Context, key string, until time.Time) error
+
+	// Reset removes the state of the key.
+	Reset(ctx context.Context, key string) error
+
+	// Purge removes the states which are neither failed after the time nor banned.
+	Purge(ctx context.Context, before time.Time) error
+}
+
+// MemoryBindAttemptStore is the BindAttemptStore in the process.
+type MemoryBindAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]*BindAttempt
+}
+
+func NewMemoryBindAttemptStore() *MemoryBindAttemptStore {
+	return &MemoryBindAttemptStore{
+		attempts: map[string]*BindAttempt{},
+	}
+}
+
+func (m *MemoryBindAttemptStore) Find(ctx context.Context, key string) (*BindAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.attempts[key]
+	if !ok {
+		return nil, nil
+	}
+	copied := *a
+	return &copied, nil
+}
+
+func (m *MemoryBindAttemptStore) RecordFailure(ctx context.Context, key string, now, windowStart time.Time) (*BindAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.attempts[key]
+	if !ok {
+		a = &BindAttempt{
+			Key: key,
+		}
+		m.attempts[key] = a
+	}
+	if a.LastFailureTime.Before(windowStart) {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.LastFailureTime = now
+
+	copied := *a
+	return &copied, nil
+}
+
+func (m *MemoryBindAttemptStore) Ban(ctx context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.attempts[key]
+	if !ok {
+		a = &BindAttempt{
+			Key: key,
+		}
+		m.attempts[key] = a
+	}
+	a.BannedUntil = sql.NullTime{Time: until, Valid: true}
+	return nil
+}
+
+func (m *MemoryBindAttemptStore) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.attempts, key)
+	return nil
+}
+
+func (m *MemoryBindAttemptStore) Purge(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, v := range m.attempts {
+		if v.LastFailureTime.Before(before) && !v.IsBanned(before) {
+			delete(m.attempts, k)
+		}
+	}
+	return nil
+}
+
+// DBBindAttemptStore is the BindAttemptStore shared across the instances through the DB.
+type DBBindAttemptStore struct {
+	db *sqlx.DB
+}
+
+func (r *DBRepository) BindAttemptStore() BindAttemptStore {
+	return &DBBindAttemptStore{
+		db: r.db,
+	}
+}
+
+func (d *DBBindAttemptStore) Find(ctx context.Context, key string) (*BindAttempt, error) {
+	var a BindAttempt
+	err := d.db.GetContext(ctx, &a, `
+SELECT key, failures, last_failure_time, banned_until FROM bind_attempt WHERE key = $1
+`, key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, xerrors.Errorf("Failed to find bind attempt. key: %s, err: %w", key, err)
+	}
+	return &a, nil
+}
+
+func (d *DBBindAttemptStore) RecordFailure(ctx context.Context, key string, now, windowStart time.Time) (*BindAttempt, error) {
+	var a BindAttempt
+	err := d.db.GetContext(ctx, &a, `
+INSERT INTO bind_attempt (key, failures, last_failure_time)
+VALUES ($1, 1, $2)
+ON CONFLICT (key) DO UPDATE SET
+	failures = CASE WHEN bind_attempt.last_failure_time < $3 THEN 1 ELSE bind_attempt.failures + 1 END,
+	last_failure_time = $2
+RETURNING key, failures, last_failure_time, banned_until
+`, key, now, windowStart)
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to record bind failure. key: %s, err: %w", key, err)
+	}
+	return &a, nil
+}
+
+func (d *DBBindAttemptStore) Ban(ctx context.Context, key string, until time.Time) error {
+	_, err := d.db.ExecContext(ctx, `
+INSERT INTO bind_attempt (key, failures, last_failure_time, banned_until)
+VALUES ($1, 0, NOW(), $2)
+ON CONFLICT (key) DO UPDATE SET banned_until = $2
+`, key, until)
+	if err != nil {
+		return xerrors.Errorf("Failed to ban. key: %s, err: %w", key, err)
+	}
+	return nil
+}
+
+func (d *DBBindAttemptStore) Reset(ctx context.Context, key string) error {
+	_, err := d.db.ExecContext(ctx, `DELETE FROM bind_attempt WHERE key = $1`, key)
+	if err != nil {
+		return xerrors.Errorf("Failed to reset bind attempt. key: %s, err: %w", key, err)
+	}
+	return nil
+}
+
+func (d *DBBindAttemptStore) Purge(ctx context.Context, before time.Time) error {
+	_, err := d.db.ExecContext(ctx, `
+DELETE FROM bind_attempt WHERE last_failure_time < $1 AND (banned_until IS NULL OR banned_until < $1)
+`, before)
+	if err != nil {
+		return xerrors.Errorf("Failed to purge bind attempts. err: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+//go:build test
+
+package repo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryBindAttemptStore(t *testing.T) {
+	ctx := context.Background()
+	base := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	window := 10 * time.Minute
+
+	testcases := []struct {
+		Name             string
+		Failures         []time.Duration
+		Ban              time.Duration
+		Now              time.Duration
+		ExpectedFailures int
+		ExpectedBanned   bool
+	}{
+		{
+			"first failure",
+			[]time.Duration{0},
+			0,
+			time.Second,
+			1,
+			false,
+		},
+		{
+			"failures within the window",
+			[]time.Duration{0, time.Minute, 2 * time.Minute},
+			0,
+			3 * time.Minute,
+			3,
+			false,
+		},
+		{
+			"restart the count after the window",
+			[]time.Duration{0, time.Minute, 12 * time.Minute},
+			0,
+			13 * time.Minute,
+			1,
+			false,
+		},
+		{
+			"banned",
+			[]time.Duration{0, time.Minute},
+			15 * time.Minute,
+			3 * time.Minute,
+			2,
+			true,
+		},
+		{
+			"ban expired",
+			[]time.Duration{0, time.Minute},
+			15 * time.Minute,
+			20 * time.Minute,
+			2,
+			false,
+		},
+	}
+
+	for i, tc := range testcases {
+		store := NewMemoryBindAttemptStore()
+		key := "ip:192.0.2.1"
+
+		var last time.Time
+		for _, f := range tc.Failures {
+			last = base.Add(f)
+			if _, err := store.RecordFailure(ctx, key, last, last.Add(-window)); err != nil {
+				t.Fatalf("Unexpected error on %d %s: %+v", i, tc.Name, err)
+			}
+		}
+		if tc.Ban > 0 {
+			if err := store.Ban(ctx, key, last.Add(tc.Ban)); err != nil {
+				t.Fatalf("Unexpected error on %d %s: %+v", i, tc.Name, err)
+			}
+		}
+
+		a, err := store.Find(ctx, key)
+		if err != nil {
+			t.Fatalf("Unexpected error on %d %s: %+v", i, tc.Name, err)
+		}
+		if a.Failures != tc.ExpectedFailures {
+			t.Errorf("Unexpected failures on %d %s: expected %d, got %d", i, tc.Name, tc.ExpectedFailures, a.Failures)
+		}
+		if a.IsBanned(base.Add(tc.Now)) != tc.ExpectedBanned {
+			t.Errorf("Unexpected banned on %d %s: expected %v", i, tc.Name, tc.ExpectedBanned)
+		}
+	}
+}
+
+func TestMemoryBindAttemptStoreResetAndPurge(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	store := NewMemoryBindAttemptStore()
+	store.RecordFailure(ctx, "dn:uid=user1", now, now.Add(-time.Minute))
+	store.RecordFailure(ctx, "dn:uid=user2", now, now.Add(-time.Minute))
+	store.RecordFailure(ctx, "ip:192.0.2.1", now, now.Add(-time.Minute))
+	store.Ban(ctx, "ip:192.0.2.1", now.Add(time.Hour))
+
+	store.Reset(ctx, "dn:uid=user1")
+	if a, _ := store.Find(ctx, "dn:uid=user1"); a != nil {
+		t.Errorf("Unexpected state after reset: %v", a)
+	}
+
+	store.Purge(ctx, now.Add(time.Minute))
+	if a, _ := store.Find(ctx, "dn:uid=user2"); a != nil {
+		t.Errorf("Unexpected state after purge: %v", a)
+	}
+	if a, _ := store.Find(ctx, "ip:192.0.2.1"); a == nil {
+		t.Errorf("Banned state must not be purged")
+	}
+}
@@ -0,0 +1,173 @@
+package repo
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// The cache DB holds all entries of DefaultRepository in the process to resolve the DN and evaluate the search filter.
+// The implementation is selected by the name at startup (DBRepositoryConfig.CacheIndex):
+//   - reindexer: Reindexer with the builtin binding. It's available only when it's built with cgo.
+//   - native: The pure Go in-memory index.
+// The query interface follows the semantics of Reindexer to switch them without changing the callers.
+
+// Conditions of CacheQuery.Where
+const (
+	// Any of the keys equals to any of the values
+	cacheEQ = iota
+	// Any of the values is greater than or equal to the key
+	cacheGE
+	// Any of the values is less than or equal to the key
+	cacheLE
+	// Any of the values is less than the key
+	cacheLT
+	// Same as cacheEQ, for the multiple keys
+	cacheSET
+	// All of the keys are in the values
+	cacheALLSET
+	// No values
+	cacheEMPTY
+	// Any of the values matches the pattern. '%' matches any sequence and '_' matches any character.
+	// '\' escapes them, see escapeLike
+	cacheLIKE
+)
+
+// CacheItem is the document stored in the cache DB.
+type CacheItem struct {
+	ID          int64                  `json:"id"`
+	Version     int64                  `json:"rev"`
+	ParentID    int64                  `json:"parentId"`
+	Path        []int64                `json:"path"`
+	IsContainer bool                   `json:"isContainer"`
+	RDNOrig     string                 `json:"rdnOrig"`
+	RDNNorm     string                 `json:"rdnNorm"`
+	AttrsOrig   map[string][]string    `json:"attrsOrig"`
+	AttrsNorm   map[string]interface{} `json:"attrsNorm"`
+}
+
+// CacheIndexDef defines the index of the field in the cache DB.
+type CacheIndexDef struct {
+	// JSON path of the field (e.g. attrsNorm.cn)
+	Name string
+	// "string" or "int64"
+	FieldType string
+	IsArray   bool
+}
+
+type CacheDB interface {
+	AddIndex(def CacheIndexDef) error
+	// Truncate deletes all items. The indexes are kept.
+	Truncate() error
+	Query() CacheQuery
+	BeginTx() (CacheTx, error)
+	Close()
+}
+
+// CacheTx is the transaction of the cache DB.
+// The query from the transaction reads only the committed items, the changes are applied on commit.
+type CacheTx interface {
+	Query() CacheQuery
+	Upsert(item *CacheItem) error
+	Commit() error
+	Rollback() error
+}
+
+// CacheQuery is the query builder of the cache DB.
+// The conditions are joined by AND unless Or() or Not() is called before the condition or the bracket.
+type CacheQuery interface {
+	Select(fields ...string) CacheQuery
+	Where(index string, condition int, keys interface{}) CacheQuery
+	WhereInt64(index string, condition int, keys ...int64) CacheQuery
+	WhereString(index string, condition int, keys ...string) CacheQuery
+	WhereBool(index string, condition int, keys ...bool) CacheQuery
+	Not() CacheQuery
+	Or() CacheQuery
+	OpenBracket() CacheQuery
+	CloseBracket() CacheQuery
+	Limit(limit int) CacheQuery
+	Offset(offset int) CacheQuery
+	ReqTotal() CacheQuery
+	// Set adds the field to be updated by UpdateCtx
+	Set(field string, value interface{}) CacheQuery
+	ExecCtx(ctx context.Context) CacheIterator
+	ExecToJsonCtx(ctx context.Context) CacheJSONIterator
+	GetJsonCtx(ctx context.Context) ([]byte, bool)
+	DeleteCtx(ctx context.Context) (int, error)
+	UpdateCtx(ctx context.Context) error
+}
+
+// CacheIterator iterates the result as *CacheEntry.
+type CacheIterator interface {
+	Next() bool
+	Object() interface{}
+	Count() int
+	TotalCount() int
+	Error() error
+	Close()
+}
+
+// CacheJSONIterator iterates the result as JSON. It has only the selected fields if Select is called.
+type CacheJSONIterator interface {
+	Next() bool
+	JSON() []byte
+	Error() error
+	Close()
+}
+
+// CacheDBFactory creates the CacheDB with the namespace for the entries.
+type CacheDBFactory func() (CacheDB, error)
+
+var (
+	cacheFactoriesMu sync.RWMutex
+	cacheFactories   = map[string]CacheDBFactory{}
+)
+
+// RegisterCacheDB makes the cache DB implementation available by the name.
+// It panics if the factory is nil or the name is registered twice.
+func RegisterCacheDB(name string, factory CacheDBFactory) {
+	cacheFactoriesMu.Lock()
+	defer cacheFactoriesMu.Unlock()
+
+	if factory == nil {
+		panic("repo: RegisterCacheDB factory is nil")
+	}
+	if _, dup := cacheFactories[name]; dup {
+		panic("repo: RegisterCacheDB called twice for name " + name)
+	}
+	cacheFactories[name] = factory
+}
+
+// CacheDBNames returns the sorted list of the registered cache DB implementations.
+func CacheDBNames() []string {
+	cacheFactoriesMu.RLock()
+	defer cacheFactoriesMu.RUnlock()
+
+	names := make([]string, 0, len(cacheFactories))
+	for k := range cacheFactories {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewCacheDB creates the cache DB by the name.
+// If the name is empty, reindexer is used if it's available, otherwise native is used.
+func NewCacheDB(name string) (CacheDB, error) {
+	cacheFactoriesMu.RLock()
+	if name == "" {
+		name = "native"
+		if _, ok := cacheFactories["reindexer"]; ok {
+			name = "reindexer"
+		}
+	}
+	factory, ok := cacheFactories[name]
+	cacheFactoriesMu.RUnlock()
+	if !ok {
+		return nil, xerrors.Errorf("Unsupported cache index: %s, supported: %v", name, CacheDBNames())
+	}
+
+	return factory()
+}
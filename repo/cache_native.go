@@ -0,0 +1,541 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cloudldap/cloudldap/util"
+	"golang.org/x/xerrors"
+)
+
+// nativeCacheDB is the pure Go CacheDB. It doesn't require cgo, so it can be used for the static build.
+// The items are indexed by id (pk), parentId, rdnNorm, path and the fields added by AddIndex.
+// The other fields are evaluated by scanning the candidates selected by the indexes, or all items.
+
+func init() {
+	RegisterCacheDB("native", func() (CacheDB, error) {
+		return newNativeCacheDB(), nil
+	})
+}
+
+type nativeCacheDB struct {
+	mu    sync.RWMutex
+	items map[int64]*nativeCacheItem
+	// Items in the order of the ID to scan them
+	sorted  []*nativeCacheItem
+	indexes map[string]*nativeCacheIndex
+}
+
+func newNativeCacheDB() *nativeCacheDB {
+	return &nativeCacheDB{
+		items: map[int64]*nativeCacheItem{},
+		indexes: map[string]*nativeCacheIndex{
+			"parentId": newNativeCacheIndex("int64"),
+			"rdnNorm":  newNativeCacheIndex("string"),
+			"path":     newNativeCacheIndex("int64"),
+		},
+	}
+}
+
+func (c *nativeCacheDB) AddIndex(def CacheIndexDef) error {
+	if def.FieldType != "string" && def.FieldType != "int64" {
+		return xerrors.Errorf("Unsupported field type of the index. name: %s, type: %s", def.Name, def.FieldType)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.indexes[def.Name]; ok {
+		return nil
+	}
+	x := newNativeCacheIndex(def.FieldType)
+	for _, item := range c.items {
+		x.add(item.ID, item.fields[def.Name])
+	}
+	c.indexes[def.Name] = x
+
+	return nil
+}
+
+func (c *nativeCacheDB) Truncate() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = map[int64]*nativeCacheItem{}
+	c.sorted = nil
+	for k, x := range c.indexes {
+		c.indexes[k] = newNativeCacheIndex(x.fieldType)
+	}
+	return nil
+}
+
+func (c *nativeCacheDB) Query() CacheQuery {
+	return newNativeCacheQuery(c, nil)
+}
+
+func (c *nativeCacheDB) BeginTx() (CacheTx, error) {
+	return &nativeCacheTx{db: c}, nil
+}
+
+func (c *nativeCacheDB) Close() {
+}
+
+// put adds or replaces the item. It must be called with the write lock.
+func (c *nativeCacheDB) put(item *nativeCacheItem) {
+	if old, ok := c.items[item.ID]; ok {
+		for k, x := range c.indexes {
+			x.remove(old.ID, old.fields[k])
+		}
+		c.sorted[c.position(item.ID)] = item
+	} else if n := len(c.sorted); n == 0 || c.sorted[n-1].ID < item.ID {
+		// The new entry has the largest ID usually
+		c.sorted = append(c.sorted, item)
+	} else {
+		i := c.position(item.ID)
+		c.sorted = append(c.sorted, nil)
+		copy(c.sorted[i+1:], c.sorted[i:])
+		c.sorted[i] = item
+	}
+
+	c.items[item.ID] = item
+	for k, x := range c.indexes {
+		x.add(item.ID, item.fields[k])
+	}
+}
+
+// remove deletes the item. It must be called with the write lock.
+func (c *nativeCacheDB) remove(id int64) {
+	old, ok := c.items[id]
+	if !ok {
+		return
+	}
+	for k, x := range c.indexes {
+		x.remove(id, old.fields[k])
+	}
+	delete(c.items, id)
+
+	i := c.position(id)
+	copy(c.sorted[i:], c.sorted[i+1:])
+	c.sorted[len(c.sorted)-1] = nil
+	c.sorted = c.sorted[:len(c.sorted)-1]
+}
+
+// position returns the index of the ID in the sorted items, or where it should be inserted.
+func (c *nativeCacheDB) position(id int64) int {
+	return sort.Search(len(c.sorted), func(i int) bool {
+		return c.sorted[i].ID >= id
+	})
+}
+
+// nativeCacheTx buffers the changes, then applies them at once on commit.
+type nativeCacheTx struct {
+	db       *nativeCacheDB
+	ops      []func()
+	finished bool
+}
+
+func (t *nativeCacheTx) Query() CacheQuery {
+	return newNativeCacheQuery(t.db, t)
+}
+
+func (t *nativeCacheTx) Upsert(item *CacheItem) error {
+	if t.finished {
+		return xerrors.Errorf("Cache transaction is already finished")
+	}
+	i := newNativeCacheItem(item)
+	t.ops = append(t.ops, func() {
+		t.db.put(i)
+	})
+	return nil
+}
+
+func (t *nativeCacheTx) Commit() error {
+	if t.finished {
+		return xerrors.Errorf("Cache transaction is already finished")
+	}
+	t.finished = true
+
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+
+	for _, op := range t.ops {
+		op()
+	}
+	t.ops = nil
+
+	return nil
+}
+
+func (t *nativeCacheTx) Rollback() error {
+	t.finished = true
+	t.ops = nil
+	return nil
+}
+
+// nativeCacheItem is the stored item. It must not be modified after storing it.
+type nativeCacheItem struct {
+	*CacheItem
+	// field name => values in string for the query
+	fields map[string][]string
+}
+
+func newNativeCacheItem(item *CacheItem) *nativeCacheItem {
+	path := make([]string, len(item.Path))
+	for i, v := range item.Path {
+		path[i] = strconv.FormatInt(v, 10)
+	}
+
+	fields := make(map[string][]string, len(item.AttrsNorm)+7)
+	fields["id"] = []string{strconv.FormatInt(item.ID, 10)}
+	fields["rev"] = []string{strconv.FormatInt(item.Version, 10)}
+	fields["parentId"] = []string{strconv.FormatInt(item.ParentID, 10)}
+	fields["path"] = path
+	fields["isContainer"] = []string{strconv.FormatBool(item.IsContainer)}
+	fields["rdnNorm"] = []string{item.RDNNorm}
+	fields["rdnOrig"] = []string{item.RDNOrig}
+	for k, v := range item.AttrsNorm {
+		fields["attrsNorm."+k] = nativeCacheKeys(v)
+	}
+
+	return &nativeCacheItem{
+		CacheItem: item,
+		fields:    fields,
+	}
+}
+
+// setCacheItemField updates the field of the item by the value of CacheQuery.Set.
+func setCacheItemField(item *CacheItem, field string, value interface{}) error {
+	ok := true
+
+	switch field {
+	case "rev":
+		item.Version, ok = value.(int64)
+	case "parentId":
+		item.ParentID, ok = value.(int64)
+	case "path":
+		item.Path, ok = value.([]int64)
+	case "isContainer":
+		item.IsContainer, ok = value.(bool)
+	case "rdnNorm":
+		item.RDNNorm, ok = value.(string)
+	case "rdnOrig":
+		item.RDNOrig, ok = value.(string)
+	default:
+		return xerrors.Errorf("Unsupported field to update. field: %s", field)
+	}
+	if !ok {
+		return xerrors.Errorf("Unexpected value type to update. field: %s, value: %v", field, value)
+	}
+	return nil
+}
+
+func (i *nativeCacheItem) entry() *CacheEntry {
+	attrsOrig := make(CacheAttrsOrig, len(i.AttrsOrig))
+	for k, v := range i.AttrsOrig {
+		attrsOrig[k] = append([]string{}, v...)
+	}
+	return &CacheEntry{
+		ID:          i.ID,
+		Version:     i.Version,
+		ParentID:    i.ParentID,
+		Path:        append([]int64{}, i.Path...),
+		IsContainer: i.IsContainer,
+		RDNNorm:     i.RDNNorm,
+		RDNOrig:     i.RDNOrig,
+		AttrsOrig:   attrsOrig,
+	}
+}
+
+// json returns the item in JSON which has only the selected fields.
+// The nested field like "attrsNorm.member" is supported.
+func (i *nativeCacheItem) json(fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		return json.Marshal(i.CacheItem)
+	}
+
+	m := make(map[string]interface{}, len(fields))
+	attrsNorm := map[string]interface{}{}
+	for _, f := range fields {
+		switch f {
+		case "id":
+			m[f] = i.ID
+		case "rev":
+			m[f] = i.Version
+		case "parentId":
+			m[f] = i.ParentID
+		case "path":
+			m[f] = i.Path
+		case "isContainer":
+			m[f] = i.IsContainer
+		case "rdnNorm":
+			m[f] = i.RDNNorm
+		case "rdnOrig":
+			m[f] = i.RDNOrig
+		case "attrsOrig":
+			m[f] = i.AttrsOrig
+		case "attrsNorm":
+			for k, v := range i.AttrsNorm {
+				attrsNorm[k] = v
+			}
+			m[f] = attrsNorm
+		default:
+			if !strings.HasPrefix(f, "attrsNorm.") {
+				continue
+			}
+			name := strings.TrimPrefix(f, "attrsNorm.")
+			v, ok := i.AttrsNorm[name]
+			if !ok {
+				continue
+			}
+			attrsNorm[name] = v
+			m["attrsNorm"] = attrsNorm
+		}
+	}
+	return json.Marshal(m)
+}
+
+// nativeCacheKeys converts the keys or the values to string for comparison.
+func nativeCacheKeys(keys interface{}) []string {
+	switch v := keys.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case int64:
+		return []string{strconv.FormatInt(v, 10)}
+	case int:
+		return []string{strconv.Itoa(v)}
+	case bool:
+		return []string{strconv.FormatBool(v)}
+	case json.Number:
+		return []string{v.String()}
+	case []int64:
+		rtn := make([]string, len(v))
+		for i, vv := range v {
+			rtn[i] = strconv.FormatInt(vv, 10)
+		}
+		return rtn
+	case []bool:
+		rtn := make([]string, len(v))
+		for i, vv := range v {
+			rtn[i] = strconv.FormatBool(vv)
+		}
+		return rtn
+	case []interface{}:
+		rtn := make([]string, 0, len(v))
+		for _, vv := range v {
+			rtn = append(rtn, nativeCacheKeys(vv)...)
+		}
+		return rtn
+	}
+	return []string{fmt.Sprint(keys)}
+}
+
+// nativeCacheIndex is the hash index of the field. It also works as the tree index for the range and prefix lookup
+// by the sorted keys which are built lazily after the keys are changed.
+type nativeCacheIndex struct {
+	fieldType string
+	postings  map[string]util.Int64Set
+
+	// The readers sort the keys concurrently under the read lock of the DB
+	sortMu sync.Mutex
+	sorted bool
+	keys   []string
+	nums   []int64
+}
+
+func newNativeCacheIndex(fieldType string) *nativeCacheIndex {
+	return &nativeCacheIndex{
+		fieldType: fieldType,
+		postings:  map[string]util.Int64Set{},
+	}
+}
+
+func (x *nativeCacheIndex) add(id int64, values []string) {
+	for _, v := range values {
+		ids, ok := x.postings[v]
+		if !ok {
+			ids = util.NewInt64Set()
+			x.postings[v] = ids
+			x.sorted = false
+		}
+		ids.Add(id)
+	}
+}
+
+func (x *nativeCacheIndex) remove(id int64, values []string) {
+	for _, v := range values {
+		if ids, ok := x.postings[v]; ok {
+			delete(ids, id)
+			if len(ids) == 0 {
+				delete(x.postings, v)
+				x.sorted = false
+			}
+		}
+	}
+}
+
+// matchedKeys returns the keys which match the condition. It returns false if the index can't be used for the condition.
+// The ALLSET condition returns the keys which all of them must be matched.
+func (x *nativeCacheIndex) matchedKeys(cond int, keys []string) ([]string, bool) {
+	switch cond {
+	case cacheEQ, cacheSET:
+		return keys, true
+
+	case cacheALLSET:
+		return keys, len(keys) > 0
+
+	case cacheGE, cacheLE, cacheLT:
+		if x.fieldType != "int64" || len(keys) == 0 {
+			return nil, false
+		}
+		key, err := strconv.ParseInt(keys[0], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		x.sort()
+
+		var from, to int
+		switch cond {
+		case cacheGE:
+			from = sort.Search(len(x.nums), func(i int) bool { return x.nums[i] >= key })
+			to = len(x.nums)
+		case cacheLE:
+			to = sort.Search(len(x.nums), func(i int) bool { return x.nums[i] > key })
+		case cacheLT:
+			to = sort.Search(len(x.nums), func(i int) bool { return x.nums[i] >= key })
+		}
+		return x.keys[from:to], true
+
+	case cacheLIKE:
+		if x.fieldType != "string" || len(keys) == 0 {
+			return nil, false
+		}
+		prefix := likePrefix(keys[0])
+		if prefix == "" {
+			return nil, false
+		}
+		x.sort()
+
+		from := sort.SearchStrings(x.keys, prefix)
+		to := from
+		for to < len(x.keys) && strings.HasPrefix(x.keys[to], prefix) {
+			to++
+		}
+		return x.keys[from:to], true
+	}
+
+	return nil, false
+}
+
+// estimate returns the upper bound of the number of the IDs which match the condition.
+func (x *nativeCacheIndex) estimate(cond int, keys []string) (int, bool) {
+	matched, ok := x.matchedKeys(cond, keys)
+	if !ok {
+		return 0, false
+	}
+
+	size := 0
+	for i, k := range matched {
+		n := len(x.postings[k])
+		if cond == cacheALLSET {
+			if i == 0 || n < size {
+				size = n
+			}
+		} else {
+			size += n
+		}
+	}
+	return size, true
+}
+
+// lookup returns the IDs which match the condition. It returns false if the index can't be used for the condition.
+// The returned set must not be modified.
+func (x *nativeCacheIndex) lookup(cond int, keys []string) (util.Int64Set, bool) {
+	matched, ok := x.matchedKeys(cond, keys)
+	if !ok {
+		return nil, false
+	}
+
+	if cond == cacheALLSET {
+		// Intersect from the smallest one
+		base := matched[0]
+		for _, k := range matched[1:] {
+			if len(x.postings[k]) < len(x.postings[base]) {
+				base = k
+			}
+		}
+		ids := util.NewInt64Set()
+		for id := range x.postings[base] {
+			found := true
+			for _, k := range matched {
+				if _, ok := x.postings[k][id]; !ok {
+					found = false
+					break
+				}
+			}
+			if found {
+				ids.Add(id)
+			}
+		}
+		return ids, true
+	}
+
+	if len(matched) == 1 {
+		return x.postings[matched[0]], true
+	}
+	ids := util.NewInt64Set()
+	for _, k := range matched {
+		for id := range x.postings[k] {
+			ids.Add(id)
+		}
+	}
+	return ids, true
+}
+
+func (x *nativeCacheIndex) sort() {
+	x.sortMu.Lock()
+	defer x.sortMu.Unlock()
+
+	if x.sorted {
+		return
+	}
+
+	x.keys = x.keys[:0]
+	x.nums = x.nums[:0]
+
+	if x.fieldType == "int64" {
+		type pair struct {
+			key string
+			num int64
+		}
+		pairs := make([]pair, 0, len(x.postings))
+		for k := range x.postings {
+			n, err := strconv.ParseInt(k, 10, 64)
+			if err != nil {
+				continue
+			}
+			pairs = append(pairs, pair{k, n})
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			return pairs[i].num < pairs[j].num
+		})
+		for _, p := range pairs {
+			x.keys = append(x.keys, p.key)
+			x.nums = append(x.nums, p.num)
+		}
+	} else {
+		for k := range x.postings {
+			x.keys = append(x.keys, k)
+		}
+		sort.Strings(x.keys)
+	}
+
+	x.sorted = true
+}
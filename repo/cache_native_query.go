@@ -0,0 +1,665 @@
+package repo
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cloudldap/cloudldap/util"
+	"golang.org/x/xerrors"
+)
+
+const (
+	nativeOpAnd = iota
+	nativeOpOr
+	nativeOpNot
+)
+
+// nativeCacheTerm is the condition or the bracket of the query.
+// It's joined with the previous term by the op. OR binds tighter than AND like Reindexer,
+// e.g. "a AND b OR c" is evaluated as "a AND (b OR c)".
+type nativeCacheTerm struct {
+	op     int
+	field  string
+	cond   int
+	keys   []string
+	keySet map[string]struct{}
+	// The first key as integer for the ordering conditions
+	keyNum   int64
+	keyIsNum bool
+	bracket  bool
+	terms    []*nativeCacheTerm
+}
+
+type nativeCacheQuery struct {
+	db *nativeCacheDB
+	tx *nativeCacheTx
+
+	terms []*nativeCacheTerm
+	// Opened brackets
+	stack    []*nativeCacheTerm
+	nextOp   int
+	fields   []string
+	limit    int
+	offset   int
+	reqTotal bool
+	sets     []nativeCacheSet
+}
+
+type nativeCacheSet struct {
+	field string
+	value interface{}
+}
+
+func newNativeCacheQuery(db *nativeCacheDB, tx *nativeCacheTx) *nativeCacheQuery {
+	return &nativeCacheQuery{
+		db:    db,
+		tx:    tx,
+		limit: -1,
+	}
+}
+
+func (q *nativeCacheQuery) add(t *nativeCacheTerm) {
+	t.op = q.nextOp
+	q.nextOp = nativeOpAnd
+
+	if len(q.stack) > 0 {
+		b := q.stack[len(q.stack)-1]
+		b.terms = append(b.terms, t)
+	} else {
+		q.terms = append(q.terms, t)
+	}
+}
+
+func (q *nativeCacheQuery) Select(fields ...string) CacheQuery {
+	q.fields = append(q.fields, fields...)
+	return q
+}
+
+func (q *nativeCacheQuery) Where(index string, condition int, keys interface{}) CacheQuery {
+	t := &nativeCacheTerm{
+		field: index,
+		cond:  condition,
+		keys:  nativeCacheKeys(keys),
+	}
+	if len(t.keys) > 0 {
+		n, err := strconv.ParseInt(t.keys[0], 10, 64)
+		t.keyNum, t.keyIsNum = n, err == nil
+	}
+	if len(t.keys) > 8 {
+		t.keySet = make(map[string]struct{}, len(t.keys))
+		for _, k := range t.keys {
+			t.keySet[k] = struct{}{}
+		}
+	}
+	q.add(t)
+	return q
+}
+
+func (q *nativeCacheQuery) WhereInt64(index string, condition int, keys ...int64) CacheQuery {
+	return q.Where(index, condition, keys)
+}
+
+func (q *nativeCacheQuery) WhereString(index string, condition int, keys ...string) CacheQuery {
+	return q.Where(index, condition, keys)
+}
+
+func (q *nativeCacheQuery) WhereBool(index string, condition int, keys ...bool) CacheQuery {
+	return q.Where(index, condition, keys)
+}
+
+func (q *nativeCacheQuery) Not() CacheQuery {
+	q.nextOp = nativeOpNot
+	return q
+}
+
+func (q *nativeCacheQuery) Or() CacheQuery {
+	q.nextOp = nativeOpOr
+	return q
+}
+
+func (q *nativeCacheQuery) OpenBracket() CacheQuery {
+	t := &nativeCacheTerm{
+		bracket: true,
+	}
+	q.add(t)
+	q.stack = append(q.stack, t)
+	return q
+}
+
+func (q *nativeCacheQuery) CloseBracket() CacheQuery {
+	if len(q.stack) > 0 {
+		q.stack = q.stack[:len(q.stack)-1]
+	}
+	return q
+}
+
+func (q *nativeCacheQuery) Limit(limit int) CacheQuery {
+	q.limit = limit
+	return q
+}
+
+func (q *nativeCacheQuery) Offset(offset int) CacheQuery {
+	q.offset = offset
+	return q
+}
+
+func (q *nativeCacheQuery) ReqTotal() CacheQuery {
+	q.reqTotal = true
+	return q
+}
+
+func (q *nativeCacheQuery) Set(field string, value interface{}) CacheQuery {
+	q.sets = append(q.sets, nativeCacheSet{field, value})
+	return q
+}
+
+func (q *nativeCacheQuery) ExecCtx(ctx context.Context) CacheIterator {
+	iter := &nativeCacheIterator{}
+	if err := ctx.Err(); err != nil {
+		iter.err = err
+		return iter
+	}
+
+	q.db.mu.RLock()
+	defer q.db.mu.RUnlock()
+
+	ids, total := q.find()
+	iter.entries = make([]*CacheEntry, len(ids))
+	for i, id := range ids {
+		iter.entries[i] = q.db.items[id].entry()
+	}
+	if q.reqTotal {
+		iter.total = total
+	}
+	return iter
+}
+
+func (q *nativeCacheQuery) ExecToJsonCtx(ctx context.Context) CacheJSONIterator {
+	iter := &nativeCacheJSONIterator{}
+	if err := ctx.Err(); err != nil {
+		iter.err = err
+		return iter
+	}
+
+	q.db.mu.RLock()
+	defer q.db.mu.RUnlock()
+
+	ids, _ := q.find()
+	iter.jsons = make([][]byte, len(ids))
+	for i, id := range ids {
+		b, err := q.db.items[id].json(q.fields)
+		if err != nil {
+			iter.jsons = nil
+			iter.err = xerrors.Errorf("Failed to marshal cache item. id: %d, err: %w", id, err)
+			return iter
+		}
+		iter.jsons[i] = b
+	}
+	return iter
+}
+
+func (q *nativeCacheQuery) GetJsonCtx(ctx context.Context) ([]byte, bool) {
+	iter := q.Limit(1).ExecToJsonCtx(ctx)
+	defer iter.Close()
+
+	if !iter.Next() {
+		return nil, false
+	}
+	return iter.JSON(), true
+}
+
+// DeleteCtx deletes the matched items. In the transaction, it returns the number of the items matched now,
+// and they are deleted on commit.
+func (q *nativeCacheQuery) DeleteCtx(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if q.tx != nil {
+		if q.tx.finished {
+			return 0, xerrors.Errorf("Cache transaction is already finished")
+		}
+		q.db.mu.RLock()
+		ids, _ := q.find()
+		q.db.mu.RUnlock()
+
+		q.tx.ops = append(q.tx.ops, func() {
+			q.delete()
+		})
+		return len(ids), nil
+	}
+
+	q.db.mu.Lock()
+	defer q.db.mu.Unlock()
+
+	return q.delete(), nil
+}
+
+// UpdateCtx updates the fields added by Set of the matched items. In the transaction, they are updated on commit.
+func (q *nativeCacheQuery) UpdateCtx(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, s := range q.sets {
+		if err := setCacheItemField(&CacheItem{}, s.field, s.value); err != nil {
+			return err
+		}
+	}
+
+	if q.tx != nil {
+		if q.tx.finished {
+			return xerrors.Errorf("Cache transaction is already finished")
+		}
+		q.tx.ops = append(q.tx.ops, func() {
+			q.update()
+		})
+		return nil
+	}
+
+	q.db.mu.Lock()
+	defer q.db.mu.Unlock()
+
+	q.update()
+	return nil
+}
+
+// delete must be called with the write lock.
+func (q *nativeCacheQuery) delete() int {
+	ids, _ := q.find()
+	for _, id := range ids {
+		q.db.remove(id)
+	}
+	return len(ids)
+}
+
+// update must be called with the write lock. The fields are already validated.
+func (q *nativeCacheQuery) update() {
+	ids, _ := q.find()
+	for _, id := range ids {
+		item := *q.db.items[id].CacheItem
+		for _, s := range q.sets {
+			setCacheItemField(&item, s.field, s.value)
+		}
+		q.db.put(newNativeCacheItem(&item))
+	}
+}
+
+// find returns the sorted IDs of the matched items in the page, and the total number of the matched items.
+// The total is counted only if it's requested. It must be called with the lock.
+func (q *nativeCacheQuery) find() ([]int64, int) {
+	ids := []int64{}
+	total := 0
+
+	// Stop when the page is filled if the total isn't required
+	end := -1
+	if q.limit >= 0 && !q.reqTotal {
+		end = q.offset + q.limit
+	}
+
+	collect := func(item *nativeCacheItem) bool {
+		if !q.matchTerms(item, q.terms) {
+			return true
+		}
+		if total >= q.offset && (q.limit < 0 || len(ids) < q.limit) {
+			ids = append(ids, item.ID)
+		}
+		total++
+		return end < 0 || total < end
+	}
+
+	// Scanning all items in order is faster than looking up the large candidates
+	if group, size, ok := q.plan(q.terms); ok && size < len(q.db.sorted)/2 {
+		candidates := q.lookupGroup(group)
+		cids := make([]int64, 0, len(candidates))
+		for id := range candidates {
+			cids = append(cids, id)
+		}
+		sortIDs(cids)
+
+		for _, id := range cids {
+			if item, ok := q.db.items[id]; ok && !collect(item) {
+				break
+			}
+		}
+	} else {
+		for _, item := range q.db.sorted {
+			if !collect(item) {
+				break
+			}
+		}
+	}
+
+	return ids, total
+}
+
+// plan returns the group of the terms which has the smallest candidates by the indexes.
+// The group is the term and the following OR terms, the matched items are the subset of the candidates of any group.
+// It returns false if the indexes can't narrow down the items.
+func (q *nativeCacheQuery) plan(terms []*nativeCacheTerm) ([]*nativeCacheTerm, int, bool) {
+	var best []*nativeCacheTerm
+	bestSize := 0
+
+	for i := 0; i < len(terms); {
+		j := i + 1
+		for j < len(terms) && terms[j].op == nativeOpOr {
+			j++
+		}
+
+		if terms[i].op != nativeOpNot {
+			size := 0
+			ok := true
+			for _, t := range terms[i:j] {
+				n, tok := q.estimate(t)
+				if !tok {
+					ok = false
+					break
+				}
+				size += n
+			}
+			if ok && (best == nil || size < bestSize) {
+				best = terms[i:j]
+				bestSize = size
+			}
+		}
+		i = j
+	}
+
+	return best, bestSize, best != nil
+}
+
+func (q *nativeCacheQuery) estimate(t *nativeCacheTerm) (int, bool) {
+	if t.bracket {
+		_, size, ok := q.plan(t.terms)
+		return size, ok
+	}
+	if t.field == "id" && (t.cond == cacheEQ || t.cond == cacheSET) {
+		return len(t.keys), true
+	}
+	if x, ok := q.db.indexes[t.field]; ok {
+		return x.estimate(t.cond, t.keys)
+	}
+	return 0, false
+}
+
+func (q *nativeCacheQuery) lookupGroup(group []*nativeCacheTerm) util.Int64Set {
+	if len(group) == 1 {
+		return q.lookup(group[0])
+	}
+	ids := util.NewInt64Set()
+	for _, t := range group {
+		for id := range q.lookup(t) {
+			ids.Add(id)
+		}
+	}
+	return ids
+}
+
+// lookup returns the candidates of the term which is planned.
+func (q *nativeCacheQuery) lookup(t *nativeCacheTerm) util.Int64Set {
+	if t.bracket {
+		group, _, _ := q.plan(t.terms)
+		return q.lookupGroup(group)
+	}
+	if t.field == "id" {
+		ids := util.NewInt64Set()
+		for _, k := range t.keys {
+			if id, err := strconv.ParseInt(k, 10, 64); err == nil {
+				ids.Add(id)
+			}
+		}
+		return ids
+	}
+	ids, _ := q.db.indexes[t.field].lookup(t.cond, t.keys)
+	return ids
+}
+
+func (q *nativeCacheQuery) matchTerms(item *nativeCacheItem, terms []*nativeCacheTerm) bool {
+	result := true
+	group := true
+
+	for i, t := range terms {
+		var matched bool
+		if t.bracket {
+			matched = q.matchTerms(item, t.terms)
+		} else {
+			matched = t.match(item)
+		}
+
+		if i > 0 && t.op == nativeOpOr {
+			group = group || matched
+		} else {
+			if i > 0 {
+				result = result && group
+				if !result {
+					return false
+				}
+			}
+			if t.op == nativeOpNot {
+				group = !matched
+			} else {
+				group = matched
+			}
+		}
+	}
+
+	return result && group
+}
+
+func (t *nativeCacheTerm) match(item *nativeCacheItem) bool {
+	values := item.fields[t.field]
+
+	switch t.cond {
+	case cacheEQ, cacheSET:
+		for _, v := range values {
+			if t.hasKey(v) {
+				return true
+			}
+		}
+
+	case cacheALLSET:
+		for _, k := range t.keys {
+			found := false
+			for _, v := range values {
+				if v == k {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+
+	case cacheEMPTY:
+		return len(values) == 0
+
+	case cacheGE, cacheLE, cacheLT:
+		if len(t.keys) == 0 {
+			return false
+		}
+		for _, v := range values {
+			c := t.compare(v)
+			if (t.cond == cacheGE && c >= 0) || (t.cond == cacheLE && c <= 0) || (t.cond == cacheLT && c < 0) {
+				return true
+			}
+		}
+
+	case cacheLIKE:
+		if len(t.keys) == 0 {
+			return false
+		}
+		for _, v := range values {
+			if likeMatch(v, t.keys[0]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (t *nativeCacheTerm) hasKey(v string) bool {
+	if t.keySet != nil {
+		_, ok := t.keySet[v]
+		return ok
+	}
+	for _, k := range t.keys {
+		if k == v {
+			return true
+		}
+	}
+	return false
+}
+
+// compare compares the value with the first key as integer if both are integer.
+// The integer attributes are cached as the normalized string.
+func (t *nativeCacheTerm) compare(v string) int {
+	if t.keyIsNum {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			switch {
+			case n < t.keyNum:
+				return -1
+			case n > t.keyNum:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(v, t.keys[0])
+}
+
+// likeMatch returns true if the value matches the pattern of LIKE.
+// '%' matches any sequence of characters and '_' matches any character. '\' escapes the next character.
+func likeMatch(v, pattern string) bool {
+	vi, pi := 0, 0
+	// Position to restart from the last '%'
+	star, mark := -1, 0
+
+	for vi < len(v) {
+		if pi < len(pattern) {
+			switch pattern[pi] {
+			case '%':
+				star, mark = pi, vi
+				pi++
+				continue
+			case '_':
+				_, n := utf8.DecodeRuneInString(v[vi:])
+				vi += n
+				pi++
+				continue
+			case '\\':
+				if pi+1 < len(pattern) && pattern[pi+1] == v[vi] {
+					vi++
+					pi += 2
+					continue
+				}
+			default:
+				if pattern[pi] == v[vi] {
+					vi++
+					pi++
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		_, n := utf8.DecodeRuneInString(v[mark:])
+		mark += n
+		vi = mark
+		pi = star + 1
+	}
+
+	for pi < len(pattern) && pattern[pi] == '%' {
+		pi++
+	}
+	return pi == len(pattern)
+}
+
+// likePrefix returns the fixed prefix of the pattern of LIKE without the escapes.
+func likePrefix(pattern string) string {
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '%', '_':
+			return sb.String()
+		case '\\':
+			i++
+			if i == len(pattern) {
+				return sb.String()
+			}
+		}
+		sb.WriteByte(pattern[i])
+	}
+	return sb.String()
+}
+
+type nativeCacheIterator struct {
+	entries []*CacheEntry
+	total   int
+	pos     int
+	err     error
+}
+
+func (it *nativeCacheIterator) Next() bool {
+	if it.pos >= len(it.entries) {
+		return false
+	}
+	it.pos++
+	return true
+}
+
+func (it *nativeCacheIterator) Object() interface{} {
+	if it.pos == 0 || it.pos > len(it.entries) {
+		return nil
+	}
+	return it.entries[it.pos-1]
+}
+
+func (it *nativeCacheIterator) Count() int {
+	return len(it.entries)
+}
+
+func (it *nativeCacheIterator) TotalCount() int {
+	return it.total
+}
+
+func (it *nativeCacheIterator) Error() error {
+	return it.err
+}
+
+func (it *nativeCacheIterator) Close() {
+	it.entries = nil
+}
+
+type nativeCacheJSONIterator struct {
+	jsons [][]byte
+	pos   int
+	err   error
+}
+
+func (it *nativeCacheJSONIterator) Next() bool {
+	if it.pos >= len(it.jsons) {
+		return false
+	}
+	it.pos++
+	return true
+}
+
+func (it *nativeCacheJSONIterator) JSON() []byte {
+	if it.pos == 0 || it.pos > len(it.jsons) {
+		return nil
+	}
+	return it.jsons[it.pos-1]
+}
+
+func (it *nativeCacheJSONIterator) Error() error {
+	return it.err
+}
+
+func (it *nativeCacheJSONIterator) Close() {
+	it.jsons = nil
+}
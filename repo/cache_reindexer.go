@@ -0,0 +1,223 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/restream/reindexer"
+	"github.com/restream/reindexer/bindings"
+	"golang.org/x/xerrors"
+)
+
+// reindexerCacheDB is the CacheDB by Reindexer.
+// The binding is registered by the build with cgo, see cache_reindexer_builtin.go.
+
+const cacheNamespace = "entries"
+
+var reindexerConditions = map[int]int{
+	cacheEQ:     reindexer.EQ,
+	cacheGE:     reindexer.GE,
+	cacheLE:     reindexer.LE,
+	cacheLT:     reindexer.LT,
+	cacheSET:    reindexer.SET,
+	cacheALLSET: reindexer.ALLSET,
+	cacheEMPTY:  reindexer.EMPTY,
+	cacheLIKE:   reindexer.LIKE,
+}
+
+type reindexerCacheDB struct {
+	db *reindexer.Reindexer
+}
+
+func newReindexerCacheDB(dsn string) (CacheDB, error) {
+	// NewReindex panics if the binding isn't linked
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid cacheDB DSN. err: %w", err)
+	}
+	if bindings.GetBinding(u.Scheme) == nil {
+		return nil, xerrors.Errorf("Reindexer binding '%s' is not available", u.Scheme)
+	}
+
+	db := reindexer.NewReindex(dsn)
+	err = db.OpenNamespace(cacheNamespace, reindexer.DefaultNamespaceOptions().NoStorage(), CacheEntry{})
+	if err != nil {
+		return nil, xerrors.Errorf("Open cacheDB error. err: %w", err)
+	}
+	return &reindexerCacheDB{db: db}, nil
+}
+
+func (c *reindexerCacheDB) AddIndex(def CacheIndexDef) error {
+	return c.db.AddIndex(cacheNamespace, reindexer.IndexDef{
+		Name:      def.Name,
+		JSONPaths: []string{def.Name},
+		IndexType: "hash",
+		FieldType: def.FieldType,
+		IsArray:   def.IsArray,
+	})
+}
+
+func (c *reindexerCacheDB) Truncate() error {
+	return c.db.TruncateNamespace(cacheNamespace)
+}
+
+func (c *reindexerCacheDB) Query() CacheQuery {
+	return &reindexerCacheQuery{q: c.db.Query(cacheNamespace)}
+}
+
+func (c *reindexerCacheDB) BeginTx() (CacheTx, error) {
+	tx, err := c.db.BeginTx(cacheNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return &reindexerCacheTx{tx: tx}, nil
+}
+
+func (c *reindexerCacheDB) Close() {
+	c.db.Close()
+}
+
+type reindexerCacheTx struct {
+	tx *reindexer.Tx
+}
+
+func (t *reindexerCacheTx) Query() CacheQuery {
+	return &reindexerCacheQuery{q: t.tx.Query()}
+}
+
+func (t *reindexerCacheTx) Upsert(item *CacheItem) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return t.tx.Upsert(b)
+}
+
+func (t *reindexerCacheTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *reindexerCacheTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+type reindexerCacheQuery struct {
+	q *reindexer.Query
+}
+
+func (q *reindexerCacheQuery) Select(fields ...string) CacheQuery {
+	q.q.Select(fields...)
+	return q
+}
+
+func (q *reindexerCacheQuery) Where(index string, condition int, keys interface{}) CacheQuery {
+	if pattern, ok := keys.(string); ok && condition == cacheLIKE {
+		keys = reindexerLikePattern(pattern)
+	}
+	q.q.Where(index, reindexerConditions[condition], keys)
+	return q
+}
+
+func (q *reindexerCacheQuery) WhereInt64(index string, condition int, keys ...int64) CacheQuery {
+	q.q.WhereInt64(index, reindexerConditions[condition], keys...)
+	return q
+}
+
+func (q *reindexerCacheQuery) WhereString(index string, condition int, keys ...string) CacheQuery {
+	if condition == cacheLIKE {
+		for i, v := range keys {
+			keys[i] = reindexerLikePattern(v)
+		}
+	}
+	q.q.WhereString(index, reindexerConditions[condition], keys...)
+	return q
+}
+
+func (q *reindexerCacheQuery) WhereBool(index string, condition int, keys ...bool) CacheQuery {
+	q.q.WhereBool(index, reindexerConditions[condition], keys...)
+	return q
+}
+
+func (q *reindexerCacheQuery) Not() CacheQuery {
+	q.q.Not()
+	return q
+}
+
+func (q *reindexerCacheQuery) Or() CacheQuery {
+	q.q.Or()
+	return q
+}
+
+func (q *reindexerCacheQuery) OpenBracket() CacheQuery {
+	q.q.OpenBracket()
+	return q
+}
+
+func (q *reindexerCacheQuery) CloseBracket() CacheQuery {
+	q.q.CloseBracket()
+	return q
+}
+
+func (q *reindexerCacheQuery) Limit(limit int) CacheQuery {
+	q.q.Limit(limit)
+	return q
+}
+
+func (q *reindexerCacheQuery) Offset(offset int) CacheQuery {
+	q.q.Offset(offset)
+	return q
+}
+
+func (q *reindexerCacheQuery) ReqTotal() CacheQuery {
+	q.q.ReqTotal()
+	return q
+}
+
+func (q *reindexerCacheQuery) Set(field string, value interface{}) CacheQuery {
+	q.q.Set(field, value)
+	return q
+}
+
+func (q *reindexerCacheQuery) ExecCtx(ctx context.Context) CacheIterator {
+	return q.q.ExecCtx(ctx)
+}
+
+func (q *reindexerCacheQuery) ExecToJsonCtx(ctx context.Context) CacheJSONIterator {
+	return q.q.ExecToJsonCtx(ctx)
+}
+
+func (q *reindexerCacheQuery) GetJsonCtx(ctx context.Context) ([]byte, bool) {
+	return q.q.GetJsonCtx(ctx)
+}
+
+func (q *reindexerCacheQuery) DeleteCtx(ctx context.Context) (int, error) {
+	return q.q.DeleteCtx(ctx)
+}
+
+func (q *reindexerCacheQuery) UpdateCtx(ctx context.Context) error {
+	iter := q.q.UpdateCtx(ctx)
+	defer iter.Close()
+	return iter.Error()
+}
+
+// reindexerLikePattern converts the escaped LIKE pattern for Reindexer.
+// Reindexer's LIKE has no escape, so the escaped '%' and '_' match any one character there.
+func reindexerLikePattern(pattern string) string {
+	if !strings.Contains(pattern, "\\") {
+		return pattern
+	}
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+			if pattern[i] == '%' {
+				sb.WriteByte('_')
+				continue
+			}
+		}
+		sb.WriteByte(pattern[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,14 @@
+//go:build cgo
+
+package repo
+
+import (
+	// choose how the Reindexer binds to the app (in this case "builtin," which means link Reindexer as a static library)
+	_ "github.com/restream/reindexer/bindings/builtin"
+)
+
+func init() {
+	RegisterCacheDB("reindexer", func() (CacheDB, error) {
+		return newReindexerCacheDB("builtin:///tmp/cloudldap")
+	})
+}
@@ -0,0 +1,213 @@
+package repo
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+	"golang.org/x/xerrors"
+)
+
+// The cache snapshot is the file which has all rows of the entry table at the point of a DB snapshot.
+// It's written when all entries are cached, then it's loaded at startup with only the entries changed
+// since the point instead of fetching all entries from DB. See DefaultRepository.CacheFromSnapshot.
+//
+// The format is the gzip compressed gob stream: cacheSnapshotHeader, cacheSnapshotRecord... and the
+// last record which has End to detect the truncated file. The rows are stored as is, not normalized,
+// so the snapshot is still compatible after the schema is changed.
+
+const cacheSnapshotVersion = 1
+
+type cacheSnapshotHeader struct {
+	Version int
+	// The database and the suffix which the snapshot is taken from
+	Database string
+	Suffix   string
+	// The high-water mark of the snapshot, see DefaultRepository.snapshotMark
+	Mark    uint64
+	Created time.Time
+}
+
+type cacheSnapshotRecord struct {
+	Entry *cacheSnapshotEntry
+	// The last record has End and the number of the entries
+	End   bool
+	Count int
+}
+
+type cacheSnapshotEntry struct {
+	ID          int64
+	Version     int64
+	ParentID    int64
+	Path        []int64
+	IsContainer bool
+	RDNNorm     string
+	RDNOrig     string
+	AttrsOrig   []byte
+}
+
+type cacheSnapshotWriter struct {
+	path  string
+	f     *os.File
+	zw    *gzip.Writer
+	enc   *gob.Encoder
+	count int
+}
+
+// createCacheSnapshot creates the temporary file of the snapshot, it replaces the snapshot at Commit.
+func createCacheSnapshot(path string, header *cacheSnapshotHeader) (*cacheSnapshotWriter, error) {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to create cache snapshot. path: %s, err: %w", path, err)
+	}
+
+	zw := gzip.NewWriter(f)
+	w := &cacheSnapshotWriter{
+		path: path,
+		f:    f,
+		zw:   zw,
+		enc:  gob.NewEncoder(zw),
+	}
+
+	header.Version = cacheSnapshotVersion
+	if err := w.enc.Encode(header); err != nil {
+		w.Abort()
+		return nil, xerrors.Errorf("Failed to write cache snapshot header. path: %s, err: %w", path, err)
+	}
+	return w, nil
+}
+
+func (w *cacheSnapshotWriter) Write(entry *DBEntry) error {
+	err := w.enc.Encode(&cacheSnapshotRecord{
+		Entry: &cacheSnapshotEntry{
+			ID:          entry.ID,
+			Version:     entry.Version,
+			ParentID:    entry.ParentID,
+			Path:        entry.Path,
+			IsContainer: entry.IsContainer,
+			RDNNorm:     entry.RDNNorm,
+			RDNOrig:     entry.RDNOrig,
+			AttrsOrig:   entry.AttrsOrig,
+		},
+	})
+	if err != nil {
+		return xerrors.Errorf("Failed to write cache snapshot. path: %s, id: %d, err: %w", w.path, entry.ID, err)
+	}
+	w.count++
+	return nil
+}
+
+// Commit writes the last record, then replaces the snapshot with the temporary file.
+func (w *cacheSnapshotWriter) Commit() error {
+	reportError := func(err error) error {
+		w.Abort()
+		return xerrors.Errorf("Failed to commit cache snapshot. path: %s, err: %w", w.path, err)
+	}
+
+	if err := w.enc.Encode(&cacheSnapshotRecord{End: true, Count: w.count}); err != nil {
+		return reportError(err)
+	}
+	if err := w.zw.Close(); err != nil {
+		return reportError(err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return reportError(err)
+	}
+	if err := w.f.Close(); err != nil {
+		return reportError(err)
+	}
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		return reportError(err)
+	}
+	return nil
+}
+
+// Abort removes the temporary file. It's no-op after Commit.
+func (w *cacheSnapshotWriter) Abort() {
+	w.zw.Close()
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+type cacheSnapshotReader struct {
+	Header cacheSnapshotHeader
+	path   string
+	f      *os.File
+	zr     *gzip.Reader
+	dec    *gob.Decoder
+	count  int
+}
+
+// openCacheSnapshot opens the snapshot, then reads the header.
+// It returns the error if the snapshot isn't the current version.
+func openCacheSnapshot(path string) (*cacheSnapshotReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to open cache snapshot. path: %s, err: %w", path, err)
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, xerrors.Errorf("Invalid cache snapshot. path: %s, err: %w", path, err)
+	}
+
+	r := &cacheSnapshotReader{
+		path: path,
+		f:    f,
+		zr:   zr,
+		dec:  gob.NewDecoder(zr),
+	}
+	if err := r.dec.Decode(&r.Header); err != nil {
+		r.Close()
+		return nil, xerrors.Errorf("Invalid cache snapshot header. path: %s, err: %w", path, err)
+	}
+	if r.Header.Version != cacheSnapshotVersion {
+		r.Close()
+		return nil, xerrors.Errorf("Incompatible cache snapshot version. path: %s, version: %d", path, r.Header.Version)
+	}
+	return r, nil
+}
+
+// Next returns the next entry. It returns nil if all entries have been read.
+func (r *cacheSnapshotReader) Next() (*DBEntry, error) {
+	var record cacheSnapshotRecord
+	if err := r.dec.Decode(&record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, xerrors.Errorf("Corrupt cache snapshot. path: %s, read: %d, err: %w", r.path, r.count, err)
+	}
+
+	if record.End {
+		if record.Count != r.count {
+			return nil, xerrors.Errorf("Corrupt cache snapshot. path: %s, expected: %d, read: %d", r.path, record.Count, r.count)
+		}
+		return nil, nil
+	}
+	if record.Entry == nil {
+		return nil, xerrors.Errorf("Corrupt cache snapshot. path: %s, read: %d, err: no entry", r.path, r.count)
+	}
+	r.count++
+
+	e := record.Entry
+	return &DBEntry{
+		ID:          e.ID,
+		Version:     e.Version,
+		ParentID:    e.ParentID,
+		Path:        pq.Int64Array(e.Path),
+		IsContainer: e.IsContainer,
+		RDNNorm:     e.RDNNorm,
+		RDNOrig:     e.RDNOrig,
+		AttrsOrig:   types.JSONText(e.AttrsOrig),
+	}, nil
+}
+
+func (r *cacheSnapshotReader) Close() {
+	r.zr.Close()
+	r.f.Close()
+}
@@ -0,0 +1,201 @@
+//go:build test
+
+package repo
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+	"golang.org/x/xerrors"
+)
+
+func writeTestCacheSnapshot(t *testing.T, path string, entries []*DBEntry) {
+	w, err := createCacheSnapshot(path, &cacheSnapshotHeader{
+		Database: "ldap",
+		Suffix:   "dc=example,dc=com",
+		Mark:     100,
+		Created:  time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	for _, e := range entries {
+		if err := w.Write(e); err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+}
+
+func readTestCacheSnapshot(path string) ([]*DBEntry, error) {
+	r, err := openCacheSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	entries := []*DBEntry{}
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			return entries, nil
+		}
+		entries = append(entries, e)
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	entries := []*DBEntry{
+		{
+			ID:          1,
+			Version:     1,
+			ParentID:    0,
+			Path:        pq.Int64Array{1},
+			IsContainer: true,
+			RDNNorm:     "dc=example",
+			RDNOrig:     "dc=Example",
+			AttrsOrig:   types.JSONText(`{"dc":["Example"]}`),
+		},
+		{
+			ID:        2,
+			Version:   3,
+			ParentID:  1,
+			RDNNorm:   "uid=user1",
+			RDNOrig:   "uid=user1",
+			AttrsOrig: types.JSONText(`{"uid":["user1"]}`),
+		},
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cache.snapshot")
+		writeTestCacheSnapshot(t, path, entries)
+
+		if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("Unexpected temporary file. err: %v", err)
+		}
+
+		r, err := openCacheSnapshot(path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		r.Close()
+		if r.Header.Database != "ldap" || r.Header.Suffix != "dc=example,dc=com" || r.Header.Mark != 100 {
+			t.Errorf("Unexpected header: %+v", r.Header)
+		}
+
+		actual, err := readTestCacheSnapshot(path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		if len(actual) != len(entries) {
+			t.Fatalf("Unexpected entries. expected: %d, actual: %d", len(entries), len(actual))
+		}
+		for i := range entries {
+			// gob decodes the empty path as nil
+			if len(actual[i].Path) == 0 && len(entries[i].Path) == 0 {
+				actual[i].Path = entries[i].Path
+			}
+			if !reflect.DeepEqual(actual[i], entries[i]) {
+				t.Errorf("Unexpected entry. expected: %+v, actual: %+v", entries[i], actual[i])
+			}
+		}
+	})
+
+	t.Run("aborted", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cache.snapshot")
+		w, err := createCacheSnapshot(path, &cacheSnapshotHeader{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		w.Write(entries[0])
+		w.Abort()
+
+		if _, err := openCacheSnapshot(path); !xerrors.Is(err, os.ErrNotExist) {
+			t.Errorf("Unexpected error: %+v", err)
+		}
+		if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("Unexpected temporary file. err: %v", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cache.snapshot")
+		writeTestCacheSnapshot(t, path, entries)
+
+		// Rewrite it without the last record
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		zw := gzip.NewWriter(f)
+		enc := gob.NewEncoder(zw)
+		enc.Encode(&cacheSnapshotHeader{Version: cacheSnapshotVersion})
+		enc.Encode(&cacheSnapshotRecord{Entry: &cacheSnapshotEntry{ID: 1}})
+		zw.Close()
+		f.Close()
+
+		if _, err := readTestCacheSnapshot(path); err == nil {
+			t.Errorf("Expected error but no error")
+		}
+	})
+
+	t.Run("count mismatch", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		zw := gzip.NewWriter(f)
+		enc := gob.NewEncoder(zw)
+		enc.Encode(&cacheSnapshotHeader{Version: cacheSnapshotVersion})
+		enc.Encode(&cacheSnapshotRecord{Entry: &cacheSnapshotEntry{ID: 1}})
+		enc.Encode(&cacheSnapshotRecord{End: true, Count: 2})
+		zw.Close()
+		f.Close()
+
+		if _, err := readTestCacheSnapshot(path); err == nil {
+			t.Errorf("Expected error but no error")
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cache.snapshot")
+		if err := os.WriteFile(path, []byte("corrupt"), 0600); err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+
+		if _, err := openCacheSnapshot(path); err == nil {
+			t.Errorf("Expected error but no error")
+		}
+	})
+
+	t.Run("incompatible version", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		zw := gzip.NewWriter(f)
+		gob.NewEncoder(zw).Encode(&cacheSnapshotHeader{Version: cacheSnapshotVersion + 1})
+		zw.Close()
+		f.Close()
+
+		if _, err := openCacheSnapshot(path); err == nil {
+			t.Errorf("Expected error but no error")
+		}
+	})
+}
@@ -0,0 +1,696 @@
+//go:build test
+
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// forEachCacheDB runs the test with each cache DB available in the build.
+func forEachCacheDB(t *testing.T, test func(t *testing.T, db CacheDB)) {
+	for _, name := range CacheDBNames() {
+		t.Run(name, func(t *testing.T) {
+			db, err := NewCacheDB(name)
+			if err != nil {
+				t.Skipf("Cache DB isn't available: %v", err)
+			}
+			defer db.Close()
+			test(t, db)
+		})
+	}
+}
+
+func cacheTestItems() []*CacheItem {
+	item := func(id, parentID int64, path []int64, rdnNorm string, attrsNorm map[string]interface{}) *CacheItem {
+		return &CacheItem{
+			ID:          id,
+			Version:     1,
+			ParentID:    parentID,
+			Path:        path,
+			IsContainer: len(path) > 0,
+			RDNOrig:     rdnNorm,
+			RDNNorm:     rdnNorm,
+			AttrsOrig:   map[string][]string{"rdn": {rdnNorm}},
+			AttrsNorm:   attrsNorm,
+		}
+	}
+	user := func(uid, cn string, sn []string, uidNumber string) map[string]interface{} {
+		m := map[string]interface{}{
+			"objectClass": []string{"top", "person", "inetorgperson"},
+			"uid":         []string{uid},
+			"cn":          []string{cn},
+			"uidNumber":   []string{uidNumber},
+		}
+		if len(sn) > 0 {
+			m["sn"] = sn
+		}
+		return m
+	}
+
+	return []*CacheItem{
+		item(1, 0, []int64{1}, "dc=example,dc=com", map[string]interface{}{"objectClass": []string{"top", "dcobject"}}),
+		item(2, 1, []int64{1, 2}, "ou=users", map[string]interface{}{"objectClass": []string{"top", "organizationalunit"}}),
+		item(3, 1, []int64{1, 3}, "ou=groups", map[string]interface{}{"objectClass": []string{"top", "organizationalunit"}}),
+		item(10, 2, nil, "uid=user1", user("user1", "user one", []string{"one"}, "1000")),
+		item(11, 2, nil, "uid=user2", user("user2", "user two", []string{"two"}, "2000")),
+		item(12, 2, nil, "uid=user10", user("user10", "user ten", nil, "10000")),
+		item(20, 3, nil, "cn=group1", map[string]interface{}{
+			"objectClass": []string{"top", "groupofnames"},
+			"cn":          []string{"group1"},
+			"member":      []interface{}{int64(10), int64(11)},
+		}),
+	}
+}
+
+func setupTestCacheDB(t testing.TB, db CacheDB, items []*CacheItem) {
+	for _, def := range []CacheIndexDef{
+		{Name: "attrsNorm.objectClass", FieldType: "string", IsArray: true},
+		{Name: "attrsNorm.uid", FieldType: "string", IsArray: true},
+		{Name: "attrsNorm.cn", FieldType: "string", IsArray: true},
+		{Name: "attrsNorm.sn", FieldType: "string", IsArray: true},
+		{Name: "attrsNorm.member", FieldType: "int64", IsArray: true},
+	} {
+		if err := db.AddIndex(def); err != nil {
+			t.Fatalf("Unexpected add index error: %+v", err)
+		}
+	}
+
+	tx, err := db.BeginTx()
+	if err != nil {
+		t.Fatalf("Unexpected begin error: %+v", err)
+	}
+	for _, item := range items {
+		if err := tx.Upsert(item); err != nil {
+			t.Fatalf("Unexpected upsert error: %+v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Unexpected commit error: %+v", err)
+	}
+}
+
+func cacheIDs(t *testing.T, q CacheQuery) []int64 {
+	iter := q.Select("id").ExecToJsonCtx(context.Background())
+	defer iter.Close()
+
+	ids := []int64{}
+	for iter.Next() {
+		var dest struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.Unmarshal(iter.JSON(), &dest); err != nil {
+			t.Fatalf("Unexpected unmarshal error: %+v", err)
+		}
+		ids = append(ids, dest.ID)
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatalf("Unexpected query error: %+v", err)
+	}
+	sortIDs(ids)
+	return ids
+}
+
+func TestCacheDBQuery(t *testing.T) {
+	testcases := []struct {
+		Name     string
+		Query    func(q CacheQuery)
+		Expected []int64
+	}{
+		{
+			Name: "EQ",
+			Query: func(q CacheQuery) {
+				q.WhereInt64("parentId", cacheEQ, 2)
+			},
+			Expected: []int64{10, 11, 12},
+		},
+		{
+			Name: "SET",
+			Query: func(q CacheQuery) {
+				q.WhereInt64("parentId", cacheSET, 2, 3)
+			},
+			Expected: []int64{10, 11, 12, 20},
+		},
+		{
+			Name: "SET by string ID",
+			Query: func(q CacheQuery) {
+				q.WhereString("id", cacheSET, "10", "11", "99")
+			},
+			Expected: []int64{10, 11},
+		},
+		{
+			Name: "ALLSET",
+			Query: func(q CacheQuery) {
+				q.Where("attrsNorm.objectClass", cacheALLSET, []string{"person", "inetorgperson"})
+			},
+			Expected: []int64{10, 11, 12},
+		},
+		{
+			Name: "OR binds the previous condition",
+			Query: func(q CacheQuery) {
+				q.WhereInt64("parentId", cacheEQ, 2).
+					WhereString("attrsNorm.sn", cacheEQ, "one").
+					Or().
+					WhereString("attrsNorm.sn", cacheEQ, "two")
+			},
+			Expected: []int64{10, 11},
+		},
+		{
+			Name: "NOT bracket",
+			Query: func(q CacheQuery) {
+				q.WhereInt64("parentId", cacheEQ, 2).
+					Not().
+					OpenBracket().
+					WhereString("attrsNorm.uid", cacheEQ, "user1").
+					Or().
+					WhereString("attrsNorm.uid", cacheEQ, "user2").
+					CloseBracket()
+			},
+			Expected: []int64{12},
+		},
+		{
+			Name: "OR brackets",
+			Query: func(q CacheQuery) {
+				q.OpenBracket().
+					WhereInt64("id", cacheEQ, 1).
+					CloseBracket().
+					Or().
+					OpenBracket().
+					WhereString("attrsNorm.cn", cacheEQ, "group1").
+					CloseBracket()
+			},
+			Expected: []int64{1, 20},
+		},
+		{
+			Name: "Present",
+			Query: func(q CacheQuery) {
+				q.Not().Where("attrsNorm.sn", cacheEMPTY, 0)
+			},
+			Expected: []int64{10, 11},
+		},
+		{
+			Name: "LIKE prefix",
+			Query: func(q CacheQuery) {
+				q.Where("attrsNorm.uid", cacheLIKE, "user1%")
+			},
+			Expected: []int64{10, 12},
+		},
+		{
+			Name: "LIKE suffix",
+			Query: func(q CacheQuery) {
+				q.Where("attrsNorm.cn", cacheLIKE, "%two")
+			},
+			Expected: []int64{11},
+		},
+		{
+			Name: "LIKE any character",
+			Query: func(q CacheQuery) {
+				q.Where("attrsNorm.uid", cacheLIKE, "_ser2")
+			},
+			Expected: []int64{11},
+		},
+		{
+			Name: "GE compares integer",
+			Query: func(q CacheQuery) {
+				q.Where("attrsNorm.uidNumber", cacheGE, int64(2000))
+			},
+			Expected: []int64{11, 12},
+		},
+		{
+			Name: "LT compares integer",
+			Query: func(q CacheQuery) {
+				q.Where("attrsNorm.uidNumber", cacheLT, int64(2000))
+			},
+			Expected: []int64{10},
+		},
+		{
+			Name: "Association",
+			Query: func(q CacheQuery) {
+				q.WhereInt64("attrsNorm.member", cacheEQ, 11)
+			},
+			Expected: []int64{20},
+		},
+		{
+			Name: "Tree of path",
+			Query: func(q CacheQuery) {
+				q.WhereInt64("path", cacheSET, 1)
+			},
+			Expected: []int64{1, 2, 3},
+		},
+		{
+			Name: "Container by RDN",
+			Query: func(q CacheQuery) {
+				q.WhereBool("isContainer", cacheEQ, true).
+					WhereString("rdnNorm", cacheSET, "ou=users", "uid=user1")
+			},
+			Expected: []int64{2},
+		},
+		{
+			Name: "Dummy never matches",
+			Query: func(q CacheQuery) {
+				q.Where("dummy", cacheEQ, "dummy")
+			},
+			Expected: []int64{},
+		},
+	}
+
+	forEachCacheDB(t, func(t *testing.T, db CacheDB) {
+		setupTestCacheDB(t, db, cacheTestItems())
+
+		for _, tc := range testcases {
+			q := db.Query()
+			tc.Query(q)
+			if ids := cacheIDs(t, q); !reflect.DeepEqual(ids, tc.Expected) {
+				t.Errorf("Unexpected result of '%s'. expected: %v, got: %v", tc.Name, tc.Expected, ids)
+			}
+		}
+	})
+}
+
+func TestCacheDBPaging(t *testing.T) {
+	forEachCacheDB(t, func(t *testing.T, db CacheDB) {
+		setupTestCacheDB(t, db, cacheTestItems())
+
+		iter := db.Query().
+			WhereInt64("parentId", cacheEQ, 2).
+			ReqTotal().
+			Limit(2).
+			Offset(1).
+			ExecCtx(context.Background())
+		defer iter.Close()
+
+		if iter.Error() != nil {
+			t.Fatalf("Unexpected query error: %+v", iter.Error())
+		}
+		if iter.TotalCount() != 3 || iter.Count() != 2 {
+			t.Errorf("Unexpected count. total: %d, count: %d", iter.TotalCount(), iter.Count())
+		}
+
+		ids := []int64{}
+		for iter.Next() {
+			e, ok := iter.Object().(*CacheEntry)
+			if !ok {
+				t.Fatalf("Unexpected object: %v", iter.Object())
+			}
+			if !reflect.DeepEqual(e.AttrsOrig["rdn"], []string{e.RDNNorm}) {
+				t.Errorf("Unexpected attrsOrig: %v", e.AttrsOrig)
+			}
+			ids = append(ids, e.ID)
+		}
+		if !reflect.DeepEqual(ids, []int64{11, 12}) {
+			t.Errorf("Unexpected page: %v", ids)
+		}
+	})
+}
+
+func TestCacheDBSelect(t *testing.T) {
+	forEachCacheDB(t, func(t *testing.T, db CacheDB) {
+		setupTestCacheDB(t, db, cacheTestItems())
+
+		b, found := db.Query().
+			Select("id", "attrsNorm.member").
+			WhereInt64("id", cacheEQ, 20).
+			GetJsonCtx(context.Background())
+		if !found {
+			t.Fatalf("Unexpected not found")
+		}
+
+		var dest map[string]interface{}
+		if err := json.Unmarshal(b, &dest); err != nil {
+			t.Fatalf("Unexpected unmarshal error: %+v", err)
+		}
+		expected := map[string]interface{}{
+			"id": float64(20),
+			"attrsNorm": map[string]interface{}{
+				"member": []interface{}{float64(10), float64(11)},
+			},
+		}
+		if !reflect.DeepEqual(dest, expected) {
+			t.Errorf("Unexpected JSON. expected: %v, got: %s", expected, b)
+		}
+
+		if _, found := db.Query().WhereInt64("id", cacheEQ, 99).GetJsonCtx(context.Background()); found {
+			t.Errorf("Unexpected found")
+		}
+	})
+}
+
+func TestCacheDBTx(t *testing.T) {
+	forEachCacheDB(t, func(t *testing.T, db CacheDB) {
+		setupTestCacheDB(t, db, cacheTestItems())
+		ctx := context.Background()
+
+		tx, err := db.BeginTx()
+		if err != nil {
+			t.Fatalf("Unexpected begin error: %+v", err)
+		}
+
+		item := cacheTestItems()[4]
+		item.ID = 13
+		item.RDNNorm = "uid=user3"
+		if err := tx.Upsert(item); err != nil {
+			t.Fatalf("Unexpected upsert error: %+v", err)
+		}
+
+		deleted, err := tx.Query().WhereInt64("id", cacheEQ, 20).DeleteCtx(ctx)
+		if err != nil {
+			t.Fatalf("Unexpected delete error: %+v", err)
+		}
+		if deleted != 1 {
+			t.Errorf("Unexpected deleted count: %d", deleted)
+		}
+
+		err = tx.Query().
+			WhereInt64("id", cacheEQ, 3).
+			Set("isContainer", false).
+			Set("path", []int64{}).
+			UpdateCtx(ctx)
+		if err != nil {
+			t.Fatalf("Unexpected update error: %+v", err)
+		}
+
+		// The changes are invisible before commit
+		if ids := cacheIDs(t, tx.Query().WhereInt64("parentId", cacheSET, 2, 3)); !reflect.DeepEqual(ids, []int64{10, 11, 12, 20}) {
+			t.Errorf("Unexpected result before commit: %v", ids)
+		}
+
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Unexpected commit error: %+v", err)
+		}
+
+		if ids := cacheIDs(t, db.Query().WhereInt64("parentId", cacheSET, 2, 3)); !reflect.DeepEqual(ids, []int64{10, 11, 12, 13}) {
+			t.Errorf("Unexpected result after commit: %v", ids)
+		}
+		if ids := cacheIDs(t, db.Query().WhereString("rdnNorm", cacheEQ, "uid=user3")); !reflect.DeepEqual(ids, []int64{13}) {
+			t.Errorf("Unexpected result of the upserted entry: %v", ids)
+		}
+		if ids := cacheIDs(t, db.Query().WhereInt64("path", cacheSET, 1)); !reflect.DeepEqual(ids, []int64{1, 2}) {
+			t.Errorf("Unexpected result of the updated container: %v", ids)
+		}
+
+		// Rollback discards the changes
+		tx, err = db.BeginTx()
+		if err != nil {
+			t.Fatalf("Unexpected begin error: %+v", err)
+		}
+		if _, err := tx.Query().WhereInt64("parentId", cacheEQ, 2).DeleteCtx(ctx); err != nil {
+			t.Fatalf("Unexpected delete error: %+v", err)
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("Unexpected rollback error: %+v", err)
+		}
+		if ids := cacheIDs(t, db.Query().WhereInt64("parentId", cacheEQ, 2)); !reflect.DeepEqual(ids, []int64{10, 11, 12, 13}) {
+			t.Errorf("Unexpected result after rollback: %v", ids)
+		}
+
+		// Truncate keeps the indexes
+		if err := db.Truncate(); err != nil {
+			t.Fatalf("Unexpected truncate error: %+v", err)
+		}
+		if ids := cacheIDs(t, db.Query()); len(ids) != 0 {
+			t.Errorf("Unexpected result after truncate: %v", ids)
+		}
+		setupTestCacheDB(t, db, cacheTestItems())
+		if ids := cacheIDs(t, db.Query().Where("attrsNorm.uid", cacheLIKE, "user1%")); !reflect.DeepEqual(ids, []int64{10, 12}) {
+			t.Errorf("Unexpected result after truncate and upsert: %v", ids)
+		}
+	})
+}
+
+func TestLikeMatch(t *testing.T) {
+	testcases := []struct {
+		Value    string
+		Pattern  string
+		Expected bool
+	}{
+		{"user1", "user1", true},
+		{"user1", "user", false},
+		{"user1", "user%", true},
+		{"user1", "%1", true},
+		{"user1", "%ser%", true},
+		{"user1", "%x%", false},
+		{"user1", "u%r_", true},
+		{"user1", "%", true},
+		{"", "%", true},
+		{"", "_", false},
+		{"aXbXc", "a%b%c", true},
+		{"abcbc", "a%bc", true},
+		{"ユーザー", "ユ_ザー", true},
+		{"ユーザー", "ユ__ー", true},
+		{"a_c", `a\_c`, true},
+		{"abc", `a\_c`, false},
+		{"50%", `50\%`, true},
+		{"500", `50\%`, false},
+		{`a\b`, `a\\b`, true},
+		{"a_c", escapeLike("a_c") + "%", true},
+		{"abc", escapeLike("a_c") + "%", false},
+	}
+
+	for i, tc := range testcases {
+		if got := likeMatch(tc.Value, tc.Pattern); got != tc.Expected {
+			t.Errorf("Unexpected result [%d]. value: %s, pattern: %s, expected: %v, got: %v", i, tc.Value, tc.Pattern, tc.Expected, got)
+		}
+	}
+
+	// The prefix is used for the index lookup, the escapes are removed
+	for pattern, expected := range map[string]string{
+		"user%":     "user",
+		`a\_c%`:     "a_c",
+		`50\%_`:     "50%",
+		`a\\b%`:     `a\b`,
+		`%user`:     "",
+		`trailing\`: "trailing",
+	} {
+		if got := likePrefix(pattern); got != expected {
+			t.Errorf("Unexpected prefix. pattern: %s, expected: %s, got: %s", pattern, expected, got)
+		}
+	}
+}
+
+// The benchmarks compare the cache DBs with the queries which DefaultRepository executes.
+// Run with: go test -tags test -run ^$ -bench CacheDB ./repo/
+
+const benchmarkCacheItems = 100000
+
+func benchmarkCacheItemList() []*CacheItem {
+	items := []*CacheItem{
+		{ID: 1, ParentID: 0, Path: []int64{1}, IsContainer: true, RDNNorm: "dc=example,dc=com",
+			AttrsNorm: map[string]interface{}{"objectClass": []string{"top", "dcobject"}}},
+		{ID: 2, ParentID: 1, Path: []int64{1, 2}, IsContainer: true, RDNNorm: "ou=users",
+			AttrsNorm: map[string]interface{}{"objectClass": []string{"top", "organizationalunit"}}},
+		{ID: 3, ParentID: 1, Path: []int64{1, 3}, IsContainer: true, RDNNorm: "ou=groups",
+			AttrsNorm: map[string]interface{}{"objectClass": []string{"top", "organizationalunit"}}},
+	}
+
+	// 1% of the entries are the groups which have 100 members
+	groups := benchmarkCacheItems / 100
+	for i := 0; i < benchmarkCacheItems-groups; i++ {
+		uid := fmt.Sprintf("user%d", i)
+		items = append(items, &CacheItem{
+			ID:        int64(len(items) + 1),
+			Version:   1,
+			ParentID:  2,
+			RDNOrig:   "uid=" + uid,
+			RDNNorm:   "uid=" + uid,
+			AttrsOrig: map[string][]string{"uid": {uid}, "cn": {"User " + uid}},
+			AttrsNorm: map[string]interface{}{
+				"objectClass": []string{"top", "person", "organizationalperson", "inetorgperson"},
+				"uid":         []string{uid},
+				"cn":          []string{"user " + uid},
+				"sn":          []string{fmt.Sprintf("sn%d", i%1000)},
+				"uidNumber":   []string{fmt.Sprint(10000 + i)},
+			},
+		})
+	}
+	for i := 0; i < groups; i++ {
+		member := make([]interface{}, 100)
+		for j := range member {
+			member[j] = int64(4 + (i*100+j)%(benchmarkCacheItems-groups))
+		}
+		cn := fmt.Sprintf("group%d", i)
+		items = append(items, &CacheItem{
+			ID:        int64(len(items) + 1),
+			Version:   1,
+			ParentID:  3,
+			RDNOrig:   "cn=" + cn,
+			RDNNorm:   "cn=" + cn,
+			AttrsOrig: map[string][]string{"cn": {cn}},
+			AttrsNorm: map[string]interface{}{
+				"objectClass": []string{"top", "groupofnames"},
+				"cn":          []string{cn},
+				"member":      member,
+			},
+		})
+	}
+	return items
+}
+
+func BenchmarkCacheDBLoad(b *testing.B) {
+	items := benchmarkCacheItemList()
+
+	for _, name := range CacheDBNames() {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db, err := NewCacheDB(name)
+				if err != nil {
+					b.Skipf("Cache DB isn't available: %v", err)
+				}
+				b.StartTimer()
+
+				setupTestCacheDB(b, db, items)
+
+				b.StopTimer()
+				db.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func BenchmarkCacheDB(b *testing.B) {
+	items := benchmarkCacheItemList()
+	ctx := context.Background()
+
+	benchmarks := []struct {
+		Name  string
+		Query func(db CacheDB, i int) CacheQuery
+	}{
+		{
+			// findEntryIDWithTx
+			Name: "FindEntryID",
+			Query: func(db CacheDB, i int) CacheQuery {
+				return db.Query().
+					Select("id").
+					WhereInt64("parentId", cacheEQ, 2).
+					WhereString("rdnNorm", cacheEQ, fmt.Sprintf("uid=user%d", i%benchmarkCacheItems)).
+					Limit(1)
+			},
+		},
+		{
+			// (&(objectClass=inetOrgPerson)(uid=userN)) in subtree
+			Name: "SearchEquality",
+			Query: func(db CacheDB, i int) CacheQuery {
+				return db.Query().
+					OpenBracket().
+					OpenBracket().Where("attrsNorm.objectClass", cacheALLSET, []string{"inetorgperson"}).CloseBracket().
+					OpenBracket().Where("attrsNorm.uid", cacheEQ, []string{fmt.Sprintf("user%d", i%benchmarkCacheItems)}).CloseBracket().
+					CloseBracket().
+					OpenBracket().WhereInt64("id", cacheEQ, 1).Or().WhereInt64("parentId", cacheEQ, 1, 2, 3).CloseBracket().
+					ReqTotal().
+					Limit(500)
+			},
+		},
+		{
+			// (uid=user1*)
+			Name: "SearchPrefix",
+			Query: func(db CacheDB, i int) CacheQuery {
+				return db.Query().
+					Where("attrsNorm.uid", cacheLIKE, fmt.Sprintf("user%d%%", i%1000)).
+					WhereInt64("parentId", cacheEQ, 2).
+					ReqTotal().
+					Limit(500)
+			},
+		},
+		{
+			// (cn=*N*)
+			Name: "SearchSubstrings",
+			Query: func(db CacheDB, i int) CacheQuery {
+				return db.Query().
+					Where("attrsNorm.cn", cacheLIKE, fmt.Sprintf("%%%d%%", i%1000)).
+					WhereInt64("parentId", cacheEQ, 2).
+					ReqTotal().
+					Limit(500)
+			},
+		},
+		{
+			// (uidNumber>=N)
+			Name: "SearchGreaterOrEqual",
+			Query: func(db CacheDB, i int) CacheQuery {
+				return db.Query().
+					Where("attrsNorm.uidNumber", cacheGE, int64(10000+benchmarkCacheItems-i%1000)).
+					ReqTotal().
+					Limit(500)
+			},
+		},
+		{
+			// (sn=*) with paging
+			Name: "SearchPresentPaged",
+			Query: func(db CacheDB, i int) CacheQuery {
+				return db.Query().
+					Not().Where("attrsNorm.sn", cacheEMPTY, 0).
+					ReqTotal().
+					Offset((i % 100) * 500).
+					Limit(500)
+			},
+		},
+		{
+			// (member=uid=userN,ou=users,dc=example,dc=com)
+			Name: "SearchMember",
+			Query: func(db CacheDB, i int) CacheQuery {
+				return db.Query().
+					WhereInt64("attrsNorm.member", cacheEQ, int64(4+i%benchmarkCacheItems)).
+					ReqTotal().
+					Limit(500)
+			},
+		},
+		{
+			// findChildContainerIDs
+			Name: "FindChildContainers",
+			Query: func(db CacheDB, i int) CacheQuery {
+				return db.Query().
+					Select("id").
+					WhereInt64("path", cacheSET, 1)
+			},
+		},
+	}
+
+	for _, name := range CacheDBNames() {
+		db, err := NewCacheDB(name)
+		if err != nil {
+			b.Logf("Skip the cache DB which isn't available: %v", err)
+			continue
+		}
+		setupTestCacheDB(b, db, items)
+
+		for _, bm := range benchmarks {
+			b.Run(name+"/"+bm.Name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					iter := bm.Query(db, i).ExecToJsonCtx(ctx)
+					for iter.Next() {
+						_ = iter.JSON()
+					}
+					if err := iter.Error(); err != nil {
+						b.Fatalf("Unexpected query error: %+v", err)
+					}
+					iter.Close()
+				}
+			})
+		}
+
+		b.Run(name+"/Upsert", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				item := *items[3+i%(len(items)-3)]
+				item.Version++
+
+				tx, err := db.BeginTx()
+				if err != nil {
+					b.Fatalf("Unexpected begin error: %+v", err)
+				}
+				if err := tx.Upsert(&item); err != nil {
+					b.Fatalf("Unexpected upsert error: %+v", err)
+				}
+				if err := tx.Commit(); err != nil {
+					b.Fatalf("Unexpected commit error: %+v", err)
+				}
+			}
+		})
+
+		db.Close()
+	}
+}
@@ -228,8 +228,9 @@ func (c *Changelog) ToMemberOfDiff() (add []string, del []string) {
 			}
 
 			if len(replace) > 0 {
-				// No old values, it means new values are added values
+				// All old values are replaced, it means new values are added values and old values are deleted values
 				a.AddAll(nsv.Orig()...)
+				d.AddAll(osv.Orig()...)
 			} else if len(add) > 0 || len(del) > 0 {
 				if len(add) > 0 {
 					a.AddAll(add...)
@@ -0,0 +1,583 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+	"golang.org/x/xerrors"
+)
+
+// Fsck checks the invariants of the entry table of the postgres backend without the cache.
+// It's run by the command while the servers are running, so the repair locks the table against the writes,
+// then the repaired entries are notified by the changelog with the new rev.
+
+type FsckCheck string
+
+const (
+	// The parent chain doesn't reach the root
+	FsckParent FsckCheck = "parent"
+	// is_container doesn't match whether the entry has the children
+	FsckContainer FsckCheck = "container"
+	// path doesn't match the parent chain
+	FsckPath FsckCheck = "path"
+	// member, uniqueMember or memberOf has the id which doesn't exist
+	FsckAssociation FsckCheck = "association"
+	// memberOf doesn't match the member and uniqueMember of the groups
+	FsckMemberOf FsckCheck = "memberOf"
+	// The attributes don't satisfy the schema
+	FsckSchema FsckCheck = "schema"
+	// entryUUID is missing, duplicated or doesn't match the uuid column
+	FsckEntryUUID FsckCheck = "entryUUID"
+)
+
+type FsckIssue struct {
+	Check    FsckCheck `json:"check"`
+	ID       int64     `json:"id"`
+	DN       string    `json:"dn,omitempty"`
+	Message  string    `json:"message"`
+	Repaired bool      `json:"repaired"`
+}
+
+type FsckResult struct {
+	Checked  int         `json:"checked"`
+	Issues   []FsckIssue `json:"issues"`
+	Repaired int         `json:"repaired"`
+}
+
+type fsckEntry struct {
+	ID          int64          `db:"id"`
+	UUID        string         `db:"uuid"`
+	Version     int64          `db:"rev"`
+	ParentID    int64          `db:"parent_id"`
+	Path        pq.Int64Array  `db:"path"`
+	IsContainer bool           `db:"is_container"`
+	RDNOrig     string         `db:"rdn_orig"`
+	AttrsOrig   types.JSONText `db:"attrs_orig"`
+
+	attrs map[string][]string
+	// Set when the fields are repaired
+	fixed bool
+	// The repaired issues of the entry, they're reported as repaired after the update
+	issues []int
+}
+
+// fsck checks all entries of the entry table in memory.
+type fsck struct {
+	sr       *schema.SchemaRegistry
+	entries  map[int64]*fsckEntry
+	ids      []int64
+	children map[int64][]int64
+	dn       map[int64]string
+	result   *FsckResult
+	// Set when the association is stored in the association table
+	association bool
+}
+
+func newFsck(sr *schema.SchemaRegistry, entries []*fsckEntry) *fsck {
+	f := &fsck{
+		sr:       sr,
+		entries:  map[int64]*fsckEntry{},
+		children: map[int64][]int64{},
+		dn:       map[int64]string{},
+		result: &FsckResult{
+			Issues: []FsckIssue{},
+		},
+	}
+	for _, e := range entries {
+		f.entries[e.ID] = e
+		f.ids = append(f.ids, e.ID)
+	}
+	sort.Slice(f.ids, func(i, j int) bool {
+		return f.ids[i] < f.ids[j]
+	})
+	return f
+}
+
+func (f *fsck) report(e *fsckEntry, check FsckCheck, repairable bool, format string, args ...interface{}) {
+	f.result.Issues = append(f.result.Issues, FsckIssue{
+		Check:   check,
+		ID:      e.ID,
+		DN:      f.dn[e.ID],
+		Message: fmt.Sprintf(format, args...),
+	})
+	if repairable {
+		e.fixed = true
+		e.issues = append(e.issues, len(f.result.Issues)-1)
+	}
+}
+
+// check runs all checks, then the entries have the repaired fields if it's repairable.
+func (f *fsck) check() *FsckResult {
+	// The root of root isn't checked
+	f.result.Checked = len(f.ids) - 1
+
+	for _, id := range f.ids {
+		e := f.entries[id]
+		e.attrs = map[string][]string{}
+		if err := e.AttrsOrig.Unmarshal(&e.attrs); err != nil {
+			f.report(e, FsckSchema, false, "Invalid attrs_orig: %v", err)
+			// The attributes aren't checked nor repaired
+			e.attrs = nil
+		}
+		if id != 0 {
+			f.children[e.ParentID] = append(f.children[e.ParentID], id)
+		}
+	}
+
+	f.checkParent()
+	f.checkContainer()
+	f.checkAssociation()
+	f.checkEntryUUID()
+	f.checkSchema()
+
+	return f.result
+}
+
+// ancestors returns the ids from the top to the parent, it returns false if the chain doesn't reach the root.
+func (f *fsck) ancestors(e *fsckEntry) ([]int64, bool) {
+	ids := []int64{}
+	visited := map[int64]struct{}{e.ID: {}}
+	for pid := e.ParentID; pid != 0; {
+		if _, ok := visited[pid]; ok {
+			return nil, false
+		}
+		visited[pid] = struct{}{}
+
+		p, ok := f.entries[pid]
+		if !ok {
+			return nil, false
+		}
+		ids = append([]int64{pid}, ids...)
+		pid = p.ParentID
+	}
+	return ids, true
+}
+
+func (f *fsck) checkParent() {
+	for _, id := range f.ids {
+		if id == 0 {
+			continue
+		}
+		e := f.entries[id]
+		ancestors, ok := f.ancestors(e)
+		if !ok {
+			f.report(e, FsckParent, false, "The parent chain doesn't reach the root. parent_id: %d", e.ParentID)
+			continue
+		}
+
+		// The suffix entry has the suffix DN
+		rdns := []string{}
+		if e.ParentID != 0 {
+			rdns = append(rdns, e.RDNOrig)
+		}
+		for i := len(ancestors) - 1; i >= 1; i-- {
+			rdns = append(rdns, f.entries[ancestors[i]].RDNOrig)
+		}
+		rdns = append(rdns, f.sr.Config.Suffix)
+		f.dn[id] = strings.Join(rdns, ",")
+	}
+}
+
+func (f *fsck) checkContainer() {
+	for _, id := range f.ids {
+		if id == 0 {
+			continue
+		}
+		e := f.entries[id]
+		if _, ok := f.dn[id]; !ok {
+			// Broken parent chain
+			continue
+		}
+
+		isContainer := len(f.children[id]) > 0
+		if e.IsContainer != isContainer {
+			f.report(e, FsckContainer, true, "is_container is %v, but it has %d children", e.IsContainer, len(f.children[id]))
+			e.IsContainer = isContainer
+		}
+
+		var path []int64
+		if isContainer {
+			ancestors, _ := f.ancestors(e)
+			path = append(ancestors, id)
+		}
+		// The leaf has null or empty path
+		if !(len(path) == 0 && len(e.Path) == 0) && !reflect.DeepEqual(path, []int64(e.Path)) {
+			f.report(e, FsckPath, true, "path is %v, but the parent chain is %v", []int64(e.Path), path)
+			e.Path = path
+		}
+	}
+}
+
+func (f *fsck) checkAssociation() {
+	memberOf := map[int64][]int64{}
+
+	for _, id := range f.ids {
+		if id == 0 {
+			continue
+		}
+		e := f.entries[id]
+		if e.attrs == nil {
+			continue
+		}
+		for _, name := range []string{"member", "uniqueMember", "memberOf"} {
+			values, ok := e.attrs[name]
+			if !ok {
+				continue
+			}
+			valid := []string{}
+			for _, v := range values {
+				mid, err := strconv.ParseInt(v, 10, 64)
+				if _, exists := f.entries[mid]; err != nil || !exists || mid == 0 {
+					f.report(e, FsckAssociation, true, "%s has the id which doesn't exist: %s", name, v)
+					continue
+				}
+				valid = append(valid, v)
+				if name != "memberOf" {
+					memberOf[mid] = append(memberOf[mid], id)
+				}
+			}
+			if len(valid) != len(values) {
+				f.setAttr(e, name, valid)
+			}
+		}
+	}
+
+	for _, id := range f.ids {
+		if id == 0 {
+			continue
+		}
+		e := f.entries[id]
+		if e.attrs == nil {
+			continue
+		}
+
+		expected := []string{}
+		seen := map[int64]struct{}{}
+		sort.Slice(memberOf[id], func(i, j int) bool {
+			return memberOf[id][i] < memberOf[id][j]
+		})
+		for _, gid := range memberOf[id] {
+			if _, ok := seen[gid]; ok {
+				continue
+			}
+			seen[gid] = struct{}{}
+			expected = append(expected, strconv.FormatInt(gid, 10))
+		}
+
+		actual := append([]string{}, e.attrs["memberOf"]...)
+		sort.Slice(actual, func(i, j int) bool {
+			a, _ := strconv.ParseInt(actual[i], 10, 64)
+			b, _ := strconv.ParseInt(actual[j], 10, 64)
+			return a < b
+		})
+		if !(len(expected) == 0 && len(actual) == 0) && !reflect.DeepEqual(expected, actual) {
+			f.report(e, FsckMemberOf, true, "memberOf is %v, but the groups are %v", e.attrs["memberOf"], expected)
+			f.setAttr(e, "memberOf", expected)
+		}
+	}
+}
+
+func (f *fsck) checkEntryUUID() {
+	owners := map[string][]int64{}
+	for _, id := range f.ids {
+		if id == 0 {
+			continue
+		}
+		for _, v := range f.entries[id].attrs["entryUUID"] {
+			owners[strings.ToLower(v)] = append(owners[strings.ToLower(v)], id)
+		}
+	}
+
+	for _, id := range f.ids {
+		if id == 0 {
+			continue
+		}
+		e := f.entries[id]
+		if e.attrs == nil {
+			continue
+		}
+		values := e.attrs["entryUUID"]
+
+		switch {
+		case len(values) == 0:
+			f.report(e, FsckEntryUUID, true, "entryUUID is missing, uuid: %s", e.UUID)
+		case len(values) > 1:
+			f.report(e, FsckEntryUUID, true, "entryUUID has multiple values: %v, uuid: %s", values, e.UUID)
+		case !strings.EqualFold(values[0], e.UUID):
+			if others := owners[strings.ToLower(values[0])]; len(others) > 1 {
+				f.report(e, FsckEntryUUID, true, "entryUUID is duplicated with %v: %s, uuid: %s", others, values[0], e.UUID)
+			} else {
+				f.report(e, FsckEntryUUID, true, "entryUUID doesn't match uuid: %s, uuid: %s", values[0], e.UUID)
+			}
+		default:
+			continue
+		}
+		// The uuid column is unique
+		f.setAttr(e, "entryUUID", []string{e.UUID})
+	}
+}
+
+func (f *fsck) checkSchema() {
+	for _, id := range f.ids {
+		if id == 0 {
+			continue
+		}
+		e := f.entries[id]
+		if _, ok := f.dn[id]; !ok || e.attrs == nil {
+			continue
+		}
+
+		svs := map[string]*schema.SchemaValue{}
+		failed := false
+		for k, v := range e.attrs {
+			// The association has the ids, then it's validated as DN
+			if isAssociationAttribute(k) {
+				dns := []string{}
+				for _, vv := range v {
+					mid, _ := strconv.ParseInt(vv, 10, 64)
+					dn, ok := f.dn[mid]
+					if !ok {
+						// The associated entry has the broken parent chain, it's reported already
+						break
+					}
+					dns = append(dns, dn)
+				}
+				if len(dns) != len(v) {
+					failed = true
+					continue
+				}
+				v = dns
+			}
+			if len(v) == 0 {
+				continue
+			}
+
+			sv, err := schema.NewSchemaValue(f.sr, k, v)
+			if err == nil {
+				err = sv.Normalize()
+			}
+			if err != nil {
+				f.report(e, FsckSchema, false, "Invalid attribute %s: %v", k, err)
+				failed = true
+				continue
+			}
+			svs[sv.Name()] = sv
+		}
+		if failed {
+			continue
+		}
+
+		oc, ok := svs["objectClass"]
+		if !ok || oc.IsEmpty() {
+			f.report(e, FsckSchema, false, "objectClass is missing")
+			continue
+		}
+		if err := f.sr.ValidateObjectClass(oc.NormStr(), svs); err != nil {
+			f.report(e, FsckSchema, false, "%v", err)
+		}
+	}
+}
+
+func (f *fsck) setAttr(e *fsckEntry, name string, values []string) {
+	if len(values) == 0 {
+		delete(e.attrs, name)
+	} else {
+		e.attrs[name] = values
+	}
+}
+
+func isAssociationAttribute(name string) bool {
+	return name == "member" || name == "uniqueMember" || name == "memberOf"
+}
+
+// Fsck checks the entry table of the postgres backend, then repairs the entries in a transaction if repair is true.
+// The servers apply the repaired entries by the changelog.
+func Fsck(ctx context.Context, config *DBRepositoryConfig, sr *schema.SchemaRegistry, repair bool) (*FsckResult, error) {
+	if config.URL != "" {
+		u, err := url.Parse(config.URL)
+		if err != nil {
+			return nil, xerrors.Errorf("Invalid DB URL. err: %w", err)
+		}
+		if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+			return nil, xerrors.Errorf("Unsupported DB URL for fsck: %s", u.Scheme)
+		}
+	}
+
+	db, err := sqlx.Connect("postgres", postgresConnInfo(config))
+	if err != nil {
+		return nil, xerrors.Errorf("Connect error. host=%s, port=%d, user=%s, dbname=%s, err: %w",
+			config.DBHostName, config.DBPort, config.DBUser, config.DBName, err)
+	}
+	defer db.Close()
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  !repair,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to begin transaction. err: %w", err)
+	}
+	defer rollback(tx)
+
+	if repair {
+		// Block the writes by the servers until the repair is committed
+		if _, err := tx.ExecContext(ctx, `LOCK TABLE entry IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+			return nil, xerrors.Errorf("Failed to lock the entry table. err: %w", err)
+		}
+	}
+
+	var association bool
+	if err := tx.GetContext(ctx, &association, `SELECT to_regclass('association') IS NOT NULL`); err != nil {
+		return nil, xerrors.Errorf("Failed to check the association table. err: %w", err)
+	}
+	attrsOrig := `e.attrs_orig`
+	if association {
+		attrsOrig = attrsOrigWithAssociation + ` AS attrs_orig`
+	}
+
+	var entries []*fsckEntry
+	err = tx.SelectContext(ctx, &entries, `
+SELECT
+	e.id, CAST(e.uuid AS text) AS uuid, e.rev, e.parent_id, e.path, e.is_container, e.rdn_orig, `+attrsOrig+`
+FROM entry e
+`)
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to fetch all entries. err: %w", err)
+	}
+
+	f := newFsck(sr, entries)
+	f.association = association
+	result := f.check()
+
+	log.Printf("info: Checked entries: %d, issues: %d", result.Checked, len(result.Issues))
+
+	if !repair {
+		return result, nil
+	}
+
+	if err := f.repair(ctx, tx); err != nil {
+		return nil, err
+	}
+	if err := commit(tx); err != nil {
+		return nil, err
+	}
+
+	for _, id := range f.ids {
+		for _, i := range f.entries[id].issues {
+			result.Issues[i].Repaired = true
+			result.Repaired++
+		}
+	}
+
+	log.Printf("info: Repaired issues: %d", result.Repaired)
+
+	return result, nil
+}
+
+// repair updates the fixed entries with the new rev, then notifies them by the changelog if it exists.
+func (f *fsck) repair(ctx context.Context, tx *sqlx.Tx) error {
+	var changelog bool
+	if err := tx.GetContext(ctx, &changelog, `SELECT to_regclass('entry_change') IS NOT NULL`); err != nil {
+		return xerrors.Errorf("Failed to check the changelog. err: %w", err)
+	}
+	var attrsNorm bool
+	err := tx.GetContext(ctx, &attrsNorm, `
+SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'entry' AND column_name = 'attrs_norm')
+`)
+	if err != nil {
+		return xerrors.Errorf("Failed to check attrs_norm. err: %w", err)
+	}
+
+	var seq int64
+	for _, id := range f.ids {
+		e := f.entries[id]
+		if !e.fixed {
+			continue
+		}
+
+		attrs := e.attrs
+		if f.association {
+			// The association table is kept by the foreign keys, and memberOf is derived from it
+			attrs = map[string][]string{}
+			for k, v := range e.attrs {
+				if !isAssociationAttribute(k) {
+					attrs[k] = v
+				}
+			}
+		}
+
+		b, err := json.Marshal(attrs)
+		if err != nil {
+			return xerrors.Errorf("Unexpected marshal error. id: %d, err: %w", id, err)
+		}
+		var path interface{}
+		if len(e.Path) > 0 {
+			path = pq.Array([]int64(e.Path))
+		}
+
+		var rev int64
+		err = tx.GetContext(ctx, &rev, `
+UPDATE entry
+SET
+	rev = rev + 1,
+	path = $2,
+	is_container = $3,
+	attrs_orig = $4
+WHERE
+	id = $1
+RETURNING rev
+`, id, path, e.IsContainer, types.JSONText(b))
+		if err != nil {
+			return xerrors.Errorf("Failed to repair the entry. id: %d, err: %w", id, err)
+		}
+		if attrsNorm {
+			// Stored for the search by SQL, it's migrated again by the server if it can't be normalized
+			var norm interface{}
+			if n, err := toAttrsNorm(f.sr, attrs); err != nil {
+				log.Printf("warn: Failed to normalize the repaired entry. id: %d, err: %v", id, err)
+			} else {
+				norm = string(n)
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE entry SET attrs_norm = CAST($2 AS jsonb) WHERE id = $1`, id, norm); err != nil {
+				return xerrors.Errorf("Failed to repair attrs_norm of the entry. id: %d, err: %w", id, err)
+			}
+		}
+
+		if !changelog {
+			continue
+		}
+		m, err := json.Marshal(&NotifyMessage{
+			Issuer:    "fsck",
+			ID:        id,
+			Op:        NotifyMod,
+			Rev:       rev,
+			Dependant: []int64{},
+		})
+		if err != nil {
+			return xerrors.Errorf("Unexpected marshal error. id: %d, err: %w", id, err)
+		}
+		err = tx.GetContext(ctx, &seq, `INSERT INTO entry_change (message) VALUES (CAST($1 AS jsonb)) RETURNING seq`, string(m))
+		if err != nil {
+			return xerrors.Errorf("Failed to record the change. id: %d, err: %w", id, err)
+		}
+	}
+
+	if seq > 0 {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, notifyChannel, strconv.FormatInt(seq, 10)); err != nil {
+			return xerrors.Errorf("Failed to notify the changes. err: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+//go:build test
+
+package repo
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/jmoiron/sqlx/types"
+)
+
+func TestFsck(t *testing.T) {
+	sr := schema.NewSchemaRegistry(&schema.SchemaConfig{
+		Suffix: "dc=example,dc=com",
+		RootDN: "cn=Manager,dc=example,dc=com",
+	})
+
+	entry := func(id, parentID int64, rdn string, path []int64, attrs map[string][]string) *fsckEntry {
+		b, _ := json.Marshal(attrs)
+		return &fsckEntry{
+			ID:          id,
+			UUID:        attrs["entryUUID"][0],
+			Version:     1,
+			ParentID:    parentID,
+			Path:        path,
+			IsContainer: len(path) > 0,
+			RDNOrig:     rdn,
+			AttrsOrig:   types.JSONText(b),
+		}
+	}
+	entries := func() []*fsckEntry {
+		return []*fsckEntry{
+			{ID: 0, UUID: "00000000-0000-0000-0000-000000000000", IsContainer: true, AttrsOrig: types.JSONText(`{}`)},
+			entry(1, 0, "dc=example", []int64{1}, map[string][]string{
+				"objectClass": {"top", "dcObject", "organization"},
+				"dc":          {"example"},
+				"o":           {"example"},
+				"entryUUID":   {"5b2f7c3e-1d4a-4c7b-9a1e-000000000001"},
+			}),
+			entry(2, 1, "ou=Users", []int64{1, 2}, map[string][]string{
+				"objectClass": {"organizationalUnit"},
+				"ou":          {"Users"},
+				"entryUUID":   {"5b2f7c3e-1d4a-4c7b-9a1e-000000000002"},
+			}),
+			entry(3, 2, "uid=user1", nil, map[string][]string{
+				"objectClass": {"inetOrgPerson"},
+				"uid":         {"user1"},
+				"cn":          {"user1"},
+				"sn":          {"user1"},
+				"memberOf":    {"4"},
+				"entryUUID":   {"5b2f7c3e-1d4a-4c7b-9a1e-000000000003"},
+			}),
+			entry(4, 1, "cn=group1", nil, map[string][]string{
+				"objectClass": {"groupOfNames"},
+				"cn":          {"group1"},
+				"member":      {"3"},
+				"entryUUID":   {"5b2f7c3e-1d4a-4c7b-9a1e-000000000004"},
+			}),
+		}
+	}
+
+	type issue struct {
+		Check      FsckCheck
+		ID         int64
+		Repairable bool
+	}
+
+	sameIssues := func(a, b []issue) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		counts := map[issue]int{}
+		for _, v := range a {
+			counts[v]++
+		}
+		for _, v := range b {
+			counts[v]--
+			if counts[v] < 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	testcases := []struct {
+		Name           string
+		Corrupt        func(entries []*fsckEntry)
+		ExpectedIssues []issue
+		Verify         func(t *testing.T, f *fsck)
+	}{
+		{
+			"consistent",
+			func(entries []*fsckEntry) {},
+			[]issue{},
+			nil,
+		},
+		{
+			"is_container and path of container",
+			func(entries []*fsckEntry) {
+				entries[2].IsContainer = false
+				entries[2].Path = []int64{2}
+			},
+			[]issue{
+				{FsckContainer, 2, true},
+				{FsckPath, 2, true},
+			},
+			func(t *testing.T, f *fsck) {
+				e := f.entries[2]
+				if !e.IsContainer || !reflect.DeepEqual([]int64(e.Path), []int64{1, 2}) {
+					t.Errorf("Unexpected repaired entry: is_container: %v, path: %v", e.IsContainer, e.Path)
+				}
+			},
+		},
+		{
+			"path of leaf",
+			func(entries []*fsckEntry) {
+				entries[4].IsContainer = true
+				entries[4].Path = []int64{1, 4}
+			},
+			[]issue{
+				{FsckContainer, 4, true},
+				{FsckPath, 4, true},
+			},
+			func(t *testing.T, f *fsck) {
+				e := f.entries[4]
+				if e.IsContainer || len(e.Path) != 0 {
+					t.Errorf("Unexpected repaired entry: is_container: %v, path: %v", e.IsContainer, e.Path)
+				}
+			},
+		},
+		{
+			"broken parent chain",
+			func(entries []*fsckEntry) {
+				entries[3].ParentID = 99
+			},
+			[]issue{
+				{FsckParent, 3, false},
+				// ou=Users has no children
+				{FsckContainer, 2, true},
+				{FsckPath, 2, true},
+			},
+			nil,
+		},
+		{
+			"dangling member",
+			func(entries []*fsckEntry) {
+				entries[4].AttrsOrig = types.JSONText(`{"objectClass":["groupOfNames"],"cn":["group1"],"member":["3","99"],"entryUUID":["5b2f7c3e-1d4a-4c7b-9a1e-000000000004"]}`)
+			},
+			[]issue{
+				{FsckAssociation, 4, true},
+			},
+			func(t *testing.T, f *fsck) {
+				if v := f.entries[4].attrs["member"]; !reflect.DeepEqual(v, []string{"3"}) {
+					t.Errorf("Unexpected repaired member: %v", v)
+				}
+			},
+		},
+		{
+			"stale memberOf",
+			func(entries []*fsckEntry) {
+				entries[4].AttrsOrig = types.JSONText(`{"objectClass":["groupOfNames"],"cn":["group1"],"member":["2"],"entryUUID":["5b2f7c3e-1d4a-4c7b-9a1e-000000000004"]}`)
+			},
+			[]issue{
+				{FsckMemberOf, 2, true},
+				{FsckMemberOf, 3, true},
+			},
+			func(t *testing.T, f *fsck) {
+				if v := f.entries[2].attrs["memberOf"]; !reflect.DeepEqual(v, []string{"4"}) {
+					t.Errorf("Unexpected repaired memberOf: %v", v)
+				}
+				if _, ok := f.entries[3].attrs["memberOf"]; ok {
+					t.Errorf("Unexpected repaired memberOf: %v", f.entries[3].attrs["memberOf"])
+				}
+			},
+		},
+		{
+			"duplicated entryUUID",
+			func(entries []*fsckEntry) {
+				entries[3].AttrsOrig = types.JSONText(`{"objectClass":["inetOrgPerson"],"uid":["user1"],"cn":["user1"],"sn":["user1"],"memberOf":["4"],"entryUUID":["5b2f7c3e-1d4a-4c7b-9a1e-000000000002"]}`)
+			},
+			[]issue{
+				{FsckEntryUUID, 3, true},
+			},
+			func(t *testing.T, f *fsck) {
+				if v := f.entries[3].attrs["entryUUID"]; !reflect.DeepEqual(v, []string{"5b2f7c3e-1d4a-4c7b-9a1e-000000000003"}) {
+					t.Errorf("Unexpected repaired entryUUID: %v", v)
+				}
+			},
+		},
+		{
+			"schema violation",
+			func(entries []*fsckEntry) {
+				// sn is required by inetOrgPerson
+				entries[3].AttrsOrig = types.JSONText(`{"objectClass":["inetOrgPerson"],"uid":["user1"],"cn":["user1"],"memberOf":["4"],"entryUUID":["5b2f7c3e-1d4a-4c7b-9a1e-000000000003"]}`)
+			},
+			[]issue{
+				{FsckSchema, 3, false},
+			},
+			nil,
+		},
+		{
+			"invalid attrs_orig",
+			func(entries []*fsckEntry) {
+				entries[3].AttrsOrig = types.JSONText(`[]`)
+			},
+			[]issue{
+				{FsckSchema, 3, false},
+			},
+			nil,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			es := entries()
+			tc.Corrupt(es)
+
+			f := newFsck(sr, es)
+			result := f.check()
+
+			if result.Checked != 4 {
+				t.Errorf("Unexpected checked: %d", result.Checked)
+			}
+
+			issues := []issue{}
+			for i, is := range result.Issues {
+				repairable := false
+				for _, j := range f.entries[is.ID].issues {
+					if i == j {
+						repairable = true
+					}
+				}
+				issues = append(issues, issue{is.Check, is.ID, repairable})
+			}
+			if !sameIssues(issues, tc.ExpectedIssues) {
+				t.Errorf("Unexpected issues:\nexpected: %+v\ngot: %+v\nresult: %+v", tc.ExpectedIssues, issues, result.Issues)
+			}
+
+			if tc.Verify != nil {
+				tc.Verify(t, f)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package repo
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// LDIFEntry is the entry record in LDIF (RFC 2849).
+type LDIFEntry struct {
+	DN string
+	// The attribute names in the order of the appearance
+	Names []string
+	Attrs map[string][]string
+}
+
+func (e *LDIFEntry) add(name, value string) {
+	if _, ok := e.Attrs[name]; !ok {
+		e.Names = append(e.Names, name)
+	}
+	e.Attrs[name] = append(e.Attrs[name], value)
+}
+
+// ParseLDIF reads the entry records from LDIF.
+// Only the content records and the change records with "changetype: add" are supported.
+func ParseLDIF(r io.Reader) ([]*LDIFEntry, error) {
+	entries := []*LDIFEntry{}
+
+	var entry *LDIFEntry
+	var lines []string
+	var lineNo, startNo int
+
+	flushLine := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		line := strings.Join(lines, "")
+		lines = nil
+
+		name, value, err := parseLDIFLine(line)
+		if err != nil {
+			return xerrors.Errorf("Invalid LDIF at line %d: %w", startNo, err)
+		}
+
+		if entry == nil {
+			switch strings.ToLower(name) {
+			case "version":
+				if len(entries) > 0 || value != "1" {
+					return xerrors.Errorf("Invalid LDIF at line %d: unsupported version: %s", startNo, value)
+				}
+				return nil
+			case "dn":
+				entry = &LDIFEntry{
+					DN:    value,
+					Attrs: map[string][]string{},
+				}
+				return nil
+			default:
+				return xerrors.Errorf("Invalid LDIF at line %d: dn is required at the first of the record", startNo)
+			}
+		}
+
+		if strings.EqualFold(name, "changetype") {
+			if !strings.EqualFold(value, "add") {
+				return xerrors.Errorf("Invalid LDIF at line %d: unsupported changetype: %s", startNo, value)
+			}
+			return nil
+		}
+		if strings.EqualFold(name, "control") {
+			return xerrors.Errorf("Invalid LDIF at line %d: control isn't supported", startNo)
+		}
+		entry.add(name, value)
+		return nil
+	}
+
+	flushEntry := func() error {
+		if err := flushLine(); err != nil {
+			return err
+		}
+		if entry != nil {
+			if len(entry.Attrs) == 0 {
+				return xerrors.Errorf("Invalid LDIF: no attributes. dn: %s", entry.DN)
+			}
+			entries = append(entries, entry)
+			entry = nil
+		}
+		return nil
+	}
+
+	comment := false
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 5*1024*1024)
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+
+		// Folded line
+		if strings.HasPrefix(line, " ") {
+			if comment {
+				continue
+			}
+			if len(lines) == 0 {
+				return nil, xerrors.Errorf("Invalid LDIF at line %d: unexpected continuation line", lineNo)
+			}
+			lines = append(lines, line[1:])
+			continue
+		}
+
+		if err := flushLine(); err != nil {
+			return nil, err
+		}
+		comment = false
+
+		if line == "" {
+			if err := flushEntry(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			comment = true
+			continue
+		}
+
+		lines = append(lines, line)
+		startNo = lineNo
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("Failed to read LDIF. err: %w", err)
+	}
+
+	if err := flushEntry(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// ReadLDIFFile reads the entry records from the LDIF file.
+func ReadLDIFFile(path string) ([]*LDIFEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to open LDIF file. path: %s, err: %w", path, err)
+	}
+	defer f.Close()
+
+	entries, err := ParseLDIF(f)
+	if err != nil {
+		return nil, xerrors.Errorf("path: %s, err: %w", path, err)
+	}
+	return entries, nil
+}
+
+func parseLDIFLine(line string) (string, string, error) {
+	i := strings.Index(line, ":")
+	if i <= 0 {
+		return "", "", xerrors.Errorf("missing attribute separator")
+	}
+	name := line[:i]
+	rest := line[i+1:]
+
+	switch {
+	// Base64 encoded value
+	case strings.HasPrefix(rest, ":"):
+		b, err := base64.StdEncoding.DecodeString(strings.TrimLeft(rest[1:], " "))
+		if err != nil {
+			return "", "", xerrors.Errorf("invalid base64 value of %s: %w", name, err)
+		}
+		return name, string(b), nil
+
+	// URL value
+	case strings.HasPrefix(rest, "<"):
+		u, err := url.Parse(strings.TrimLeft(rest[1:], " "))
+		if err != nil {
+			return "", "", xerrors.Errorf("invalid URL value of %s: %w", name, err)
+		}
+		if u.Scheme != "file" {
+			return "", "", xerrors.Errorf("unsupported URL value of %s: %s", name, u.String())
+		}
+		b, err := os.ReadFile(u.Path)
+		if err != nil {
+			return "", "", xerrors.Errorf("failed to read the value of %s: %w", name, err)
+		}
+		return name, string(b), nil
+	}
+
+	return name, strings.TrimLeft(rest, " "), nil
+}
@@ -0,0 +1,111 @@
+//go:build test
+
+package repo
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLDIF(t *testing.T) {
+	testcases := []struct {
+		Name     string
+		LDIF     string
+		Expected []*LDIFEntry
+		Err      string
+	}{
+		{
+			"Content records",
+			`version: 1
+# comment
+#  continued comment
+dn: dc=example,dc=com
+objectClass: top
+objectClass: dcObject
+dc: example
+
+dn: ou=Users,
+ dc=example,dc=com
+changetype: add
+ou: Users
+description:: w6lsw6h2ZQ==
+`,
+			[]*LDIFEntry{
+				{
+					DN:    "dc=example,dc=com",
+					Names: []string{"objectClass", "dc"},
+					Attrs: map[string][]string{
+						"objectClass": {"top", "dcObject"},
+						"dc":          {"example"},
+					},
+				},
+				{
+					DN:    "ou=Users,dc=example,dc=com",
+					Names: []string{"ou", "description"},
+					Attrs: map[string][]string{
+						"ou":          {"Users"},
+						"description": {"élève"},
+					},
+				},
+			},
+			"",
+		},
+		{
+			"CRLF and multiple blank lines",
+			"dn: dc=example,dc=com\r\ndc: example\r\n\r\n\r\n",
+			[]*LDIFEntry{
+				{
+					DN:    "dc=example,dc=com",
+					Names: []string{"dc"},
+					Attrs: map[string][]string{
+						"dc": {"example"},
+					},
+				},
+			},
+			"",
+		},
+		{
+			"No dn",
+			"dc: example\n",
+			nil,
+			"line 1: dn is required",
+		},
+		{
+			"Unsupported changetype",
+			"dn: dc=example,dc=com\nchangetype: modify\n",
+			nil,
+			"line 2: unsupported changetype",
+		},
+		{
+			"Invalid base64",
+			"dn: dc=example,dc=com\ndc:: !!!\n",
+			nil,
+			"line 2: invalid base64",
+		},
+		{
+			"Unexpected continuation",
+			" dc=example\n",
+			nil,
+			"line 1: unexpected continuation",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			entries, err := ParseLDIF(strings.NewReader(tc.LDIF))
+			if tc.Err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.Err) {
+					t.Fatalf("Expected error: %s, got: %v", tc.Err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(entries, tc.Expected) {
+				t.Errorf("Unexpected entries. expected: %+v, got: %+v", tc.Expected, entries)
+			}
+		})
+	}
+}
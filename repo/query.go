@@ -2,20 +2,31 @@ package repo
 
 import (
 	"context"
+	"encoding/json"
 	"log"
+	"strconv"
 	"strings"
 
 	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
 	"github.com/cloudldap/goldap/message"
-	"github.com/restream/reindexer"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// LDAP_MATCHING_RULE_IN_CHAIN of Active Directory
+	matchingRuleInChainOID = "1.2.840.113556.1.4.1941"
+	// LDAP_MATCHING_RULE_BIT_AND/OR of Active Directory
+	matchingRuleBitAndOID = "1.2.840.113556.1.4.803"
+	matchingRuleBitOrOID  = "1.2.840.113556.1.4.804"
 )
 
 type FilterTranslator struct {
-	tx *reindexer.Tx
+	tx CacheTx
 	r  *DefaultRepository
 }
 
-func (t *FilterTranslator) translate(ctx context.Context, sr *schema.SchemaRegistry, packet message.Filter, q *reindexer.Query) (err error) {
+func (t *FilterTranslator) translate(ctx context.Context, sr *schema.SchemaRegistry, packet message.Filter, q CacheQuery) (err error) {
 	err = nil
 
 	switch f := packet.(type) {
@@ -63,7 +74,7 @@ func (t *FilterTranslator) translate(ctx context.Context, sr *schema.SchemaRegis
 		s, ok := sr.AttributeType(attrName)
 		if !ok {
 			// TODO check
-			q.Where("dummy", reindexer.EQ, "dummy")
+			q.Where("dummy", cacheEQ, "dummy")
 			return
 		}
 
@@ -92,7 +103,7 @@ func (t *FilterTranslator) translate(ctx context.Context, sr *schema.SchemaRegis
 			t.EqualityMatch(ctx, s, q, string(f.AssertionValue()))
 		} else {
 			// TODO check
-			q.Where("dummy", reindexer.EQ, "dummy")
+			q.Where("dummy", cacheEQ, "dummy")
 		}
 		q.CloseBracket()
 
@@ -102,7 +113,7 @@ func (t *FilterTranslator) translate(ctx context.Context, sr *schema.SchemaRegis
 			t.GreaterOrEqualMatch(ctx, s, q, string(f.AssertionValue()))
 		} else {
 			// TODO check
-			q.Where("dummy", reindexer.EQ, "dummy")
+			q.Where("dummy", cacheEQ, "dummy")
 		}
 		q.CloseBracket()
 
@@ -112,7 +123,7 @@ func (t *FilterTranslator) translate(ctx context.Context, sr *schema.SchemaRegis
 			t.LessOrEqualMatch(ctx, s, q, string(f.AssertionValue()))
 		} else {
 			// TODO check
-			q.Where("dummy", reindexer.EQ, "dummy")
+			q.Where("dummy", cacheEQ, "dummy")
 		}
 		q.CloseBracket()
 
@@ -122,7 +133,7 @@ func (t *FilterTranslator) translate(ctx context.Context, sr *schema.SchemaRegis
 			t.PresentMatch(ctx, s, q)
 		} else {
 			// TODO check
-			q.Where("dummy", reindexer.EQ, string(f))
+			q.Where("dummy", cacheEQ, string(f))
 		}
 		q.CloseBracket()
 
@@ -132,7 +143,15 @@ func (t *FilterTranslator) translate(ctx context.Context, sr *schema.SchemaRegis
 			t.ApproxMatch(ctx, s, q, string(f.AssertionValue()))
 		} else {
 			// TODO check
-			q.Where("dummy", reindexer.EQ, "dummy")
+			q.Where("dummy", cacheEQ, "dummy")
+		}
+		q.CloseBracket()
+
+	case message.FilterExtensibleMatch:
+		q.OpenBracket()
+		err = t.ExtensibleMatch(ctx, sr, f, q)
+		if err != nil {
+			return
 		}
 		q.CloseBracket()
 	}
@@ -140,7 +159,7 @@ func (t *FilterTranslator) translate(ctx context.Context, sr *schema.SchemaRegis
 	return nil
 }
 
-func (t *FilterTranslator) StartsWithMatch(s *schema.AttributeType, q *reindexer.Query, val string, i int) {
+func (t *FilterTranslator) StartsWithMatch(s *schema.AttributeType, q CacheQuery, val string, i int) {
 	sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
 	if err != nil {
 		log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s", s.Name, val)
@@ -149,15 +168,14 @@ func (t *FilterTranslator) StartsWithMatch(s *schema.AttributeType, q *reindexer
 
 	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
 		log.Printf("Filter for association doesn't support substring initial")
-		q.Where("dummy", reindexer.EQ, "dummy")
+		q.Where("dummy", cacheEQ, "dummy")
 		return
 	}
 
-	// TODO check escape
-	q.Where(t.Name(s), reindexer.LIKE, string(sv.NormStr()[0])+"%")
+	q.Where(t.Name(s), cacheLIKE, escapeLike(sv.NormStr()[0])+"%")
 }
 
-func (t *FilterTranslator) AnyMatch(s *schema.AttributeType, q *reindexer.Query, val string, i int) {
+func (t *FilterTranslator) AnyMatch(s *schema.AttributeType, q CacheQuery, val string, i int) {
 	sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
 	if err != nil {
 		log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s", s.Name, val)
@@ -166,15 +184,14 @@ func (t *FilterTranslator) AnyMatch(s *schema.AttributeType, q *reindexer.Query,
 
 	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
 		log.Printf("Filter for association doesn't support substring any")
-		q.Where("dummy", reindexer.EQ, "dummy")
+		q.Where("dummy", cacheEQ, "dummy")
 		return
 	}
 
-	// TODO check escape
-	q.Where(t.Name(s), reindexer.LIKE, "%"+string(sv.NormStr()[0]))
+	q.Where(t.Name(s), cacheLIKE, "%"+escapeLike(sv.NormStr()[0]))
 }
 
-func (t *FilterTranslator) EndsMatch(s *schema.AttributeType, q *reindexer.Query, val string, i int) {
+func (t *FilterTranslator) EndsMatch(s *schema.AttributeType, q CacheQuery, val string, i int) {
 	sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
 	if err != nil {
 		log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s", s.Name, val)
@@ -183,20 +200,19 @@ func (t *FilterTranslator) EndsMatch(s *schema.AttributeType, q *reindexer.Query
 
 	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
 		log.Printf("Filter for association doesn't support substring final")
-		q.Where("dummy", reindexer.EQ, "dummy")
+		q.Where("dummy", cacheEQ, "dummy")
 		return
 	}
 
-	// TODO check escape
-	q.Where(t.Name(s), reindexer.LIKE, "%"+string(sv.NormStr()[0])+"%")
+	q.Where(t.Name(s), cacheLIKE, "%"+escapeLike(sv.NormStr()[0])+"%")
 }
 
-func (t *FilterTranslator) EqualityMatch(ctx context.Context, s *schema.AttributeType, q *reindexer.Query, val string) {
+func (t *FilterTranslator) EqualityMatch(ctx context.Context, s *schema.AttributeType, q CacheQuery, val string) {
 	sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
 	if err != nil {
 		// TODO error no entry response
 		log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s, err: %+v", s.Name, val, err)
-		q.Where("dummy", reindexer.EQ, "dummy")
+		q.Where("dummy", cacheEQ, "dummy")
 		return
 	}
 
@@ -204,25 +220,25 @@ func (t *FilterTranslator) EqualityMatch(ctx context.Context, s *schema.Attribut
 		reqDN, err := s.Schema().NormalizeDN(val)
 		if err != nil {
 			log.Printf("warn: Ignore filter due to invalid DN syntax of association. attrName: %s, value: %s, err: %+v", s.Name, val, err)
-			q.Where("dummy", reindexer.EQ, "dummy")
+			q.Where("dummy", cacheEQ, "dummy")
 			return
 		}
 		id, err := t.r.findEntryID(ctx, reqDN)
 		if err != nil {
 			// Not found case
-			q.Where("dummy", reindexer.EQ, "dummy")
+			q.Where("dummy", cacheEQ, "dummy")
 			return
 		}
-		q.WhereInt64(t.Name(s), reindexer.EQ, id)
+		q.WhereInt64(t.Name(s), cacheEQ, id)
 
 	} else if s.IsObjectClass() {
-		q.Where(t.Name(s), reindexer.ALLSET, sv.NormStr())
+		q.Where(t.Name(s), cacheALLSET, sv.NormStr())
 	} else {
-		q.Where(t.Name(s), reindexer.EQ, sv.NormStr())
+		q.Where(t.Name(s), cacheEQ, sv.NormStr())
 	}
 }
 
-func (t *FilterTranslator) GreaterOrEqualMatch(ctx context.Context, s *schema.AttributeType, q *reindexer.Query, val string) {
+func (t *FilterTranslator) GreaterOrEqualMatch(ctx context.Context, s *schema.AttributeType, q CacheQuery, val string) {
 	sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
 	if err != nil {
 		log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s", s.Name, val)
@@ -231,19 +247,19 @@ func (t *FilterTranslator) GreaterOrEqualMatch(ctx context.Context, s *schema.At
 
 	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
 		log.Printf("Filter for association doesn't support greater or equal")
-		q.Where("dummy", reindexer.EQ, "dummy")
+		q.Where("dummy", cacheEQ, "dummy")
 		return
 	}
 	if !s.IsNumberOrdering() {
 		log.Printf("Not number ordering doesn't support reater or equal")
-		q.Where("dummy", reindexer.EQ, "dummy")
+		q.Where("dummy", cacheEQ, "dummy")
 		return
 	}
 
-	q.Where(t.Name(s), reindexer.GE, sv.Norm()[0])
+	q.Where(t.Name(s), cacheGE, sv.Norm()[0])
 }
 
-func (t *FilterTranslator) LessOrEqualMatch(ctx context.Context, s *schema.AttributeType, q *reindexer.Query, val string) {
+func (t *FilterTranslator) LessOrEqualMatch(ctx context.Context, s *schema.AttributeType, q CacheQuery, val string) {
 	sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
 	if err != nil {
 		log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s", s.Name, val)
@@ -252,24 +268,24 @@ func (t *FilterTranslator) LessOrEqualMatch(ctx context.Context, s *schema.Attri
 
 	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
 		log.Printf("Filter for association doesn't support less or equal")
-		q.Where("dummy", reindexer.EQ, "dummy")
+		q.Where("dummy", cacheEQ, "dummy")
 		return
 	}
 	if !s.IsNumberOrdering() {
 		log.Printf("Not number ordering doesn't support less or equal")
-		q.Where("dummy", reindexer.EQ, "dummy")
+		q.Where("dummy", cacheEQ, "dummy")
 		return
 	}
 
-	q.Where(t.Name(s), reindexer.LE, sv.Norm()[0])
+	q.Where(t.Name(s), cacheLE, sv.Norm()[0])
 }
 
-func (t *FilterTranslator) PresentMatch(ctx context.Context, s *schema.AttributeType, q *reindexer.Query) {
+func (t *FilterTranslator) PresentMatch(ctx context.Context, s *schema.AttributeType, q CacheQuery) {
 	q.Not()
-	q.Where(t.Name(s), reindexer.EMPTY, 0)
+	q.Where(t.Name(s), cacheEMPTY, 0)
 }
 
-func (t *FilterTranslator) ApproxMatch(ctx context.Context, s *schema.AttributeType, q *reindexer.Query, val string) {
+func (t *FilterTranslator) ApproxMatch(ctx context.Context, s *schema.AttributeType, q CacheQuery, val string) {
 	sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
 	if err != nil {
 		log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s", s.Name, val)
@@ -278,11 +294,387 @@ func (t *FilterTranslator) ApproxMatch(ctx context.Context, s *schema.AttributeT
 
 	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
 		log.Printf("Filter for association doesn't support approx match")
-		q.Where("dummy", reindexer.EQ, "dummy")
+		q.Where("dummy", cacheEQ, "dummy")
 		return
 	}
 
-	q.Where(t.Name(s), reindexer.LIKE, "%"+sv.NormStr()[0]+"%")
+	q.Where(t.Name(s), cacheLIKE, "%"+escapeLike(sv.NormStr()[0])+"%")
+}
+
+// ExtensibleMatch handles extensibleMatch filter.
+// The format is "attr [:dn] [:rule] := value".
+// See: https://datatracker.ietf.org/doc/html/rfc4511#section-4.5.1.7.7
+func (t *FilterTranslator) ExtensibleMatch(ctx context.Context, sr *schema.SchemaRegistry, f message.FilterExtensibleMatch, q CacheQuery) error {
+	var ruleName, attrName, val string
+	if f.MatchingRule() != nil {
+		ruleName = string(*f.MatchingRule())
+	}
+	if f.Type_() != nil {
+		attrName = string(*f.Type_())
+	}
+	if f.MatchValue() != nil {
+		val = string(*f.MatchValue())
+	}
+
+	// Active Directory compatible nested membership
+	if ruleName == matchingRuleInChainOID {
+		s, ok := findSchema(sr, attrName)
+		if !ok || !(s.IsAssociationAttribute() || s.IsReverseAssociationAttribute()) {
+			log.Printf("warn: Filter for in-chain matching supports only association. attrName: %s", attrName)
+			q.Where("dummy", cacheEQ, "dummy")
+			return nil
+		}
+		return t.InChainMatch(ctx, s, q, val)
+	}
+
+	var rule *schema.MatchingRule
+	if ruleName != "" {
+		var ok bool
+		rule, ok = sr.MatchingRule(ruleName)
+		if !ok {
+			log.Printf("warn: Unsupported matching rule, ignore filter. rule: %s", ruleName)
+			q.Where("dummy", cacheEQ, "dummy")
+			return nil
+		}
+	}
+
+	if attrName == "" {
+		if rule == nil {
+			// Invalid filter, either type or matchingRule is required
+			q.Where("dummy", cacheEQ, "dummy")
+			return nil
+		}
+
+		// Match with all attributes which the matching rule can be applied to
+		matched := 0
+		for _, s := range sr.AttributeTypes {
+			if s.Equality != rule.Name || s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+				continue
+			}
+			if matched > 0 {
+				q.Or()
+			}
+			q.OpenBracket()
+			if err := t.RuleMatch(ctx, s, rule, q, val); err != nil {
+				return err
+			}
+			q.CloseBracket()
+			matched++
+		}
+		if f.DnAttributes() {
+			if matched > 0 {
+				q.Or()
+			}
+			if err := t.DNAttributesMatch(ctx, sr, "", rule, q, val); err != nil {
+				return err
+			}
+			matched++
+		}
+		if matched == 0 {
+			q.Where("dummy", cacheEQ, "dummy")
+		}
+		return nil
+	}
+
+	s, ok := findSchema(sr, attrName)
+	if !ok {
+		// TODO check
+		q.Where("dummy", cacheEQ, "dummy")
+		return nil
+	}
+
+	q.OpenBracket()
+	if err := t.RuleMatch(ctx, s, rule, q, val); err != nil {
+		return err
+	}
+	q.CloseBracket()
+
+	if f.DnAttributes() {
+		q.Or()
+		if err := t.DNAttributesMatch(ctx, sr, attrName, rule, q, val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RuleMatch handles the attribute value assertion with the matching rule.
+// If the rule is nil, the equality rule of the attribute is used.
+func (t *FilterTranslator) RuleMatch(ctx context.Context, s *schema.AttributeType, rule *schema.MatchingRule, q CacheQuery, val string) error {
+	if rule == nil || rule.Name == s.Equality {
+		t.EqualityMatch(ctx, s, q, val)
+		return nil
+	}
+
+	if rule.Oid == matchingRuleBitAndOID || rule.Oid == matchingRuleBitOrOID {
+		return t.BitwiseMatch(ctx, s, rule, q, val)
+	}
+
+	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+		if rule.Name == "distinguishedNameMatch" {
+			t.EqualityMatch(ctx, s, q, val)
+			return nil
+		}
+		log.Printf("Filter for association doesn't support matching rule: %s", rule.Name)
+		q.Where("dummy", cacheEQ, "dummy")
+		return nil
+	}
+
+	if (rule.IsSubstrings() && s.Substr == "") || (!rule.IsSubstrings() && rule.Syntax != s.Syntax) {
+		// Inappropriate matching, it's evaluated to Undefined
+		log.Printf("info: Inappropriate matching rule for the attribute. attrName: %s, rule: %s", s.Name, rule.Name)
+		q.Where("dummy", cacheEQ, "dummy")
+		return nil
+	}
+
+	switch {
+	case rule.IsOrdering():
+		// The ordering rule returns true if the attribute value is less than the assertion value
+		if !s.IsNumberOrdering() {
+			log.Printf("Not number ordering doesn't support ordering rule: %s", rule.Name)
+			q.Where("dummy", cacheEQ, "dummy")
+			return nil
+		}
+		sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
+		if err != nil {
+			log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s", s.Name, val)
+			q.Where("dummy", cacheEQ, "dummy")
+			return nil
+		}
+		q.Where(t.Name(s), cacheLT, sv.Norm()[0])
+
+	case rule.IsSubstrings():
+		// The assertion value is "initial*any*final"
+		parts := strings.Split(val, "*")
+		for i, v := range parts {
+			if v == "" {
+				continue
+			}
+			sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{v})
+			if err != nil {
+				log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s", s.Name, val)
+				q.Where("dummy", cacheEQ, "dummy")
+				return nil
+			}
+			parts[i] = escapeLike(sv.NormStr()[0])
+		}
+		q.Where(t.Name(s), cacheLIKE, strings.Join(parts, "%"))
+
+	default:
+		// The value is compared with normalized value by the attribute's equality
+		t.EqualityMatch(ctx, s, q, val)
+	}
+
+	return nil
+}
+
+// InChainMatch handles LDAP_MATCHING_RULE_IN_CHAIN.
+// It walks the association graph transitively, starting from the entry of the assertion value.
+// e.g. (memberOf:1.2.840.113556.1.4.1941:=cn=admins,ou=groups,dc=example,dc=com) returns
+// all entries which are the member of the group directly or through nested groups.
+func (t *FilterTranslator) InChainMatch(ctx context.Context, s *schema.AttributeType, q CacheQuery, val string) error {
+	reqDN, err := s.Schema().NormalizeDN(val)
+	if err != nil {
+		log.Printf("warn: Ignore filter due to invalid DN syntax of association. attrName: %s, value: %s, err: %+v", s.Name, val, err)
+		q.Where("dummy", cacheEQ, "dummy")
+		return nil
+	}
+	id, err := t.r.findEntryID(ctx, reqDN)
+	if err != nil {
+		// Not found case
+		q.Where("dummy", cacheEQ, "dummy")
+		return nil
+	}
+
+	found := util.NewInt64Set()
+	visited := util.NewInt64Set(id)
+	next := []int64{id}
+
+	dest := struct {
+		ID int64 `json:"id"`
+	}{}
+
+	for len(next) > 0 {
+		iter := t.tx.Query().
+			Select("id").
+			WhereInt64(t.Name(s), cacheSET, next...).
+			ExecToJsonCtx(ctx)
+
+		next = []int64{}
+
+		for iter.Next() {
+			if err := json.Unmarshal(iter.JSON(), &dest); err != nil {
+				iter.Close()
+				return xerrors.Errorf("Unexpected unmarshal error. err: %w", err)
+			}
+			found.Add(dest.ID)
+
+			if _, ok := visited[dest.ID]; !ok {
+				visited.Add(dest.ID)
+				next = append(next, dest.ID)
+			}
+		}
+		if err := iter.Error(); err != nil {
+			iter.Close()
+			return xerrors.Errorf("Failed to walk association. attrName: %s, err: %w", s.Name, err)
+		}
+		iter.Close()
+	}
+
+	if len(found) == 0 {
+		q.Where("dummy", cacheEQ, "dummy")
+		return nil
+	}
+
+	q.WhereInt64("id", cacheSET, found.Values()...)
+
+	return nil
+}
+
+// BitwiseMatch handles LDAP_MATCHING_RULE_BIT_AND and LDAP_MATCHING_RULE_BIT_OR.
+// The cache DB doesn't support bitwise operation, so the candidates are evaluated in memory.
+func (t *FilterTranslator) BitwiseMatch(ctx context.Context, s *schema.AttributeType, rule *schema.MatchingRule, q CacheQuery, val string) error {
+	mask, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		log.Printf("warn: Ignore filter due to invalid integer. attrName: %s, value: %s", s.Name, val)
+		q.Where("dummy", cacheEQ, "dummy")
+		return nil
+	}
+
+	iter := t.tx.Query().
+		Select("id", "attrsNorm").
+		Not().Where(t.Name(s), cacheEMPTY, 0).
+		ExecToJsonCtx(ctx)
+	defer iter.Close()
+
+	dest := struct {
+		ID        int64          `json:"id"`
+		AttrsNorm CacheAttrsNorm `json:"attrsNorm"`
+	}{}
+
+	ids := []int64{}
+
+	for iter.Next() {
+		dest.AttrsNorm = nil
+		if err := json.Unmarshal(iter.JSON(), &dest); err != nil {
+			return xerrors.Errorf("Unexpected unmarshal error. err: %w", err)
+		}
+		for _, v := range dest.AttrsNorm.ValueStr(s.Name) {
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				continue
+			}
+			if (rule.Oid == matchingRuleBitAndOID && i&mask == mask) ||
+				(rule.Oid == matchingRuleBitOrOID && i&mask != 0) {
+				ids = append(ids, dest.ID)
+				break
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return xerrors.Errorf("Failed to evaluate bitwise matching. attrName: %s, err: %w", s.Name, err)
+	}
+
+	if len(ids) == 0 {
+		q.Where("dummy", cacheEQ, "dummy")
+		return nil
+	}
+
+	q.WhereInt64("id", cacheSET, ids...)
+
+	return nil
+}
+
+// DNAttributesMatch handles ":dn" of extensibleMatch filter.
+// The entry matches if the attribute value assertion is true for any RDN of the entry's DN.
+// If the attrName is empty, all attribute types in the RDN are evaluated.
+func (t *FilterTranslator) DNAttributesMatch(ctx context.Context, sr *schema.SchemaRegistry, attrName string, rule *schema.MatchingRule, q CacheQuery, val string) error {
+	var types []*schema.AttributeType
+	if attrName != "" {
+		if s, ok := findSchema(sr, attrName); ok {
+			types = []*schema.AttributeType{s}
+		}
+	} else {
+		types = sr.NamingAttributeTypes()
+	}
+
+	rdnNorms := []string{}
+	for _, s := range types {
+		if rule != nil && rule.Name != s.Equality && rule.Syntax != s.Syntax {
+			continue
+		}
+		sv, err := schema.NewSchemaValue(sr, s.Name, []string{val})
+		if err != nil {
+			continue
+		}
+		// The attribute type of RDN is normalized to lower case, not to the primary name
+		rdnNorms = append(rdnNorms, strings.ToLower(s.Name)+"="+sv.NormStr()[0])
+		for _, name := range s.AName {
+			rdnNorms = append(rdnNorms, strings.ToLower(name)+"="+sv.NormStr()[0])
+		}
+	}
+
+	if len(rdnNorms) == 0 {
+		q.Where("dummy", cacheEQ, "dummy")
+		return nil
+	}
+
+	// Find the containers which have the RDN, then collect all containers under them
+	iter := t.tx.Query().
+		Select("id").
+		WhereBool("isContainer", cacheEQ, true).
+		WhereString("rdnNorm", cacheSET, rdnNorms...).
+		ExecToJsonCtx(ctx)
+	defer iter.Close()
+
+	dest := struct {
+		ID int64 `json:"id"`
+	}{}
+
+	pids := util.NewInt64Set()
+	for iter.Next() {
+		if err := json.Unmarshal(iter.JSON(), &dest); err != nil {
+			return xerrors.Errorf("Unexpected unmarshal error. err: %w", err)
+		}
+		children, err := t.r.findChildContainerIDs(ctx, t.tx, dest.ID)
+		if err != nil {
+			return err
+		}
+		for _, v := range children {
+			pids.Add(v)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return xerrors.Errorf("Failed to find containers by RDN. rdnNorm: %v, err: %w", rdnNorms, err)
+	}
+
+	q.OpenBracket()
+	q.WhereString("rdnNorm", cacheSET, rdnNorms...)
+	if len(pids) > 0 {
+		q.Or().
+			WhereInt64("parentId", cacheSET, pids.Values()...)
+	}
+	q.CloseBracket()
+
+	return nil
+}
+
+// escapeLike escapes '%', '_' and '\' of the value for cacheLIKE.
+func escapeLike(v string) string {
+	if !strings.ContainsAny(v, `%_\`) {
+		return v
+	}
+	var sb strings.Builder
+	sb.Grow(len(v) + 4)
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '%', '_', '\\':
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(v[i])
+	}
+	return sb.String()
 }
 
 func (t *FilterTranslator) Name(s *schema.AttributeType) string {
@@ -0,0 +1,568 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/cloudldap/goldap/message"
+	"github.com/lib/pq"
+)
+
+// SQLFilterTranslator translates the search filter to the condition of PostgreSQL over the entry table aliased as "e".
+// The semantics follow FilterTranslator, the unsupported filter is evaluated to FALSE.
+//
+// The assertion values are normalized, then compared with attrs_norm which has the normalized values
+// like attrsNorm of the cache DB. See initSQLSearch for the indexes.
+type SQLFilterTranslator struct {
+	r      *DefaultRepository
+	params map[string]interface{}
+}
+
+func newSQLFilterTranslator(r *DefaultRepository) *SQLFilterTranslator {
+	return &SQLFilterTranslator{
+		r:      r,
+		params: map[string]interface{}{},
+	}
+}
+
+// bind adds the value as the named parameter, then returns the placeholder.
+func (t *SQLFilterTranslator) bind(value interface{}) string {
+	name := "f" + strconv.Itoa(len(t.params))
+	t.params[name] = value
+	return ":" + name
+}
+
+func (t *SQLFilterTranslator) translate(ctx context.Context, sr *schema.SchemaRegistry, packet message.Filter, sb *strings.Builder) error {
+	switch f := packet.(type) {
+	case message.FilterAnd:
+		if len(f) == 0 {
+			sb.WriteString(`TRUE`)
+			return nil
+		}
+		sb.WriteString(`(`)
+		for i, child := range f {
+			if i > 0 {
+				sb.WriteString(` AND `)
+			}
+			if err := t.translate(ctx, sr, child, sb); err != nil {
+				return err
+			}
+		}
+		sb.WriteString(`)`)
+		return nil
+
+	case message.FilterOr:
+		if len(f) == 0 {
+			writeFalse(sb)
+			return nil
+		}
+		sb.WriteString(`(`)
+		for i, child := range f {
+			if i > 0 {
+				sb.WriteString(` OR `)
+			}
+			if err := t.translate(ctx, sr, child, sb); err != nil {
+				return err
+			}
+		}
+		sb.WriteString(`)`)
+		return nil
+
+	case message.FilterNot:
+		sb.WriteString(`NOT (`)
+		if err := t.translate(ctx, sr, f.Filter, sb); err != nil {
+			return err
+		}
+		sb.WriteString(`)`)
+		return nil
+
+	case message.FilterSubstrings:
+		s, ok := findSchema(sr, string(f.Type_()))
+		if !ok {
+			break
+		}
+
+		// The parts are "initial", "any"..., "final"
+		var initial, final string
+		var anys []string
+		for _, fs := range f.Substrings() {
+			switch fsv := fs.(type) {
+			case message.SubstringInitial:
+				initial = string(fsv)
+			case message.SubstringAny:
+				anys = append(anys, string(fsv))
+			case message.SubstringFinal:
+				final = string(fsv)
+			}
+		}
+		t.SubstringsMatch(s, append(append([]string{initial}, anys...), final), sb)
+		return nil
+
+	case message.FilterEqualityMatch:
+		if s, ok := findSchema(sr, string(f.AttributeDesc())); ok {
+			return t.EqualityMatch(ctx, s, string(f.AssertionValue()), sb)
+		}
+
+	case message.FilterGreaterOrEqual:
+		if s, ok := findSchema(sr, string(f.AttributeDesc())); ok {
+			t.OrderingMatch(s, ">=", string(f.AssertionValue()), sb)
+			return nil
+		}
+
+	case message.FilterLessOrEqual:
+		if s, ok := findSchema(sr, string(f.AttributeDesc())); ok {
+			t.OrderingMatch(s, "<=", string(f.AssertionValue()), sb)
+			return nil
+		}
+
+	case message.FilterPresent:
+		if s, ok := findSchema(sr, string(f)); ok {
+			t.PresentMatch(s, sb)
+			return nil
+		}
+
+	case message.FilterApproxMatch:
+		if s, ok := findSchema(sr, string(f.AttributeDesc())); ok {
+			t.ApproxMatch(s, string(f.AssertionValue()), sb)
+			return nil
+		}
+
+	case message.FilterExtensibleMatch:
+		return t.ExtensibleMatch(ctx, sr, f, sb)
+	}
+
+	writeFalse(sb)
+	return nil
+}
+
+// SubstringsMatch handles the substrings assertion. The parts are joined by the wildcard,
+// the empty part means no initial or final substring.
+func (t *SQLFilterTranslator) SubstringsMatch(s *schema.AttributeType, parts []string, sb *strings.Builder) {
+	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+		log.Printf("Filter for association doesn't support substrings")
+		writeFalse(sb)
+		return
+	}
+
+	var re strings.Builder
+	re.WriteString(`^`)
+	for i, v := range parts {
+		if i > 0 {
+			re.WriteString(`.*`)
+		}
+		if v == "" {
+			continue
+		}
+		norm, ok := t.normStr(s, v)
+		if !ok {
+			writeFalse(sb)
+			return
+		}
+		re.WriteString(escapeRegex(norm))
+	}
+	re.WriteString(`$`)
+
+	t.writeRegexMatch(s, re.String(), sb)
+}
+
+func (t *SQLFilterTranslator) EqualityMatch(ctx context.Context, s *schema.AttributeType, val string, sb *strings.Builder) error {
+	sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
+	if err != nil {
+		log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s, err: %+v", s.Name, val, err)
+		writeFalse(sb)
+		return nil
+	}
+
+	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+		reqDN, err := s.Schema().NormalizeDN(val)
+		if err != nil {
+			log.Printf("warn: Ignore filter due to invalid DN syntax of association. attrName: %s, value: %s, err: %+v", s.Name, val, err)
+			writeFalse(sb)
+			return nil
+		}
+		id, err := t.r.findEntryIDBySQL(ctx, reqDN)
+		if err != nil {
+			if util.IsNoSuchObjectError(err) {
+				writeFalse(sb)
+				return nil
+			}
+			return err
+		}
+		// The association is stored as the entry ID in the association table
+		t.writeAssociationExists(s, sb)
+		if s.IsReverseAssociationAttribute() {
+			sb.WriteString(` AND a.id = `)
+		} else {
+			sb.WriteString(` AND a.member_id = `)
+		}
+		sb.WriteString(t.bind(id))
+		sb.WriteString(`)`)
+		return nil
+	}
+
+	// objectClass is normalized with the superclasses, the entry must have all of them
+	t.writeContains(s.Name, sv.NormStr(), sb)
+	return nil
+}
+
+// OrderingMatch handles greaterOrEqual and lessOrEqual filter with the operator.
+func (t *SQLFilterTranslator) OrderingMatch(s *schema.AttributeType, op string, val string, sb *strings.Builder) {
+	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+		log.Printf("Filter for association doesn't support ordering")
+		writeFalse(sb)
+		return
+	}
+	if !s.IsNumberOrdering() {
+		log.Printf("Not number ordering doesn't support ordering")
+		writeFalse(sb)
+		return
+	}
+
+	sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
+	if err != nil {
+		log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s", s.Name, val)
+		writeFalse(sb)
+		return
+	}
+
+	t.writeCompare(s, op, sv.Norm()[0], sb)
+}
+
+func (t *SQLFilterTranslator) PresentMatch(s *schema.AttributeType, sb *strings.Builder) {
+	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+		t.writeAssociationExists(s, sb)
+		sb.WriteString(`)`)
+		return
+	}
+	sb.WriteString(`e.attrs_norm ? `)
+	sb.WriteString(t.bind(s.Name))
+}
+
+func (t *SQLFilterTranslator) ApproxMatch(s *schema.AttributeType, val string, sb *strings.Builder) {
+	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+		log.Printf("Filter for association doesn't support approx match")
+		writeFalse(sb)
+		return
+	}
+
+	norm, ok := t.normStr(s, val)
+	if !ok {
+		writeFalse(sb)
+		return
+	}
+	t.writeRegexMatch(s, escapeRegex(norm), sb)
+}
+
+// ExtensibleMatch handles extensibleMatch filter.
+// See FilterTranslator.ExtensibleMatch.
+func (t *SQLFilterTranslator) ExtensibleMatch(ctx context.Context, sr *schema.SchemaRegistry, f message.FilterExtensibleMatch, sb *strings.Builder) error {
+	var ruleName, attrName, val string
+	if f.MatchingRule() != nil {
+		ruleName = string(*f.MatchingRule())
+	}
+	if f.Type_() != nil {
+		attrName = string(*f.Type_())
+	}
+	if f.MatchValue() != nil {
+		val = string(*f.MatchValue())
+	}
+
+	// Active Directory compatible nested membership
+	if ruleName == matchingRuleInChainOID {
+		s, ok := findSchema(sr, attrName)
+		if !ok || !(s.IsAssociationAttribute() || s.IsReverseAssociationAttribute()) {
+			log.Printf("warn: Filter for in-chain matching supports only association. attrName: %s", attrName)
+			writeFalse(sb)
+			return nil
+		}
+		return t.InChainMatch(ctx, s, val, sb)
+	}
+
+	var rule *schema.MatchingRule
+	if ruleName != "" {
+		var ok bool
+		rule, ok = sr.MatchingRule(ruleName)
+		if !ok {
+			log.Printf("warn: Unsupported matching rule, ignore filter. rule: %s", ruleName)
+			writeFalse(sb)
+			return nil
+		}
+	}
+
+	if attrName == "" {
+		if rule == nil {
+			// Invalid filter, either type or matchingRule is required
+			writeFalse(sb)
+			return nil
+		}
+
+		// Match with all attributes which the matching rule can be applied to
+		sb.WriteString(`(`)
+		matched := 0
+		for _, s := range sr.AttributeTypes {
+			if s.Equality != rule.Name || s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+				continue
+			}
+			if matched > 0 {
+				sb.WriteString(` OR `)
+			}
+			if err := t.RuleMatch(ctx, s, rule, val, sb); err != nil {
+				return err
+			}
+			matched++
+		}
+		if f.DnAttributes() {
+			if matched > 0 {
+				sb.WriteString(` OR `)
+			}
+			t.DNAttributesMatch(sr, "", rule, val, sb)
+			matched++
+		}
+		if matched == 0 {
+			writeFalse(sb)
+		}
+		sb.WriteString(`)`)
+		return nil
+	}
+
+	s, ok := findSchema(sr, attrName)
+	if !ok {
+		writeFalse(sb)
+		return nil
+	}
+
+	sb.WriteString(`(`)
+	if err := t.RuleMatch(ctx, s, rule, val, sb); err != nil {
+		return err
+	}
+	if f.DnAttributes() {
+		sb.WriteString(` OR `)
+		t.DNAttributesMatch(sr, attrName, rule, val, sb)
+	}
+	sb.WriteString(`)`)
+
+	return nil
+}
+
+// RuleMatch handles the attribute value assertion with the matching rule.
+// If the rule is nil, the equality rule of the attribute is used.
+func (t *SQLFilterTranslator) RuleMatch(ctx context.Context, s *schema.AttributeType, rule *schema.MatchingRule, val string, sb *strings.Builder) error {
+	if rule == nil || rule.Name == s.Equality {
+		return t.EqualityMatch(ctx, s, val, sb)
+	}
+
+	if rule.Oid == matchingRuleBitAndOID || rule.Oid == matchingRuleBitOrOID {
+		t.BitwiseMatch(s, rule, val, sb)
+		return nil
+	}
+
+	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+		if rule.Name == "distinguishedNameMatch" {
+			return t.EqualityMatch(ctx, s, val, sb)
+		}
+		log.Printf("Filter for association doesn't support matching rule: %s", rule.Name)
+		writeFalse(sb)
+		return nil
+	}
+
+	if (rule.IsSubstrings() && s.Substr == "") || (!rule.IsSubstrings() && rule.Syntax != s.Syntax) {
+		// Inappropriate matching, it's evaluated to Undefined
+		log.Printf("info: Inappropriate matching rule for the attribute. attrName: %s, rule: %s", s.Name, rule.Name)
+		writeFalse(sb)
+		return nil
+	}
+
+	switch {
+	case rule.IsOrdering():
+		// The ordering rule returns true if the attribute value is less than the assertion value
+		t.OrderingMatch(s, "<", val, sb)
+
+	case rule.IsSubstrings():
+		// The assertion value is "initial*any*final"
+		t.SubstringsMatch(s, strings.Split(val, "*"), sb)
+
+	default:
+		// The value is compared with normalized value by the attribute's equality
+		return t.EqualityMatch(ctx, s, val, sb)
+	}
+
+	return nil
+}
+
+// InChainMatch handles LDAP_MATCHING_RULE_IN_CHAIN.
+// The association graph is walked transitively by the recursive query.
+func (t *SQLFilterTranslator) InChainMatch(ctx context.Context, s *schema.AttributeType, val string, sb *strings.Builder) error {
+	reqDN, err := s.Schema().NormalizeDN(val)
+	if err != nil {
+		log.Printf("warn: Ignore filter due to invalid DN syntax of association. attrName: %s, value: %s, err: %+v", s.Name, val, err)
+		writeFalse(sb)
+		return nil
+	}
+	id, err := t.r.findEntryIDBySQL(ctx, reqDN)
+	if err != nil {
+		if util.IsNoSuchObjectError(err) {
+			writeFalse(sb)
+			return nil
+		}
+		return err
+	}
+
+	start := t.bind(id)
+
+	// UNION removes the duplicates, so it terminates even if the association has a cycle
+	if s.IsReverseAssociationAttribute() {
+		// The members of the group, and the members of them
+		sb.WriteString(`e.id IN (WITH RECURSIVE chain(id) AS (SELECT a.member_id FROM association a WHERE a.id = `)
+		sb.WriteString(start)
+		sb.WriteString(` UNION SELECT a.member_id FROM association a, chain WHERE a.id = chain.id) SELECT id FROM chain)`)
+		return nil
+	}
+
+	// The groups which have the member, and the groups which have them
+	name := t.bind(s.Name)
+	sb.WriteString(`e.id IN (WITH RECURSIVE chain(id) AS (SELECT a.id FROM association a WHERE a.name = `)
+	sb.WriteString(name)
+	sb.WriteString(` AND a.member_id = `)
+	sb.WriteString(start)
+	sb.WriteString(` UNION SELECT a.id FROM association a, chain WHERE a.name = `)
+	sb.WriteString(name)
+	sb.WriteString(` AND a.member_id = chain.id) SELECT id FROM chain)`)
+
+	return nil
+}
+
+// BitwiseMatch handles LDAP_MATCHING_RULE_BIT_AND and LDAP_MATCHING_RULE_BIT_OR.
+func (t *SQLFilterTranslator) BitwiseMatch(s *schema.AttributeType, rule *schema.MatchingRule, val string, sb *strings.Builder) {
+	mask, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		log.Printf("warn: Ignore filter due to invalid integer. attrName: %s, value: %s", s.Name, val)
+		writeFalse(sb)
+		return
+	}
+
+	m := t.bind(mask)
+
+	t.writeValueExists(s, sb)
+	// Guard the cast, the values which aren't bigint are ignored
+	sb.WriteString(`CASE WHEN v.value ~ '^-?[0-9]{1,18}$' THEN (CAST(v.value AS bigint) & `)
+	sb.WriteString(m)
+	if rule.Oid == matchingRuleBitAndOID {
+		sb.WriteString(`) = `)
+		sb.WriteString(m)
+	} else {
+		sb.WriteString(`) != 0`)
+	}
+	sb.WriteString(` ELSE FALSE END)`)
+}
+
+// DNAttributesMatch handles ":dn" of extensibleMatch filter.
+// See FilterTranslator.DNAttributesMatch.
+func (t *SQLFilterTranslator) DNAttributesMatch(sr *schema.SchemaRegistry, attrName string, rule *schema.MatchingRule, val string, sb *strings.Builder) {
+	var names []string
+	if attrName != "" {
+		names = []string{attrName}
+	} else {
+		// Well-known naming attributes
+		// TODO configurable
+		names = []string{"cn", "uid", "ou", "o", "dc", "l", "c"}
+	}
+
+	rdnNorms := []string{}
+	for _, name := range names {
+		s, ok := findSchema(sr, name)
+		if !ok {
+			continue
+		}
+		if rule != nil && rule.Name != s.Equality && rule.Syntax != s.Syntax {
+			continue
+		}
+		sv, err := schema.NewSchemaValue(sr, s.Name, []string{val})
+		if err != nil {
+			continue
+		}
+		rdnNorms = append(rdnNorms, strings.ToLower(name)+"="+sv.NormStr()[0])
+	}
+
+	if len(rdnNorms) == 0 {
+		writeFalse(sb)
+		return
+	}
+
+	r := t.bind(pq.Array(rdnNorms))
+
+	// The entry has the RDN, or it's under the container which has the RDN
+	sb.WriteString(`(e.rdn_norm = ANY(`)
+	sb.WriteString(r)
+	sb.WriteString(`) OR e.parent_id IN (SELECT p.id FROM entry p JOIN entry c ON p.path @> ARRAY[c.id] WHERE c.is_container AND c.rdn_norm = ANY(`)
+	sb.WriteString(r)
+	sb.WriteString(`)))`)
+}
+
+func (t *SQLFilterTranslator) normStr(s *schema.AttributeType, val string) (string, bool) {
+	sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
+	if err != nil {
+		log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s", s.Name, val)
+		return "", false
+	}
+	return sv.NormStr()[0], true
+}
+
+// writeContains writes the containment condition which can use GIN index of attrs_norm.
+func (t *SQLFilterTranslator) writeContains(attrName string, values []string, sb *strings.Builder) {
+	doc, _ := json.Marshal(map[string][]string{attrName: values})
+
+	sb.WriteString(`e.attrs_norm @> CAST(`)
+	sb.WriteString(t.bind(string(doc)))
+	sb.WriteString(` AS jsonb)`)
+}
+
+// writeRegexMatch writes the jsonpath condition which matches the normalized values with the regex.
+func (t *SQLFilterTranslator) writeRegexMatch(s *schema.AttributeType, pattern string, sb *strings.Builder) {
+	var jp strings.Builder
+	jp.WriteString(`$."`)
+	jp.WriteString(escapeName(s.Name))
+	jp.WriteString(`"[*] ? (@ like_regex "`)
+	jp.WriteString(escapeValue(pattern))
+	jp.WriteString(`")`)
+
+	sb.WriteString(`e.attrs_norm @? CAST(`)
+	sb.WriteString(t.bind(jp.String()))
+	sb.WriteString(` AS jsonpath)`)
+}
+
+// writeCompare writes the condition which compares the normalized values with the normalized value as number.
+// The generalized time is normalized to the unix time in the precision of the attribute, see IsNanoFormat.
+func (t *SQLFilterTranslator) writeCompare(s *schema.AttributeType, op string, norm interface{}, sb *strings.Builder) {
+	t.writeValueExists(s, sb)
+
+	sb.WriteString(`CASE WHEN v.value ~ '^-?[0-9]+$' THEN CAST(v.value AS numeric) `)
+	sb.WriteString(op)
+	sb.WriteString(` CAST(`)
+	sb.WriteString(t.bind(norm))
+	sb.WriteString(` AS numeric) ELSE FALSE END)`)
+}
+
+// writeAssociationExists writes the beginning of the subquery over the association of the attribute as "a".
+// memberOf is derived from member and uniqueMember of the groups.
+// The caller must write the condition and the closing parenthesis.
+func (t *SQLFilterTranslator) writeAssociationExists(s *schema.AttributeType, sb *strings.Builder) {
+	if s.IsReverseAssociationAttribute() {
+		sb.WriteString(`EXISTS (SELECT 1 FROM association a WHERE a.member_id = e.id`)
+		return
+	}
+	sb.WriteString(`EXISTS (SELECT 1 FROM association a WHERE a.id = e.id AND a.name = `)
+	sb.WriteString(t.bind(s.Name))
+}
+
+// writeValueExists writes the beginning of the subquery over the normalized values of the attribute as "v.value".
+// The caller must write the condition and the closing parenthesis.
+func (t *SQLFilterTranslator) writeValueExists(s *schema.AttributeType, sb *strings.Builder) {
+	sb.WriteString(`EXISTS (SELECT 1 FROM jsonb_array_elements_text(e.attrs_norm -> CAST(`)
+	sb.WriteString(t.bind(s.Name))
+	sb.WriteString(` AS text)) AS v(value) WHERE `)
+}
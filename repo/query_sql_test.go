@@ -0,0 +1,252 @@
+//go:build test
+
+package repo
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/goldap/message"
+)
+
+func TestSQLFilterTranslator(t *testing.T) {
+	sr := schema.NewSchemaRegistry(&schema.SchemaConfig{
+		Suffix: "dc=example,dc=com",
+		RootDN: "cn=Manager,dc=example,dc=com",
+	})
+
+	testcases := []struct {
+		Name           string
+		Filter         message.Filter
+		ExpectedSQL    string
+		ExpectedParams map[string]interface{}
+	}{
+		{
+			"present",
+			message.FilterPresent("objectClass"),
+			`e.attrs_norm ? :f0`,
+			map[string]interface{}{"f0": "objectClass"},
+		},
+		{
+			"unknown attribute",
+			message.FilterPresent("unknown"),
+			`FALSE`,
+			map[string]interface{}{},
+		},
+		{
+			"and",
+			message.FilterAnd{message.FilterPresent("cn"), message.FilterPresent("sn")},
+			`(e.attrs_norm ? :f0 AND e.attrs_norm ? :f1)`,
+			map[string]interface{}{"f0": "cn", "f1": "sn"},
+		},
+		{
+			"or",
+			message.FilterOr{message.FilterPresent("cn"), message.FilterPresent("unknown")},
+			`(e.attrs_norm ? :f0 OR FALSE)`,
+			map[string]interface{}{"f0": "cn"},
+		},
+		{
+			"not",
+			message.FilterNot{Filter: message.FilterPresent("cn")},
+			`NOT (e.attrs_norm ? :f0)`,
+			map[string]interface{}{"f0": "cn"},
+		},
+		{
+			"absolute true and false",
+			message.FilterOr{message.FilterAnd{}, message.FilterOr{}},
+			`(TRUE OR FALSE)`,
+			map[string]interface{}{},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			translator := newSQLFilterTranslator(nil)
+
+			var sb strings.Builder
+			if err := translator.translate(context.Background(), sr, tc.Filter, &sb); err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if sb.String() != tc.ExpectedSQL {
+				t.Errorf("Unexpected SQL\nexpected: %s\nactual:   %s", tc.ExpectedSQL, sb.String())
+			}
+			if !reflect.DeepEqual(translator.params, tc.ExpectedParams) {
+				t.Errorf("Unexpected params. expected: %v, actual: %v", tc.ExpectedParams, translator.params)
+			}
+		})
+	}
+}
+
+func TestSQLFilterTranslatorMatch(t *testing.T) {
+	sr := schema.NewSchemaRegistry(&schema.SchemaConfig{
+		Suffix: "dc=example,dc=com",
+		RootDN: "cn=Manager,dc=example,dc=com",
+	})
+
+	attr := func(name string) *schema.AttributeType {
+		s, ok := sr.AttributeType(name)
+		if !ok {
+			t.Fatalf("Unexpected attribute: %s", name)
+		}
+		return s
+	}
+
+	testcases := []struct {
+		Name           string
+		Translate      func(translator *SQLFilterTranslator, sb *strings.Builder) error
+		ExpectedSQL    string
+		ExpectedParams map[string]interface{}
+	}{
+		{
+			"equality of case ignore",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				return translator.EqualityMatch(context.Background(), attr("cn"), "Foo  Bar", sb)
+			},
+			`e.attrs_norm @> CAST(:f0 AS jsonb)`,
+			map[string]interface{}{"f0": `{"cn":["foo bar"]}`},
+		},
+		{
+			"equality of objectClass",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				return translator.EqualityMatch(context.Background(), attr("objectClass"), "inetOrgPerson", sb)
+			},
+			`e.attrs_norm @> CAST(:f0 AS jsonb)`,
+			map[string]interface{}{"f0": `{"objectClass":["inetorgperson","organizationalperson","person","top"]}`},
+		},
+		{
+			"equality of integer",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				return translator.EqualityMatch(context.Background(), attr("uidNumber"), "1000", sb)
+			},
+			`e.attrs_norm @> CAST(:f0 AS jsonb)`,
+			map[string]interface{}{"f0": `{"uidNumber":["1000"]}`},
+		},
+		{
+			"equality of DN syntax",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				return translator.EqualityMatch(context.Background(), attr("seeAlso"), "CN=Foo,  ou=Users,dc=Example,dc=com", sb)
+			},
+			`e.attrs_norm @> CAST(:f0 AS jsonb)`,
+			map[string]interface{}{"f0": `{"seeAlso":["cn=foo,ou=users,dc=example,dc=com"]}`},
+		},
+		{
+			"equality of generalized time",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				return translator.EqualityMatch(context.Background(), attr("createTimestamp"), "20240101000000Z", sb)
+			},
+			`e.attrs_norm @> CAST(:f0 AS jsonb)`,
+			map[string]interface{}{"f0": `{"createTimestamp":["1704067200"]}`},
+		},
+		{
+			"equality of invalid syntax",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				return translator.EqualityMatch(context.Background(), attr("uidNumber"), "abc", sb)
+			},
+			`FALSE`,
+			map[string]interface{}{},
+		},
+		{
+			"substrings",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				translator.SubstringsMatch(attr("cn"), []string{"A.b", "C", ""}, sb)
+				return nil
+			},
+			`e.attrs_norm @? CAST(:f0 AS jsonpath)`,
+			map[string]interface{}{"f0": `$."cn"[*] ? (@ like_regex "^a\\.b.*c.*$")`},
+		},
+		{
+			"substrings final only",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				translator.SubstringsMatch(attr("cn"), []string{"", `x"y`}, sb)
+				return nil
+			},
+			`e.attrs_norm @? CAST(:f0 AS jsonpath)`,
+			map[string]interface{}{"f0": `$."cn"[*] ? (@ like_regex "^.*x\"y$")`},
+		},
+		{
+			"substrings of association",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				translator.SubstringsMatch(attr("member"), []string{"cn=", ""}, sb)
+				return nil
+			},
+			`FALSE`,
+			map[string]interface{}{},
+		},
+		{
+			"present of association",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				translator.PresentMatch(attr("member"), sb)
+				return nil
+			},
+			`EXISTS (SELECT 1 FROM association a WHERE a.id = e.id AND a.name = :f0)`,
+			map[string]interface{}{"f0": "member"},
+		},
+		{
+			"present of memberOf",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				translator.PresentMatch(attr("memberOf"), sb)
+				return nil
+			},
+			`EXISTS (SELECT 1 FROM association a WHERE a.member_id = e.id)`,
+			map[string]interface{}{},
+		},
+		{
+			"greater or equal of integer",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				translator.OrderingMatch(attr("uidNumber"), ">=", "1000", sb)
+				return nil
+			},
+			`EXISTS (SELECT 1 FROM jsonb_array_elements_text(e.attrs_norm -> CAST(:f0 AS text)) AS v(value) WHERE ` +
+				`CASE WHEN v.value ~ '^-?[0-9]+$' THEN CAST(v.value AS numeric) >= CAST(:f1 AS numeric) ELSE FALSE END)`,
+			map[string]interface{}{"f0": "uidNumber", "f1": int64(1000)},
+		},
+		{
+			"greater or equal of nano format time",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				translator.OrderingMatch(attr("pwdFailureTime"), ">=", "20240101000000.5Z", sb)
+				return nil
+			},
+			`EXISTS (SELECT 1 FROM jsonb_array_elements_text(e.attrs_norm -> CAST(:f0 AS text)) AS v(value) WHERE ` +
+				`CASE WHEN v.value ~ '^-?[0-9]+$' THEN CAST(v.value AS numeric) >= CAST(:f1 AS numeric) ELSE FALSE END)`,
+			map[string]interface{}{"f0": "pwdFailureTime", "f1": int64(1704067200500000000)},
+		},
+		{
+			"less or equal of not number ordering",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				translator.OrderingMatch(attr("cn"), "<=", "foo", sb)
+				return nil
+			},
+			`FALSE`,
+			map[string]interface{}{},
+		},
+		{
+			"approx",
+			func(translator *SQLFilterTranslator, sb *strings.Builder) error {
+				translator.ApproxMatch(attr("sn"), "Foo", sb)
+				return nil
+			},
+			`e.attrs_norm @? CAST(:f0 AS jsonpath)`,
+			map[string]interface{}{"f0": `$."sn"[*] ? (@ like_regex "foo")`},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			translator := newSQLFilterTranslator(nil)
+
+			var sb strings.Builder
+			if err := tc.Translate(translator, &sb); err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if sb.String() != tc.ExpectedSQL {
+				t.Errorf("Unexpected SQL\nexpected: %s\nactual:   %s", tc.ExpectedSQL, sb.String())
+			}
+			if !reflect.DeepEqual(translator.params, tc.ExpectedParams) {
+				t.Errorf("Unexpected params. expected: %v, actual: %v", tc.ExpectedParams, translator.params)
+			}
+		})
+	}
+}
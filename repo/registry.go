@@ -0,0 +1,74 @@
+package repo
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"golang.org/x/xerrors"
+)
+
+// RepositoryFactory creates the Repository of the backend.
+// The url is parsed from DBRepositoryConfig.URL.
+type RepositoryFactory func(config *DBRepositoryConfig, u *url.URL, sr *schema.SchemaRegistry) (Repository, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]RepositoryFactory{}
+)
+
+// RegisterRepository makes the backend available by the URL scheme.
+// It panics if the factory is nil or the scheme is registered twice.
+func RegisterRepository(scheme string, factory RepositoryFactory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if factory == nil {
+		panic("repo: RegisterRepository factory is nil")
+	}
+	if _, dup := factories[scheme]; dup {
+		panic("repo: RegisterRepository called twice for scheme " + scheme)
+	}
+	factories[scheme] = factory
+}
+
+// RepositorySchemes returns the sorted list of the registered URL schemes.
+func RepositorySchemes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	schemes := make([]string, 0, len(factories))
+	for k := range factories {
+		schemes = append(schemes, k)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// NewRepository creates the Repository of the backend selected by the URL scheme of the config.
+// The postgres backend configured by the DB* fields is used if the URL is empty.
+func NewRepository(config *DBRepositoryConfig, sr *schema.SchemaRegistry) (Repository, error) {
+	u := &url.URL{Scheme: "postgres"}
+	if config.URL != "" {
+		var err error
+		u, err = url.Parse(config.URL)
+		if err != nil {
+			// Don't leak the password in the URL
+			var uerr *url.Error
+			if xerrors.As(err, &uerr) {
+				err = uerr.Err
+			}
+			return nil, xerrors.Errorf("Invalid repository URL. err: %w", err)
+		}
+	}
+
+	factoriesMu.RLock()
+	factory, ok := factories[u.Scheme]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, xerrors.Errorf("Unsupported repository scheme: %s, supported: %v", u.Scheme, RepositorySchemes())
+	}
+
+	return factory(config, u, sr)
+}
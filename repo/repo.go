@@ -3,8 +3,6 @@ package repo
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
-	"fmt"
 	"log"
 	"sync"
 	"time"
@@ -12,13 +10,8 @@ import (
 	"github.com/cloudldap/cloudldap/schema"
 	"github.com/cloudldap/goldap/message"
 	"github.com/jmoiron/sqlx"
-	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"golang.org/x/xerrors"
-
-	"github.com/restream/reindexer"
-	// choose how the Reindexer binds to the app (in this case "builtin," which means link Reindexer as a static library)
-	_ "github.com/restream/reindexer/bindings/builtin"
 )
 
 // For generic filter
@@ -38,15 +31,10 @@ func (m *StmtCache) Put(key string, value *sqlx.NamedStmt) {
 	m.sm.Store(key, value)
 }
 
-type DBRepository struct {
-	db             *sqlx.DB
-	cacheDB        *reindexer.Reindexer
-	schemaRegistry *schema.SchemaRegistry
-	serverID       string
-	config         *DBRepositoryConfig
-}
-
 type DBRepositoryConfig struct {
+	// URL selects the backend by the scheme (e.g. postgres://, sqlite://, memory://).
+	// The postgres backend configured by the DB* fields is used if it's empty.
+	URL            string
 	DBHostName     string
 	DBPort         int
 	DBUser         string
@@ -55,100 +43,23 @@ type DBRepositoryConfig struct {
 	DBName         string
 	DBMaxOpenConns int
 	DBMaxIdleConns int
-	ServerID       string
-	LogLevel       string
-}
-
-func NewRepository(config *DBRepositoryConfig, sr *schema.SchemaRegistry) (Repository, error) {
-	cacheDB := reindexer.NewReindex("builtin:///tmp/cloudldap")
-	err := cacheDB.OpenNamespace("entries", reindexer.DefaultNamespaceOptions().NoStorage(), CacheEntry{})
-	if err != nil {
-		log.Fatalf("alert: Open cacheDB error. err: %v", err)
-	}
-
-	// Init DB Connection
-	connInfo := fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s sslmode=disable search_path=%s",
-		config.DBHostName, config.DBPort, config.DBUser, config.DBName,
-		config.DBPassword, config.DBSchema)
-	db, err := sqlx.Connect("postgres", connInfo)
-	if err != nil {
-		log.Fatalf("alert: Connect error. host=%s, port=%d, user=%s, dbname=%s, error=%s",
-			config.DBHostName, config.DBPort, config.DBUser, config.DBName, err)
-	}
-	db.SetMaxOpenConns(config.DBMaxOpenConns)
-	db.SetMaxIdleConns(config.DBMaxIdleConns)
-	// db.SetConnMaxLifetime(time.Hour)
-
-	// TODO: Enable to switch another implementation
-	repo := &DefaultRepository{
-		DBRepository: &DBRepository{
-			db:             db,
-			cacheDB:        cacheDB,
-			schemaRegistry: sr,
-			config:         config,
-		},
-	}
-
-	err = repo.Init()
-	if err != nil {
-		return nil, err
-	}
-
-	// Start listener
-	reportErr := func(ev pq.ListenerEventType, err error) {
-		if err != nil {
-			log.Printf("alert: Failed to start listener: %s", err)
-		}
-	}
-	minReconn := 10 * time.Second
-	maxReconn := time.Minute
-	listener := pq.NewListener(connInfo, minReconn, maxReconn, reportErr)
-	err = listener.Listen("entry_update")
-	if err != nil {
-		log.Fatalf("alert: Failed to LISTEN to channel 'entry_update': %v", err)
-	}
-
-	log.Printf("info: Listening to notifications on channel 'entry_update'")
-
-	go func() {
-		timeout := 1 * time.Minute
-
-		for {
-			log.Println("Waiting for notification...")
-
-			select {
-			case n := <-listener.Notify:
-				if n == nil {
-					log.Printf("error: Invalid notify message: %v", n)
-					continue
-				}
-				var m NotifyMessage
-				err := json.Unmarshal([]byte(n.Extra), &m)
-				if err != nil {
-					log.Printf("error: Failed to parse '%s': %v", n.Extra, err)
-					continue
-				}
-				log.Printf("debug: Received event: %v", m)
-
-				if m.Issuer == config.ServerID {
-					log.Printf("debug: Skip own message: %v", m)
-					continue
-				}
-
-				if err := repo.OnUpdate(context.Background(), &m); err != nil {
-					log.Printf("error: Error on update for '%s': %v", n.Extra, err)
-				}
-
-			case <-time.After(timeout):
-				log.Printf("Received no events for %s, checking connection", timeout.String())
-				go func() {
-					_ = listener.Ping()
-				}()
-			}
-		}
-	}()
-
-	return repo, nil
+	// CacheIndex selects the cache DB of the postgres backend (e.g. reindexer, native).
+	// Reindexer is used if it's empty and available.
+	CacheIndex string
+	// SearchMode selects how the postgres backend serves the searches (cache, sql, hybrid).
+	// The cache DB is used if it's empty. See SearchModeCache.
+	SearchMode string
+	// ReplicaURL is the connection string of the read replica which serves the searches by SQL.
+	// The primary is used if it's empty.
+	ReplicaURL string
+	// CacheSnapshotPath is the file path of the cache snapshot of the postgres backend.
+	// All entries are fetched from DB at startup if it's empty.
+	CacheSnapshotPath string
+	// ReconcileInterval is the interval to reconcile the cache with the rev of the entries in DB,
+	// and to prune the old changelog. It's disabled if it's zero.
+	ReconcileInterval time.Duration
+	ServerID          string
+	LogLevel          string
 }
 
 type Repository interface {
@@ -187,6 +98,56 @@ type Repository interface {
 	DeleteByDN(ctx context.Context, dn *schema.DN) error
 
 	OnUpdate(ctx context.Context, m *NotifyMessage) error
+
+	// BindAttemptStore returns the store of the failed bind attempts shared across the instances.
+	// This is used for the rate limiting of BIND operation.
+	BindAttemptStore() BindAttemptStore
+}
+
+// CacheRefresher is implemented by the backend which caches the entries in the process.
+type CacheRefresher interface {
+	// RefreshCache reloads all entries from the storage into the cache.
+	RefreshCache(ctx context.Context) error
+}
+
+// CacheVerifier is implemented by the backend which caches the entries in the process.
+type CacheVerifier interface {
+	// VerifyCache compares all cached entries with the storage.
+	// The different entries are cached again if repair is true.
+	VerifyCache(ctx context.Context, repair bool) (*CacheVerifyResult, error)
+}
+
+// MembershipUpdater is implemented by the backend which stores the association in bulk.
+type MembershipUpdater interface {
+	// UpdateMembers adds and removes the members of the group in a transaction.
+	// The name must be member or uniqueMember. It fails like the modification of the attribute
+	// if the added member exists already or the removed member doesn't exist.
+	UpdateMembers(ctx context.Context, dn *schema.DN, name string, add, del []*schema.DN) error
+}
+
+type CacheDiffKind string
+
+const (
+	// The entry is in the storage, but not cached
+	CacheDiffMissing CacheDiffKind = "missing"
+	// The entry is cached, but not in the storage
+	CacheDiffOrphan CacheDiffKind = "orphan"
+	// The cached entry is different from the storage
+	CacheDiffMismatch CacheDiffKind = "mismatch"
+)
+
+type CacheDiff struct {
+	ID   int64         `json:"id"`
+	Kind CacheDiffKind `json:"kind"`
+	// The different fields of the mismatch (e.g. rev, parentId, path, attrsNorm)
+	Fields   []string `json:"fields,omitempty"`
+	Repaired bool     `json:"repaired"`
+}
+
+type CacheVerifyResult struct {
+	Checked  int         `json:"checked"`
+	Diffs    []CacheDiff `json:"diffs"`
+	Repaired int         `json:"repaired"`
 }
 
 type AttrsOrig map[string][]string
@@ -277,6 +238,8 @@ type FetchedCredential struct {
 	PwdAccountLockedTime *time.Time
 	LastPwdFailureTime   *time.Time
 	PwdFailureCount      int
+	// Normalized attributes of this entry for the additional checks (e.g. TOTP)
+	Attrs CacheAttrsNorm
 }
 
 type NotifyOp string
@@ -331,14 +294,14 @@ func withDBTx(ctx context.Context, db *sqlx.DB, callback func(dbTx *sqlx.Tx) err
 	return nil
 }
 
-func rollbackCache(tx *reindexer.Tx) {
+func rollbackCache(tx CacheTx) {
 	err := tx.Rollback()
 	if err != nil {
 		log.Printf("warn: Detect error when rollback cache, ignore it. err: %v", err)
 	}
 }
 
-func commitCache(tx *reindexer.Tx) error {
+func commitCache(tx CacheTx) error {
 	err := tx.Commit()
 	if err != nil {
 		log.Printf("warn: Detect error when commit cache, do rollback. err: %v", err)
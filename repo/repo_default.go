@@ -16,7 +16,6 @@ import (
 	"github.com/jmoiron/sqlx/types"
 	"github.com/lib/pq"
 	"github.com/pkg/errors"
-	"github.com/restream/reindexer"
 	"golang.org/x/xerrors"
 )
 
@@ -66,7 +65,17 @@ func (c CacheAttrsNorm) ValueInt64(name string) []int64 {
 	rtn := make([]int64, len(c[name]))
 	for i, v := range c[name] {
 		var err error
-		rtn[i], err = v.(json.Number).Int64()
+		switch vv := v.(type) {
+		case json.Number:
+			rtn[i], err = vv.Int64()
+		case string:
+			// The integer and generalizedTime are cached as the normalized string
+			rtn[i], err = strconv.ParseInt(vv, 10, 64)
+		case int64:
+			rtn[i] = vv
+		default:
+			err = fmt.Errorf("unexpected type: %T", v)
+		}
 		if err != nil {
 			panic(fmt.Sprintf("Unexpected normalized value type: %v", v))
 		}
@@ -96,8 +105,6 @@ var (
 	updateParent         *sqlx.NamedStmt
 	updateParentWithPath *sqlx.NamedStmt
 	updatePath           *sqlx.NamedStmt
-	addMemberOf          *sqlx.NamedStmt
-	removeMember         *sqlx.NamedStmt
 
 	// delete
 	deleteByIDEntry *sqlx.NamedStmt
@@ -136,6 +143,14 @@ CREATE TABLE IF NOT EXISTS entry (
 		REFERENCES entry (id)
 		ON DELETE RESTRICT ON UPDATE RESTRICT
 );
+-- The normalized attrs_orig for the search by SQL. NULL means it isn't migrated yet.
+ALTER TABLE entry ADD COLUMN IF NOT EXISTS attrs_norm JSONB;
+CREATE TABLE IF NOT EXISTS bind_attempt (
+	key TEXT PRIMARY KEY,
+	failures INT NOT NULL,
+	last_failure_time TIMESTAMPTZ NOT NULL,
+	banned_until TIMESTAMPTZ
+);
 `)
 	if err != nil {
 		return reportError(err)
@@ -149,6 +164,14 @@ INSERT INTO entry VALUES (0, gen_random_uuid(), 1, 0, ARRAY []::BIGINT[], TRUE,
 		return reportError(err)
 	}
 
+	if err := r.initChangeLog(); err != nil {
+		return err
+	}
+
+	if err := r.initAssociation(); err != nil {
+		return err
+	}
+
 	// DEBUG
 	if false {
 		_, err = db.Exec(`
@@ -216,7 +239,7 @@ SELECT SETVAL('entry_id_seq', (SELECT MAX(id) + 1 FROM entry));
 
 	findAll, err = db.PrepareNamed(`
 SELECT
-	e.id, e.rev, e.parent_id, e.path, e.is_container, e.rdn_norm, e.rdn_orig, e.attrs_orig
+	e.id, e.rev, e.parent_id, e.path, e.is_container, e.rdn_norm, e.rdn_orig, ` + attrsOrigWithAssociation + ` AS attrs_orig
 FROM entry e
 `)
 	if err != nil {
@@ -225,7 +248,7 @@ FROM entry e
 
 	findEntryByID, err = db.PrepareNamed(`
 SELECT
-	e.id, e.rev, e.parent_id, e.path, e.is_container, e.rdn_norm, e.rdn_orig, e.attrs_orig
+	e.id, e.rev, e.parent_id, e.path, e.is_container, e.rdn_norm, e.rdn_orig, ` + attrsOrigWithAssociation + ` AS attrs_orig
 FROM entry e
 WHERE
 	e.id = :id
@@ -236,7 +259,7 @@ WHERE
 
 	findSubContainerByPath, err = db.PrepareNamed(`
 SELECT
-	e.id, e.rev, e.parent_id, e.path, e.is_container, e.rdn_norm, e.rdn_orig, e.attrs_orig
+	e.id, e.rev, e.parent_id, e.path, e.is_container, e.rdn_norm, e.rdn_orig, ` + attrsOrigWithAssociation + ` AS attrs_orig
 FROM entry e
 WHERE
 	e.path @> :path
@@ -274,7 +297,7 @@ FOR UPDATE
 
 	lockEntryByIDForUpdate, err = db.PrepareNamed(`
 SELECT
-	e.id, e.rev, e.path, e.is_container, e.rdn_norm, e.rdn_orig, e.attrs_orig
+	e.id, e.rev, e.path, e.is_container, e.rdn_norm, e.rdn_orig, ` + attrsOrigWithAssociation + ` AS attrs_orig
 FROM entry e
 WHERE
 	e.id = :id
@@ -335,8 +358,8 @@ LIMIT 1
 	}
 
 	insertRootEntry, err = db.PrepareNamed(`
-INSERT INTO entry (uuid, rev, parent_id, is_container, rdn_norm, rdn_orig, attrs_orig)
-VALUES(:uuid, 1, 0, FALSE, :rdn_norm, :rdn_orig, :attrs_orig)
+INSERT INTO entry (uuid, rev, parent_id, is_container, rdn_norm, rdn_orig, attrs_orig, attrs_norm)
+VALUES(:uuid, 1, 0, FALSE, :rdn_norm, :rdn_orig, :attrs_orig, :attrs_norm)
 RETURNING id
 	`)
 	if err != nil {
@@ -344,8 +367,8 @@ RETURNING id
 	}
 
 	insertEntry, err = db.PrepareNamed(`
-INSERT INTO entry (uuid, rev, parent_id, is_container, rdn_norm, rdn_orig, attrs_orig)
-VALUES(:uuid, 1, :parent_id, FALSE, :rdn_norm, :rdn_orig, :attrs_orig)
+INSERT INTO entry (uuid, rev, parent_id, is_container, rdn_norm, rdn_orig, attrs_orig, attrs_norm)
+VALUES(:uuid, 1, :parent_id, FALSE, :rdn_norm, :rdn_orig, :attrs_orig, :attrs_norm)
 RETURNING id
 `)
 	if err != nil {
@@ -418,98 +441,79 @@ WHERE
 		return reportError(err)
 	}
 
-	addMemberOf, err = db.PrepareNamed(`
-UPDATE
-	entry
-SET
-	attrs_orig = JSONB_SET(attrs_orig, ARRAY['memberOf'], (attrs_orig->'memberOf') || :member_id),
-	rev = rev + 1
-WHERE
-	id = :id
-`)
-	if err != nil {
-		return reportError(err)
-	}
-
-	removeMember, err = db.PrepareNamed(`
-UPDATE
-	entry
-SET	
-	attrs_orig = JSONB_SET(attrs_orig, ARRAY['memberOf'], (attrs_orig->'memberOf') - (:member_id)::::text),
-	rev = rev + 1
-WHERE
-	id = :id
-`)
-	if err != nil {
-		return reportError(err)
-	}
-
 	notifyStmt, err = db.PrepareNamed(`
-SELECT pg_notify(
-	'entry_update',
-	JSON_BUILD_OBJECT(
-		'iss', (:iss)::::TEXT, 
-		'id', (:id)::::BIGINT,
-		'op', (:op)::::TEXT,
-		'rev', (:rev)::::BIGINT,
-		'asc', (:asc)::::BOOLEAN,
-		'dep', (:dep)::::BIGINT[],
-		'sub', (:sub)::::BOOLEAN
-	)::::text
+WITH change AS (
+	INSERT INTO entry_change (message)
+	VALUES (
+		JSON_BUILD_OBJECT(
+			'iss', (:iss)::::TEXT, 
+			'id', (:id)::::BIGINT,
+			'op', (:op)::::TEXT,
+			'rev', (:rev)::::BIGINT,
+			'asc', (:asc)::::BOOLEAN,
+			'dep', (:dep)::::BIGINT[],
+			'sub', (:sub)::::BOOLEAN
+		)
+	)
+	RETURNING seq
 )
+SELECT pg_notify('entry_update', (seq)::::text) FROM change
 	`)
 	if err != nil {
 		return reportError(err)
 	}
 
-	// 	allStmt, err = db.PrepareNamed(`
-	// SELECT
-	//     e.id, e.parent_id, e.attrs_orig,
-	//     member.member,
-	//     uniqueMember.unique_member,
-	//     memberOf.member_of
-	// FROM entry e
-	// -- member
-	// LEFT JOIN LATERAL (
-	//     SELECT ARRAY_AGG(a.member_id) as member FROM association a WHERE e.id = a.id AND a.name = 'member'
-	// ) AS member ON TRUE
-	// -- uniqueMember
-	// LEFT JOIN LATERAL (
-	//     SELECT ARRAY_AGG(a.member_id) as unique_member FROM association a WHERE e.id = a.id AND a.name = 'uniqueMember'
-	// ) AS uniqueMember ON TRUE
-	// -- memberOf
-	// LEFT JOIN LATERAL (
-	//     SELECT ARRAY_AGG(a.id) as member_of FROM association a WHERE e.id = a.member_id
-	// ) AS memberOf ON TRUE
-	// 	`)
-	if err != nil {
-		return reportError(err)
-	}
-
 	// indexer
-	err = r.cacheDB.AddIndex("entries", reindexer.IndexDef{Name: "attrsNorm.objectClass", JSONPaths: []string{"attrsNorm.objectClass"}, IndexType: "hash", FieldType: "string", IsArray: true})
+	err = r.cacheDB.AddIndex(CacheIndexDef{Name: "attrsNorm.objectClass", FieldType: "string", IsArray: true})
 	if err != nil {
 		return errors.Wrap(err, "Failed to initialize local index. name: objectClass")
 	}
 	for k, _ := range r.schemaRegistry.AttributeTypes {
 		if isIndexedAttribute(k) {
-			err = r.cacheDB.AddIndex("entries", reindexer.IndexDef{Name: "attrsNorm." + k, JSONPaths: []string{"attrsNorm." + k}, IndexType: "hash", FieldType: "string", IsArray: true})
+			err = r.cacheDB.AddIndex(CacheIndexDef{Name: "attrsNorm." + k, FieldType: "string", IsArray: true})
 			if err != nil {
 				return errors.Wrapf(err, "Failed to initialize local index. name: %s", k)
 			}
 		}
 		if isNumIndexedAttribute(k) {
-			err = r.cacheDB.AddIndex("entries", reindexer.IndexDef{Name: "attrsNorm." + k, JSONPaths: []string{"attrsNorm." + k}, IndexType: "hash", FieldType: "int64", IsArray: true})
+			err = r.cacheDB.AddIndex(CacheIndexDef{Name: "attrsNorm." + k, FieldType: "int64", IsArray: true})
 			if err != nil {
 				return errors.Wrapf(err, "Failed to initialize local index. name: %s", k)
 			}
 		}
 	}
 
+	if r.config.SearchMode == SearchModeSQL || r.config.SearchMode == SearchModeHybrid {
+		if err := r.initSQLSearch(); err != nil {
+			return err
+		}
+	}
+
+	if r.config.CacheSnapshotPath != "" {
+		if err := r.initCacheSnapshot(); err != nil {
+			return err
+		}
+	}
+
 	ctx := context.Background()
-	if err := r.CacheAll(ctx); err != nil {
+
+	if r.config.SearchMode == SearchModeHybrid {
+		// Serve the searches by SQL until the cache DB is warmed up
+		go func() {
+			if err := r.loadCache(ctx); err != nil {
+				log.Printf("alert: Failed to warm up cache DB, the searches are still served by SQL. err: %+v", err)
+				return
+			}
+			r.setCacheReady(true)
+			log.Printf("info: Warmed up cache DB, the searches are served by the cache DB")
+		}()
+		return nil
+	}
+
+	if err := r.loadCache(ctx); err != nil {
 		return errors.Wrap(err, "Failed to initialize cache DB.")
 	}
+	r.setCacheReady(true)
 
 	return nil
 }
@@ -532,11 +536,17 @@ func isNumIndexedAttribute(name string) bool {
 
 func (r *DefaultRepository) RefreshCache(ctx context.Context) error {
 	log.Printf("info: Clear all cache entries")
-	if err := r.cacheDB.TruncateNamespace("entries"); err != nil {
+	r.setCacheReady(false)
+	if err := r.cacheDB.Truncate(); err != nil {
 		return errors.Wrapf(err, "Failed to truncate cache DB")
 	}
 
-	return r.CacheAll(ctx)
+	if err := r.CacheAll(ctx); err != nil {
+		return err
+	}
+	r.setCacheReady(true)
+
+	return nil
 }
 
 func (r *DefaultRepository) CacheAll(ctx context.Context) error {
@@ -549,12 +559,33 @@ func (r *DefaultRepository) CacheAll(ctx context.Context) error {
 		return xerrors.Errorf("Failed to begin cache DB transaction: %w", err)
 	}
 
-	tx, err := r.beginReadonly(ctx)
+	// The cache snapshot needs the repeatable read to fetch all entries at the point of the mark
+	var tx *sqlx.Tx
+	if r.config.CacheSnapshotPath != "" {
+		tx, err = r.beginSnapshot(ctx)
+	} else {
+		tx, err = r.beginReadonly(ctx)
+	}
 	if err != nil {
 		return xerrors.Errorf("Failed to begin DB transaction: %w", err)
 	}
 	defer rollback(tx)
 
+	var writer *cacheSnapshotWriter
+	if r.config.CacheSnapshotPath != "" {
+		mark, err := r.snapshotMark(ctx, tx)
+		if err != nil {
+			log.Printf("warn: Skip writing cache snapshot. err: %+v", err)
+		} else {
+			writer = r.createCacheSnapshot(mark)
+		}
+	}
+	defer func() {
+		if writer != nil {
+			writer.Abort()
+		}
+	}()
+
 	log.Printf("info: Feching all entries")
 	start := time.Now()
 
@@ -578,6 +609,14 @@ func (r *DefaultRepository) CacheAll(ctx context.Context) error {
 		if err := r.CacheEntry(ctx, cacheTx, &dbEntry, true); err != nil {
 			return errors.Wrap(err, "cache entry error")
 		}
+
+		if writer != nil {
+			if err := writer.Write(&dbEntry); err != nil {
+				log.Printf("warn: Skip writing cache snapshot. err: %+v", err)
+				writer.Abort()
+				writer = nil
+			}
+		}
 	}
 
 	elapsed = time.Since(start)
@@ -590,6 +629,15 @@ func (r *DefaultRepository) CacheAll(ctx context.Context) error {
 	elapsed = time.Since(first)
 	log.Printf("info: Cache commited: %v", elapsed)
 
+	if writer != nil {
+		if err := writer.Commit(); err != nil {
+			log.Printf("warn: Failed to write cache snapshot. err: %+v", err)
+		} else {
+			log.Printf("info: Wrote cache snapshot. path: %s", r.config.CacheSnapshotPath)
+		}
+		writer = nil
+	}
+
 	// start = time.Now()
 	// if err := r.CacheAssociation(ctx, memberOfMap); err != nil {
 	// 	return xerrors.Errorf("Unexpected cache association error. err: %w", err)
@@ -602,7 +650,7 @@ func (r *DefaultRepository) CacheAll(ctx context.Context) error {
 
 	// start = time.Now()
 
-	// query := r.cacheDB.Query("entries").
+	// query := r.cacheDB.Query().
 	// 	WhereInt64("path", reindexer.EQ, 0).
 	// 	ReqTotal()
 	// iterator := query.Exec()
@@ -626,7 +674,7 @@ func (r *DefaultRepository) CacheAll(ctx context.Context) error {
 
 	// start = time.Now()
 
-	// query = r.cacheDB.Query("entries").
+	// query = r.cacheDB.Query().
 	// 	Sort("id", false).
 	// 	WhereInt64("parentId", reindexer.EQ, 2).
 	// 	WhereString("attrsNorm.objectClass", reindexer.EQ, "groupofnames").
@@ -669,7 +717,7 @@ func (r *DefaultRepository) CacheAll(ctx context.Context) error {
 	return nil
 }
 
-func (r *DefaultRepository) CacheEntryByID(ctx context.Context, cacheTx *reindexer.Tx, dbTx *sqlx.Tx, id int64, assoc bool) error {
+func (r *DefaultRepository) CacheEntryByID(ctx context.Context, cacheTx CacheTx, dbTx *sqlx.Tx, id int64, assoc bool) error {
 	// Fetch the latest entry from DB to cache it
 	var dbEntry DBEntry
 	err := r.get(dbTx, findEntryByID, &dbEntry, map[string]interface{}{
@@ -707,7 +755,7 @@ func (r *DefaultRepository) CacheEntryByID(ctx context.Context, cacheTx *reindex
 	return nil
 }
 
-func (r *DefaultRepository) CacheEntryBySubTree(ctx context.Context, cacheTx *reindexer.Tx, dbTx *sqlx.Tx, id int64) error {
+func (r *DefaultRepository) CacheEntryBySubTree(ctx context.Context, cacheTx CacheTx, dbTx *sqlx.Tx, id int64) error {
 	// Fetch the latest entry from DB to cache it
 	rows, err := r.stmtQuery(ctx, dbTx, findSubContainerByPath, map[string]interface{}{
 		"id":   id,
@@ -732,23 +780,41 @@ func (r *DefaultRepository) CacheEntryBySubTree(ctx context.Context, cacheTx *re
 	return nil
 }
 
-func (r *DefaultRepository) CacheEntry(ctx context.Context, tx *reindexer.Tx, entry *DBEntry, ignoreParent bool) error {
+func (r *DefaultRepository) CacheEntry(ctx context.Context, tx CacheTx, entry *DBEntry, ignoreParent bool) error {
+	item, err := r.toCacheItem(entry)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Upsert(item)
+	if err != nil {
+		return xerrors.Errorf("Failed to upsert into cacheDB. err: %w", err)
+	}
+
+	// cache
+	entry.AttrsOrigMap = item.AttrsOrig
+
+	return nil
+}
+
+// toCacheItem normalizes the entry of DB to the item of the cache DB.
+func (r *DefaultRepository) toCacheItem(entry *DBEntry) (*CacheItem, error) {
 	dbAttrsOrig := make(DBAttrsNorm)
 	cacheAttrsNorm := make(map[string]interface{})
 
 	if err := entry.AttrsOrig.Unmarshal(&dbAttrsOrig); err != nil {
-		return xerrors.Errorf("Unexpected unmarshal error. raw: %v, err: %w", entry.AttrsOrig, err)
+		return nil, xerrors.Errorf("Unexpected unmarshal error. raw: %v, err: %w", entry.AttrsOrig, err)
 	}
 
 	// Normalize attrs
 	for k, v := range dbAttrsOrig {
 		sv, err := schema.NewSchemaValue(r.schemaRegistry, k, v)
 		if err != nil {
-			return xerrors.Errorf("Unexpected schema error. name: %s, value: %v, err: %w", k, v, err)
+			return nil, xerrors.Errorf("Unexpected schema error. name: %s, value: %v, err: %w", k, v, err)
 		}
 		err = sv.Normalize()
 		if err != nil {
-			return xerrors.Errorf("Unexpected normalization error. err: %w", err)
+			return nil, xerrors.Errorf("Unexpected normalization error. err: %w", err)
 		}
 
 		if isNumIndexedAttribute(sv.Name()) {
@@ -762,38 +828,23 @@ func (r *DefaultRepository) CacheEntry(ctx context.Context, tx *reindexer.Tx, en
 	// TODO: create NormalizeRDNStr()
 	rdn, err := r.schemaRegistry.NormalizeDN(entry.RDNOrig)
 	if err != nil {
-		return xerrors.Errorf("Unexpected normalization rdn error. rdn: %s, err: %w", entry.RDNOrig, err)
-	}
-
-	jsonMap := make(map[string]interface{})
-	jsonMap["id"] = entry.ID
-	jsonMap["rev"] = entry.Version
-	jsonMap["parentId"] = entry.ParentID
-	jsonMap["path"] = entry.Path
-	jsonMap["isContainer"] = entry.IsContainer
-	jsonMap["rdnOrig"] = entry.RDNOrig
-	jsonMap["rdnNorm"] = rdn.RDNNormStr()
-	jsonMap["attrsOrig"] = dbAttrsOrig
-	jsonMap["attrsNorm"] = cacheAttrsNorm
-	entryJson, err := json.Marshal(jsonMap)
-	if err != nil {
-		return xerrors.Errorf("Unexpected schema error. err: %w", err)
-	}
-
-	// log.Printf("%v", string(entryJson))
-
-	err = tx.Upsert(entryJson)
-	if err != nil {
-		return xerrors.Errorf("Failed to upsert into cacheDB. err: %w", err)
-	}
-
-	// cache
-	entry.AttrsOrigMap = dbAttrsOrig
-
-	return nil
+		return nil, xerrors.Errorf("Unexpected normalization rdn error. rdn: %s, err: %w", entry.RDNOrig, err)
+	}
+
+	return &CacheItem{
+		ID:          entry.ID,
+		Version:     entry.Version,
+		ParentID:    entry.ParentID,
+		Path:        entry.Path,
+		IsContainer: entry.IsContainer,
+		RDNOrig:     entry.RDNOrig,
+		RDNNorm:     rdn.RDNNormStr(),
+		AttrsOrig:   dbAttrsOrig,
+		AttrsNorm:   cacheAttrsNorm,
+	}, nil
 }
 
-func (r *DefaultRepository) CacheAssociation(ctx context.Context, cacheTx *reindexer.Tx, dbTx *sqlx.Tx, memberOf []int64) error {
+func (r *DefaultRepository) CacheAssociation(ctx context.Context, cacheTx CacheTx, dbTx *sqlx.Tx, memberOf []int64) error {
 	reportError := func(err error) error {
 		return errors.Wrapf(err, "Failed to cache assoication. memberOf: %v", memberOf)
 	}
@@ -803,30 +854,20 @@ func (r *DefaultRepository) CacheAssociation(ctx context.Context, cacheTx *reind
 	}
 
 	// Fetch current memberOf from DB, then sync them to cache DB
-	q, args, err := sqlx.Named(`
+	// The ids are bound as an array, the large group has more ids than the limit of the parameters
+	rows, err := dbTx.NamedQuery(`
 SELECT
-e.id, e.rev, e.parent_id, e.rdn_norm, e.rdn_orig, e.attrs_orig
+	e.id, e.rev, e.parent_id, e.path, e.is_container, e.rdn_norm, e.rdn_orig, `+attrsOrigWithAssociation+` AS attrs_orig
 FROM entry e
 WHERE
-id IN (:id)
+	e.id = ANY(CAST(:ids AS bigint[]))
 `, map[string]interface{}{
-		"id": memberOf,
+		"ids": pq.Array(memberOf),
 	})
 	if err != nil {
 		return reportError(err)
 	}
-
-	q, args, err = sqlx.In(q, args...)
-	if err != nil {
-		return reportError(err)
-	}
-
-	q = dbTx.Rebind(q)
-
-	rows, err := dbTx.QueryxContext(ctx, q, args...)
-	if err != nil {
-		return reportError(err)
-	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var dbdest DBEntry
@@ -837,14 +878,16 @@ id IN (:id)
 
 		iter := cacheTx.Query().
 			Select("rev").
-			WhereInt64("id", reindexer.EQ, dbdest.ID).
+			WhereInt64("id", cacheEQ, dbdest.ID).
 			ExecToJsonCtx(ctx)
 		if iter.Next() {
 			// Exists in cache
 			var cdest struct {
 				Version int64 `json:"rev"`
 			}
-			if err := json.Unmarshal(iter.JSON(), &cdest); err != nil {
+			err := json.Unmarshal(iter.JSON(), &cdest)
+			iter.Close()
+			if err != nil {
 				return reportError(err)
 			}
 			if shouldVersionUpdated(dbdest.Version, cdest.Version) {
@@ -865,6 +908,9 @@ id IN (:id)
 			return reportError(err)
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return reportError(err)
+	}
 
 	return nil
 }
@@ -873,9 +919,9 @@ id IN (:id)
 func (r *DefaultRepository) findAttrsOrigByID(ctx context.Context, id int64) (CacheAttrsOrig, error) {
 	iter := r.query().
 		Select("attrsOrig").
-		WhereInt64("id", reindexer.EQ, id).
+		WhereInt64("id", cacheEQ, id).
 		Limit(1).
-		ExecToJson()
+		ExecToJsonCtx(ctx)
 	defer iter.Close()
 
 	if !iter.Next() {
@@ -899,7 +945,7 @@ func (r *DefaultRepository) findEntryID(ctx context.Context, dn *schema.DN) (int
 	return r.findEntryIDWithTx(ctx, nil, dn)
 }
 
-func (r *DefaultRepository) findEntryIDWithTx(ctx context.Context, cacheTx *reindexer.Tx, dn *schema.DN) (int64, error) {
+func (r *DefaultRepository) findEntryIDWithTx(ctx context.Context, cacheTx CacheTx, dn *schema.DN) (int64, error) {
 	var rdnNorms []string
 
 	if dn.IsSuffix(r.schemaRegistry.SuffixDN) {
@@ -936,7 +982,7 @@ func (r *DefaultRepository) findEntryIDWithTx(ctx context.Context, cacheTx *rein
 			id = cid
 		} else {
 			// Not cached
-			var q *reindexer.Query
+			var q CacheQuery
 			if cacheTx == nil {
 				q = r.query()
 			} else {
@@ -944,8 +990,8 @@ func (r *DefaultRepository) findEntryIDWithTx(ctx context.Context, cacheTx *rein
 			}
 			iter := q.
 				Select("id").
-				WhereInt64("parentId", reindexer.EQ, id).
-				WhereString("rdnNorm", reindexer.EQ, rdnNorms[i]).
+				WhereInt64("parentId", cacheEQ, id).
+				WhereString("rdnNorm", cacheEQ, rdnNorms[i]).
 				Limit(1).
 				ExecToJsonCtx(ctx)
 			defer iter.Close()
@@ -998,8 +1044,8 @@ func (r *DefaultRepository) findEntryPath(ctx context.Context, dn *schema.DN) ([
 	for i := len(rdnNorms) - 1; i >= 0; i-- {
 		iter := r.query().
 			Select("id").
-			WhereInt64("parentId", reindexer.EQ, id).
-			WhereString("rdnNorm", reindexer.EQ, rdnNorms[i]).
+			WhereInt64("parentId", cacheEQ, id).
+			WhereString("rdnNorm", cacheEQ, rdnNorms[i]).
 			Limit(1).
 			ExecToJsonCtx(ctx)
 		defer iter.Close()
@@ -1045,100 +1091,6 @@ func (r *DefaultRepository) dnStrArrayToIDStrArray(ctx context.Context, dn []str
 	return ids, nil, -1
 }
 
-func (r *DefaultRepository) addMemberOf(ctx context.Context, dbTx *sqlx.Tx, ids []string, id int64) error {
-	reportError := func(err error) error {
-		return errors.Wrapf(err, "Failed to add memberOf. memberOf: %d, ids: %v", id, ids)
-	}
-
-	if len(ids) == 0 {
-		return nil
-	}
-
-	// Use COALESCE for non memberOf situation
-	q, args, err := sqlx.Named(`
-UPDATE entry
-SET
-	attrs_orig = JSONB_SET(attrs_orig, ARRAY['memberOf'], COALESCE((attrs_orig->'memberOf')::::jsonb, '[]'::::jsonb) || :member_id),
-	rev = rev + 1
-WHERE id IN (:id)
-`, map[string]interface{}{
-		"member_id": types.JSONText(fmt.Sprintf(`["%d"]`, id)),
-		"id":        ids,
-	})
-	if err != nil {
-		return reportError(err)
-	}
-
-	q, args, err = sqlx.In(q, args...)
-	if err != nil {
-		return reportError(err)
-	}
-
-	q = dbTx.Rebind(q)
-
-	result, err := dbTx.Exec(q, args...)
-	if err != nil {
-		return reportError(err)
-	}
-	updated, err := result.RowsAffected()
-	if err != nil {
-		return reportError(err)
-	}
-
-	if updated != int64(len(ids)) {
-		return reportError(err)
-	}
-
-	return nil
-}
-
-func (r *DefaultRepository) deleteMemberOf(ctx context.Context, dbTx *sqlx.Tx, ids []string, id int64) error {
-	reportError := func(err error) error {
-		return errors.Wrapf(err, "Failed to delete memberOf. memberOf: %d, ids: %v", id, ids)
-	}
-
-	if len(ids) == 0 {
-		return nil
-	}
-
-	q, args, err := sqlx.Named(`
-UPDATE entry
-SET
-	attrs_orig = JSONB_SET(attrs_orig, ARRAY['memberOf'], COALESCE((attrs_orig->'memberOf')::::jsonb, '[]'::::jsonb) - (:member_id)::::text),
-	rev = rev + 1
-WHERE id IN (:id)
-`, map[string]interface{}{
-		"member_id": id,
-		"id":        ids,
-	})
-	if err != nil {
-		return reportError(err)
-	}
-
-	q, args, err = sqlx.In(q, args...)
-	if err != nil {
-		return reportError(err)
-	}
-
-	q = dbTx.Rebind(q)
-
-	result, err := dbTx.Exec(q, args...)
-	if err != nil {
-		return reportError(err)
-	}
-	updated, err := result.RowsAffected()
-	if err != nil {
-		return reportError(err)
-	}
-
-	if updated != int64(len(ids)) {
-		log.Printf("warn: Detected inconsistency while removing memberOf. id: %d", id)
-		return util.NewRetryError(err)
-	}
-
-	return nil
-}
-
 func (r *DefaultRepository) OnUpdate(ctx context.Context, m *NotifyMessage) error {
 	if m == nil {
 		return nil
@@ -1161,7 +1113,7 @@ func (r *DefaultRepository) OnUpdate(ctx context.Context, m *NotifyMessage) erro
 
 	iter := cacheTx.Query().
 		Select("rev", "parentId").
-		WhereInt64("id", reindexer.EQ, m.ID).
+		WhereInt64("id", cacheEQ, m.ID).
 		ExecToJsonCtx(ctx)
 
 	if iter.Error() != nil {
@@ -1202,12 +1154,9 @@ func (r *DefaultRepository) OnUpdate(ctx context.Context, m *NotifyMessage) erro
 		}
 		log.Printf("Upsert cache DB, id: %d, version: %d", m.ID, m.Rev)
 
-		for _, id := range m.Dependant {
-			err = r.CacheEntryByID(ctx, cacheTx, dbTx, id, false)
-			if err != nil {
-				return reportError(err)
-			}
-			log.Printf("Upsert cache DB, id: %d, version: %d", m.ID, m.Rev)
+		// The dependants are fetched at once, the bulk membership change has many of them
+		if err := r.CacheAssociation(ctx, cacheTx, dbTx, m.Dependant); err != nil {
+			return reportError(err)
 		}
 
 		if m.Sub {
@@ -1243,13 +1192,13 @@ func (r *DefaultRepository) OnUpdate(ctx context.Context, m *NotifyMessage) erro
 	return nil
 }
 
-func (r *DefaultRepository) DeleteCacheEntry(ctx context.Context, cacheTx *reindexer.Tx, dbTx *sqlx.Tx, id, parentId int64, acc bool) (int, error) {
+func (r *DefaultRepository) DeleteCacheEntry(ctx context.Context, cacheTx CacheTx, dbTx *sqlx.Tx, id, parentId int64, acc bool) (int, error) {
 	reportError := func(err error) (int, error) {
 		return -1, errors.Wrapf(err, "Failed to delete cache. id: %d", id)
 	}
 	// Delete it from cache DB
 	deleted, err := cacheTx.Query().
-		WhereInt64("id", reindexer.EQ, id).
+		WhereInt64("id", cacheEQ, id).
 		DeleteCtx(ctx)
 	if err != nil {
 		return reportError(err)
@@ -1258,21 +1207,24 @@ func (r *DefaultRepository) DeleteCacheEntry(ctx context.Context, cacheTx *reind
 	// Update parent container
 	_, found := cacheTx.Query().
 		Select("id").
-		WhereInt64("parentId", reindexer.EQ, parentId).
+		WhereInt64("parentId", cacheEQ, parentId).
 		GetJsonCtx(ctx)
 	if !found {
 		// Detected no children, change parent container
-		cacheTx.Query().
-			WhereInt64("id", reindexer.EQ, parentId).
+		err := cacheTx.Query().
+			WhereInt64("id", cacheEQ, parentId).
 			Set("isContainer", false).
 			Set("path", []int64{}).
-			ExecCtx(ctx)
+			UpdateCtx(ctx)
+		if err != nil {
+			return reportError(err)
+		}
 	}
 
 	if acc {
 		iter := r.query().
 			Select("attrsNorm.member", "attrsNorm.uniqueMember", "attrsNorm.memberOf").
-			WhereInt64("id", reindexer.EQ, id).
+			WhereInt64("id", cacheEQ, id).
 			ExecToJsonCtx(ctx)
 		defer iter.Close()
 
@@ -1317,8 +1269,8 @@ func shouldVersionUpdated(dbVersion, cacheVersion int64) bool {
 // Utilities
 //////////////////////////////////////////
 
-func (r *DefaultRepository) withTx(ctx context.Context, callback func(cacheTx *reindexer.Tx, dbTx *sqlx.Tx) error) error {
-	cacheTx, err := r.cacheDB.BeginTx("entries")
+func (r *DefaultRepository) withTx(ctx context.Context, callback func(cacheTx CacheTx, dbTx *sqlx.Tx) error) error {
+	cacheTx, err := r.cacheDB.BeginTx()
 	if err != nil {
 		return errors.Wrap(err, "Failed to begin cache transaction")
 	}
@@ -1348,12 +1300,12 @@ func (r *DefaultRepository) withTx(ctx context.Context, callback func(cacheTx *r
 	return nil
 }
 
-func (r *DefaultRepository) query() *reindexer.Query {
-	return r.cacheDB.Query("entries")
+func (r *DefaultRepository) query() CacheQuery {
+	return r.cacheDB.Query()
 }
 
-func (r *DefaultRepository) beginCacheTX() (*reindexer.Tx, error) {
-	tx, err := r.cacheDB.BeginTx("entries")
+func (r *DefaultRepository) beginCacheTX() (CacheTx, error) {
+	tx, err := r.cacheDB.BeginTx()
 	if err != nil {
 		return nil, xerrors.Errorf("Failed to begin cache db transaction. err: %w", err)
 	}
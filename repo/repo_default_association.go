@@ -0,0 +1,496 @@
+package repo
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudldap/cloudldap/auth"
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"golang.org/x/xerrors"
+)
+
+var (
+	// association
+	addAssociation    *sqlx.NamedStmt
+	removeAssociation *sqlx.NamedStmt
+	clearAssociation  *sqlx.NamedStmt
+	touchEntries      *sqlx.NamedStmt
+)
+
+// storedAssociationAttributes are stored in the association table instead of attrs_orig.
+// memberOf isn't stored, it's derived from member and uniqueMember of the groups.
+// TODO configurable
+var storedAssociationAttributes = []string{"member", "uniqueMember"}
+
+// attrsOrigWithAssociation is the expression of attrs_orig of the entry "e" merged with the association.
+// The entries are fetched with it, so the association looks like stored in attrs_orig as before.
+const attrsOrigWithAssociation = `((e.attrs_orig - CAST(ARRAY['member', 'uniqueMember', 'memberOf'] AS text[])) || COALESCE((
+	SELECT jsonb_object_agg(g.name, g.ids) FROM (
+		SELECT a.name, jsonb_agg(CAST(a.member_id AS text) ORDER BY a.member_id) AS ids
+		FROM association a WHERE a.id = e.id GROUP BY a.name
+		UNION ALL
+		SELECT 'memberOf', jsonb_agg(CAST(m.id AS text) ORDER BY m.id)
+		FROM (SELECT DISTINCT a.id FROM association a WHERE a.member_id = e.id) m
+		HAVING COUNT(*) > 0
+	) g
+), '{}'))`
+
+func isStoredAssociationAttribute(name string) bool {
+	for _, v := range storedAssociationAttributes {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// initAssociation creates the association table, migrates the association in attrs_orig to it,
+// then prepares the statements.
+func (r *DefaultRepository) initAssociation() error {
+	reportError := func(err error) error {
+		return errors.Wrap(err, "Failed to initialize DB for the association")
+	}
+
+	_, err := r.db.Exec(`
+CREATE TABLE IF NOT EXISTS association (
+	name TEXT NOT NULL,
+	id BIGINT NOT NULL,
+	member_id BIGINT NOT NULL,
+
+	CONSTRAINT pk_association
+		PRIMARY KEY (id, name, member_id),
+	CONSTRAINT fk_association_id
+		FOREIGN KEY (id)
+		REFERENCES entry (id)
+		ON DELETE CASCADE ON UPDATE RESTRICT,
+	CONSTRAINT fk_association_member_id
+		FOREIGN KEY (member_id)
+		REFERENCES entry (id)
+		ON DELETE CASCADE ON UPDATE RESTRICT
+);
+CREATE INDEX IF NOT EXISTS idx_association_member_id ON association (member_id);
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	if err := r.migrateAssociation(); err != nil {
+		return reportError(err)
+	}
+
+	addAssociation, err = r.db.PrepareNamed(`
+INSERT INTO association (name, id, member_id)
+SELECT CAST(:name AS text), CAST(:id AS bigint), m.member_id
+FROM unnest(CAST(:member_ids AS bigint[])) AS m(member_id)
+ON CONFLICT DO NOTHING
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	removeAssociation, err = r.db.PrepareNamed(`
+DELETE FROM association
+WHERE
+	id = :id
+	AND name = :name
+	AND member_id = ANY(CAST(:member_ids AS bigint[]))
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	clearAssociation, err = r.db.PrepareNamed(`
+DELETE FROM association
+WHERE
+	id = :id
+	AND name = :name
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	// Only rev is changed to notify the change of memberOf, attrs_orig isn't rewritten
+	touchEntries, err = r.db.PrepareNamed(`
+UPDATE
+	entry
+SET
+	rev = rev + 1
+WHERE
+	id = ANY(CAST(:ids AS bigint[]))
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	return nil
+}
+
+// migrateAssociation moves member and uniqueMember in attrs_orig to the association table, and removes memberOf.
+// The invalid ids and the ids which don't exist are dropped with the warning log. It does nothing if already migrated.
+func (r *DefaultRepository) migrateAssociation() error {
+	return withDBTx(context.Background(), r.db, func(tx *sqlx.Tx) error {
+		var count int
+		err := tx.Get(&count, `
+SELECT COUNT(*) FROM entry e WHERE e.attrs_orig ?| CAST(ARRAY['member', 'uniqueMember', 'memberOf'] AS text[])
+`)
+		if err != nil {
+			return xerrors.Errorf("Failed to count the entries to migrate. err: %w", err)
+		}
+		if count == 0 {
+			return nil
+		}
+
+		log.Printf("info: Migrating the association to the association table. entries: %d", count)
+
+		// Block the writes by the other servers until migrated
+		if _, err := tx.Exec(`LOCK TABLE entry IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+			return xerrors.Errorf("Failed to lock the entry table. err: %w", err)
+		}
+
+		var dropped []struct {
+			ID    int64  `db:"id"`
+			Name  string `db:"name"`
+			Value string `db:"value"`
+		}
+		err = tx.Select(&dropped, `
+SELECT e.id, n.name, v.value
+FROM entry e
+CROSS JOIN (VALUES ('member'), ('uniqueMember')) AS n(name)
+CROSS JOIN jsonb_array_elements_text(e.attrs_orig -> n.name) AS v(value)
+WHERE
+	jsonb_typeof(e.attrs_orig -> n.name) = 'array'
+	AND CASE
+		WHEN v.value ~ '^[0-9]{1,18}$' THEN NOT EXISTS (SELECT 1 FROM entry m WHERE m.id = CAST(v.value AS bigint))
+		ELSE true
+	END
+`)
+		if err != nil {
+			return xerrors.Errorf("Failed to find the association to drop. err: %w", err)
+		}
+		for _, v := range dropped {
+			log.Printf("warn: Dropped the invalid or missing member in migrating the association. id: %d, name: %s, value: %s", v.ID, v.Name, v.Value)
+		}
+
+		result, err := tx.Exec(`
+INSERT INTO association (name, id, member_id)
+SELECT n.name, e.id, CAST(v.value AS bigint)
+FROM entry e
+CROSS JOIN (VALUES ('member'), ('uniqueMember')) AS n(name)
+CROSS JOIN jsonb_array_elements_text(e.attrs_orig -> n.name) AS v(value)
+WHERE
+	jsonb_typeof(e.attrs_orig -> n.name) = 'array'
+	AND v.value ~ '^[0-9]{1,18}$'
+	AND EXISTS (SELECT 1 FROM entry m WHERE m.id = CAST(v.value AS bigint))
+ON CONFLICT DO NOTHING
+`)
+		if err != nil {
+			return xerrors.Errorf("Failed to migrate the association. err: %w", err)
+		}
+		migrated, _ := result.RowsAffected()
+
+		_, err = tx.Exec(`
+UPDATE
+	entry
+SET
+	attrs_orig = attrs_orig - CAST(ARRAY['member', 'uniqueMember', 'memberOf'] AS text[])
+WHERE
+	attrs_orig ?| CAST(ARRAY['member', 'uniqueMember', 'memberOf'] AS text[])
+`)
+		if err != nil {
+			return xerrors.Errorf("Failed to remove the association from attrs_orig. err: %w", err)
+		}
+
+		log.Printf("info: Migrated the association. entries: %d, associations: %d", count, migrated)
+
+		return nil
+	})
+}
+
+// splitAssociation removes the association attributes from the attributes, then returns the stored ones as ids.
+func splitAssociation(attrsOrig map[string][]string) map[string][]int64 {
+	assoc := map[string][]int64{}
+	for _, name := range storedAssociationAttributes {
+		if v, ok := attrsOrig[name]; ok {
+			assoc[name] = toInt64s(v)
+		}
+	}
+	for _, name := range storedAssociationAttributes {
+		delete(attrsOrig, name)
+	}
+	delete(attrsOrig, "memberOf")
+	return assoc
+}
+
+func toInt64s(values []string) []int64 {
+	ids := make([]int64, 0, len(values))
+	for _, v := range values {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Printf("warn: The association value is not number, ignored. value: %s", v)
+			continue
+		}
+		ids = append(ids, i)
+	}
+	return ids
+}
+
+// addMembers adds the members of the entry in bulk. The existing members are ignored.
+func (r *DefaultRepository) addMembers(ctx context.Context, dbTx *sqlx.Tx, name string, id int64, memberIDs []int64) error {
+	if len(memberIDs) == 0 {
+		return nil
+	}
+	_, err := r.execAffected(dbTx, addAssociation, map[string]interface{}{
+		"name":       name,
+		"id":         id,
+		"member_ids": pq.Array(memberIDs),
+	})
+	if err != nil {
+		if isForeignKeyError(err) {
+			// The member was deleted concurrently
+			return util.NewRetryError(err)
+		}
+		return errors.Wrapf(err, "Failed to add %s. id: %d, members: %v", name, id, memberIDs)
+	}
+	return nil
+}
+
+// removeMembers removes the members of the entry in bulk. The missing members are ignored.
+func (r *DefaultRepository) removeMembers(ctx context.Context, dbTx *sqlx.Tx, name string, id int64, memberIDs []int64) error {
+	if len(memberIDs) == 0 {
+		return nil
+	}
+	_, err := r.execAffected(dbTx, removeAssociation, map[string]interface{}{
+		"name":       name,
+		"id":         id,
+		"member_ids": pq.Array(memberIDs),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to remove %s. id: %d, members: %v", name, id, memberIDs)
+	}
+	return nil
+}
+
+// updateAssociation applies the modification of the association attribute to the association table.
+func (r *DefaultRepository) updateAssociation(ctx context.Context, dbTx *sqlx.Tx, name string, id int64, op *ModOperation) error {
+	if op.IsReplace() || op.IsClear() {
+		_, err := r.execAffected(dbTx, clearAssociation, map[string]interface{}{
+			"name": name,
+			"id":   id,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Failed to clear %s. id: %d", name, id)
+		}
+		return r.addMembers(ctx, dbTx, name, id, toInt64s(op.Replace))
+	}
+	if err := r.removeMembers(ctx, dbTx, name, id, toInt64s(op.Delete)); err != nil {
+		return err
+	}
+	return r.addMembers(ctx, dbTx, name, id, toInt64s(op.Add))
+}
+
+// touchMemberOf increments rev of the entries whose memberOf is changed, then the cache picks up the new memberOf.
+func (r *DefaultRepository) touchMemberOf(ctx context.Context, dbTx *sqlx.Tx, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	updated, err := r.execAffected(dbTx, touchEntries, map[string]interface{}{
+		"ids": pq.Array(ids),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to update memberOf. ids: %v", ids)
+	}
+	if updated != int64(len(ids)) {
+		log.Printf("warn: Detected inconsistency while updating memberOf. ids: %v", ids)
+		return util.NewRetryError(xerrors.Errorf("Detected inconsistency while updating memberOf. ids: %v", ids))
+	}
+	return nil
+}
+
+// UpdateMembers adds and removes the members of the group in bulk.
+// Unlike Update, only the changed members are fetched, so the cost doesn't depend on the size of the group.
+func (r *DefaultRepository) UpdateMembers(ctx context.Context, dn *schema.DN, name string, add, del []*schema.DN) error {
+	reportError := func(err error) error {
+		return errors.Wrapf(err, "Failed to update %s. dn_norm: %s", name, dn.DNNormStr())
+	}
+
+	if err := r.checkCacheReady(); err != nil {
+		return err
+	}
+
+	at, ok := r.schemaRegistry.AttributeType(name)
+	if !ok || !isStoredAssociationAttribute(at.Name) {
+		return util.NewUndefinedType(name)
+	}
+	name = at.Name
+
+	session, err := auth.AuthSessionContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Not authenticated")
+	}
+
+	id, err := r.findEntryID(ctx, dn)
+	if err != nil {
+		return err
+	}
+	addIDs := make([]int64, len(add))
+	for i, v := range add {
+		mid, err := r.findEntryID(ctx, v)
+		if err != nil {
+			if util.IsNoSuchObjectError(err) {
+				return util.NewInvalidPerSyntax(name, i)
+			}
+			return reportError(err)
+		}
+		addIDs[i] = mid
+	}
+	delIDs := make([]int64, len(del))
+	for i, v := range del {
+		mid, err := r.findEntryID(ctx, v)
+		if err != nil {
+			// The member which doesn't exist can't be the value
+			if util.IsNoSuchObjectError(err) {
+				return util.NewNoSuchAttribute("modify/delete", name)
+			}
+			return reportError(err)
+		}
+		delIDs[i] = mid
+	}
+
+	var m *NotifyMessage
+
+	err = withDBTx(ctx, r.db, func(tx *sqlx.Tx) error {
+		var dest struct {
+			Version     int64          `db:"rev"`
+			ObjectClass pq.StringArray `db:"object_class"`
+			Remaining   bool           `db:"remaining"`
+		}
+		err := tx.GetContext(ctx, &dest, `
+SELECT
+	e.rev,
+	ARRAY(SELECT jsonb_array_elements_text(e.attrs_orig -> 'objectClass')) AS object_class,
+	cardinality(CAST($4 AS bigint[])) > 0 OR EXISTS (
+		SELECT 1 FROM association a
+		WHERE a.id = e.id AND a.name = $2 AND a.member_id <> ALL(CAST($3 AS bigint[]))
+	) AS remaining
+FROM entry e
+WHERE
+	e.id = $1
+FOR UPDATE
+`, id, name, pq.Array(delIDs), pq.Array(addIDs))
+		if err != nil {
+			return reportError(err)
+		}
+
+		// The group must allow the attribute, and it must have the required members
+		allowed := false
+		for _, v := range dest.ObjectClass {
+			oc, ok := r.schemaRegistry.ObjectClass(v)
+			if !ok {
+				continue
+			}
+			if oc.Contains(name) {
+				allowed = true
+			}
+			for _, mv := range oc.Must() {
+				if strings.EqualFold(mv, name) && !dest.Remaining {
+					return util.NewObjectClassViolationRequiresAttribute(oc.Name, name)
+				}
+			}
+		}
+		if !allowed {
+			return util.NewObjectClassViolationNotAllowed(name)
+		}
+
+		// Same as the modification of the attribute, the added members must not exist and the removed members must exist
+		var current []int64
+		err = tx.SelectContext(ctx, &current, `
+SELECT a.member_id FROM association a
+WHERE a.id = $1 AND a.name = $2 AND a.member_id = ANY(CAST($3 AS bigint[]))
+`, id, name, pq.Array(append(append([]int64{}, addIDs...), delIDs...)))
+		if err != nil {
+			return reportError(err)
+		}
+		members := util.NewInt64Set(current...)
+		for i, v := range addIDs {
+			if _, ok := members[v]; ok {
+				return util.NewTypeOrValueExists("modify/add", name, i)
+			}
+		}
+		for _, v := range delIDs {
+			if _, ok := members[v]; !ok {
+				return util.NewNoSuchAttribute("modify/delete", name)
+			}
+		}
+
+		if err := r.removeMembers(ctx, tx, name, id, delIDs); err != nil {
+			return err
+		}
+		if err := r.addMembers(ctx, tx, name, id, addIDs); err != nil {
+			return err
+		}
+
+		mn, err := strToJSONText(session.DN.DNOrigEncodedStrWithoutSuffix(r.schemaRegistry.SuffixDN))
+		if err != nil {
+			return reportError(err)
+		}
+		mt, err := strToJSONText(time.Now().In(time.UTC).Format(schema.TIMESTAMP_FORMAT))
+		if err != nil {
+			return reportError(err)
+		}
+		_, err = tx.ExecContext(ctx, `
+UPDATE
+	entry
+SET
+	attrs_orig = attrs_orig || JSONB_BUILD_OBJECT('modifiersName', CAST($2 AS jsonb), 'modifyTimestamp', CAST($3 AS jsonb)),
+	rev = rev + 1
+WHERE
+	id = $1
+`, id, mn, mt)
+		if err != nil {
+			return reportError(err)
+		}
+		if err := r.updateAttrsNorm(ctx, tx, id); err != nil {
+			return reportError(err)
+		}
+
+		// The changed members are cached again with the new memberOf
+		tids := util.NewInt64Set()
+		for _, v := range addIDs {
+			tids.Add(v)
+		}
+		for _, v := range delIDs {
+			tids.Add(v)
+		}
+		if err := r.touchMemberOf(ctx, tx, tids.Values()); err != nil {
+			return err
+		}
+
+		m = &NotifyMessage{
+			Issuer:    r.config.ServerID,
+			ID:        id,
+			Op:        NotifyMod,
+			Rev:       dest.Version + 1,
+			Dependant: tids.Values(),
+		}
+		return r.notify(tx, m)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Handle own notify message now
+	if err := r.OnUpdate(ctx, m); err != nil {
+		return errors.Wrapf(err, "Failed to update cache DB for modifed entry. id: %d, dn_norm: %s", m.ID, dn.DNNormStr())
+	}
+
+	log.Printf("info: Modified %s. dn_norm: %s, add: %d, delete: %d", name, dn.DNNormStr(), len(addIDs), len(delIDs))
+
+	return nil
+}
@@ -10,7 +10,6 @@ import (
 
 	"github.com/cloudldap/cloudldap/schema"
 	"github.com/cloudldap/cloudldap/util"
-	"github.com/restream/reindexer"
 	"golang.org/x/xerrors"
 )
 
@@ -18,6 +17,10 @@ import (
 // The callback is expected checking the credential, account lock status and so on.
 // This is used for BIND operation.
 func (r *DefaultRepository) Bind(ctx context.Context, dn *schema.DN, callback func(current *FetchedCredential) error) error {
+	if err := r.checkCacheReady(); err != nil {
+		return err
+	}
+
 	id, err := r.findEntryID(ctx, dn)
 	if err != nil {
 		return util.NewInvalidCredentials()
@@ -31,10 +34,8 @@ func (r *DefaultRepository) Bind(ctx context.Context, dn *schema.DN, callback fu
 	var pwdAccountLockedTime time.Time
 
 	if len(jsonEntry["pwdAccountLockedTime"]) > 0 {
-		pwdAccountLockedTime, err = time.Parse(schema.TIMESTAMP_FORMAT, jsonEntry.ValueStr("pwdAccountLockedTime")[0])
-		if err != nil {
-			return xerrors.Errorf("Failed to parse pwdAccountLockedTime. dn_orig: %s, err: %w", dn.DNOrigStr(), err)
-		}
+		// The normalized value of generalizedTime is the unix time
+		pwdAccountLockedTime = time.Unix(jsonEntry.ValueInt64("pwdAccountLockedTime")[0], 0).UTC()
 	}
 
 	var lastPwdFailureTime *time.Time
@@ -79,6 +80,7 @@ func (r *DefaultRepository) Bind(ctx context.Context, dn *schema.DN, callback fu
 		PwdAccountLockedTime: &pwdAccountLockedTime,
 		LastPwdFailureTime:   lastPwdFailureTime,
 		PwdFailureCount:      len(jsonEntry["pwdFailureTime"]),
+		Attrs:                jsonEntry,
 	}
 
 	// Call the callback implemented bind logic
@@ -89,11 +91,15 @@ func (r *DefaultRepository) Bind(ctx context.Context, dn *schema.DN, callback fu
 		var lerr *util.LDAPError
 		isLDAPError := xerrors.As(callbackErr, &lerr)
 		if !isLDAPError || !lerr.IsInvalidCredentials() {
-			return err
+			return callbackErr
 		}
 
-		if lerr.IsAccountLocked() {
-			log.Printf("Account is locked, dn_norm: %s", dn.DNNormStr())
+		if lerr.IsAccountUnusable() {
+			log.Printf("Account is unusable, dn_norm: %s, reason: %s", dn.DNNormStr(), lerr.Subtype)
+			return callbackErr
+		}
+		if lerr.IsNetworkRestricted() {
+			// The password isn't checked, so it's not a failure of the password policy
 			return callbackErr
 		}
 
@@ -207,7 +213,7 @@ func (r *DefaultRepository) toDNWithSuffixRDN(ctx context.Context, id int64) (*s
 	for {
 		iter := r.query().
 			Select("parentId", "rdnOrig").
-			WhereInt64("id", reindexer.EQ, id).
+			WhereInt64("id", cacheEQ, id).
 			Limit(1).
 			ExecToJsonCtx(ctx)
 		defer iter.Close()
@@ -257,9 +263,9 @@ func (r *DefaultRepository) toDNWithSuffixRDN(ctx context.Context, id int64) (*s
 func (r *DefaultRepository) findAttrsNormByID(ctx context.Context, id int64) (CacheAttrsNorm, error) {
 	iter := r.query().
 		Select("attrsNorm").
-		WhereInt64("id", reindexer.EQ, id).
+		WhereInt64("id", cacheEQ, id).
 		Limit(1).
-		ExecToJson()
+		ExecToJsonCtx(ctx)
 	defer iter.Close()
 
 	if !iter.Next() {
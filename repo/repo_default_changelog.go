@@ -0,0 +1,312 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"golang.org/x/xerrors"
+)
+
+// The changes are recorded in the entry_change table with the monotonic sequence in the same transaction
+// of the entry, then only the sequence is sent by pg_notify. Each instance fetches the changes since the
+// last applied sequence when it's notified, reconnected or idle, so the lost notifications are caught up.
+// The cache is also reconciled with the rev of the entry table periodically in case the change is missed.
+//
+// The sequence is assigned at insert, but the changes are committed in the different order. So the missing
+// sequence is waited for changeLogGapTimeout, then it's skipped since it may be rollbacked.
+
+const (
+	changeLogBatchSize  = 1000
+	changeLogGapTimeout = time.Minute
+	// The gap which is larger than this isn't waited, it means the changes have been pruned
+	changeLogMaxGap    = 10000
+	changeLogRetention = 24 * time.Hour
+	// The changes are pruned periodically regardless of the reconcile
+	changeLogPruneInterval = time.Hour
+)
+
+var (
+	// changelog
+	findChanges *sqlx.NamedStmt
+)
+
+func (r *DefaultRepository) initChangeLog() error {
+	reportError := func(err error) error {
+		return errors.Wrap(err, "Failed to initialize DB for the changelog")
+	}
+
+	_, err := r.db.Exec(`
+CREATE TABLE IF NOT EXISTS entry_change (
+	seq BIGSERIAL PRIMARY KEY,
+	message JSONB NOT NULL,
+	created TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_entry_change_created ON entry_change (created);
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	findChanges, err = r.db.PrepareNamed(`
+SELECT
+	seq, message
+FROM entry_change
+WHERE
+	seq > :seq
+ORDER BY seq
+LIMIT :limit
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	// Start from the changes in the gap timeout since they may be committed after the cache is loaded.
+	// They are applied again, but it's no-op if the cache already has the same rev.
+	err = r.db.Get(&r.changeSeq, `
+SELECT COALESCE(
+	(SELECT MIN(seq) - 1 FROM entry_change WHERE created > now() - CAST($1 AS interval)),
+	(SELECT MAX(seq) FROM entry_change),
+	0
+)
+`, changeLogGapTimeout.String())
+	if err != nil {
+		return reportError(err)
+	}
+
+	return nil
+}
+
+// changeCursor tracks the applied changes. It's used only by the listener goroutine.
+type changeCursor struct {
+	// All changes less than or equal to last have been applied or skipped
+	last int64
+	// The applied changes greater than last
+	applied util.Int64Set
+	// The first seen time of the missing sequences greater than last
+	gaps map[int64]time.Time
+	// Set when the changes may be lost, then the cache is reconciled
+	lost bool
+}
+
+func newChangeCursor(last int64) *changeCursor {
+	return &changeCursor{
+		last:    last,
+		applied: util.NewInt64Set(),
+		gaps:    map[int64]time.Time{},
+	}
+}
+
+// advance moves last forward while the next sequence has been applied or the gap is expired.
+func (c *changeCursor) advance(now time.Time) {
+	for {
+		next := c.last + 1
+		if _, ok := c.applied[next]; ok {
+			delete(c.applied, next)
+			c.last = next
+			continue
+		}
+		if seen, ok := c.gaps[next]; ok && now.Sub(seen) > changeLogGapTimeout {
+			log.Printf("warn: Skip the missing change. seq: %d", next)
+			delete(c.gaps, next)
+			c.last = next
+			c.lost = true
+			continue
+		}
+		return
+	}
+}
+
+// see marks the missing sequences between from and to exclusively.
+func (c *changeCursor) see(from, to int64, now time.Time) {
+	if to-from > changeLogMaxGap {
+		log.Printf("warn: Detected the pruned changes. from: %d, to: %d", from, to)
+		for s := range c.gaps {
+			if s < to {
+				delete(c.gaps, s)
+			}
+		}
+		for s := range c.applied {
+			if s < to {
+				delete(c.applied, s)
+			}
+		}
+		c.last = to - 1
+		c.lost = true
+		return
+	}
+	for s := from + 1; s < to; s++ {
+		if _, ok := c.applied[s]; ok {
+			continue
+		}
+		if _, ok := c.gaps[s]; !ok {
+			c.gaps[s] = now
+		}
+	}
+}
+
+type dbChange struct {
+	Seq     int64  `db:"seq"`
+	Message []byte `db:"message"`
+}
+
+// catchUp applies the changes since the cursor, then reconciles the cache if the changes may be lost.
+func (r *DefaultRepository) catchUp(ctx context.Context, c *changeCursor) error {
+	from := c.last
+	for {
+		var changes []dbChange
+		err := findChanges.SelectContext(ctx, &changes, map[string]interface{}{
+			"seq":   from,
+			"limit": changeLogBatchSize,
+		})
+		if err != nil {
+			return xerrors.Errorf("Failed to fetch changes. seq: %d, err: %w", from, err)
+		}
+
+		now := time.Now()
+		for _, change := range changes {
+			c.see(from, change.Seq, now)
+			from = change.Seq
+
+			if _, ok := c.applied[change.Seq]; ok || change.Seq <= c.last {
+				continue
+			}
+			delete(c.gaps, change.Seq)
+			c.applied.Add(change.Seq)
+
+			var m NotifyMessage
+			if err := json.Unmarshal(change.Message, &m); err != nil {
+				log.Printf("error: Failed to parse the change. seq: %d, message: %s, err: %v", change.Seq, change.Message, err)
+				c.lost = true
+				continue
+			}
+			if m.Issuer == r.config.ServerID {
+				continue
+			}
+			log.Printf("debug: Received event: %v", m)
+
+			if err := r.OnUpdate(ctx, &m); err != nil {
+				log.Printf("error: Error on update for the change. seq: %d, message: %s, err: %v", change.Seq, change.Message, err)
+				c.lost = true
+			}
+		}
+		c.advance(now)
+
+		if len(changes) < changeLogBatchSize {
+			break
+		}
+	}
+
+	if c.lost {
+		c.lost = false
+		if err := r.Reconcile(ctx); err != nil {
+			c.lost = true
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneChanges deletes the changes older than the retention.
+func (r *DefaultRepository) pruneChanges(ctx context.Context) error {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM entry_change WHERE created < now() - CAST($1 AS interval)`,
+		changeLogRetention.String())
+	if err != nil {
+		return xerrors.Errorf("Failed to prune changes. err: %w", err)
+	}
+	if pruned, err := result.RowsAffected(); err == nil && pruned > 0 {
+		log.Printf("info: Pruned changes: %d", pruned)
+	}
+	return nil
+}
+
+// Reconcile compares the rev of all entries between the cache and DB, then caches the different entries.
+// The cache is scanned before DB, so the entry which isn't in DB has been deleted.
+func (r *DefaultRepository) Reconcile(ctx context.Context) error {
+	if !r.isCacheReady() {
+		log.Printf("info: Skip reconcile cache while loading")
+		return nil
+	}
+
+	log.Printf("info: Starting reconcile cache")
+	start := time.Now()
+
+	type cached struct {
+		Version  int64 `json:"rev"`
+		ParentID int64 `json:"parentId"`
+	}
+	cache := map[int64]cached{}
+
+	iter := r.query().
+		Select("id", "rev", "parentId").
+		ExecToJsonCtx(ctx)
+	for iter.Next() {
+		var dest struct {
+			ID       int64 `json:"id"`
+			Version  int64 `json:"rev"`
+			ParentID int64 `json:"parentId"`
+		}
+		if err := json.Unmarshal(iter.JSON(), &dest); err != nil {
+			iter.Close()
+			return xerrors.Errorf("Unexpected unmarshal error. err: %w", err)
+		}
+		cache[dest.ID] = cached{Version: dest.Version, ParentID: dest.ParentID}
+	}
+	if err := iter.Error(); err != nil {
+		iter.Close()
+		return xerrors.Errorf("Failed to scan cache DB. err: %w", err)
+	}
+	iter.Close()
+
+	var revs []struct {
+		ID      int64 `db:"id"`
+		Version int64 `db:"rev"`
+	}
+	if err := r.db.SelectContext(ctx, &revs, `SELECT id, rev FROM entry WHERE id > 0`); err != nil {
+		return xerrors.Errorf("Failed to fetch rev of entries. err: %w", err)
+	}
+
+	updated := []int64{}
+	for _, v := range revs {
+		if c, ok := cache[v.ID]; !ok || v.Version > c.Version {
+			updated = append(updated, v.ID)
+		}
+		delete(cache, v.ID)
+	}
+	// The root of root isn't fetched
+	delete(cache, 0)
+
+	if len(updated) == 0 && len(cache) == 0 {
+		log.Printf("info: Reconciled cache: %v, no differences", time.Since(start))
+		return nil
+	}
+
+	err := r.withTx(ctx, func(cacheTx CacheTx, dbTx *sqlx.Tx) error {
+		for _, id := range updated {
+			if err := r.CacheEntryByID(ctx, cacheTx, dbTx, id, false); err != nil {
+				if xerrors.Is(err, sql.ErrNoRows) {
+					// Deleted after the scan
+					continue
+				}
+				return errors.Wrapf(err, "Failed to cache the entry. id: %d", id)
+			}
+		}
+		for id, c := range cache {
+			if _, err := r.DeleteCacheEntry(ctx, cacheTx, dbTx, id, c.ParentID, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("Failed to reconcile cache. err: %w", err)
+	}
+
+	log.Printf("warn: Reconciled cache: %v, updated: %d, deleted: %d", time.Since(start), len(updated), len(cache))
+	return nil
+}
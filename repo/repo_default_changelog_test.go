@@ -0,0 +1,75 @@
+//go:build test
+
+package repo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChangeCursor(t *testing.T) {
+	now := time.Now()
+
+	apply := func(c *changeCursor, from int64, seqs ...int64) {
+		for _, seq := range seqs {
+			c.see(from, seq, now)
+			from = seq
+			delete(c.gaps, seq)
+			c.applied.Add(seq)
+		}
+	}
+
+	t.Run("contiguous", func(t *testing.T) {
+		c := newChangeCursor(10)
+		apply(c, 10, 11, 12, 13)
+		c.advance(now)
+
+		if c.last != 13 || len(c.applied) != 0 || len(c.gaps) != 0 || c.lost {
+			t.Errorf("Unexpected cursor: %+v", c)
+		}
+	})
+
+	t.Run("wait for gap", func(t *testing.T) {
+		c := newChangeCursor(10)
+		apply(c, 10, 11, 13, 14)
+		c.advance(now)
+
+		if c.last != 11 || len(c.applied) != 2 || len(c.gaps) != 1 || c.lost {
+			t.Errorf("Unexpected cursor: %+v", c)
+		}
+
+		// The missing change is committed later
+		apply(c, 11, 12)
+		c.advance(now)
+
+		if c.last != 14 || len(c.applied) != 0 || len(c.gaps) != 0 || c.lost {
+			t.Errorf("Unexpected cursor: %+v", c)
+		}
+	})
+
+	t.Run("expired gap", func(t *testing.T) {
+		c := newChangeCursor(10)
+		apply(c, 10, 11, 13)
+		c.advance(now)
+
+		c.advance(now.Add(changeLogGapTimeout / 2))
+		if c.last != 11 || c.lost {
+			t.Errorf("Unexpected cursor: %+v", c)
+		}
+
+		c.advance(now.Add(changeLogGapTimeout + time.Second))
+		if c.last != 13 || len(c.applied) != 0 || len(c.gaps) != 0 || !c.lost {
+			t.Errorf("Unexpected cursor: %+v", c)
+		}
+	})
+
+	t.Run("pruned", func(t *testing.T) {
+		c := newChangeCursor(10)
+		apply(c, 10, 11, 11+changeLogMaxGap+1)
+		c.advance(now)
+
+		if c.last != 11+changeLogMaxGap+1 || len(c.applied) != 0 || len(c.gaps) != 0 || !c.lost {
+			t.Errorf("Unexpected cursor: last: %d, applied: %d, gaps: %d, lost: %v", c.last, len(c.applied), len(c.gaps), c.lost)
+		}
+	})
+}
@@ -16,6 +16,10 @@ import (
 
 // DeleteByDN deletes the entry by specified DN.
 func (r *DefaultRepository) DeleteByDN(ctx context.Context, dn *schema.DN) error {
+	if err := r.checkCacheReady(); err != nil {
+		return err
+	}
+
 	var m *NotifyMessage
 
 	// Insert DB
@@ -113,67 +117,25 @@ func (r *DefaultRepository) deleteInternal(ctx context.Context, dbTx *sqlx.Tx, d
 	}
 
 	// Step 5: Delete association
-	// Update association if the deleted entry has association
+	// The association of the deleted entry is deleted by the foreign key,
+	// update rev of the target entries (memberOf) and the groups (member/uniqueMember) to cache them again
 	attrsOrigMap := map[string][]string{}
 
 	if err := dbEntry.AttrsOrig.Unmarshal(&attrsOrigMap); err != nil {
 		return reportError(err)
 	}
 
-	// Delete memberOf of the target entries
-	mids := util.NewSetString()
-	for _, v := range attrsOrigMap["member"] {
-		mids.Add(v)
-	}
-	for _, v := range attrsOrigMap["uniqueMember"] {
-		mids.Add(v)
-	}
-	if err := r.deleteMemberOf(ctx, dbTx, mids.List(), id); err != nil {
-		return reportError(err)
-	}
-
-	// Delete member/uniqueMember of the target entries
-	memids := attrsOrigMap["memberOf"]
-	if len(memids) > 0 {
-
-		q, args, err := sqlx.Named(`
-UPDATE entry
-SET
-	attrs_orig = JSONB_SET(
-		JSONB_SET(attrs_orig, ARRAY['member'], COALESCE((attrs_orig->'member')::::jsonb, '[]'::::jsonb) - :(member_of_id)::::text),
-		ARRAY['uniqueMember'], COALESCE((attrs_orig->'uniqueMember')::::jsonb, '[]'::::jsonb) - :(member_of_id)::::text
-	),
-	rev = rev + 1
-WHERE id IN (:id)
-		`, map[string]interface{}{
-			"member_of_id": id,
-			"id":           memids,
-		})
-		if err != nil {
-			return reportError(err)
-		}
-
-		q, args, err = sqlx.In(q, args...)
-		if err != nil {
-			return reportError(err)
-		}
-
-		q = dbTx.Rebind(q)
-
-		result, err := dbTx.Exec(q, args...)
-		if err != nil {
-			return reportError(err)
-		}
-		updated, err := result.RowsAffected()
-		if err != nil {
-			return reportError(err)
-		}
-
-		if updated != int64(len(memids)) {
-			log.Printf("warn: Detected inconsistency while removing member. dn_norm: %s", dn.DNNormStr())
-			return nil, util.NewRetryError(err)
+	tids := util.NewInt64Set()
+	for _, name := range []string{"member", "uniqueMember", "memberOf"} {
+		for _, v := range toInt64s(attrsOrigMap[name]) {
+			tids.Add(v)
 		}
 	}
+	// The entry might be the member of itself
+	delete(tids, id)
+	if err := r.touchMemberOf(ctx, dbTx, tids.Values()); err != nil {
+		return nil, err
+	}
 
 	// Step 6: Update parent if no children
 	dep := []int64{}
@@ -14,6 +14,10 @@ import (
 
 // Insert creates the entry by specified entry data.
 func (r *DefaultRepository) Insert(ctx context.Context, changelog *Changelog) (int64, error) {
+	if err := r.checkCacheReady(); err != nil {
+		return -1, err
+	}
+
 	var m *NotifyMessage
 
 	// Insert DB
@@ -53,6 +57,10 @@ func (r *DefaultRepository) insertRootInternal(ctx context.Context, tx *sqlx.Tx,
 	if err != nil {
 		return reportError(err)
 	}
+	attrsNorm, err := toAttrsNorm(r.schemaRegistry, attrsOrig)
+	if err != nil {
+		return reportError(err)
+	}
 
 	newEntry := &DBEntry{
 		Version:     1,
@@ -69,6 +77,7 @@ func (r *DefaultRepository) insertRootInternal(ctx context.Context, tx *sqlx.Tx,
 		"rdn_norm":   newEntry.RDNNorm,
 		"rdn_orig":   newEntry.RDNOrig,
 		"attrs_orig": newEntry.AttrsOrig,
+		"attrs_norm": attrsNorm,
 	})
 	if err != nil {
 		if isDuplicateKeyError(err) {
@@ -170,10 +179,16 @@ func (r *DefaultRepository) insertInternal(ctx context.Context, tx *sqlx.Tx, cha
 	if err := convAssoc("uniqueMember"); err != nil {
 		return reportError(err)
 	}
+	// The association is stored in the association table
+	assoc := splitAssociation(attrsOrig)
 	bOrig, err := json.Marshal(attrsOrig)
 	if err != nil {
 		return reportError(err)
 	}
+	attrsNorm, err := toAttrsNorm(r.schemaRegistry, attrsOrig)
+	if err != nil {
+		return reportError(err)
+	}
 	newEntry := &DBEntry{
 		Version:     1,
 		ParentID:    pid,
@@ -192,6 +207,7 @@ func (r *DefaultRepository) insertInternal(ctx context.Context, tx *sqlx.Tx, cha
 		"rdn_norm":   newEntry.RDNNorm,
 		"rdn_orig":   newEntry.RDNOrig,
 		"attrs_orig": newEntry.AttrsOrig,
+		"attrs_norm": attrsNorm,
 	})
 	if err != nil {
 		if isDuplicateKeyError(err) {
@@ -203,10 +219,15 @@ func (r *DefaultRepository) insertInternal(ctx context.Context, tx *sqlx.Tx, cha
 	// Don't forget store generated new ID!!
 	newEntry.ID = newID
 
-	// Step 6: Update association if it has association
-	// If the inserted entry has association (e.g. member attribute), update memberOf attribute of the target entries.
-	mids := tids.List()
-	if err := r.addMemberOf(ctx, tx, mids, newID); err != nil {
+	// Step 6: Insert association if it has association
+	// If the inserted entry has association (e.g. member attribute), update rev of the target entries for memberOf.
+	for _, name := range storedAssociationAttributes {
+		if err := r.addMembers(ctx, tx, name, newID, assoc[name]); err != nil {
+			return reportError(err)
+		}
+	}
+	mids := toInt64s(tids.List())
+	if err := r.touchMemberOf(ctx, tx, mids); err != nil {
 		return reportError(err)
 	}
 
@@ -10,14 +10,13 @@ import (
 
 	"github.com/cloudldap/cloudldap/schema"
 	"github.com/pkg/errors"
-	"github.com/restream/reindexer"
 	"golang.org/x/xerrors"
 )
 
 type FilterContext struct {
 	context.Context
-	tx *reindexer.Tx
-	q  *reindexer.Query
+	tx CacheTx
+	q  CacheQuery
 }
 
 // Search handles search request by filter.
@@ -27,6 +26,10 @@ func (r *DefaultRepository) Search(ctx context.Context, baseDN *schema.DN, optio
 		return 0, 0, errors.Wrapf(err, "dn_norm: %s, filter: %v", baseDN.DNNormStr(), option.Filter)
 	}
 
+	if r.useSQLSearch() {
+		return r.searchBySQL(ctx, baseDN, option, handler)
+	}
+
 	cacheTx, err := r.beginCacheTX()
 	if err != nil {
 		return reportError(err)
@@ -52,10 +55,10 @@ func (r *DefaultRepository) Search(ctx context.Context, baseDN *schema.DN, optio
 	switch option.Scope {
 	// Base only
 	case 0:
-		q.WhereInt64("id", reindexer.EQ, baseDNID)
+		q.WhereInt64("id", cacheEQ, baseDNID)
 	// Childlen only
 	case 1:
-		q.WhereInt64("parentId", reindexer.EQ, baseDNID)
+		q.WhereInt64("parentId", cacheEQ, baseDNID)
 	// Base + Children including grandchildren
 	case 2:
 		pids, err := r.findChildContainerIDs(ctx, cacheTx, baseDNID)
@@ -64,10 +67,10 @@ func (r *DefaultRepository) Search(ctx context.Context, baseDN *schema.DN, optio
 		}
 
 		q.OpenBracket().
-			WhereInt64("id", reindexer.EQ, baseDNID)
+			WhereInt64("id", cacheEQ, baseDNID)
 		if len(pids) > 0 {
 			q.Or().
-				WhereInt64("parentId", reindexer.EQ, pids...).
+				WhereInt64("parentId", cacheEQ, pids...).
 				CloseBracket()
 		} else {
 			q.CloseBracket()
@@ -79,9 +82,9 @@ func (r *DefaultRepository) Search(ctx context.Context, baseDN *schema.DN, optio
 			return reportError(err)
 		}
 		if len(pids) > 0 {
-			q.WhereInt64("parentId", reindexer.EQ, pids...)
+			q.WhereInt64("parentId", cacheEQ, pids...)
 		} else {
-			q.Where("dummy", reindexer.EQ, "dummy")
+			q.Where("dummy", cacheEQ, "dummy")
 		}
 	}
 
@@ -151,7 +154,7 @@ type RDNCache struct {
 	RDNOrig  string `json:"rdnOrig"`
 }
 
-func (r *DefaultRepository) toDNOrigs(ctx context.Context, cacheTx *reindexer.Tx, ids []string) ([]string, error) {
+func (r *DefaultRepository) toDNOrigs(ctx context.Context, cacheTx CacheTx, ids []string) ([]string, error) {
 	if len(ids) == 0 {
 		return nil, nil
 	}
@@ -168,7 +171,7 @@ func (r *DefaultRepository) toDNOrigs(ctx context.Context, cacheTx *reindexer.Tx
 
 	iter := cacheTx.Query().
 		Select("id", "rdnOrig", "parentId").
-		WhereString("id", reindexer.SET, ids...).
+		WhereString("id", cacheSET, ids...).
 		ExecToJsonCtx(ctx)
 	defer iter.Close()
 
@@ -207,7 +210,7 @@ func (r *DefaultRepository) toDNOrigWithSuffixRDN(ctx context.Context, id int64)
 	for {
 		iter := r.query().
 			Select("parentId", "rdnOrig").
-			WhereInt64("id", reindexer.EQ, id).
+			WhereInt64("id", cacheEQ, id).
 			Limit(1).
 			ExecToJsonCtx(ctx)
 		defer iter.Close()
@@ -254,7 +257,7 @@ func (r *DefaultRepository) toDNOrigWithSuffixRDN(ctx context.Context, id int64)
 	return dn, nil
 }
 
-func (r *DefaultRepository) toDNOrig(ctx context.Context, cacheTx *reindexer.Tx, rdn *RDNCache) (string, error) {
+func (r *DefaultRepository) toDNOrig(ctx context.Context, cacheTx CacheTx, rdn *RDNCache) (string, error) {
 	// start := time.Now()
 	// defer func() {
 	// 	elapsed := time.Since(start)
@@ -283,7 +286,7 @@ func (r *DefaultRepository) toDNOrig(ctx context.Context, cacheTx *reindexer.Tx,
 
 		iter := cacheTx.Query().
 			Select("parentId", "rdnOrig").
-			WhereInt64("id", reindexer.EQ, nextID).
+			WhereInt64("id", cacheEQ, nextID).
 			Limit(1).
 			ExecToJsonCtx(ctx)
 		defer iter.Close()
@@ -324,11 +327,11 @@ func (r *DefaultRepository) toDNOrig(ctx context.Context, cacheTx *reindexer.Tx,
 	return dn, nil
 }
 
-func (r *DefaultRepository) findChildContainerIDs(ctx context.Context, cacheTx *reindexer.Tx, id int64) ([]int64, error) {
+func (r *DefaultRepository) findChildContainerIDs(ctx context.Context, cacheTx CacheTx, id int64) ([]int64, error) {
 	pids := []int64{}
 	iter := cacheTx.Query().
 		Select("id").
-		WhereInt64("path", reindexer.SET, id).
+		WhereInt64("path", cacheSET, id).
 		ExecToJsonCtx(ctx)
 	defer iter.Close()
 	for iter.Next() {
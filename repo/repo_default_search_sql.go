@@ -0,0 +1,610 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"golang.org/x/xerrors"
+)
+
+// The search mode of the postgres backend.
+// "cache" serves the searches from the cache DB, this is the default.
+// "sql" serves the searches from PostgreSQL (or the read replica) by SQLFilterTranslator.
+// "hybrid" serves the searches by SQL while the cache DB is warming, then switches to the cache DB.
+// The other operations always use the cache DB, so they are unavailable while it's warming.
+const (
+	SearchModeCache  = "cache"
+	SearchModeSQL    = "sql"
+	SearchModeHybrid = "hybrid"
+)
+
+const (
+	// sqlSearchMigrationLockID is the advisory lock to run the migration for the search by SQL by one server at a time
+	sqlSearchMigrationLockID = 0x636c6401
+	// attrsNormMigrationBatchSize is the number of the entries normalized in a batch
+	attrsNormMigrationBatchSize = 1000
+)
+
+var (
+	// select for the search by SQL, they are prepared with the read DB
+	findEntryIDByRDNNorm      *sqlx.NamedStmt
+	findRDNOrigsByContainerID *sqlx.NamedStmt
+	findRDNOrigsByIDs         *sqlx.NamedStmt
+)
+
+func isValidSearchMode(mode string) bool {
+	return mode == "" || mode == SearchModeCache || mode == SearchModeSQL || mode == SearchModeHybrid
+}
+
+// initSQLSearch migrates attrs_norm and creates the indexes for SQLFilterTranslator, then prepares the statements.
+func (r *DefaultRepository) initSQLSearch() error {
+	reportError := func(err error) error {
+		return errors.Wrap(err, "Failed to initialize DB for the search by SQL")
+	}
+
+	if err := r.migrateSQLSearch(context.Background()); err != nil {
+		return reportError(err)
+	}
+
+	var err error
+	findEntryIDByRDNNorm, err = r.readDB.PrepareNamed(`
+SELECT
+	e.id
+FROM entry e
+WHERE
+	e.parent_id = :parent_id
+	AND e.rdn_norm = :rdn_norm
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	// The path of the container is the IDs from the suffix to itself
+	findRDNOrigsByContainerID, err = r.readDB.PrepareNamed(`
+SELECT
+	a.parent_id, a.rdn_orig
+FROM entry e
+CROSS JOIN LATERAL unnest(e.path) WITH ORDINALITY AS x(id, ord)
+JOIN entry a ON a.id = x.id
+WHERE
+	e.id = :id
+ORDER BY x.ord DESC
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	findRDNOrigsByIDs, err = r.readDB.PrepareNamed(`
+SELECT
+	e.id, e.parent_id, e.rdn_orig
+FROM entry e
+WHERE
+	e.id = ANY(:ids)
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	return nil
+}
+
+// migrateSQLSearch fills attrs_norm of the existing entries, then creates the indexes without blocking the writes.
+// It holds the advisory lock while migrating, so the other servers wait for it instead of dropping the index being built.
+func (r *DefaultRepository) migrateSQLSearch(ctx context.Context) error {
+	conn, err := r.db.Connx(ctx)
+	if err != nil {
+		return xerrors.Errorf("Failed to get the connection. err: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, sqlSearchMigrationLockID); err != nil {
+		return xerrors.Errorf("Failed to get the migration lock. err: %w", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, sqlSearchMigrationLockID)
+
+	if err := r.migrateAttrsNorm(ctx, conn); err != nil {
+		return err
+	}
+
+	indexes := []struct {
+		name string
+		def  string
+	}{
+		{"idx_entry_attrs_norm", `entry USING GIN (attrs_norm)`},
+		{"idx_entry_path", `entry USING GIN (path)`},
+	}
+	for _, index := range indexes {
+		// The failed concurrent build leaves the invalid index, it must be rebuilt
+		var valid bool
+		err := conn.GetContext(ctx, &valid, `SELECT i.indisvalid FROM pg_index i WHERE i.indexrelid = to_regclass(CAST($1 AS text))`, index.name)
+		if err != nil && !isNoResult(err) {
+			return xerrors.Errorf("Failed to check the index. name: %s, err: %w", index.name, err)
+		}
+		if err == nil && !valid {
+			log.Printf("warn: Rebuilding the invalid index. name: %s", index.name)
+			if _, err := conn.ExecContext(ctx, `DROP INDEX CONCURRENTLY IF EXISTS `+index.name); err != nil {
+				return xerrors.Errorf("Failed to drop the invalid index. name: %s, err: %w", index.name, err)
+			}
+		}
+
+		// CONCURRENTLY can't run in the transaction, so each statement is executed one by one
+		if _, err := conn.ExecContext(ctx, `CREATE INDEX CONCURRENTLY IF NOT EXISTS `+index.name+` ON `+index.def); err != nil {
+			return xerrors.Errorf("Failed to create the index. name: %s, err: %w", index.name, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateAttrsNorm fills attrs_norm of the entries stored before it's introduced.
+// The entry updated while migrating is skipped because the update stores attrs_norm too.
+func (r *DefaultRepository) migrateAttrsNorm(ctx context.Context, conn *sqlx.Conn) error {
+	var last int64
+	migrated := 0
+
+	for {
+		var dest []struct {
+			ID        int64          `db:"id"`
+			Version   int64          `db:"rev"`
+			AttrsOrig types.JSONText `db:"attrs_orig"`
+		}
+		err := sqlx.SelectContext(ctx, conn, &dest, `
+SELECT
+	e.id, e.rev, e.attrs_orig
+FROM entry e
+WHERE
+	e.id > $1
+	AND e.attrs_norm IS NULL
+ORDER BY e.id
+LIMIT $2
+`, last, attrsNormMigrationBatchSize)
+		if err != nil {
+			return xerrors.Errorf("Failed to fetch the entries to migrate attrs_norm. err: %w", err)
+		}
+		if len(dest) == 0 {
+			break
+		}
+		last = dest[len(dest)-1].ID
+
+		ids := make([]int64, 0, len(dest))
+		revs := make([]int64, 0, len(dest))
+		norms := make([]string, 0, len(dest))
+		for _, e := range dest {
+			var attrsOrig map[string][]string
+			if err := e.AttrsOrig.Unmarshal(&attrsOrig); err != nil {
+				log.Printf("warn: Skipped the entry which has invalid attrs_orig. id: %d, err: %v", e.ID, err)
+				continue
+			}
+			norm, err := toAttrsNorm(r.schemaRegistry, attrsOrig)
+			if err != nil {
+				log.Printf("warn: Skipped the entry which can't be normalized. id: %d, err: %v", e.ID, err)
+				continue
+			}
+			ids = append(ids, e.ID)
+			revs = append(revs, e.Version)
+			norms = append(norms, string(norm))
+		}
+
+		result, err := conn.ExecContext(ctx, `
+UPDATE
+	entry e
+SET
+	attrs_norm = CAST(x.norm AS jsonb)
+FROM unnest(CAST($1 AS bigint[]), CAST($2 AS bigint[]), CAST($3 AS text[])) AS x(id, rev, norm)
+WHERE
+	e.id = x.id
+	AND e.rev = x.rev
+`, pq.Array(ids), pq.Array(revs), pq.Array(norms))
+		if err != nil {
+			return xerrors.Errorf("Failed to migrate attrs_norm. err: %w", err)
+		}
+		n, _ := result.RowsAffected()
+		migrated += int(n)
+	}
+
+	if migrated > 0 {
+		log.Printf("info: Migrated attrs_norm for the search by SQL. entries: %d", migrated)
+	}
+	return nil
+}
+
+// toAttrsNorm normalizes the attributes for attrs_norm, the values are the same as attrsNorm of the cache DB.
+// The association isn't included because it's stored in the association table.
+func toAttrsNorm(sr *schema.SchemaRegistry, attrsOrig map[string][]string) (types.JSONText, error) {
+	attrsNorm := make(map[string][]string, len(attrsOrig))
+	for k, v := range attrsOrig {
+		if isAssociationAttribute(k) {
+			continue
+		}
+		sv, err := schema.NewSchemaValue(sr, k, v)
+		if err != nil {
+			return nil, xerrors.Errorf("Unexpected schema error. name: %s, value: %v, err: %w", k, v, err)
+		}
+		if err := sv.Normalize(); err != nil {
+			return nil, xerrors.Errorf("Unexpected normalization error. name: %s, value: %v, err: %w", k, v, err)
+		}
+		attrsNorm[sv.Name()] = sv.NormStr()
+	}
+
+	b, err := json.Marshal(attrsNorm)
+	if err != nil {
+		return nil, xerrors.Errorf("Unexpected marshal error. err: %w", err)
+	}
+	return types.JSONText(b), nil
+}
+
+// updateAttrsNorm stores attrs_norm of the entries updated in the transaction.
+// It's used after attrs_orig is updated by SQL, the new values aren't known without fetching them.
+func (r *DefaultRepository) updateAttrsNorm(ctx context.Context, dbTx *sqlx.Tx, ids ...int64) error {
+	var dest []struct {
+		ID        int64          `db:"id"`
+		AttrsOrig types.JSONText `db:"attrs_orig"`
+	}
+	err := dbTx.SelectContext(ctx, &dest, `SELECT e.id, e.attrs_orig FROM entry e WHERE e.id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return xerrors.Errorf("Failed to fetch attrs_orig. ids: %v, err: %w", ids, err)
+	}
+
+	nids := make([]int64, len(dest))
+	norms := make([]string, len(dest))
+	for i, e := range dest {
+		var attrsOrig map[string][]string
+		if err := e.AttrsOrig.Unmarshal(&attrsOrig); err != nil {
+			return xerrors.Errorf("Unexpected unmarshal error. id: %d, err: %w", e.ID, err)
+		}
+		norm, err := toAttrsNorm(r.schemaRegistry, attrsOrig)
+		if err != nil {
+			return err
+		}
+		nids[i] = e.ID
+		norms[i] = string(norm)
+	}
+
+	_, err = dbTx.ExecContext(ctx, `
+UPDATE
+	entry e
+SET
+	attrs_norm = CAST(x.norm AS jsonb)
+FROM unnest(CAST($1 AS bigint[]), CAST($2 AS text[])) AS x(id, norm)
+WHERE
+	e.id = x.id
+`, pq.Array(nids), pq.Array(norms))
+	if err != nil {
+		return xerrors.Errorf("Failed to update attrs_norm. ids: %v, err: %w", ids, err)
+	}
+	return nil
+}
+
+func (r *DefaultRepository) isCacheReady() bool {
+	return atomic.LoadInt32(&r.cacheReady) == 1
+}
+
+func (r *DefaultRepository) setCacheReady(ready bool) {
+	if ready {
+		atomic.StoreInt32(&r.cacheReady, 1)
+	} else {
+		atomic.StoreInt32(&r.cacheReady, 0)
+	}
+}
+
+// checkCacheReady returns unavailable error if the cache DB is warming.
+func (r *DefaultRepository) checkCacheReady() error {
+	if !r.isCacheReady() {
+		log.Printf("warn: The cache DB is warming, the operation is unavailable")
+		return util.NewUnavailable()
+	}
+	return nil
+}
+
+func (r *DefaultRepository) useSQLSearch() bool {
+	switch r.config.SearchMode {
+	case SearchModeSQL:
+		return true
+	case SearchModeHybrid:
+		return !r.isCacheReady()
+	}
+	return false
+}
+
+// searchBySQL handles search request by SQL without the cache DB.
+func (r *DefaultRepository) searchBySQL(ctx context.Context, baseDN *schema.DN, option *SearchOption, handler func(entry *SearchEntry) error) (int32, int32, error) {
+	reportError := func(err error) (int32, int32, error) {
+		return 0, 0, errors.Wrapf(err, "dn_norm: %s, filter: %v", baseDN.DNNormStr(), option.Filter)
+	}
+
+	baseDNID, err := r.findEntryIDBySQL(ctx, baseDN)
+	if err != nil {
+		// It's ok returning NoSuchObject error if no base DN
+		return reportError(err)
+	}
+
+	translator := newSQLFilterTranslator(r)
+
+	var where strings.Builder
+	where.Grow(256)
+
+	switch option.Scope {
+	// Base only
+	case 0:
+		where.WriteString(`e.id = `)
+		where.WriteString(translator.bind(baseDNID))
+	// Childlen only
+	case 1:
+		where.WriteString(`e.parent_id = `)
+		where.WriteString(translator.bind(baseDNID))
+	// Base + Children including grandchildren
+	case 2:
+		where.WriteString(`(e.id = `)
+		where.WriteString(translator.bind(baseDNID))
+		where.WriteString(` OR e.parent_id IN (SELECT c.id FROM entry c WHERE c.path @> `)
+		where.WriteString(translator.bind(pq.Array([]int64{baseDNID})))
+		where.WriteString(`))`)
+	// Children including grandchildren
+	case 3:
+		where.WriteString(`e.parent_id IN (SELECT c.id FROM entry c WHERE c.path @> `)
+		where.WriteString(translator.bind(pq.Array([]int64{baseDNID})))
+		where.WriteString(`)`)
+	default:
+		writeFalse(&where)
+	}
+
+	where.WriteString(` AND `)
+	if err := translator.translate(ctx, r.schemaRegistry, option.Filter, &where); err != nil {
+		return reportError(err)
+	}
+
+	q := `
+SELECT
+	e.id, e.parent_id, e.is_container, e.rdn_orig, ` + attrsOrigWithAssociation + ` AS attrs_orig, COUNT(*) OVER() AS total
+FROM entry e
+WHERE
+	` + where.String() + `
+ORDER BY e.id`
+	if option.PageSize > 0 {
+		q += ` LIMIT :limit`
+		translator.params["limit"] = option.PageSize
+	}
+	if option.Offset > 0 {
+		q += ` OFFSET :offset`
+		translator.params["offset"] = option.Offset
+	}
+
+	rows, err := r.readDB.NamedQueryContext(ctx, q, translator.params)
+	if err != nil {
+		return reportError(err)
+	}
+
+	// Fetch all rows of the page before resolving DNs, it needs the other connection
+	type searchRow struct {
+		DBEntry
+		Total int32 `db:"total"`
+	}
+	var dest []searchRow
+	for rows.Next() {
+		var row searchRow
+		if err := rows.StructScan(&row); err != nil {
+			rows.Close()
+			return reportError(err)
+		}
+		dest = append(dest, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return reportError(err)
+	}
+
+	var maxCnt int32
+	if len(dest) > 0 {
+		maxCnt = dest[0].Total
+	} else if option.Offset > 0 {
+		// The total isn't returned if the offset is over it
+		cq := `SELECT COUNT(*) AS total FROM entry e WHERE ` + where.String()
+		rows, err := r.readDB.NamedQueryContext(ctx, cq, translator.params)
+		if err != nil {
+			return reportError(err)
+		}
+		if rows.Next() {
+			err = rows.Scan(&maxCnt)
+		}
+		rows.Close()
+		if err != nil {
+			return reportError(err)
+		}
+	}
+
+	for _, row := range dest {
+		dnOrig, err := r.toDNOrigBySQL(ctx, row.ParentID, row.RDNOrig)
+		if err != nil {
+			return reportError(err)
+		}
+
+		var attrsOrig CacheAttrsOrig
+		if err := row.AttrsOrig.Unmarshal(&attrsOrig); err != nil {
+			return reportError(xerrors.Errorf("Unexpected unmarshal error. id: %d, err: %w", row.ID, err))
+		}
+
+		entry := NewSearchEntry(r.schemaRegistry, dnOrig, attrsOrig)
+
+		if option.IsHasSubordinatesRequested {
+			entry.AttrsOrig()["hasSubordinates"] = []string{strings.ToUpper(strconv.FormatBool(row.IsContainer))}
+		}
+		if option.IsMemberOfRequested {
+			m, err := r.toDNOrigsBySQL(ctx, entry.AttrsOrig()["memberOf"])
+			if err != nil {
+				return reportError(err)
+			}
+			entry.AttrsOrig()["memberOf"] = m
+		}
+		for _, v := range option.RequestedAssocation {
+			m, err := r.toDNOrigsBySQL(ctx, entry.AttrsOrig()[v])
+			if err != nil {
+				return reportError(err)
+			}
+			entry.AttrsOrig()[v] = m
+		}
+
+		if err := handler(entry); err != nil {
+			return reportError(err)
+		}
+	}
+
+	return maxCnt, int32(len(dest)), nil
+}
+
+// findEntryIDBySQL is the same as findEntryID, but it doesn't use the cache DB.
+func (r *DefaultRepository) findEntryIDBySQL(ctx context.Context, dn *schema.DN) (int64, error) {
+	var rdnNorms []string
+
+	if dn.IsSuffix(r.schemaRegistry.SuffixDN) {
+		// To support multiple base DN
+		rdnNorms = []string{dn.RDNNormStr()}
+	} else {
+		size := dn.LevelWithoutSuffix(r.schemaRegistry.SuffixDN) + 1
+		rdnNorms = make([]string, size)
+
+		for i := 0; i < size; i++ {
+			rdnNorms[i] = dn.RDNNormStr()
+			dn = dn.ParentDN()
+		}
+	}
+
+	dnCache, _ := ctx.Value(schema.DNCacheContextKey).(*schema.DNCache)
+
+	var id int64 = 0
+	var dnNorm string
+
+	for i := len(rdnNorms) - 1; i >= 0; i-- {
+		if i == len(rdnNorms)-1 {
+			dnNorm = rdnNorms[i]
+		} else {
+			dnNorm = rdnNorms[i] + "," + dnNorm
+		}
+		if cid, ok := dnCache.Atoi[dnNorm]; ok {
+			// Cached
+			id = cid
+			continue
+		}
+
+		var dest int64
+		err := findEntryIDByRDNNorm.GetContext(ctx, &dest, map[string]interface{}{
+			"parent_id": id,
+			"rdn_norm":  rdnNorms[i],
+		})
+		if err != nil {
+			if isNoResult(err) {
+				return -1, util.NewNoSuchObject()
+			}
+			return -1, xerrors.Errorf("Failed to fetch by parent_id = %d and rdn_norm = %s. err: %w", id, rdnNorms[i], err)
+		}
+		id = dest
+
+		// Cache container DN
+		// Don't cache entry which isn't container
+		if i > 0 {
+			dnCache.Atoi[dnNorm] = id
+		}
+	}
+
+	return id, nil
+}
+
+// toDNOrigBySQL returns the DN of the entry from the parent ID and the RDN.
+func (r *DefaultRepository) toDNOrigBySQL(ctx context.Context, parentID int64, rdnOrig string) (string, error) {
+	// It's Root
+	if parentID == 0 {
+		// TODO Support multiple suffix
+		return r.schemaRegistry.Config.Suffix, nil
+	}
+
+	dnCache, _ := ctx.Value(schema.DNCacheContextKey).(*schema.DNCache)
+	if pdn, ok := dnCache.Itoao[parentID]; ok {
+		return rdnOrig + "," + pdn, nil
+	}
+
+	rows, err := findRDNOrigsByContainerID.QueryxContext(ctx, map[string]interface{}{
+		"id": parentID,
+	})
+	if err != nil {
+		return "", xerrors.Errorf("Failed to fetch RDNs of the container. id: %d, err: %w", parentID, err)
+	}
+	defer rows.Close()
+
+	rdns := []string{}
+	for rows.Next() {
+		var dest struct {
+			ParentID int64  `db:"parent_id"`
+			RDNOrig  string `db:"rdn_orig"`
+		}
+		if err := rows.StructScan(&dest); err != nil {
+			return "", xerrors.Errorf("Unexpected struct scan error. id: %d, err: %w", parentID, err)
+		}
+		if dest.ParentID == 0 {
+			// TODO Support multiple suffix
+			rdns = append(rdns, r.schemaRegistry.Config.Suffix)
+		} else {
+			rdns = append(rdns, dest.RDNOrig)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", xerrors.Errorf("Failed to fetch RDNs of the container. id: %d, err: %w", parentID, err)
+	}
+	if len(rdns) == 0 {
+		return "", errors.Errorf("Detected inconsistency. Not found container. id: %d", parentID)
+	}
+
+	// Cache Parent Container DNOrig
+	pdn := strings.Join(rdns, ",")
+	dnCache.Itoao[parentID] = pdn
+
+	return rdnOrig + "," + pdn, nil
+}
+
+// toDNOrigsBySQL is the same as toDNOrigs, but it doesn't use the cache DB.
+func (r *DefaultRepository) toDNOrigsBySQL(ctx context.Context, ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	nids := make([]int64, 0, len(ids))
+	for _, v := range ids {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Printf("warn: The association value is not number, ignored. value: %s", v)
+			continue
+		}
+		nids = append(nids, i)
+	}
+
+	var dest []struct {
+		ID       int64  `db:"id"`
+		ParentID int64  `db:"parent_id"`
+		RDNOrig  string `db:"rdn_orig"`
+	}
+	err := findRDNOrigsByIDs.SelectContext(ctx, &dest, map[string]interface{}{
+		"ids": pq.Array(nids),
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to fetch RDNs. ids: %v, err: %w", nids, err)
+	}
+
+	dns := make([]string, 0, len(dest))
+	for _, v := range dest {
+		dn, err := r.toDNOrigBySQL(ctx, v.ParentID, v.RDNOrig)
+		if err != nil {
+			return nil, err
+		}
+		dns = append(dns, dn)
+	}
+
+	return dns, nil
+}
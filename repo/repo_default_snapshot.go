@@ -0,0 +1,282 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"golang.org/x/xerrors"
+)
+
+var (
+	// select for the cache snapshot
+	findChangedEntries *sqlx.NamedStmt
+)
+
+// initCacheSnapshot records the xid of the last change of the entry by the trigger,
+// then prepares the statements. The xid8 requires PostgreSQL 13 or later.
+func (r *DefaultRepository) initCacheSnapshot() error {
+	reportError := func(err error) error {
+		return errors.Wrap(err, "Failed to initialize DB for the cache snapshot")
+	}
+
+	_, err := r.db.Exec(`
+ALTER TABLE entry ADD COLUMN IF NOT EXISTS change_xid xid8;
+CREATE INDEX IF NOT EXISTS idx_entry_change_xid ON entry (change_xid);
+CREATE OR REPLACE FUNCTION entry_change_xid() RETURNS trigger AS $$
+BEGIN
+	NEW.change_xid := pg_current_xact_id();
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'entry_change_xid' AND tgrelid = 'entry'::regclass) THEN
+		CREATE TRIGGER entry_change_xid BEFORE INSERT OR UPDATE ON entry FOR EACH ROW EXECUTE FUNCTION entry_change_xid();
+	END IF;
+END;
+$$;
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	findChangedEntries, err = r.db.PrepareNamed(`
+SELECT
+	e.id, e.rev, e.parent_id, e.path, e.is_container, e.rdn_norm, e.rdn_orig, ` + attrsOrigWithAssociation + ` AS attrs_orig
+FROM entry e
+WHERE
+	e.change_xid >= CAST(:mark AS xid8)
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	return nil
+}
+
+type snapshotMark struct {
+	Database string `db:"database"`
+	// Every transaction which isn't visible in the DB snapshot has the xid greater than or equal to xmin
+	Xmin uint64 `db:"xmin"`
+	// All xids are less than xmax
+	Xmax uint64 `db:"xmax"`
+}
+
+// snapshotMark returns the high-water mark of the DB snapshot of the transaction.
+// The transaction must be repeatable read to see the same snapshot in the other queries.
+func (r *DefaultRepository) snapshotMark(ctx context.Context, tx *sqlx.Tx) (*snapshotMark, error) {
+	var dest struct {
+		Database string `db:"database"`
+		Xmin     string `db:"xmin"`
+		Xmax     string `db:"xmax"`
+	}
+	err := tx.GetContext(ctx, &dest, `
+SELECT
+	current_database() AS database,
+	CAST(pg_snapshot_xmin(pg_current_snapshot()) AS text) AS xmin,
+	CAST(pg_snapshot_xmax(pg_current_snapshot()) AS text) AS xmax
+`)
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to fetch the snapshot mark. err: %w", err)
+	}
+
+	m := &snapshotMark{Database: dest.Database}
+	if m.Xmin, err = strconv.ParseUint(dest.Xmin, 10, 64); err != nil {
+		return nil, xerrors.Errorf("Unexpected snapshot xmin: %s, err: %w", dest.Xmin, err)
+	}
+	if m.Xmax, err = strconv.ParseUint(dest.Xmax, 10, 64); err != nil {
+		return nil, xerrors.Errorf("Unexpected snapshot xmax: %s, err: %w", dest.Xmax, err)
+	}
+	return m, nil
+}
+
+// createCacheSnapshot creates the writer of the cache snapshot if it's enabled.
+// The snapshot is optional, so it returns nil if failed.
+func (r *DefaultRepository) createCacheSnapshot(mark *snapshotMark) *cacheSnapshotWriter {
+	if r.config.CacheSnapshotPath == "" || mark == nil {
+		return nil
+	}
+	w, err := createCacheSnapshot(r.config.CacheSnapshotPath, &cacheSnapshotHeader{
+		Database: mark.Database,
+		Suffix:   r.schemaRegistry.Config.Suffix,
+		Mark:     mark.Xmin,
+		Created:  time.Now(),
+	})
+	if err != nil {
+		log.Printf("warn: Skip writing cache snapshot. err: %+v", err)
+		return nil
+	}
+	return w
+}
+
+// loadCache caches all entries from the cache snapshot if it's enabled, otherwise from DB.
+// It falls back to fetch all entries from DB if the snapshot isn't available.
+func (r *DefaultRepository) loadCache(ctx context.Context) error {
+	if r.config.CacheSnapshotPath != "" {
+		err := r.CacheFromSnapshot(ctx)
+		if err == nil {
+			return nil
+		}
+		if xerrors.Is(err, os.ErrNotExist) {
+			log.Printf("info: No cache snapshot yet. path: %s", r.config.CacheSnapshotPath)
+		} else {
+			log.Printf("warn: Failed to load cache snapshot, fallback to cache all entries. err: %+v", err)
+		}
+
+		if err := r.cacheDB.Truncate(); err != nil {
+			return errors.Wrapf(err, "Failed to truncate cache DB")
+		}
+	}
+
+	return r.CacheAll(ctx)
+}
+
+// CacheFromSnapshot caches all entries from the cache snapshot and the entries changed since it.
+// Then it replaces the snapshot with the latest one.
+func (r *DefaultRepository) CacheFromSnapshot(ctx context.Context) error {
+	log.Printf("info: Starting cache all entries from snapshot")
+	first := time.Now()
+
+	snapshot, err := openCacheSnapshot(r.config.CacheSnapshotPath)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	tx, err := r.beginSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	mark, err := r.snapshotMark(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	h := snapshot.Header
+	if h.Database != mark.Database || h.Suffix != r.schemaRegistry.Config.Suffix || h.Mark > mark.Xmax {
+		return xerrors.Errorf("Incompatible cache snapshot. database: %s, suffix: %s, mark: %d, created: %s",
+			h.Database, h.Suffix, h.Mark, h.Created)
+	}
+
+	// Fetch the entries changed since the snapshot
+	rows, err := tx.NamedStmtContext(ctx, findChangedEntries).QueryxContext(ctx, map[string]interface{}{
+		"mark": strconv.FormatUint(h.Mark, 10),
+	})
+	if err != nil {
+		return xerrors.Errorf("Failed to fetch changed entries. err: %w", err)
+	}
+	changed := []*DBEntry{}
+	changedIDs := util.NewInt64Set()
+	for rows.Next() {
+		var dbEntry DBEntry
+		if err := rows.StructScan(&dbEntry); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "Unexpected struct scan error")
+		}
+		changed = append(changed, &dbEntry)
+		changedIDs.Add(dbEntry.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return xerrors.Errorf("Failed to fetch changed entries. err: %w", err)
+	}
+
+	// Fetch all IDs to skip the deleted entries
+	var ids []int64
+	if err := tx.SelectContext(ctx, &ids, `SELECT id FROM entry`); err != nil {
+		return xerrors.Errorf("Failed to fetch all IDs. err: %w", err)
+	}
+	exists := util.NewInt64Set(ids...)
+
+	log.Printf("info: Fetched changed entries since snapshot: %d, created: %s", len(changed), h.Created)
+
+	cacheTx, err := r.beginCacheTX()
+	if err != nil {
+		return xerrors.Errorf("Failed to begin cache DB transaction: %w", err)
+	}
+
+	writer := r.createCacheSnapshot(mark)
+	write := func(dbEntry *DBEntry) {
+		if writer == nil {
+			return
+		}
+		if err := writer.Write(dbEntry); err != nil {
+			log.Printf("warn: Skip writing cache snapshot. err: %+v", err)
+			writer.Abort()
+			writer = nil
+		}
+	}
+	defer func() {
+		if writer != nil {
+			writer.Abort()
+		}
+	}()
+
+	cached := 0
+	for {
+		dbEntry, err := snapshot.Next()
+		if err != nil {
+			rollbackCache(cacheTx)
+			return err
+		}
+		if dbEntry == nil {
+			break
+		}
+		if _, ok := exists[dbEntry.ID]; !ok {
+			continue
+		}
+		if _, ok := changedIDs[dbEntry.ID]; ok {
+			continue
+		}
+
+		if err := r.CacheEntry(ctx, cacheTx, dbEntry, true); err != nil {
+			rollbackCache(cacheTx)
+			return errors.Wrap(err, "cache entry error")
+		}
+		write(dbEntry)
+		cached++
+	}
+
+	for _, dbEntry := range changed {
+		if err := r.CacheEntry(ctx, cacheTx, dbEntry, true); err != nil {
+			rollbackCache(cacheTx)
+			return errors.Wrap(err, "cache entry error")
+		}
+		write(dbEntry)
+	}
+
+	if err := commitCache(cacheTx); err != nil {
+		return err
+	}
+
+	log.Printf("info: Cache commited from snapshot: %v, snapshot: %d, changed: %d", time.Since(first), cached, len(changed))
+
+	if writer != nil {
+		if err := writer.Commit(); err != nil {
+			log.Printf("warn: Failed to write cache snapshot. err: %+v", err)
+		}
+		writer = nil
+	}
+
+	return nil
+}
+
+func (r *DefaultRepository) beginSnapshot(ctx context.Context) (*sqlx.Tx, error) {
+	tx, err := r.db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to begin transaction. err: %w", err)
+	}
+	return tx, nil
+}
@@ -14,7 +14,6 @@ import (
 	"github.com/jmoiron/sqlx/types"
 	"github.com/lib/pq"
 	"github.com/pkg/errors"
-	"github.com/restream/reindexer"
 )
 
 // Update modifies the entry by specified change data.
@@ -24,9 +23,13 @@ func (r *DefaultRepository) Update(ctx context.Context, dn *schema.DN, callback
 		return errors.Wrapf(err, "dn_norm: %s", dn.DNNormStr())
 	}
 
+	if err := r.checkCacheReady(); err != nil {
+		return err
+	}
+
 	var m *NotifyMessage
 
-	err := r.withTx(ctx, func(cacheTx *reindexer.Tx, dbTx *sqlx.Tx) error {
+	err := r.withTx(ctx, func(cacheTx CacheTx, dbTx *sqlx.Tx) error {
 		id, err := r.findEntryIDWithTx(ctx, cacheTx, dn)
 		if err != nil {
 			return reportError(err)
@@ -104,10 +107,20 @@ func (r *DefaultRepository) internalUpdate(ctx context.Context, dbTx *sqlx.Tx, i
 		"modify_timestamp": mt,
 	}
 	var obj []string
+	// The modification of the association is applied to the association table
+	assocOps := map[string]*ModOperation{}
+	changed := 0
 
 	if true {
 		// Apply patch mode
 		ops := changelog.ToDiff()
+		changed = len(ops)
+		for k, v := range ops {
+			if isStoredAssociationAttribute(k) {
+				assocOps[k] = v
+				delete(ops, k)
+			}
+		}
 
 		obj = make([]string, len(ops))
 		i := 0
@@ -152,6 +165,7 @@ func (r *DefaultRepository) internalUpdate(ctx context.Context, dbTx *sqlx.Tx, i
 	} else {
 		// Full replace mode
 		attrsOrig := changelog.ToAttrsOrig()
+		changed = len(attrsOrig)
 
 		obj = make([]string, len(attrsOrig))
 		i := 0
@@ -164,25 +178,29 @@ func (r *DefaultRepository) internalUpdate(ctx context.Context, dbTx *sqlx.Tx, i
 	}
 
 	// No modification
-	if len(obj) == 0 {
+	if changed == 0 {
 		return nil, nil
 	}
 
+	objStr := ""
+	if len(obj) > 0 {
+		objStr = strings.Join(obj, ",") + ","
+	}
 	q := fmt.Sprintf(`
 
 UPDATE
 	entry
 SET
 	attrs_orig = attrs_orig::::jsonb || JSONB_BUILD_OBJECT(
-		'modifiersName', (:modifiers_name)::::jsonb,
-		'modifyTimestamp', (:modify_timestamp)::::jsonb,
 		%s
+		'modifiersName', (:modifiers_name)::::jsonb,
+		'modifyTimestamp', (:modify_timestamp)::::jsonb
 	),
 	rev = rev + 1
 WHERE
 	id = :id
 	AND rev = :rev;
-`, strings.Join(obj, ","))
+`, objStr)
 
 	result, err := dbTx.NamedExecContext(ctx, q, params)
 	if err != nil {
@@ -197,28 +215,36 @@ WHERE
 	if updated != 1 {
 		return reportError(errors.New("Unexpected update result"))
 	}
+	if err := r.updateAttrsNorm(ctx, dbTx, id); err != nil {
+		return reportError(err)
+	}
 
 	// Association
-	associationChanged := false
-	add, del := changelog.ToMemberOfDiff()
-	if len(add) > 0 || len(del) > 0 {
-		associationChanged = true
-
-		if err := r.addMemberOf(ctx, dbTx, add, id); err != nil {
-			return reportError(err)
-		}
-		if err := r.deleteMemberOf(ctx, dbTx, del, id); err != nil {
+	for k, v := range assocOps {
+		if err := r.updateAssociation(ctx, dbTx, k, id, v); err != nil {
 			return reportError(err)
 		}
 	}
+	// Only the changed targets are cached again, not all members of the group
+	add, del := changelog.ToMemberOfDiff()
+	tids := util.NewInt64Set()
+	for _, v := range toInt64s(add) {
+		tids.Add(v)
+	}
+	for _, v := range toInt64s(del) {
+		tids.Add(v)
+	}
+	if err := r.touchMemberOf(ctx, dbTx, tids.Values()); err != nil {
+		return reportError(err)
+	}
 
 	// Notify
 	m := &NotifyMessage{
-		Issuer:      r.config.ServerID,
-		ID:          id,
-		Op:          NotifyMod,
-		Rev:         rev + 1,
-		Association: associationChanged,
+		Issuer:    r.config.ServerID,
+		ID:        id,
+		Op:        NotifyMod,
+		Rev:       rev + 1,
+		Dependant: tids.Values(),
 	}
 	err = r.notify(dbTx, m)
 	if err != nil {
@@ -231,6 +257,10 @@ WHERE
 // Association resolves the association related attributes in the attributes.
 // This is used for MOD operation.
 func (r *DefaultRepository) Association(ctx context.Context, sv *schema.SchemaValue) (*schema.SchemaValue, error) {
+	if err := r.checkCacheReady(); err != nil {
+		return nil, err
+	}
+
 	ids, err, errIndex := r.dnStrArrayToIDStrArray(ctx, sv.Orig())
 	if err != nil {
 		if util.IsNoSuchObjectError(err) {
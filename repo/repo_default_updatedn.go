@@ -9,10 +9,10 @@ import (
 	"strings"
 
 	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	"github.com/pkg/errors"
-	"github.com/restream/reindexer"
 )
 
 // UpdateRDN modifies the entry RDN by specified change data.
@@ -23,9 +23,13 @@ func (r *DefaultRepository) UpdateDN(ctx context.Context, oldDN, newDN *schema.D
 		return errors.Wrapf(err, "old_dn_norm: %s, new_dn_norm: %s", oldDN.DNNormStr(), newDN.DNNormStr())
 	}
 
+	if err := r.checkCacheReady(); err != nil {
+		return err
+	}
+
 	var m *NotifyMessage
 
-	err := r.withTx(ctx, func(cacheTx *reindexer.Tx, dbTx *sqlx.Tx) error {
+	err := r.withTx(ctx, func(cacheTx CacheTx, dbTx *sqlx.Tx) error {
 		id, err := r.findEntryIDWithTx(ctx, cacheTx, oldDN)
 		if err != nil {
 			return reportError(err)
@@ -166,7 +170,7 @@ func (r *DefaultRepository) internalUpdateDN(ctx context.Context, dbTx *sqlx.Tx,
 				if err != nil {
 					return reportError(err)
 				}
-				if updated != int64(len(oldSubTree)) {
+				if updated != 1 {
 					return reportError(err)
 				}
 			}
@@ -330,6 +334,10 @@ WHERE
 
 	result, err := dbTx.NamedExecContext(ctx, q, params)
 	if err != nil {
+		if isDuplicateKeyError(err) {
+			log.Printf("warn: The new entry already exists. dn_norm: %s", changelog.NewDN().DNNormStr())
+			return nil, util.NewAlreadyExists()
+		}
 		return reportError(err)
 	}
 
@@ -341,6 +349,9 @@ WHERE
 	if updated != 1 {
 		return reportError(errors.New("Unexpected update result"))
 	}
+	if err := r.updateAttrsNorm(ctx, dbTx, id); err != nil {
+		return reportError(err)
+	}
 
 	// Notify
 	m := &NotifyMessage{
@@ -0,0 +1,189 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"golang.org/x/xerrors"
+)
+
+// cacheVerifyItem has the fields of CacheItem to be verified.
+// Both of the cache and DB are decoded from JSON to compare them in the same representation.
+type cacheVerifyItem struct {
+	ID          int64                  `json:"id"`
+	Version     int64                  `json:"rev"`
+	ParentID    int64                  `json:"parentId"`
+	Path        []int64                `json:"path"`
+	IsContainer bool                   `json:"isContainer"`
+	RDNNorm     string                 `json:"rdnNorm"`
+	AttrsNorm   map[string]interface{} `json:"attrsNorm"`
+}
+
+// diff returns the names of the different fields.
+func (i *cacheVerifyItem) diff(o *cacheVerifyItem) []string {
+	fields := []string{}
+	if i.Version != o.Version {
+		fields = append(fields, "rev")
+	}
+	if i.ParentID != o.ParentID {
+		fields = append(fields, "parentId")
+	}
+	// The empty path is stored as null or []
+	if !(len(i.Path) == 0 && len(o.Path) == 0) && !reflect.DeepEqual(i.Path, o.Path) {
+		fields = append(fields, "path")
+	}
+	if i.IsContainer != o.IsContainer {
+		fields = append(fields, "isContainer")
+	}
+	if i.RDNNorm != o.RDNNorm {
+		fields = append(fields, "rdnNorm")
+	}
+	if !reflect.DeepEqual(i.AttrsNorm, o.AttrsNorm) {
+		fields = append(fields, "attrsNorm")
+	}
+	return fields
+}
+
+// VerifyCache compares all cached entries with DB, then caches the different entries again if repair is true.
+// The cache is scanned before DB like Reconcile, so the entry changed while verifying may be reported.
+// It's cached again by the repair anyway.
+func (r *DefaultRepository) VerifyCache(ctx context.Context, repair bool) (*CacheVerifyResult, error) {
+	if err := r.checkCacheReady(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("info: Starting verify cache. repair: %v", repair)
+	start := time.Now()
+
+	cached := map[int64]*cacheVerifyItem{}
+
+	iter := r.query().
+		Select("id", "rev", "parentId", "path", "isContainer", "rdnNorm", "attrsNorm").
+		ExecToJsonCtx(ctx)
+	for iter.Next() {
+		var item cacheVerifyItem
+		if err := json.Unmarshal(iter.JSON(), &item); err != nil {
+			iter.Close()
+			return nil, xerrors.Errorf("Unexpected unmarshal error. err: %w", err)
+		}
+		cached[item.ID] = &item
+	}
+	if err := iter.Error(); err != nil {
+		iter.Close()
+		return nil, xerrors.Errorf("Failed to scan cache DB. err: %w", err)
+	}
+	iter.Close()
+
+	result := &CacheVerifyResult{
+		Diffs: []CacheDiff{},
+	}
+	parents := map[int64]int64{}
+
+	if err := r.verifyCacheWithDB(ctx, cached, result); err != nil {
+		return nil, err
+	}
+
+	for id, c := range cached {
+		result.Checked++
+		result.Diffs = append(result.Diffs, CacheDiff{ID: id, Kind: CacheDiffOrphan})
+		parents[id] = c.ParentID
+	}
+	sort.Slice(result.Diffs, func(i, j int) bool {
+		return result.Diffs[i].ID < result.Diffs[j].ID
+	})
+
+	if repair && len(result.Diffs) > 0 {
+		err := r.withTx(ctx, func(cacheTx CacheTx, dbTx *sqlx.Tx) error {
+			for i := range result.Diffs {
+				d := &result.Diffs[i]
+				if d.Kind == CacheDiffOrphan {
+					if _, err := r.DeleteCacheEntry(ctx, cacheTx, dbTx, d.ID, parents[d.ID], false); err != nil {
+						return err
+					}
+				} else {
+					if err := r.CacheEntryByID(ctx, cacheTx, dbTx, d.ID, false); err != nil {
+						if xerrors.Is(err, sql.ErrNoRows) {
+							// Deleted after the scan, it's deleted from the cache by the changelog
+							continue
+						}
+						return errors.Wrapf(err, "Failed to cache the entry. id: %d", d.ID)
+					}
+				}
+				d.Repaired = true
+				result.Repaired++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("Failed to repair cache. err: %w", err)
+		}
+	}
+
+	if len(result.Diffs) > 0 {
+		log.Printf("warn: Verified cache: %v, checked: %d, diffs: %d, repaired: %d",
+			time.Since(start), result.Checked, len(result.Diffs), result.Repaired)
+	} else {
+		log.Printf("info: Verified cache: %v, checked: %d, no differences", time.Since(start), result.Checked)
+	}
+
+	return result, nil
+}
+
+// verifyCacheWithDB compares all entries of DB with the cached items. The compared items are removed from cached.
+func (r *DefaultRepository) verifyCacheWithDB(ctx context.Context, cached map[int64]*cacheVerifyItem, result *CacheVerifyResult) error {
+	tx, err := r.beginReadonly(ctx)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	rows, err := tx.NamedStmtContext(ctx, findAll).QueryxContext(ctx, map[string]interface{}{})
+	if err != nil {
+		return xerrors.Errorf("Failed to execute fetch all query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var dbEntry DBEntry
+		if err := rows.StructScan(&dbEntry); err != nil {
+			return errors.Wrap(err, "Unexpected struct scan error")
+		}
+		result.Checked++
+
+		c, ok := cached[dbEntry.ID]
+		if !ok {
+			result.Diffs = append(result.Diffs, CacheDiff{ID: dbEntry.ID, Kind: CacheDiffMissing})
+			continue
+		}
+		delete(cached, dbEntry.ID)
+
+		item, err := r.toCacheItem(&dbEntry)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to normalize the entry. id: %d", dbEntry.ID)
+		}
+		b, err := json.Marshal(item)
+		if err != nil {
+			return xerrors.Errorf("Unexpected marshal error. id: %d, err: %w", dbEntry.ID, err)
+		}
+		var expected cacheVerifyItem
+		if err := json.Unmarshal(b, &expected); err != nil {
+			return xerrors.Errorf("Unexpected unmarshal error. id: %d, err: %w", dbEntry.ID, err)
+		}
+
+		if fields := c.diff(&expected); len(fields) > 0 {
+			result.Diffs = append(result.Diffs, CacheDiff{ID: dbEntry.ID, Kind: CacheDiffMismatch, Fields: fields})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return xerrors.Errorf("Failed to fetch all entries. err: %w", err)
+	}
+
+	return nil
+}
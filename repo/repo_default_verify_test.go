@@ -0,0 +1,76 @@
+//go:build test
+
+package repo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCacheVerifyItemDiff(t *testing.T) {
+	base := func() *cacheVerifyItem {
+		return &cacheVerifyItem{
+			ID:          1,
+			Version:     2,
+			ParentID:    0,
+			Path:        []int64{1},
+			IsContainer: true,
+			RDNNorm:     "dc=example",
+			AttrsNorm:   map[string]interface{}{"dc": []interface{}{"example"}},
+		}
+	}
+
+	testcases := []struct {
+		Name     string
+		Modify   func(i *cacheVerifyItem)
+		Expected []string
+	}{
+		{
+			"same",
+			func(i *cacheVerifyItem) {},
+			[]string{},
+		},
+		{
+			"empty path",
+			func(i *cacheVerifyItem) {
+				i.Path = nil
+			},
+			[]string{"path"},
+		},
+		{
+			"rev and attrs",
+			func(i *cacheVerifyItem) {
+				i.Version = 1
+				i.AttrsNorm = map[string]interface{}{"dc": []interface{}{"other"}}
+			},
+			[]string{"rev", "attrsNorm"},
+		},
+		{
+			"parent and container",
+			func(i *cacheVerifyItem) {
+				i.ParentID = 2
+				i.IsContainer = false
+				i.RDNNorm = "dc=other"
+			},
+			[]string{"parentId", "isContainer", "rdnNorm"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			i := base()
+			tc.Modify(i)
+			if actual := base().diff(i); !reflect.DeepEqual(actual, tc.Expected) {
+				t.Errorf("Unexpected diff. expected: %v, actual: %v", tc.Expected, actual)
+			}
+		})
+	}
+
+	// The leaf has null or [] path
+	a, b := base(), base()
+	a.Path = nil
+	b.Path = []int64{}
+	if actual := a.diff(b); len(actual) != 0 {
+		t.Errorf("Unexpected diff of empty path: %v", actual)
+	}
+}
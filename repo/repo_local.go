@@ -0,0 +1,461 @@
+package repo
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/pkg/errors"
+	"golang.org/x/xerrors"
+)
+
+// LocalRepository is the Repository which holds all entries in the process and
+// evaluates the search without the cache DB. The entries are persisted by the localStorage.
+// The change events are delivered to the other repositories sharing the same storage in the process
+// instead of pg_notify.
+type LocalRepository struct {
+	mu             sync.RWMutex
+	index          *localIndex
+	storage        localStorage
+	schemaRegistry *schema.SchemaRegistry
+	serverID       string
+	// The key to share the change events
+	eventKey string
+	lastID   int64
+}
+
+// localStorage persists the entries of LocalRepository.
+type localStorage interface {
+	// Init prepares the storage. It's called when initializing the repository.
+	Init(ctx context.Context) error
+
+	// LoadAll fetches all entries except the root of the root.
+	LoadAll(ctx context.Context, callback func(entry *localEntry) error) error
+
+	// Load fetches the entries by the ids. The missing entries are skipped.
+	Load(ctx context.Context, ids []int64) ([]*localEntry, error)
+
+	// Save stores the changed entries and deletes the entries in a transaction.
+	// The changed entry is updated only if the stored revision is the previous one,
+	// otherwise it returns RetryError.
+	Save(ctx context.Context, upserts []*localEntry, deletes []int64) error
+
+	// BindAttemptStore returns the store of the failed bind attempts.
+	BindAttemptStore() BindAttemptStore
+
+	// Close releases the resources of the storage.
+	Close() error
+}
+
+// localEntry is the entry held in the process.
+type localEntry struct {
+	ID          int64
+	UUID        string
+	Rev         int64
+	ParentID    int64
+	Path        []int64
+	IsContainer bool
+	RDNNorm     string
+	RDNOrig     string
+	AttrsOrig   AttrsOrig
+	// The association attributes are int64, the others are normalized string like CacheEntry
+	AttrsNorm CacheAttrsNorm
+}
+
+func (e *localEntry) clone() *localEntry {
+	copied := *e
+	if e.Path != nil {
+		copied.Path = append([]int64{}, e.Path...)
+	}
+	copied.AttrsOrig = make(AttrsOrig, len(e.AttrsOrig))
+	for k, v := range e.AttrsOrig {
+		copied.AttrsOrig[k] = append([]string{}, v...)
+	}
+	return &copied
+}
+
+// associationIDs returns the ids in member, uniqueMember and memberOf.
+func (e *localEntry) associationIDs() []int64 {
+	ids := []int64{}
+	for _, k := range []string{"member", "uniqueMember", "memberOf"} {
+		ids = append(ids, e.AttrsNorm.ValueInt64(k)...)
+	}
+	return ids
+}
+
+func newLocalRepository(config *DBRepositoryConfig, sr *schema.SchemaRegistry, storage localStorage, eventKey string) *LocalRepository {
+	return &LocalRepository{
+		index:          newLocalIndex(),
+		storage:        storage,
+		schemaRegistry: sr,
+		serverID:       config.ServerID,
+		eventKey:       eventKey,
+	}
+}
+
+// Init is called when initializing repository implementation.
+func (r *LocalRepository) Init() error {
+	ctx := context.Background()
+
+	if err := r.storage.Init(ctx); err != nil {
+		return errors.Wrap(err, "Failed to initialize storage")
+	}
+	if err := r.RefreshCache(ctx); err != nil {
+		return errors.Wrap(err, "Failed to load entries")
+	}
+
+	localEvents.subscribe(r.eventKey, r)
+
+	return nil
+}
+
+// Close stops receiving the change events and closes the storage.
+func (r *LocalRepository) Close() error {
+	localEvents.unsubscribe(r.eventKey, r)
+	return r.storage.Close()
+}
+
+// RefreshCache reloads all entries from the storage.
+func (r *LocalRepository) RefreshCache(ctx context.Context) error {
+	log.Printf("info: Starting load all entries")
+
+	index := newLocalIndex()
+	err := r.storage.LoadAll(ctx, func(entry *localEntry) error {
+		if err := r.normalizeEntry(entry); err != nil {
+			return err
+		}
+		index.put(entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.index = index
+	if r.lastID < index.maxID {
+		r.lastID = index.maxID
+	}
+
+	log.Printf("info: Finished load all entries. count: %d", len(index.entries))
+
+	return nil
+}
+
+// OnUpdate reloads the changed entries by the other repository sharing the storage.
+func (r *LocalRepository) OnUpdate(ctx context.Context, m *NotifyMessage) error {
+	if m == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := util.NewInt64Set(m.ID)
+	for _, v := range m.Dependant {
+		ids.Add(v)
+	}
+	if e, ok := r.index.get(m.ID); ok {
+		if m.Association || m.IsDel() {
+			for _, v := range e.associationIDs() {
+				ids.Add(v)
+			}
+		}
+		if m.Sub {
+			for _, v := range r.index.subtree(m.ID) {
+				ids.Add(v)
+			}
+		}
+	}
+
+	if err := r.reload(ctx, ids.Values(), m.Association); err != nil {
+		return errors.Wrapf(err, "message: %v", m)
+	}
+
+	return nil
+}
+
+// reload fetches the entries from the storage, then replaces them in the index.
+// The entries not found in the storage are removed from the index.
+func (r *LocalRepository) reload(ctx context.Context, ids []int64, assoc bool) error {
+	entries, err := r.load(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	if assoc {
+		// The association targets of the current entries might be changed too
+		loaded := util.NewInt64Set(ids...)
+		more := util.NewInt64Set()
+		for _, e := range entries {
+			for _, v := range e.associationIDs() {
+				if _, ok := loaded[v]; !ok {
+					more.Add(v)
+				}
+			}
+		}
+		if len(more) > 0 {
+			moreEntries, err := r.load(ctx, more.Values())
+			if err != nil {
+				return err
+			}
+			entries = append(entries, moreEntries...)
+			ids = append(ids, more.Values()...)
+		}
+	}
+
+	found := util.NewInt64Set()
+	for _, e := range entries {
+		found.Add(e.ID)
+	}
+
+	// Remove the deleted entries first to release their RDN in the index
+	for _, id := range ids {
+		if _, ok := found[id]; !ok {
+			r.index.remove(id)
+		}
+	}
+
+	for _, e := range entries {
+		r.index.put(e)
+		if r.lastID < e.ID {
+			r.lastID = e.ID
+		}
+		log.Printf("Reload entry, id: %d, version: %d", e.ID, e.Rev)
+	}
+
+	return nil
+}
+
+func (r *LocalRepository) load(ctx context.Context, ids []int64) ([]*localEntry, error) {
+	entries, err := r.storage.Load(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if err := r.normalizeEntry(e); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// BindAttemptStore returns the store of the failed bind attempts.
+func (r *LocalRepository) BindAttemptStore() BindAttemptStore {
+	return r.storage.BindAttemptStore()
+}
+
+// normalizeEntry builds the normalized attributes of the entry like CacheEntry.
+func (r *LocalRepository) normalizeEntry(entry *localEntry) error {
+	attrsNorm := make(CacheAttrsNorm, len(entry.AttrsOrig))
+
+	for k, v := range entry.AttrsOrig {
+		if len(v) == 0 {
+			continue
+		}
+		sv, err := schema.NewSchemaValue(r.schemaRegistry, k, v)
+		if err != nil {
+			return xerrors.Errorf("Unexpected schema error. id: %d, name: %s, value: %v, err: %w", entry.ID, k, v, err)
+		}
+
+		if isNumIndexedAttribute(sv.Name()) {
+			attrsNorm[sv.Name()] = sv.Norm()
+		} else {
+			norm := make([]interface{}, len(sv.NormStr()))
+			for i, s := range sv.NormStr() {
+				norm[i] = s
+			}
+			attrsNorm[sv.Name()] = norm
+		}
+	}
+	entry.AttrsNorm = attrsNorm
+
+	return nil
+}
+
+// nextID returns the new entry ID. The ID isn't reused in the process.
+func (r *LocalRepository) nextID() int64 {
+	r.lastID++
+	return r.lastID
+}
+
+// findEntryID returns the entry ID by the DN. The caller must hold the lock.
+// fetch returns the current entry by specified DN with the read lock.
+// The returned entry must not be modified.
+func (r *LocalRepository) fetch(dn *schema.DN) (*localEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, err := r.findEntryID(dn)
+	if err != nil {
+		return nil, err
+	}
+	e, _ := r.index.get(id)
+	return e, nil
+}
+
+func (r *LocalRepository) findEntryID(dn *schema.DN) (int64, error) {
+	var rdnNorms []string
+
+	if dn.IsSuffix(r.schemaRegistry.SuffixDN) {
+		// To support multiple base DN
+		rdnNorms = []string{dn.RDNNormStr()}
+	} else {
+		if !dn.IsSubOf(r.schemaRegistry.SuffixDN) {
+			return -1, util.NewNoSuchObject()
+		}
+
+		size := dn.LevelWithoutSuffix(r.schemaRegistry.SuffixDN) + 1
+		rdnNorms = make([]string, size)
+
+		for i := 0; i < size; i++ {
+			rdnNorms[i] = dn.RDNNormStr()
+			dn = dn.ParentDN()
+		}
+	}
+
+	var id int64 = 0
+
+	for i := len(rdnNorms) - 1; i >= 0; i-- {
+		cid, ok := r.index.child(id, rdnNorms[i])
+		if !ok {
+			// Not found
+			return -1, util.NewNoSuchObject()
+		}
+		id = cid
+	}
+
+	return id, nil
+}
+
+// parentPath returns the path of the parent container of the entry. The caller must hold the lock.
+func (r *LocalRepository) parentPath(tx *localTx, e *localEntry) []int64 {
+	if e.ParentID == 0 {
+		return []int64{}
+	}
+	p, ok := tx.get(e.ParentID)
+	if !ok {
+		return []int64{}
+	}
+	return p.Path
+}
+
+// dnOrig returns the original DN of the entry. It returns empty string if not found.
+// The caller must hold the lock.
+func (r *LocalRepository) dnOrig(id int64) string {
+	var rdn []string
+
+	for {
+		e, ok := r.index.get(id)
+		if !ok {
+			// Not found
+			return ""
+		}
+
+		// It's Root, end loop
+		if e.ParentID == 0 {
+			// TODO Support multiple suffix
+			rdn = append(rdn, r.schemaRegistry.Config.Suffix)
+			break
+		}
+		rdn = append(rdn, e.RDNOrig)
+
+		id = e.ParentID
+	}
+
+	return strings.Join(rdn, ",")
+}
+
+// toDNOrigs converts the ids in the association to the original DNs. The missing ids are skipped.
+// The caller must hold the lock.
+func (r *LocalRepository) toDNOrigs(ids []int64) []string {
+	dns := []string{}
+	for _, id := range ids {
+		if dn := r.dnOrig(id); dn != "" {
+			dns = append(dns, dn)
+		}
+	}
+	return dns
+}
+
+// dnsToIDs converts the DNs in the association to the ids. The caller must hold the lock.
+func (r *LocalRepository) dnsToIDs(name string, dns []string) ([]string, error) {
+	ids := make([]string, len(dns))
+	for i, v := range dns {
+		d, err := r.schemaRegistry.NormalizeDN(v)
+		if err != nil {
+			return nil, util.NewInvalidPerSyntax(name, i)
+		}
+
+		id, err := r.findEntryID(d)
+		if err != nil {
+			return nil, util.NewInvalidPerSyntax(name, i)
+		}
+
+		ids[i] = strconv.FormatInt(id, 10)
+	}
+	return ids, nil
+}
+
+func (r *LocalRepository) publish(m *NotifyMessage) {
+	localEvents.publish(r.eventKey, r, m)
+}
+
+// localEventBus delivers the change events to the repositories sharing the same storage in the process.
+type localEventBus struct {
+	mu   sync.RWMutex
+	subs map[string][]*LocalRepository
+}
+
+var localEvents = &localEventBus{
+	subs: map[string][]*LocalRepository{},
+}
+
+func (b *localEventBus) subscribe(key string, r *LocalRepository) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs[key] = append(b.subs[key], r)
+}
+
+func (b *localEventBus) unsubscribe(key string, r *LocalRepository) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs := b.subs[key]
+	for i, v := range subs {
+		if v == r {
+			b.subs[key] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(b.subs[key]) == 0 {
+		delete(b.subs, key)
+	}
+}
+
+// publish delivers the event to the subscribers except the issuer synchronously.
+func (b *localEventBus) publish(key string, issuer *LocalRepository, m *NotifyMessage) {
+	if m == nil {
+		return
+	}
+
+	b.mu.RLock()
+	subs := append([]*LocalRepository{}, b.subs[key]...)
+	b.mu.RUnlock()
+
+	for _, v := range subs {
+		if v == issuer {
+			continue
+		}
+		if err := v.OnUpdate(context.Background(), m); err != nil {
+			log.Printf("error: Error on update for %v: %v", m, err)
+		}
+	}
+}
@@ -0,0 +1,531 @@
+package repo
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/cloudldap/goldap/message"
+)
+
+// localMatcher evaluates the search filter for the entry held in the process.
+type localMatcher func(e *localEntry) bool
+
+func matchNone(e *localEntry) bool {
+	return false
+}
+
+// localFilterCompiler compiles the search filter to localMatcher.
+// The semantics follow FilterTranslator, the unsupported filter is evaluated to false.
+// The caller must hold the lock of the repository while compiling and matching.
+type localFilterCompiler struct {
+	r *LocalRepository
+}
+
+func (c *localFilterCompiler) compile(sr *schema.SchemaRegistry, packet message.Filter) localMatcher {
+	switch f := packet.(type) {
+	case message.FilterAnd:
+		children := make([]localMatcher, len(f))
+		for i, child := range f {
+			children[i] = c.compile(sr, child)
+		}
+		return func(e *localEntry) bool {
+			for _, m := range children {
+				if !m(e) {
+					return false
+				}
+			}
+			return true
+		}
+
+	case message.FilterOr:
+		children := make([]localMatcher, len(f))
+		for i, child := range f {
+			children[i] = c.compile(sr, child)
+		}
+		return func(e *localEntry) bool {
+			for _, m := range children {
+				if m(e) {
+					return true
+				}
+			}
+			return false
+		}
+
+	case message.FilterNot:
+		child := c.compile(sr, f.Filter)
+		return func(e *localEntry) bool {
+			return !child(e)
+		}
+
+	case message.FilterSubstrings:
+		s, ok := findSchema(sr, string(f.Type_()))
+		if !ok {
+			return matchNone
+		}
+
+		var initial, final string
+		var anys []string
+		for _, fs := range f.Substrings() {
+			switch fsv := fs.(type) {
+			case message.SubstringInitial:
+				initial = string(fsv)
+			case message.SubstringAny:
+				anys = append(anys, string(fsv))
+			case message.SubstringFinal:
+				final = string(fsv)
+			}
+		}
+		return c.substringsMatch(s, initial, anys, final)
+
+	case message.FilterEqualityMatch:
+		if s, ok := findSchema(sr, string(f.AttributeDesc())); ok {
+			return c.equalityMatch(s, string(f.AssertionValue()))
+		}
+
+	case message.FilterGreaterOrEqual:
+		if s, ok := findSchema(sr, string(f.AttributeDesc())); ok {
+			return c.orderingMatch(s, string(f.AssertionValue()), func(cmp int) bool { return cmp >= 0 })
+		}
+
+	case message.FilterLessOrEqual:
+		if s, ok := findSchema(sr, string(f.AttributeDesc())); ok {
+			return c.orderingMatch(s, string(f.AssertionValue()), func(cmp int) bool { return cmp <= 0 })
+		}
+
+	case message.FilterPresent:
+		if s, ok := findSchema(sr, string(f)); ok {
+			return func(e *localEntry) bool {
+				return len(e.AttrsNorm[s.Name]) > 0
+			}
+		}
+
+	case message.FilterApproxMatch:
+		if s, ok := findSchema(sr, string(f.AttributeDesc())); ok {
+			return c.approxMatch(s, string(f.AssertionValue()))
+		}
+
+	case message.FilterExtensibleMatch:
+		return c.extensibleMatch(sr, f)
+	}
+
+	return matchNone
+}
+
+func (c *localFilterCompiler) equalityMatch(s *schema.AttributeType, val string) localMatcher {
+	sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
+	if err != nil {
+		log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s, err: %+v", s.Name, val, err)
+		return matchNone
+	}
+
+	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+		reqDN, err := s.Schema().NormalizeDN(val)
+		if err != nil {
+			log.Printf("warn: Ignore filter due to invalid DN syntax of association. attrName: %s, value: %s, err: %+v", s.Name, val, err)
+			return matchNone
+		}
+		id, err := c.r.findEntryID(reqDN)
+		if err != nil {
+			// Not found case
+			return matchNone
+		}
+		return func(e *localEntry) bool {
+			for _, v := range e.AttrsNorm.ValueInt64(s.Name) {
+				if v == id {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	if s.IsObjectClass() {
+		// The sup objectClasses are expanded, so all of them must be contained
+		return func(e *localEntry) bool {
+			values := localNormIndex(e, s.Name)
+			for _, v := range sv.NormStr() {
+				if _, ok := values[v]; !ok {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	return localValueMatch(s.Name, func(v string) bool {
+		return v == sv.NormStr()[0]
+	})
+}
+
+func (c *localFilterCompiler) substringsMatch(s *schema.AttributeType, initial string, anys []string, final string) localMatcher {
+	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+		log.Printf("Filter for association doesn't support substrings")
+		return matchNone
+	}
+
+	normalize := func(val string) (string, bool) {
+		if val == "" {
+			return "", true
+		}
+		sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
+		if err != nil {
+			log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s", s.Name, val)
+			return "", false
+		}
+		return sv.NormStr()[0], true
+	}
+
+	var ok bool
+	if initial, ok = normalize(initial); !ok {
+		return matchNone
+	}
+	if final, ok = normalize(final); !ok {
+		return matchNone
+	}
+	for i, v := range anys {
+		if anys[i], ok = normalize(v); !ok {
+			return matchNone
+		}
+	}
+
+	return localValueMatch(s.Name, func(v string) bool {
+		return matchSubstrings(v, initial, anys, final)
+	})
+}
+
+// matchSubstrings returns true if the value starts with the initial, contains the any in order
+// and ends with the final.
+func matchSubstrings(v, initial string, anys []string, final string) bool {
+	if !strings.HasPrefix(v, initial) {
+		return false
+	}
+	v = v[len(initial):]
+
+	for _, a := range anys {
+		i := strings.Index(v, a)
+		if i < 0 {
+			return false
+		}
+		v = v[i+len(a):]
+	}
+
+	return strings.HasSuffix(v, final)
+}
+
+func (c *localFilterCompiler) orderingMatch(s *schema.AttributeType, val string, match func(cmp int) bool) localMatcher {
+	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+		log.Printf("Filter for association doesn't support ordering")
+		return matchNone
+	}
+	if !s.IsNumberOrdering() {
+		log.Printf("Not number ordering doesn't support ordering")
+		return matchNone
+	}
+
+	sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
+	if err != nil {
+		log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s", s.Name, val)
+		return matchNone
+	}
+
+	switch a := sv.Norm()[0].(type) {
+	case int64:
+		// The integer and generalizedTime are compared as the number
+		return localValueMatch(s.Name, func(v string) bool {
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return false
+			}
+			switch {
+			case i < a:
+				return match(-1)
+			case i > a:
+				return match(1)
+			}
+			return match(0)
+		})
+	default:
+		return localValueMatch(s.Name, func(v string) bool {
+			return match(strings.Compare(v, sv.NormStr()[0]))
+		})
+	}
+}
+
+func (c *localFilterCompiler) approxMatch(s *schema.AttributeType, val string) localMatcher {
+	sv, err := schema.NewSchemaValue(s.Schema(), s.Name, []string{val})
+	if err != nil {
+		log.Printf("warn: Ignore filter due to invalid syntax. attrName: %s, value: %s", s.Name, val)
+		return matchNone
+	}
+
+	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+		log.Printf("Filter for association doesn't support approx match")
+		return matchNone
+	}
+
+	return localValueMatch(s.Name, func(v string) bool {
+		return strings.Contains(v, sv.NormStr()[0])
+	})
+}
+
+// extensibleMatch handles extensibleMatch filter like FilterTranslator.ExtensibleMatch.
+func (c *localFilterCompiler) extensibleMatch(sr *schema.SchemaRegistry, f message.FilterExtensibleMatch) localMatcher {
+	var ruleName, attrName, val string
+	if f.MatchingRule() != nil {
+		ruleName = string(*f.MatchingRule())
+	}
+	if f.Type_() != nil {
+		attrName = string(*f.Type_())
+	}
+	if f.MatchValue() != nil {
+		val = string(*f.MatchValue())
+	}
+
+	// Active Directory compatible nested membership
+	if ruleName == matchingRuleInChainOID {
+		s, ok := findSchema(sr, attrName)
+		if !ok || !(s.IsAssociationAttribute() || s.IsReverseAssociationAttribute()) {
+			log.Printf("warn: Filter for in-chain matching supports only association. attrName: %s", attrName)
+			return matchNone
+		}
+		return c.inChainMatch(s, val)
+	}
+
+	var rule *schema.MatchingRule
+	if ruleName != "" {
+		var ok bool
+		rule, ok = sr.MatchingRule(ruleName)
+		if !ok {
+			log.Printf("warn: Unsupported matching rule, ignore filter. rule: %s", ruleName)
+			return matchNone
+		}
+	}
+
+	matchers := []localMatcher{}
+
+	if attrName == "" {
+		if rule == nil {
+			// Invalid filter, either type or matchingRule is required
+			return matchNone
+		}
+
+		// Match with all attributes which the matching rule can be applied to
+		for _, s := range sr.AttributeTypes {
+			if s.Equality != rule.Name || s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+				continue
+			}
+			matchers = append(matchers, c.ruleMatch(s, rule, val))
+		}
+	} else {
+		s, ok := findSchema(sr, attrName)
+		if !ok {
+			return matchNone
+		}
+		matchers = append(matchers, c.ruleMatch(s, rule, val))
+	}
+
+	if f.DnAttributes() {
+		matchers = append(matchers, c.dnAttributesMatch(sr, attrName, rule, val))
+	}
+
+	return func(e *localEntry) bool {
+		for _, m := range matchers {
+			if m(e) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ruleMatch handles the attribute value assertion with the matching rule.
+// If the rule is nil, the equality rule of the attribute is used.
+func (c *localFilterCompiler) ruleMatch(s *schema.AttributeType, rule *schema.MatchingRule, val string) localMatcher {
+	if rule == nil || rule.Name == s.Equality {
+		return c.equalityMatch(s, val)
+	}
+
+	if rule.Oid == matchingRuleBitAndOID || rule.Oid == matchingRuleBitOrOID {
+		return c.bitwiseMatch(s, rule, val)
+	}
+
+	if s.IsAssociationAttribute() || s.IsReverseAssociationAttribute() {
+		if rule.Name == "distinguishedNameMatch" {
+			return c.equalityMatch(s, val)
+		}
+		log.Printf("Filter for association doesn't support matching rule: %s", rule.Name)
+		return matchNone
+	}
+
+	if (rule.IsSubstrings() && s.Substr == "") || (!rule.IsSubstrings() && rule.Syntax != s.Syntax) {
+		// Inappropriate matching, it's evaluated to Undefined
+		log.Printf("info: Inappropriate matching rule for the attribute. attrName: %s, rule: %s", s.Name, rule.Name)
+		return matchNone
+	}
+
+	switch {
+	case rule.IsOrdering():
+		// The ordering rule returns true if the attribute value is less than the assertion value
+		return c.orderingMatch(s, val, func(cmp int) bool { return cmp < 0 })
+
+	case rule.IsSubstrings():
+		// The assertion value is "initial*any*final"
+		parts := strings.Split(val, "*")
+		if len(parts) == 1 {
+			return c.equalityMatch(s, val)
+		}
+		return c.substringsMatch(s, parts[0], parts[1:len(parts)-1], parts[len(parts)-1])
+
+	default:
+		// The value is compared with normalized value by the attribute's equality
+		return c.equalityMatch(s, val)
+	}
+}
+
+// inChainMatch handles LDAP_MATCHING_RULE_IN_CHAIN.
+// It walks the association graph transitively, starting from the entry of the assertion value.
+func (c *localFilterCompiler) inChainMatch(s *schema.AttributeType, val string) localMatcher {
+	reqDN, err := s.Schema().NormalizeDN(val)
+	if err != nil {
+		log.Printf("warn: Ignore filter due to invalid DN syntax of association. attrName: %s, value: %s, err: %+v", s.Name, val, err)
+		return matchNone
+	}
+	id, err := c.r.findEntryID(reqDN)
+	if err != nil {
+		// Not found case
+		return matchNone
+	}
+
+	// Build the reverse index of the association once
+	referrers := map[int64][]int64{}
+	for _, e := range c.r.index.entries {
+		for _, v := range e.AttrsNorm.ValueInt64(s.Name) {
+			referrers[v] = append(referrers[v], e.ID)
+		}
+	}
+
+	found := util.NewInt64Set()
+	visited := util.NewInt64Set(id)
+	next := []int64{id}
+
+	for len(next) > 0 {
+		current := next
+		next = []int64{}
+
+		for _, v := range current {
+			for _, rid := range referrers[v] {
+				found.Add(rid)
+
+				if _, ok := visited[rid]; !ok {
+					visited.Add(rid)
+					next = append(next, rid)
+				}
+			}
+		}
+	}
+
+	return func(e *localEntry) bool {
+		_, ok := found[e.ID]
+		return ok
+	}
+}
+
+// bitwiseMatch handles LDAP_MATCHING_RULE_BIT_AND and LDAP_MATCHING_RULE_BIT_OR.
+func (c *localFilterCompiler) bitwiseMatch(s *schema.AttributeType, rule *schema.MatchingRule, val string) localMatcher {
+	mask, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		log.Printf("warn: Ignore filter due to invalid integer. attrName: %s, value: %s", s.Name, val)
+		return matchNone
+	}
+
+	return localValueMatch(s.Name, func(v string) bool {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return false
+		}
+		return (rule.Oid == matchingRuleBitAndOID && i&mask == mask) ||
+			(rule.Oid == matchingRuleBitOrOID && i&mask != 0)
+	})
+}
+
+// dnAttributesMatch handles ":dn" of extensibleMatch filter.
+// The entry matches if the attribute value assertion is true for any RDN of the entry's DN.
+// If the attrName is empty, all attribute types in the RDN are evaluated.
+func (c *localFilterCompiler) dnAttributesMatch(sr *schema.SchemaRegistry, attrName string, rule *schema.MatchingRule, val string) localMatcher {
+	var names []string
+	if attrName != "" {
+		names = []string{attrName}
+	} else {
+		// Well-known naming attributes
+		// TODO configurable
+		names = []string{"cn", "uid", "ou", "o", "dc", "l", "c"}
+	}
+
+	rdnNorms := util.NewStringSet()
+	for _, name := range names {
+		s, ok := findSchema(sr, name)
+		if !ok {
+			continue
+		}
+		if rule != nil && rule.Name != s.Equality && rule.Syntax != s.Syntax {
+			continue
+		}
+		sv, err := schema.NewSchemaValue(sr, s.Name, []string{val})
+		if err != nil {
+			continue
+		}
+		rdnNorms.Add(strings.ToLower(name) + "=" + sv.NormStr()[0])
+	}
+
+	if rdnNorms.Size() == 0 {
+		return matchNone
+	}
+
+	index := c.r.index
+
+	return func(e *localEntry) bool {
+		for {
+			if rdnNorms.Contains(e.RDNNorm) {
+				return true
+			}
+			p, ok := index.get(e.ParentID)
+			if !ok {
+				return false
+			}
+			e = p
+		}
+	}
+}
+
+// localValueMatch returns the matcher which is true if any value of the attribute matches.
+func localValueMatch(name string, match func(v string) bool) localMatcher {
+	return func(e *localEntry) bool {
+		for _, v := range e.AttrsNorm[name] {
+			if match(localNormStr(v)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func localNormIndex(e *localEntry, name string) map[string]struct{} {
+	m := make(map[string]struct{}, len(e.AttrsNorm[name]))
+	for _, v := range e.AttrsNorm[name] {
+		m[localNormStr(v)] = struct{}{}
+	}
+	return m
+}
+
+func localNormStr(v interface{}) string {
+	switch vv := v.(type) {
+	case string:
+		return vv
+	case int64:
+		return strconv.FormatInt(vv, 10)
+	}
+	return ""
+}
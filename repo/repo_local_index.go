@@ -0,0 +1,122 @@
+package repo
+
+import (
+	"sort"
+
+	"github.com/cloudldap/cloudldap/util"
+)
+
+// localIndex is the index of the entries held in the process by LocalRepository.
+// It isn't goroutine safe, LocalRepository guards it by the lock.
+type localIndex struct {
+	entries map[int64]*localEntry
+	// parent ID => child IDs
+	children map[int64]util.Int64Set
+	// parent ID => rdnNorm => child ID
+	rdns  map[int64]map[string]int64
+	maxID int64
+}
+
+func newLocalIndex() *localIndex {
+	return &localIndex{
+		entries:  map[int64]*localEntry{},
+		children: map[int64]util.Int64Set{},
+		rdns:     map[int64]map[string]int64{},
+	}
+}
+
+func (x *localIndex) get(id int64) (*localEntry, bool) {
+	e, ok := x.entries[id]
+	return e, ok
+}
+
+// put adds or replaces the entry. The entry must not be modified after putting it.
+func (x *localIndex) put(e *localEntry) {
+	if old, ok := x.entries[e.ID]; ok {
+		x.unlink(old)
+	}
+	x.entries[e.ID] = e
+
+	children, ok := x.children[e.ParentID]
+	if !ok {
+		children = util.NewInt64Set()
+		x.children[e.ParentID] = children
+	}
+	children.Add(e.ID)
+
+	rdns, ok := x.rdns[e.ParentID]
+	if !ok {
+		rdns = map[string]int64{}
+		x.rdns[e.ParentID] = rdns
+	}
+	rdns[e.RDNNorm] = e.ID
+
+	if x.maxID < e.ID {
+		x.maxID = e.ID
+	}
+}
+
+func (x *localIndex) remove(id int64) {
+	if old, ok := x.entries[id]; ok {
+		x.unlink(old)
+		delete(x.entries, id)
+	}
+}
+
+func (x *localIndex) unlink(e *localEntry) {
+	if children, ok := x.children[e.ParentID]; ok {
+		delete(children, e.ID)
+		if len(children) == 0 {
+			delete(x.children, e.ParentID)
+		}
+	}
+	if rdns, ok := x.rdns[e.ParentID]; ok {
+		if rdns[e.RDNNorm] == e.ID {
+			delete(rdns, e.RDNNorm)
+		}
+		if len(rdns) == 0 {
+			delete(x.rdns, e.ParentID)
+		}
+	}
+}
+
+// child returns the ID of the child entry which has the RDN.
+func (x *localIndex) child(parentID int64, rdnNorm string) (int64, bool) {
+	id, ok := x.rdns[parentID][rdnNorm]
+	return id, ok
+}
+
+// childIDs returns the sorted IDs of the children.
+func (x *localIndex) childIDs(id int64) []int64 {
+	ids := x.children[id].Values()
+	sortIDs(ids)
+	return ids
+}
+
+func (x *localIndex) hasChildren(id int64) bool {
+	return len(x.children[id]) > 0
+}
+
+// subtree returns the sorted IDs of the descendants, not including the entry itself.
+func (x *localIndex) subtree(id int64) []int64 {
+	ids := []int64{}
+	next := []int64{id}
+	for len(next) > 0 {
+		pid := next[0]
+		next = next[1:]
+		for cid := range x.children[pid] {
+			ids = append(ids, cid)
+			if len(x.children[cid]) > 0 {
+				next = append(next, cid)
+			}
+		}
+	}
+	sortIDs(ids)
+	return ids
+}
+
+func sortIDs(ids []int64) {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+}
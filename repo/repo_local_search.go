@@ -0,0 +1,206 @@
+package repo
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/pkg/errors"
+	"golang.org/x/xerrors"
+)
+
+// Search handles search request by filter.
+// This is used for SEARCH operation.
+func (r *LocalRepository) Search(ctx context.Context, baseDN *schema.DN, option *SearchOption, handler func(entry *SearchEntry) error) (int32, int32, error) {
+	reportError := func(err error) (int32, int32, error) {
+		return 0, 0, errors.Wrapf(err, "dn_norm: %s, filter: %v", baseDN.DNNormStr(), option.Filter)
+	}
+
+	// Collect the entries with the lock, then call the handler without it
+	r.mu.RLock()
+	entries, maxCnt, err := r.search(baseDN, option)
+	r.mu.RUnlock()
+	if err != nil {
+		// It's ok returning NoSuchObject error if no base DN
+		return reportError(err)
+	}
+
+	for _, entry := range entries {
+		if err := handler(entry); err != nil {
+			return reportError(err)
+		}
+	}
+
+	return int32(maxCnt), int32(len(entries)), nil
+}
+
+func (r *LocalRepository) search(baseDN *schema.DN, option *SearchOption) ([]*SearchEntry, int, error) {
+	baseDNID, err := r.findEntryID(baseDN)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ids []int64
+	switch option.Scope {
+	// Base only
+	case 0:
+		ids = []int64{baseDNID}
+	// Childlen only
+	case 1:
+		ids = r.index.childIDs(baseDNID)
+	// Base + Children including grandchildren
+	case 2:
+		ids = append([]int64{baseDNID}, r.index.subtree(baseDNID)...)
+		sortIDs(ids)
+	// Children including grandchildren
+	case 3:
+		ids = r.index.subtree(baseDNID)
+	}
+
+	compiler := &localFilterCompiler{r: r}
+	match := compiler.compile(r.schemaRegistry, option.Filter)
+
+	matched := []*localEntry{}
+	for _, id := range ids {
+		if e, ok := r.index.get(id); ok && match(e) {
+			matched = append(matched, e)
+		}
+	}
+	maxCnt := len(matched)
+
+	// Paging
+	offset := int(option.Offset)
+	if offset > len(matched) {
+		offset = len(matched)
+	}
+	matched = matched[offset:]
+	if option.PageSize > 0 && int(option.PageSize) < len(matched) {
+		matched = matched[:option.PageSize]
+	}
+
+	entries := make([]*SearchEntry, len(matched))
+	for i, e := range matched {
+		attrsOrig := make(CacheAttrsOrig, len(e.AttrsOrig)+1)
+		for k, v := range e.AttrsOrig {
+			attrsOrig[k] = append([]string{}, v...)
+		}
+
+		entry := NewSearchEntry(r.schemaRegistry, r.dnOrig(e.ID), attrsOrig)
+
+		if option.IsHasSubordinatesRequested {
+			entry.AttrsOrig()["hasSubordinates"] = []string{strings.ToUpper(strconv.FormatBool(e.IsContainer))}
+		}
+		if option.IsMemberOfRequested {
+			if _, ok := attrsOrig["memberOf"]; ok {
+				entry.AttrsOrig()["memberOf"] = r.toDNOrigs(e.AttrsNorm.ValueInt64("memberOf"))
+			}
+		}
+		for _, v := range option.RequestedAssocation {
+			if _, ok := attrsOrig[v]; ok {
+				entry.AttrsOrig()[v] = r.toDNOrigs(e.AttrsNorm.ValueInt64(v))
+			}
+		}
+
+		entries[i] = entry
+	}
+
+	return entries, maxCnt, nil
+}
+
+// Bind fetches the current bind entry by specified DN. Then execute callback with the entry.
+// The callback is expected checking the credential, account lock status and so on.
+// This is used for BIND operation.
+func (r *LocalRepository) Bind(ctx context.Context, dn *schema.DN, callback func(current *FetchedCredential) error) error {
+	r.mu.RLock()
+	id, err := r.findEntryID(dn)
+	if err != nil {
+		r.mu.RUnlock()
+		return util.NewInvalidCredentials()
+	}
+	e, _ := r.index.get(id)
+
+	memberOf := []*schema.DN{}
+	for _, v := range r.toDNOrigs(e.AttrsNorm.ValueInt64("memberOf")) {
+		dn, _ := r.schemaRegistry.NormalizeDN(v)
+		if dn != nil {
+			memberOf = append(memberOf, dn)
+		}
+	}
+	r.mu.RUnlock()
+
+	// The normalized attributes aren't modified after putting into the index
+	attrsNorm := e.AttrsNorm
+
+	var pwdAccountLockedTime time.Time
+
+	if len(attrsNorm["pwdAccountLockedTime"]) > 0 {
+		// The normalized value of generalizedTime is the unix time
+		pwdAccountLockedTime = time.Unix(attrsNorm.ValueInt64("pwdAccountLockedTime")[0], 0).UTC()
+	}
+
+	var lastPwdFailureTime *time.Time
+
+	for _, v := range attrsNorm.ValueStr("pwdFailureTime") {
+		t, err := time.Parse(schema.TIMESTAMP_NANO_FORMAT, v)
+		if err != nil {
+			return xerrors.Errorf("Failed to parse pwdFailureTime. dn_orig: %s, err: %w", dn.DNOrigStr(), err)
+		}
+		if lastPwdFailureTime == nil || t.After(*lastPwdFailureTime) {
+			lastPwdFailureTime = &t
+		}
+	}
+
+	// Fetch ppolicy
+	ppolicy, err := r.FindPPolicyByDN(ctx, dn)
+	if err != nil {
+		return xerrors.Errorf("Failed to fetch ppolicy. dn_orig: %s, err: %w", dn.DNOrigStr(), err)
+	}
+
+	fc := &FetchedCredential{
+		ID:                   id,
+		Credential:           attrsNorm.ValueStr("userPassword"),
+		MemberOf:             memberOf,
+		PPolicy:              ppolicy,
+		PwdAccountLockedTime: &pwdAccountLockedTime,
+		LastPwdFailureTime:   lastPwdFailureTime,
+		PwdFailureCount:      len(attrsNorm["pwdFailureTime"]),
+		Attrs:                attrsNorm,
+	}
+
+	// Call the callback implemented bind logic
+	return callback(fc)
+}
+
+// FindPPolicyByDN returns the password policy entry by specified DN.
+// This is used for password policy process.
+func (r *LocalRepository) FindPPolicyByDN(ctx context.Context, dn *schema.DN) (*schema.PPolicy, error) {
+	// TODO: Support user specific ppolicy
+
+	if r.schemaRegistry.DefaultPPolicyDN.IsAnonymous() {
+		return schema.NewDefaultPPolicy(), nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, err := r.findEntryID(r.schemaRegistry.DefaultPPolicyDN)
+	if err != nil {
+		if util.IsNoSuchObjectError(err) {
+			return schema.NewDefaultPPolicy(), nil
+		}
+		return nil, xerrors.Errorf("Failed to fetch ppolicy by dn = %s. err: %w", dn.DNNormStr(), err)
+	}
+	e, _ := r.index.get(id)
+
+	ppolicy := &schema.PPolicy{
+		PwdAttribute:       e.AttrsNorm.ValueStr("pwdAttribute"),
+		PwdLockout:         e.AttrsNorm.ValueStr("PwdLockout"),
+		PwdLockoutDuration: e.AttrsNorm.ValueStr("PwdLockoutDuration"),
+		PwdMaxFailure:      e.AttrsNorm.ValueStr("PwdMaxFailure"),
+	}
+
+	return ppolicy, nil
+}
@@ -0,0 +1,707 @@
+package repo
+
+import (
+	"context"
+	"log"
+	"strconv"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/pkg/errors"
+	"golang.org/x/xerrors"
+)
+
+// localTx collects the changes of a write operation. The index isn't changed until commit.
+// The caller must hold the write lock of the repository.
+type localTx struct {
+	r       *LocalRepository
+	changed map[int64]*localEntry
+	deleted util.Int64Set
+}
+
+func (r *LocalRepository) begin() *localTx {
+	return &localTx{
+		r:       r,
+		changed: map[int64]*localEntry{},
+		deleted: util.NewInt64Set(),
+	}
+}
+
+// get returns the entry in the transaction. The returned entry must not be modified.
+func (tx *localTx) get(id int64) (*localEntry, bool) {
+	if _, ok := tx.deleted[id]; ok {
+		return nil, false
+	}
+	if e, ok := tx.changed[id]; ok {
+		return e, true
+	}
+	return tx.r.index.get(id)
+}
+
+// edit returns the modifiable entry with the next revision.
+func (tx *localTx) edit(id int64) (*localEntry, error) {
+	if e, ok := tx.changed[id]; ok {
+		return e, nil
+	}
+	e, ok := tx.get(id)
+	if !ok {
+		return nil, util.NewRetryError(xerrors.Errorf("Detected inconsistency. Not found entry. id: %d", id))
+	}
+	e = e.clone()
+	e.Rev++
+	tx.changed[id] = e
+	return e, nil
+}
+
+// editRev is the same as edit, but it returns RetryError if the entry was modified after fetching the revision.
+func (tx *localTx) editRev(id, rev int64) (*localEntry, error) {
+	e, err := tx.edit(id)
+	if err != nil {
+		return nil, err
+	}
+	if e.Rev != rev+1 {
+		return nil, util.NewRetryError(xerrors.Errorf("Detected concurrent modification. id: %d, rev: %d", id, rev))
+	}
+	return e, nil
+}
+
+func (tx *localTx) create(e *localEntry) {
+	tx.changed[e.ID] = e
+}
+
+func (tx *localTx) delete(id int64) {
+	delete(tx.changed, id)
+	tx.deleted.Add(id)
+}
+
+// hasChildren returns true if the entry has the children except the ignored entry.
+func (tx *localTx) hasChildren(id, ignore int64) bool {
+	for cid := range tx.r.index.children[id] {
+		if cid == ignore {
+			continue
+		}
+		if e, ok := tx.get(cid); ok && e.ParentID == id {
+			return true
+		}
+	}
+	for _, e := range tx.changed {
+		if e.ParentID == id && e.ID != ignore {
+			return true
+		}
+	}
+	return false
+}
+
+// addMemberOf adds the id to memberOf of the target entries.
+func (tx *localTx) addMemberOf(ids []string, id int64) error {
+	v := strconv.FormatInt(id, 10)
+	for _, tid := range ids {
+		t, err := tx.edit(parseID(tid))
+		if err != nil {
+			return err
+		}
+		t.AttrsOrig["memberOf"] = appendValue(t.AttrsOrig["memberOf"], v)
+	}
+	return nil
+}
+
+// deleteMemberOf removes the id from memberOf of the target entries.
+func (tx *localTx) deleteMemberOf(ids []string, id int64) error {
+	v := strconv.FormatInt(id, 10)
+	for _, tid := range ids {
+		t, err := tx.edit(parseID(tid))
+		if err != nil {
+			log.Printf("warn: Detected inconsistency while removing memberOf. id: %d", id)
+			return err
+		}
+		setValues(t.AttrsOrig, "memberOf", removeValues(t.AttrsOrig["memberOf"], v))
+	}
+	return nil
+}
+
+// commit saves the changes into the storage, then applies them to the index.
+func (tx *localTx) commit(ctx context.Context) error {
+	r := tx.r
+
+	upserts := make([]*localEntry, 0, len(tx.changed))
+	for _, e := range tx.changed {
+		if err := r.normalizeEntry(e); err != nil {
+			return err
+		}
+		upserts = append(upserts, e)
+	}
+	// Save the parents first
+	sortEntries(upserts)
+	deletes := tx.deleted.Values()
+
+	if err := r.storage.Save(ctx, upserts, deletes); err != nil {
+		var retryError *util.RetryError
+		if xerrors.As(err, &retryError) {
+			// The entries were changed by others, reload them for the retry
+			ids := deletes
+			for _, e := range upserts {
+				ids = append(ids, e.ID)
+			}
+			if rerr := r.reload(ctx, ids, false); rerr != nil {
+				log.Printf("warn: Failed to reload the entries. err: %v", rerr)
+			}
+		}
+		return err
+	}
+
+	for _, id := range deletes {
+		r.index.remove(id)
+	}
+	for _, e := range upserts {
+		r.index.put(e)
+	}
+
+	return nil
+}
+
+// Insert creates the entry by specified entry data.
+func (r *LocalRepository) Insert(ctx context.Context, changelog *Changelog) (int64, error) {
+	dn := changelog.DN()
+	reportError := func(err error) (int64, error) {
+		return -1, errors.Wrapf(err, "dn_norm: %s", dn.DNNormStr())
+	}
+
+	r.mu.Lock()
+
+	m, err := r.insertInternal(ctx, changelog)
+	if err != nil {
+		r.mu.Unlock()
+		return reportError(err)
+	}
+
+	r.mu.Unlock()
+	r.publish(m)
+
+	log.Printf("info: Added. id: %d, dn_norm: %s", m.ID, changelog.DNNorm())
+
+	return m.ID, nil
+}
+
+func (r *LocalRepository) insertInternal(ctx context.Context, changelog *Changelog) (*NotifyMessage, error) {
+	dn := changelog.DN()
+	tx := r.begin()
+
+	// Step 1: Find the parent, then update it if it's not container yet
+	var pid int64
+	dep := []int64{}
+	if !dn.IsSuffix(r.schemaRegistry.SuffixDN) {
+		var err error
+		pid, err = r.findEntryID(dn.ParentDN())
+		if err != nil {
+			log.Printf("warn: No parent entry but try to insert the sub. dn_norm: %s", changelog.DNNorm())
+			return nil, err
+		}
+
+		if p, _ := tx.get(pid); !p.IsContainer {
+			p, err := tx.edit(pid)
+			if err != nil {
+				return nil, err
+			}
+			p.IsContainer = true
+			p.Path = append(append([]int64{}, r.parentPath(tx, p)...), p.ID)
+			dep = append(dep, p.ID)
+		}
+	}
+
+	if _, ok := r.index.child(pid, dn.RDNNormStr()); ok {
+		log.Printf("warn: The new entry already exists. parentId: %d, dn_norm: %s", pid, changelog.DNNorm())
+		return nil, util.NewAlreadyExists()
+	}
+
+	// Step 2: Resolve the association
+	tids := util.NewStringSet()
+	attrsOrig := changelog.ToNewAttrsOrig()
+	for _, name := range []string{"member", "uniqueMember"} {
+		if v, ok := attrsOrig[name]; ok {
+			ids, err := r.dnsToIDs(name, v)
+			if err != nil {
+				return nil, err
+			}
+			attrsOrig[name] = ids
+			tids.AddAll(ids...)
+		}
+	}
+
+	// Step 3: Insert entry
+	newEntry := &localEntry{
+		ID:        r.nextID(),
+		UUID:      attrsOrig["entryUUID"][0],
+		Rev:       1,
+		ParentID:  pid,
+		RDNNorm:   dn.RDNNormStr(),
+		RDNOrig:   dn.RDNOrigEncodedStr(),
+		AttrsOrig: attrsOrig,
+	}
+	tx.create(newEntry)
+
+	// Step 4: Update memberOf of the target entries
+	mids := tids.Values()
+	if err := tx.addMemberOf(mids, newEntry.ID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return &NotifyMessage{
+		Issuer:      r.serverID,
+		ID:          newEntry.ID,
+		Op:          NotifyAdd,
+		Rev:         1,
+		Association: len(mids) > 0,
+		Dependant:   dep,
+	}, nil
+}
+
+// Update modifies the entry by specified change data.
+// This is used for MOD operation.
+func (r *LocalRepository) Update(ctx context.Context, dn *schema.DN, callback func(attrsOrig AttrsOrig) (*Changelog, error)) error {
+	reportError := func(err error) error {
+		return errors.Wrapf(err, "dn_norm: %s", dn.DNNormStr())
+	}
+
+	// The callback may resolve the association with the lock, so call it without the write lock
+	current, err := r.fetch(dn)
+	if err != nil {
+		return reportError(err)
+	}
+
+	changelog, err := callback(current.clone().AttrsOrig)
+	if err != nil {
+		return reportError(err)
+	}
+
+	r.mu.Lock()
+
+	m, err := r.updateInternal(ctx, current, changelog)
+	if err != nil {
+		r.mu.Unlock()
+		return reportError(err)
+	}
+
+	r.mu.Unlock()
+	r.publish(m)
+
+	log.Printf("info: Modified. dn_norm: %s", dn.DNNormStr())
+
+	return nil
+}
+
+func (r *LocalRepository) updateInternal(ctx context.Context, current *localEntry, changelog *Changelog) (*NotifyMessage, error) {
+	id := current.ID
+	ops := changelog.ToDiff()
+
+	// No modification
+	if len(ops) == 0 {
+		return nil, nil
+	}
+
+	tx := r.begin()
+	e, err := tx.editRev(id, current.Rev)
+	if err != nil {
+		return nil, err
+	}
+	r.applyChangelog(e, changelog, ops)
+
+	// Association
+	associationChanged, err := r.applyMemberOfDiff(tx, changelog, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return &NotifyMessage{
+		Issuer:      r.serverID,
+		ID:          id,
+		Op:          NotifyMod,
+		Rev:         e.Rev,
+		Association: associationChanged,
+	}, nil
+}
+
+// UpdateDN modifies the entry DN by specified change data.
+// This is used for MODRDN operation.
+func (r *LocalRepository) UpdateDN(ctx context.Context, oldDN, newDN *schema.DN, oldRDN *schema.RelativeDN,
+	callback func(attrsOrig AttrsOrig) (*Changelog, error)) error {
+	reportError := func(err error) error {
+		return errors.Wrapf(err, "old_dn_norm: %s, new_dn_norm: %s", oldDN.DNNormStr(), newDN.DNNormStr())
+	}
+
+	// The callback may resolve the association with the lock, so call it without the write lock
+	current, err := r.fetch(oldDN)
+	if err != nil {
+		return reportError(err)
+	}
+
+	changelog, err := callback(current.clone().AttrsOrig)
+	if err != nil {
+		return reportError(err)
+	}
+
+	r.mu.Lock()
+
+	m, err := r.updateDNInternal(ctx, current, changelog)
+	if err != nil {
+		r.mu.Unlock()
+		return reportError(err)
+	}
+
+	r.mu.Unlock()
+	r.publish(m)
+
+	log.Printf("info: Modified. old_dn_norm: %s, new_dn_norm: %s", oldDN.DNNormStr(), newDN.DNNormStr())
+
+	return nil
+}
+
+func (r *LocalRepository) updateDNInternal(ctx context.Context, current *localEntry, changelog *Changelog) (*NotifyMessage, error) {
+	id := current.ID
+	newDN := changelog.NewDN()
+
+	tx := r.begin()
+	e, err := tx.editRev(id, current.Rev)
+	if err != nil {
+		return nil, err
+	}
+
+	dependant := []int64{}
+	updateSubTree := false
+
+	if !changelog.DN().ParentDN().Equal(newDN.ParentDN()) {
+		// Step 1: Find the new parent
+		newPID, err := r.findEntryID(newDN.ParentDN())
+		if err != nil {
+			return nil, err
+		}
+		if newPID == id || contains(r.index.subtree(id), newPID) {
+			return nil, util.NewUnwillingToPerform("cannot move the entry under itself")
+		}
+
+		// Step 2: Update new parent if no children before moving
+		newParent, _ := tx.get(newPID)
+		if !newParent.IsContainer {
+			np, err := tx.edit(newPID)
+			if err != nil {
+				return nil, err
+			}
+			np.IsContainer = true
+			np.Path = append(append([]int64{}, r.parentPath(tx, np)...), np.ID)
+			newParent = np
+			dependant = append(dependant, newPID)
+		}
+
+		// Step 3: Now Moving. Update entry with new parent ID, also update path if it's container
+		oldPID := e.ParentID
+		e.ParentID = newPID
+		if e.IsContainer {
+			e.Path = append(append([]int64{}, newParent.Path...), e.ID)
+
+			// Update path of the sub containers
+			for _, cid := range r.index.subtree(id) {
+				if c, _ := tx.get(cid); !c.IsContainer {
+					continue
+				}
+				c, err := tx.edit(cid)
+				if err != nil {
+					return nil, err
+				}
+				fromIndex := 0
+				for i, v := range c.Path {
+					if v == id {
+						fromIndex = i
+						break
+					}
+				}
+				c.Path = append(append([]int64{}, newParent.Path...), c.Path[fromIndex:]...)
+				updateSubTree = true
+			}
+		}
+
+		// Step 4: Update old parent if no children after moving
+		if oldPID != 0 && !tx.hasChildren(oldPID, id) {
+			op, err := tx.edit(oldPID)
+			if err != nil {
+				return nil, err
+			}
+			op.IsContainer = false
+			op.Path = nil
+			dependant = append(dependant, oldPID)
+		}
+	}
+
+	// Step 5: Update entry
+	if cid, ok := r.index.child(e.ParentID, newDN.RDNNormStr()); ok && cid != id {
+		log.Printf("warn: The new entry already exists. dn_norm: %s", newDN.DNNormStr())
+		return nil, util.NewAlreadyExists()
+	}
+	e.RDNNorm = newDN.RDNNormStr()
+	e.RDNOrig = newDN.RDNOrigEncodedStr()
+	r.applyChangelog(e, changelog, changelog.ToDiff())
+
+	associationChanged, err := r.applyMemberOfDiff(tx, changelog, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return &NotifyMessage{
+		Issuer:      r.serverID,
+		ID:          id,
+		Op:          NotifyMod,
+		Rev:         e.Rev,
+		Association: associationChanged,
+		Dependant:   dependant,
+		Sub:         updateSubTree,
+	}, nil
+}
+
+// DeleteByDN deletes the entry by specified DN.
+func (r *LocalRepository) DeleteByDN(ctx context.Context, dn *schema.DN) error {
+	r.mu.Lock()
+
+	m, err := r.deleteInternal(ctx, dn)
+	if err != nil {
+		r.mu.Unlock()
+		return errors.Wrapf(err, "dn_norm: %s", dn.DNNormStr())
+	}
+
+	r.mu.Unlock()
+	r.publish(m)
+
+	log.Printf("info: Deleted. id: %d, dn_norm: %s", m.ID, dn.DNNormStr())
+
+	return nil
+}
+
+func (r *LocalRepository) deleteInternal(ctx context.Context, dn *schema.DN) (*NotifyMessage, error) {
+	id, err := r.findEntryID(dn)
+	if err != nil {
+		return nil, err
+	}
+	e, _ := r.index.get(id)
+
+	// Not allowed error if the entry has children yet
+	if r.index.hasChildren(id) {
+		return nil, util.NewNotAllowedOnNonLeaf()
+	}
+
+	tx := r.begin()
+	tx.delete(id)
+
+	// Delete memberOf of the target entries
+	mids := util.NewStringSet()
+	mids.AddAll(e.AttrsOrig["member"]...)
+	mids.AddAll(e.AttrsOrig["uniqueMember"]...)
+	if err := tx.deleteMemberOf(mids.Values(), id); err != nil {
+		return nil, err
+	}
+
+	// Delete member/uniqueMember of the target entries
+	v := strconv.FormatInt(id, 10)
+	for _, gid := range e.AttrsOrig["memberOf"] {
+		g, err := tx.edit(parseID(gid))
+		if err != nil {
+			log.Printf("warn: Detected inconsistency while removing member. dn_norm: %s", dn.DNNormStr())
+			return nil, err
+		}
+		setValues(g.AttrsOrig, "member", removeValues(g.AttrsOrig["member"], v))
+		setValues(g.AttrsOrig, "uniqueMember", removeValues(g.AttrsOrig["uniqueMember"], v))
+	}
+
+	// Update parent if no children
+	dep := []int64{}
+	if e.ParentID != 0 && !tx.hasChildren(e.ParentID, id) {
+		p, err := tx.edit(e.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		p.IsContainer = false
+		p.Path = nil
+		dep = append(dep, p.ID)
+	}
+
+	if err := tx.commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return &NotifyMessage{
+		Issuer:      r.serverID,
+		ID:          id,
+		Op:          NotifyDel,
+		Rev:         e.Rev, // Deleted version
+		Association: true,
+		Dependant:   dep,
+	}, nil
+}
+
+// Reset deletes all entries. This is used for the tests.
+func (r *LocalRepository) Reset(ctx context.Context) error {
+	r.mu.Lock()
+
+	// Delete the children before the parent
+	levels := [][]int64{}
+	for next := r.index.childIDs(0); len(next) > 0; {
+		levels = append(levels, next)
+		children := []int64{}
+		for _, id := range next {
+			children = append(children, r.index.childIDs(id)...)
+		}
+		next = children
+	}
+	ids := []int64{}
+	for i := len(levels) - 1; i >= 0; i-- {
+		ids = append(ids, levels[i]...)
+	}
+
+	if err := r.storage.Save(ctx, nil, ids); err != nil {
+		r.mu.Unlock()
+		return errors.Wrap(err, "Failed to reset")
+	}
+
+	roots := []int64{}
+	if len(levels) > 0 {
+		roots = levels[0]
+	}
+	r.index = newLocalIndex()
+
+	r.mu.Unlock()
+
+	for _, id := range roots {
+		r.publish(&NotifyMessage{
+			Issuer: r.serverID,
+			ID:     id,
+			Op:     NotifyDel,
+			Sub:    true,
+		})
+	}
+
+	log.Printf("info: Reset. count: %d", len(ids))
+
+	return nil
+}
+
+// Association resolves the association related attributes in the attributes.
+// This is used for MOD operation.
+func (r *LocalRepository) Association(ctx context.Context, sv *schema.SchemaValue) (*schema.SchemaValue, error) {
+	r.mu.RLock()
+	ids, err := r.dnsToIDs(sv.Name(), sv.Orig())
+	r.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return schema.NewSchemaValue(r.schemaRegistry, sv.Name(), ids)
+}
+
+// applyChangelog applies the diff of the changelog to the entry, then records the modifier.
+func (r *LocalRepository) applyChangelog(e *localEntry, changelog *Changelog, ops map[string]*ModOperation) {
+	for k, v := range ops {
+		if v.IsReplace() {
+			e.AttrsOrig[k] = append([]string{}, v.Replace...)
+		} else if v.IsAdd() || v.IsDelete() {
+			values := append([]string{}, e.AttrsOrig[k]...)
+			values = append(values, v.Add...)
+			setValues(e.AttrsOrig, k, removeValues(values, v.Delete...))
+		} else if v.IsClear() {
+			delete(e.AttrsOrig, k)
+		}
+	}
+
+	e.AttrsOrig["modifiersName"] = []string{changelog.Requester().DNOrigEncodedStrWithoutSuffix(r.schemaRegistry.SuffixDN)}
+	e.AttrsOrig["modifyTimestamp"] = []string{changelog.Timestamp()}
+}
+
+// applyMemberOfDiff updates memberOf of the target entries by the association diff.
+func (r *LocalRepository) applyMemberOfDiff(tx *localTx, changelog *Changelog, id int64) (bool, error) {
+	add, del := changelog.ToMemberOfDiff()
+	if len(add) == 0 && len(del) == 0 {
+		return false, nil
+	}
+	if err := tx.addMemberOf(add, id); err != nil {
+		return false, err
+	}
+	if err := tx.deleteMemberOf(del, id); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func parseID(s string) int64 {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		// Not found ID
+		return -1
+	}
+	return id
+}
+
+func appendValue(values []string, v string) []string {
+	for _, o := range values {
+		if o == v {
+			return values
+		}
+	}
+	return append(values, v)
+}
+
+func removeValues(values []string, remove ...string) []string {
+	rtn := make([]string, 0, len(values))
+	for _, v := range values {
+		if !containsStr(remove, v) {
+			rtn = append(rtn, v)
+		}
+	}
+	return rtn
+}
+
+// setValues sets the values, or removes the attribute if no values.
+func setValues(attrsOrig AttrsOrig, name string, values []string) {
+	if len(values) == 0 {
+		delete(attrsOrig, name)
+		return
+	}
+	attrsOrig[name] = values
+}
+
+func containsStr(values []string, v string) bool {
+	for _, o := range values {
+		if o == v {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(ids []int64, id int64) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// sortEntries sorts the entries by the ID, so the new entry comes after its parent.
+func sortEntries(entries []*localEntry) {
+	ids := make([]int64, len(entries))
+	m := make(map[int64]*localEntry, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+		m[e.ID] = e
+	}
+	sortIDs(ids)
+	for i, id := range ids {
+		entries[i] = m[id]
+	}
+}
@@ -0,0 +1,184 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/cloudldap/cloudldap/auth"
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+)
+
+// The memory backend holds the entries only in the process. It's lost when the process exits.
+// The URL is memory:// and it can be seeded from the LDIF files at startup by memory://?ldif=/path/to/seed.ldif.
+// The ldif parameter can be specified multiple times. The parent entry must appear before the children,
+// and the group must appear after its members.
+
+func init() {
+	RegisterRepository("memory", newMemoryRepository)
+}
+
+func newMemoryRepository(config *DBRepositoryConfig, u *url.URL, sr *schema.SchemaRegistry) (Repository, error) {
+	seeds := []*LDIFEntry{}
+	for _, v := range u.Query()["ldif"] {
+		entries, err := ReadLDIFFile(v)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, entries...)
+	}
+
+	storage := newMemoryStorage()
+
+	// Each repository has own storage, so no one receives the change events
+	repo := newLocalRepository(config, sr, storage, fmt.Sprintf("memory:%p", storage))
+
+	if err := repo.Init(); err != nil {
+		return nil, err
+	}
+
+	if err := repo.Seed(context.Background(), seeds); err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// Seed adds the entries in order as the root DN.
+// The entryUUID is generated if the entry doesn't have it.
+func (r *LocalRepository) Seed(ctx context.Context, entries []*LDIFEntry) error {
+	ctx = auth.SetSessionContext(ctx, &auth.AuthSession{
+		DN:     r.schemaRegistry.RootDN,
+		IsRoot: true,
+	})
+
+	for _, entry := range entries {
+		dn, err := r.schemaRegistry.NormalizeDN(entry.DN)
+		if err != nil {
+			return xerrors.Errorf("Invalid DN in seed. dn: %s, err: %w", entry.DN, err)
+		}
+
+		changelog, err := NewChangelog(ctx, r.schemaRegistry, dn, AttrsOrig{})
+		if err != nil {
+			return xerrors.Errorf("Failed to seed. dn: %s, err: %w", entry.DN, err)
+		}
+		for _, k := range entry.Names {
+			sv, err := schema.NewSchemaValue(r.schemaRegistry, k, entry.Attrs[k])
+			if err != nil {
+				return xerrors.Errorf("Invalid attribute in seed. dn: %s, err: %w", entry.DN, err)
+			}
+			if err := changelog.Add(sv); err != nil {
+				return xerrors.Errorf("Invalid attribute in seed. dn: %s, err: %w", entry.DN, err)
+			}
+		}
+		if !changelog.HasAttr("entryUUID") {
+			sv, err := schema.NewSchemaValue(r.schemaRegistry, "entryUUID", []string{uuid.New().String()})
+			if err != nil {
+				return xerrors.Errorf("Failed to seed. dn: %s, err: %w", entry.DN, err)
+			}
+			if err := changelog.AddWithouCheck(sv); err != nil {
+				return xerrors.Errorf("Failed to seed. dn: %s, err: %w", entry.DN, err)
+			}
+		}
+		if err := changelog.Validate(); err != nil {
+			return xerrors.Errorf("Invalid entry in seed. dn: %s, err: %w", entry.DN, err)
+		}
+
+		if _, err := r.Insert(ctx, changelog); err != nil {
+			return xerrors.Errorf("Failed to seed. dn: %s, err: %w", entry.DN, err)
+		}
+	}
+
+	return nil
+}
+
+// memoryStorage is the localStorage which keeps the copy of the entries in the process.
+type memoryStorage struct {
+	mu           sync.RWMutex
+	entries      map[int64]*localEntry
+	bindAttempts *MemoryBindAttemptStore
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		entries:      map[int64]*localEntry{},
+		bindAttempts: NewMemoryBindAttemptStore(),
+	}
+}
+
+func (s *memoryStorage) Init(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStorage) LoadAll(ctx context.Context, callback func(entry *localEntry) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range sortedKeys(s.entries) {
+		if err := callback(s.entries[id].clone()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) Load(ctx context.Context, ids []int64) ([]*localEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := []*localEntry{}
+	for _, id := range ids {
+		if e, ok := s.entries[id]; ok {
+			entries = append(entries, e.clone())
+		}
+	}
+	return entries, nil
+}
+
+func (s *memoryStorage) Save(ctx context.Context, upserts []*localEntry, deletes []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check all before saving to keep the entries if it fails
+	for _, e := range upserts {
+		current, ok := s.entries[e.ID]
+		if (e.Rev == 1 && ok) || (e.Rev != 1 && (!ok || current.Rev != e.Rev-1)) {
+			return util.NewRetryError(xerrors.Errorf("Detected inconsistency while saving entry. id: %d, rev: %d", e.ID, e.Rev))
+		}
+	}
+	for _, id := range deletes {
+		if _, ok := s.entries[id]; !ok {
+			return util.NewRetryError(xerrors.Errorf("Detected inconsistency while deleting entry. id: %d", id))
+		}
+	}
+
+	for _, e := range upserts {
+		s.entries[e.ID] = e.clone()
+	}
+	for _, id := range deletes {
+		delete(s.entries, id)
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) BindAttemptStore() BindAttemptStore {
+	return s.bindAttempts
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+func sortedKeys(m map[int64]*localEntry) []int64 {
+	ids := make([]int64, 0, len(m))
+	for k := range m {
+		ids = append(ids, k)
+	}
+	sortIDs(ids)
+	return ids
+}
@@ -0,0 +1,181 @@
+//go:build test
+
+package repo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/goldap/message"
+)
+
+func TestMemoryRepositoryConformance(t *testing.T) {
+	testRepositoryConformance(t, func(t *testing.T, sr *schema.SchemaRegistry) Repository {
+		r, err := NewRepository(&DBRepositoryConfig{
+			URL:      "memory://",
+			ServerID: "memory",
+		}, sr)
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		return r
+	})
+}
+
+func TestMemoryRepositorySeed(t *testing.T) {
+	sr := schema.NewSchemaRegistry(&schema.SchemaConfig{
+		Suffix:       "dc=example,dc=com",
+		RootDN:       "cn=Manager,dc=example,dc=com",
+		CustomSchema: []string{},
+	})
+
+	path := filepath.Join(t.TempDir(), "seed.ldif")
+	err := os.WriteFile(path, []byte(`dn: dc=example,dc=com
+objectClass: top
+objectClass: dcObject
+objectClass: organization
+dc: example
+o: Example
+
+dn: ou=Users,dc=example,dc=com
+objectClass: organizationalUnit
+ou: Users
+
+dn: ou=Groups,dc=example,dc=com
+objectClass: organizationalUnit
+ou: Groups
+
+dn: uid=user1,ou=Users,dc=example,dc=com
+objectClass: inetOrgPerson
+uid: user1
+cn: user1
+sn: user1
+userPassword: password1
+
+dn: cn=group1,ou=Groups,dc=example,dc=com
+objectClass: groupOfNames
+cn: group1
+member: uid=user1,ou=Users,dc=example,dc=com
+`), 0600)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	r, err := NewRepository(&DBRepositoryConfig{
+		URL:      "memory://?ldif=" + path,
+		ServerID: "memory",
+	}, sr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	c := &conformance{t: t, sr: sr, r: r}
+	c.assertDNs("dc=example,dc=com", 2,
+		"dc=example,dc=com",
+		"ou=Users,dc=example,dc=com",
+		"ou=Groups,dc=example,dc=com",
+		"uid=user1,ou=Users,dc=example,dc=com",
+		"cn=group1,ou=Groups,dc=example,dc=com",
+	)
+	c.assertAttr("uid=user1,ou=Users,dc=example,dc=com", "memberOf", "cn=group1,ou=Groups,dc=example,dc=com")
+	c.assertAttr("cn=group1,ou=Groups,dc=example,dc=com", "member", "uid=user1,ou=Users,dc=example,dc=com")
+
+	// Reset removes all entries
+	if err := r.(*LocalRepository).Reset(c.context()); err != nil {
+		t.Fatalf("Unexpected reset error: %+v", err)
+	}
+	if _, err := c.search("dc=example,dc=com", 0); err == nil {
+		t.Errorf("Expected no such object error after reset")
+	}
+	c.mustAdd("dc=example,dc=com", map[string][]string{
+		"objectClass": {"top", "dcObject", "organization"},
+		"dc":          {"example"},
+		"o":           {"Example"},
+	})
+	c.assertDNs("dc=example,dc=com", 2, "dc=example,dc=com")
+}
+
+func TestMemoryRepositorySeedError(t *testing.T) {
+	sr := schema.NewSchemaRegistry(&schema.SchemaConfig{
+		Suffix:       "dc=example,dc=com",
+		RootDN:       "cn=Manager,dc=example,dc=com",
+		CustomSchema: []string{},
+	})
+
+	path := filepath.Join(t.TempDir(), "seed.ldif")
+	err := os.WriteFile(path, []byte(`dn: ou=Users,dc=example,dc=com
+objectClass: organizationalUnit
+ou: Users
+`), 0600)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	// No parent
+	_, err = NewRepository(&DBRepositoryConfig{
+		URL: "memory://?ldif=" + path,
+	}, sr)
+	if err == nil {
+		t.Errorf("Expected error for the seed without the parent")
+	}
+}
+
+func TestMemoryRepositoryPaging(t *testing.T) {
+	sr := schema.NewSchemaRegistry(&schema.SchemaConfig{
+		Suffix:       "dc=example,dc=com",
+		RootDN:       "cn=Manager,dc=example,dc=com",
+		CustomSchema: []string{},
+	})
+	r, err := NewRepository(&DBRepositoryConfig{URL: "memory://"}, sr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	c := &conformance{t: t, sr: sr, r: r}
+	c.mustAdd("dc=example,dc=com", map[string][]string{
+		"objectClass": {"top", "dcObject", "organization"},
+		"dc":          {"example"},
+		"o":           {"Example"},
+	})
+	c.mustAdd("ou=Users,dc=example,dc=com", organizationalUnit("Users"))
+	for _, uid := range []string{"user1", "user2", "user3", "user4", "user5"} {
+		c.mustAdd("uid="+uid+",ou=Users,dc=example,dc=com", inetOrgPerson(uid))
+	}
+
+	testcases := []struct {
+		Offset   int32
+		PageSize int32
+		Expected []string
+	}{
+		{0, 2, []string{"user1", "user2"}},
+		{2, 2, []string{"user3", "user4"}},
+		{4, 2, []string{"user5"}},
+		{6, 2, []string{}},
+		{1, 0, []string{"user2", "user3", "user4", "user5"}},
+	}
+
+	for i, tc := range testcases {
+		got := []string{}
+		maxCnt, cnt, err := r.Search(c.context(), c.dn("ou=Users,dc=example,dc=com"), &SearchOption{
+			Scope:    1,
+			Filter:   message.FilterPresent("objectClass"),
+			Offset:   tc.Offset,
+			PageSize: tc.PageSize,
+		}, func(entry *SearchEntry) error {
+			_, v, _ := entry.AttrOrig("uid")
+			got = append(got, v...)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Unexpected search error: %+v", err)
+		}
+		if maxCnt != 5 || int(cnt) != len(tc.Expected) {
+			t.Errorf("Unexpected count at %d. expected: 5/%d, got: %d/%d", i, len(tc.Expected), maxCnt, cnt)
+		}
+		if !equalStrings(tc.Expected, got) {
+			t.Errorf("Unexpected page at %d. expected: %v, got: %v", i, tc.Expected, got)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"golang.org/x/xerrors"
+)
+
+// The postgres backend stores the entries in PostgreSQL and caches them in the cache DB, see cache.go.
+// The cache of the other instances is updated by the changelog notified on channel 'entry_update', see catchUp.
+// The searches can be served by SQL instead of the cache DB, see SearchModeCache.
+
+const notifyChannel = "entry_update"
+
+func init() {
+	RegisterRepository("postgres", newPostgresRepository)
+	RegisterRepository("postgresql", newPostgresRepository)
+}
+
+type DBRepository struct {
+	db *sqlx.DB
+	// readDB serves the searches by SQL, it's the read replica or the same as db
+	readDB         *sqlx.DB
+	cacheDB        CacheDB
+	cacheReady     int32
+	schemaRegistry *schema.SchemaRegistry
+	serverID       string
+	config         *DBRepositoryConfig
+	// changeSeq is the sequence of the changelog which the listener starts from
+	changeSeq int64
+}
+
+func newPostgresRepository(config *DBRepositoryConfig, u *url.URL, sr *schema.SchemaRegistry) (Repository, error) {
+	if !isValidSearchMode(config.SearchMode) {
+		return nil, xerrors.Errorf("Unsupported search mode: %s", config.SearchMode)
+	}
+
+	cacheDB, err := NewCacheDB(config.CacheIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	// Init DB Connection
+	connInfo := postgresConnInfo(config)
+	db, err := sqlx.Connect("postgres", connInfo)
+	if err != nil {
+		return nil, xerrors.Errorf("Connect error. host=%s, port=%d, user=%s, dbname=%s, err: %w",
+			config.DBHostName, config.DBPort, config.DBUser, config.DBName, err)
+	}
+	db.SetMaxOpenConns(config.DBMaxOpenConns)
+	db.SetMaxIdleConns(config.DBMaxIdleConns)
+	// db.SetConnMaxLifetime(time.Hour)
+
+	readDB := db
+	if config.ReplicaURL != "" {
+		readDB, err = sqlx.Connect("postgres", config.ReplicaURL)
+		if err != nil {
+			return nil, xerrors.Errorf("Connect error to the read replica. err: %w", err)
+		}
+		readDB.SetMaxOpenConns(config.DBMaxOpenConns)
+		readDB.SetMaxIdleConns(config.DBMaxIdleConns)
+	}
+
+	repo := &DefaultRepository{
+		DBRepository: &DBRepository{
+			db:             db,
+			readDB:         readDB,
+			cacheDB:        cacheDB,
+			schemaRegistry: sr,
+			serverID:       config.ServerID,
+			config:         config,
+		},
+	}
+
+	err = repo.Init()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := repo.listen(connInfo); err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// postgresConnInfo returns the connection string. The URL is passed to lib/pq as is if it's configured,
+// so the parameters like sslmode and search_path can be set as the query parameters.
+func postgresConnInfo(config *DBRepositoryConfig) string {
+	if config.URL != "" {
+		return config.URL
+	}
+	return fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s sslmode=disable search_path=%s",
+		config.DBHostName, config.DBPort, config.DBUser, config.DBName,
+		config.DBPassword, config.DBSchema)
+}
+
+// listen starts the listener of the notifications from the other instances to update the cache.
+// The notification has only the sequence of the changelog, the changes are fetched from the changelog.
+func (r *DefaultRepository) listen(connInfo string) error {
+	reportErr := func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("alert: Failed to start listener: %s", err)
+		}
+	}
+	minReconn := 10 * time.Second
+	maxReconn := time.Minute
+	listener := pq.NewListener(connInfo, minReconn, maxReconn, reportErr)
+	err := listener.Listen(notifyChannel)
+	if err != nil {
+		return xerrors.Errorf("Failed to LISTEN to channel '%s'. err: %w", notifyChannel, err)
+	}
+
+	log.Printf("info: Listening to notifications on channel '%s'", notifyChannel)
+
+	cursor := newChangeCursor(r.changeSeq)
+
+	var reconcile <-chan time.Time
+	if r.config.ReconcileInterval > 0 {
+		reconcile = time.NewTicker(r.config.ReconcileInterval).C
+	}
+	prune := time.NewTicker(changeLogPruneInterval).C
+
+	go func() {
+		ctx := context.Background()
+		timeout := 1 * time.Minute
+
+		// Catch up the changes while starting the listener
+		if err := r.catchUp(ctx, cursor); err != nil {
+			log.Printf("error: Failed to catch up changes: %v", err)
+		}
+
+		for {
+			log.Println("Waiting for notification...")
+
+			select {
+			case n := <-listener.Notify:
+				if n == nil {
+					// The connection was re-established, the notifications may be lost
+					log.Printf("info: Reconnected, catching up changes since seq: %d", cursor.last)
+				} else {
+					log.Printf("debug: Received notification: %s", n.Extra)
+				}
+
+				if err := r.catchUp(ctx, cursor); err != nil {
+					log.Printf("error: Failed to catch up changes: %v", err)
+				}
+
+			case <-reconcile:
+				if err := r.Reconcile(ctx); err != nil {
+					log.Printf("error: Failed to reconcile cache: %v", err)
+				}
+
+			case <-prune:
+				if err := r.pruneChanges(ctx); err != nil {
+					log.Printf("error: %v", err)
+				}
+
+			case <-time.After(timeout):
+				log.Printf("Received no events for %s, checking connection", timeout.String())
+				go func() {
+					_ = listener.Ping()
+				}()
+
+				// Also wait for the missing changes to be committed or expired
+				if err := r.catchUp(ctx, cursor); err != nil {
+					log.Printf("error: Failed to catch up changes: %v", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
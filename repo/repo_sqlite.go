@@ -0,0 +1,411 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"golang.org/x/xerrors"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// The sqlite backend stores the entries in a single SQLite file, so the server runs without PostgreSQL.
+// The URL is sqlite:///path/to/ldap.db (absolute) or sqlite://ldap.db (relative).
+// The entries are held in the process by LocalRepository.
+
+func init() {
+	RegisterRepository("sqlite", newSQLiteRepository)
+}
+
+func newSQLiteRepository(config *DBRepositoryConfig, u *url.URL, sr *schema.SchemaRegistry) (Repository, error) {
+	path := u.Opaque
+	if path == "" {
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return nil, xerrors.Errorf("Invalid sqlite URL, the file path is required")
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid sqlite file path. path: %s, err: %w", path, err)
+	}
+
+	q := u.Query()
+	q.Add("_pragma", "foreign_keys(1)")
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "busy_timeout(5000)")
+	q.Set("_txlock", "immediate")
+
+	db, err := sqlx.Connect("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, xerrors.Errorf("Connect error. path: %s, err: %w", path, err)
+	}
+	// SQLite allows only one writer
+	db.SetMaxOpenConns(1)
+
+	repo := newLocalRepository(config, sr, &sqliteStorage{db: db}, "sqlite:"+path)
+
+	if err := repo.Init(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// sqliteStorage is the localStorage which stores the entries in the entry table like PostgreSQL.
+// The path and attrs_orig are stored as JSON text.
+type sqliteStorage struct {
+	db *sqlx.DB
+}
+
+type sqliteEntry struct {
+	ID          int64          `db:"id"`
+	UUID        string         `db:"uuid"`
+	Rev         int64          `db:"rev"`
+	ParentID    int64          `db:"parent_id"`
+	Path        sql.NullString `db:"path"`
+	IsContainer bool           `db:"is_container"`
+	RDNNorm     string         `db:"rdn_norm"`
+	RDNOrig     string         `db:"rdn_orig"`
+	AttrsOrig   string         `db:"attrs_orig"`
+}
+
+func (s *sqliteStorage) Init(ctx context.Context) error {
+	reportError := func(err error) error {
+		return errors.Wrap(err, "Failed to initialize DB")
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS entry (
+	id INTEGER PRIMARY KEY,
+	uuid TEXT NOT NULL,
+	rev INTEGER NOT NULL,
+	parent_id INTEGER NOT NULL,
+	path TEXT,
+	is_container BOOLEAN NOT NULL,
+	rdn_norm TEXT NOT NULL,
+	rdn_orig TEXT NOT NULL,
+	attrs_orig TEXT NOT NULL,
+
+	CONSTRAINT uniq_entry
+		UNIQUE (parent_id, rdn_norm),
+	CONSTRAINT uniq_uuid
+		UNIQUE (uuid),
+	CONSTRAINT fk_id
+		FOREIGN KEY (parent_id)
+		REFERENCES entry (id)
+		ON DELETE RESTRICT ON UPDATE RESTRICT
+);
+CREATE TABLE IF NOT EXISTS bind_attempt (
+	key TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL,
+	last_failure_time INTEGER NOT NULL,
+	banned_until INTEGER
+);
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	// Insert root of root
+	_, err = s.db.ExecContext(ctx, `
+INSERT INTO entry VALUES (0, '00000000-0000-0000-0000-000000000000', 1, 0, '[]', TRUE, 'dc=0', 'dc=0', '{"dc":["0"], "objectClass": ["dcObject"]}') ON CONFLICT DO NOTHING;
+`)
+	if err != nil {
+		return reportError(err)
+	}
+
+	return nil
+}
+
+func (s *sqliteStorage) LoadAll(ctx context.Context, callback func(entry *localEntry) error) error {
+	rows, err := s.db.QueryxContext(ctx, `
+SELECT id, uuid, rev, parent_id, path, is_container, rdn_norm, rdn_orig, attrs_orig FROM entry WHERE id != 0
+`)
+	if err != nil {
+		return errors.Wrap(err, "Failed to fetch all entries")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanSQLiteEntry(rows)
+		if err != nil {
+			return err
+		}
+		if err := callback(e); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(rows.Err(), "Failed to fetch all entries")
+}
+
+func (s *sqliteStorage) Load(ctx context.Context, ids []int64) ([]*localEntry, error) {
+	entries := []*localEntry{}
+
+	// Avoid too many variables in a query
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > 500 {
+			n = 500
+		}
+		chunk := ids[:n]
+		ids = ids[n:]
+
+		q, args, err := sqlx.In(`
+SELECT id, uuid, rev, parent_id, path, is_container, rdn_norm, rdn_orig, attrs_orig FROM entry WHERE id IN (?) AND id != 0
+`, chunk)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to fetch entries. ids: %v", chunk)
+		}
+
+		rows, err := s.db.QueryxContext(ctx, q, args...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to fetch entries. ids: %v", chunk)
+		}
+		for rows.Next() {
+			e, err := scanSQLiteEntry(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			entries = append(entries, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, errors.Wrapf(err, "Failed to fetch entries. ids: %v", chunk)
+		}
+	}
+
+	return entries, nil
+}
+
+func scanSQLiteEntry(rows *sqlx.Rows) (*localEntry, error) {
+	var dest sqliteEntry
+	if err := rows.StructScan(&dest); err != nil {
+		return nil, errors.Wrap(err, "Unexpected scan error")
+	}
+
+	e := &localEntry{
+		ID:          dest.ID,
+		UUID:        dest.UUID,
+		Rev:         dest.Rev,
+		ParentID:    dest.ParentID,
+		IsContainer: dest.IsContainer,
+		RDNNorm:     dest.RDNNorm,
+		RDNOrig:     dest.RDNOrig,
+	}
+	if dest.Path.Valid {
+		if err := json.Unmarshal([]byte(dest.Path.String), &e.Path); err != nil {
+			return nil, xerrors.Errorf("Unexpected unmarshal error. id: %d, path: %s, err: %w", dest.ID, dest.Path.String, err)
+		}
+	}
+	if err := json.Unmarshal([]byte(dest.AttrsOrig), &e.AttrsOrig); err != nil {
+		return nil, xerrors.Errorf("Unexpected unmarshal error. id: %d, attrs_orig: %s, err: %w", dest.ID, dest.AttrsOrig, err)
+	}
+
+	return e, nil
+}
+
+func (s *sqliteStorage) Save(ctx context.Context, upserts []*localEntry, deletes []int64) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return xerrors.Errorf("Failed to begin DB transaction. err: %w", err)
+	}
+
+	if err := s.save(ctx, tx, upserts, deletes); err != nil {
+		rollback(tx)
+		return err
+	}
+
+	return commit(tx)
+}
+
+func (s *sqliteStorage) save(ctx context.Context, tx *sqlx.Tx, upserts []*localEntry, deletes []int64) error {
+	for _, e := range upserts {
+		var path sql.NullString
+		if e.Path != nil {
+			b, err := json.Marshal(e.Path)
+			if err != nil {
+				return errors.Wrap(err, "Unexpected json marshal error")
+			}
+			path = sql.NullString{String: string(b), Valid: true}
+		}
+		attrsOrig, err := json.Marshal(e.AttrsOrig)
+		if err != nil {
+			return errors.Wrap(err, "Unexpected json marshal error")
+		}
+
+		var result sql.Result
+		if e.Rev == 1 {
+			result, err = tx.ExecContext(ctx, `
+INSERT INTO entry (id, uuid, rev, parent_id, path, is_container, rdn_norm, rdn_orig, attrs_orig)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+`, e.ID, e.UUID, e.Rev, e.ParentID, path, e.IsContainer, e.RDNNorm, e.RDNOrig, string(attrsOrig))
+		} else {
+			result, err = tx.ExecContext(ctx, `
+UPDATE entry
+SET
+	rev = ?,
+	parent_id = ?,
+	path = ?,
+	is_container = ?,
+	rdn_norm = ?,
+	rdn_orig = ?,
+	attrs_orig = ?
+WHERE
+	id = ?
+	AND rev = ?
+`, e.Rev, e.ParentID, path, e.IsContainer, e.RDNNorm, e.RDNOrig, string(attrsOrig), e.ID, e.Rev-1)
+		}
+		if err != nil {
+			if isSQLiteError(err, sqlite3.SQLITE_CONSTRAINT_UNIQUE) {
+				return util.NewAlreadyExists()
+			}
+			if isSQLiteError(err, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY) {
+				return util.NewRetryError(err)
+			}
+			return errors.Wrapf(err, "Failed to save entry. id: %d", e.ID)
+		}
+
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to save entry. id: %d", e.ID)
+		}
+		if updated != 1 {
+			return util.NewRetryError(xerrors.Errorf("Detected inconsistency while saving entry. id: %d, rev: %d", e.ID, e.Rev))
+		}
+	}
+
+	for _, id := range deletes {
+		result, err := tx.ExecContext(ctx, `DELETE FROM entry WHERE id = ?`, id)
+		if err != nil {
+			// Not allowed error if the entry has children yet
+			if isSQLiteError(err, sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY) {
+				return util.NewNotAllowedOnNonLeaf()
+			}
+			return errors.Wrapf(err, "Failed to delete entry. id: %d", id)
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to delete entry. id: %d", id)
+		}
+		if deleted != 1 {
+			return util.NewRetryError(xerrors.Errorf("Detected inconsistency while deleting entry. id: %d", id))
+		}
+	}
+
+	return nil
+}
+
+func (s *sqliteStorage) BindAttemptStore() BindAttemptStore {
+	return &sqliteBindAttemptStore{
+		db: s.db,
+	}
+}
+
+func (s *sqliteStorage) Close() error {
+	return s.db.Close()
+}
+
+func isSQLiteError(err error, code int) bool {
+	var serr *sqlite.Error
+	if xerrors.As(err, &serr) {
+		return serr.Code() == code
+	}
+	return false
+}
+
+// sqliteBindAttemptStore is the BindAttemptStore in the SQLite file.
+// The time is stored as the unix time in nanoseconds to compare them in SQL.
+type sqliteBindAttemptStore struct {
+	db *sqlx.DB
+}
+
+type sqliteBindAttempt struct {
+	Key             string        `db:"key"`
+	Failures        int           `db:"failures"`
+	LastFailureTime int64         `db:"last_failure_time"`
+	BannedUntil     sql.NullInt64 `db:"banned_until"`
+}
+
+func (a *sqliteBindAttempt) toBindAttempt() *BindAttempt {
+	b := &BindAttempt{
+		Key:             a.Key,
+		Failures:        a.Failures,
+		LastFailureTime: time.Unix(0, a.LastFailureTime),
+	}
+	if a.BannedUntil.Valid {
+		b.BannedUntil = sql.NullTime{Time: time.Unix(0, a.BannedUntil.Int64), Valid: true}
+	}
+	return b
+}
+
+func (d *sqliteBindAttemptStore) Find(ctx context.Context, key string) (*BindAttempt, error) {
+	var a sqliteBindAttempt
+	err := d.db.GetContext(ctx, &a, `
+SELECT key, failures, last_failure_time, banned_until FROM bind_attempt WHERE key = ?
+`, key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, xerrors.Errorf("Failed to find bind attempt. key: %s, err: %w", key, err)
+	}
+	return a.toBindAttempt(), nil
+}
+
+func (d *sqliteBindAttemptStore) RecordFailure(ctx context.Context, key string, now, windowStart time.Time) (*BindAttempt, error) {
+	var a sqliteBindAttempt
+	err := d.db.GetContext(ctx, &a, `
+INSERT INTO bind_attempt (key, failures, last_failure_time)
+VALUES (?1, 1, ?2)
+ON CONFLICT (key) DO UPDATE SET
+	failures = CASE WHEN bind_attempt.last_failure_time < ?3 THEN 1 ELSE bind_attempt.failures + 1 END,
+	last_failure_time = ?2
+RETURNING key, failures, last_failure_time, banned_until
+`, key, now.UnixNano(), windowStart.UnixNano())
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to record bind failure. key: %s, err: %w", key, err)
+	}
+	return a.toBindAttempt(), nil
+}
+
+func (d *sqliteBindAttemptStore) Ban(ctx context.Context, key string, until time.Time) error {
+	_, err := d.db.ExecContext(ctx, `
+INSERT INTO bind_attempt (key, failures, last_failure_time, banned_until)
+VALUES (?1, 0, ?2, ?3)
+ON CONFLICT (key) DO UPDATE SET banned_until = ?3
+`, key, time.Now().UnixNano(), until.UnixNano())
+	if err != nil {
+		return xerrors.Errorf("Failed to ban. key: %s, err: %w", key, err)
+	}
+	return nil
+}
+
+func (d *sqliteBindAttemptStore) Reset(ctx context.Context, key string) error {
+	_, err := d.db.ExecContext(ctx, `DELETE FROM bind_attempt WHERE key = ?`, key)
+	if err != nil {
+		return xerrors.Errorf("Failed to reset bind attempt. key: %s, err: %w", key, err)
+	}
+	return nil
+}
+
+func (d *sqliteBindAttemptStore) Purge(ctx context.Context, before time.Time) error {
+	_, err := d.db.ExecContext(ctx, `
+DELETE FROM bind_attempt WHERE last_failure_time < ?1 AND (banned_until IS NULL OR banned_until < ?1)
+`, before.UnixNano())
+	if err != nil {
+		return xerrors.Errorf("Failed to purge bind attempts. err: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+//go:build test
+
+package repo
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudldap/cloudldap/schema"
+)
+
+func newTestSQLiteRepository(t *testing.T, path string, sr *schema.SchemaRegistry) Repository {
+	r, err := NewRepository(&DBRepositoryConfig{
+		URL:      "sqlite://" + path,
+		ServerID: "sqlite",
+	}, sr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	t.Cleanup(func() {
+		r.(*LocalRepository).Close()
+	})
+	return r
+}
+
+func TestSQLiteRepositoryConformance(t *testing.T) {
+	testRepositoryConformance(t, func(t *testing.T, sr *schema.SchemaRegistry) Repository {
+		return newTestSQLiteRepository(t, filepath.Join(t.TempDir(), "ldap.db"), sr)
+	})
+}
+
+func TestSQLiteRepositorySharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ldap.db")
+	sr := schema.NewSchemaRegistry(&schema.SchemaConfig{
+		Suffix:       "dc=example,dc=com",
+		RootDN:       "cn=Manager,dc=example,dc=com",
+		CustomSchema: []string{},
+	})
+
+	c1 := &conformance{t: t, sr: sr, r: newTestSQLiteRepository(t, path, sr)}
+	c2 := &conformance{t: t, sr: sr, r: newTestSQLiteRepository(t, path, sr)}
+
+	c1.mustAdd("dc=example,dc=com", map[string][]string{
+		"objectClass": {"top", "dcObject", "organization"},
+		"dc":          {"example"},
+		"o":           {"Example"},
+	})
+	c1.mustAdd("ou=Users,dc=example,dc=com", organizationalUnit("Users"))
+	c2.mustAdd("uid=user1,ou=Users,dc=example,dc=com", inetOrgPerson("user1"))
+
+	// Both repositories see the changes by the other
+	c1.assertDNs("dc=example,dc=com", 2,
+		"dc=example,dc=com",
+		"ou=Users,dc=example,dc=com",
+		"uid=user1,ou=Users,dc=example,dc=com",
+	)
+	c2.assertDNs("dc=example,dc=com", 2,
+		"dc=example,dc=com",
+		"ou=Users,dc=example,dc=com",
+		"uid=user1,ou=Users,dc=example,dc=com",
+	)
+
+	// Reopen keeps the entries
+	c3 := &conformance{t: t, sr: sr, r: newTestSQLiteRepository(t, path, sr)}
+	c3.assertDNs("ou=Users,dc=example,dc=com", 1,
+		"uid=user1,ou=Users,dc=example,dc=com",
+	)
+
+	if err := c1.delete("uid=user1,ou=Users,dc=example,dc=com"); err != nil {
+		t.Fatalf("Unexpected delete error: %+v", err)
+	}
+	c3.assertDNs("ou=Users,dc=example,dc=com", 1)
+}
+
+func TestSQLiteBindAttemptStore(t *testing.T) {
+	sr := schema.NewSchemaRegistry(&schema.SchemaConfig{
+		Suffix:       "dc=example,dc=com",
+		RootDN:       "cn=Manager,dc=example,dc=com",
+		CustomSchema: []string{},
+	})
+	r := newTestSQLiteRepository(t, filepath.Join(t.TempDir(), "ldap.db"), sr)
+
+	c := &conformance{t: t, sr: sr, r: r}
+	ctx := c.context()
+	s := r.BindAttemptStore()
+
+	base := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	window := 10 * time.Minute
+
+	for i, d := range []time.Duration{0, time.Minute, 20 * time.Minute} {
+		now := base.Add(d)
+		a, err := s.RecordFailure(ctx, "user1", now, now.Add(-window))
+		if err != nil {
+			t.Fatalf("Unexpected record error: %+v", err)
+		}
+		// The failure out of the window restarts the count
+		expected := []int{1, 2, 1}[i]
+		if a.Failures != expected {
+			t.Errorf("Unexpected failures at %d. expected: %d, got: %d", i, expected, a.Failures)
+		}
+		if !a.LastFailureTime.Equal(now) {
+			t.Errorf("Unexpected last failure time at %d. expected: %v, got: %v", i, now, a.LastFailureTime)
+		}
+	}
+
+	until := base.Add(time.Hour)
+	if err := s.Ban(ctx, "user1", until); err != nil {
+		t.Fatalf("Unexpected ban error: %+v", err)
+	}
+	a, err := s.Find(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Unexpected find error: %+v", err)
+	}
+	if !a.BannedUntil.Valid || !a.BannedUntil.Time.Equal(until) {
+		t.Errorf("Unexpected banned until. expected: %v, got: %v", until, a.BannedUntil)
+	}
+
+	// Banned one is kept until the ban is expired
+	if err := s.Purge(ctx, base.Add(30*time.Minute)); err != nil {
+		t.Fatalf("Unexpected purge error: %+v", err)
+	}
+	if a, _ := s.Find(ctx, "user1"); a == nil {
+		t.Errorf("Unexpected purged before the ban is expired")
+	}
+	if err := s.Purge(ctx, base.Add(2*time.Hour)); err != nil {
+		t.Fatalf("Unexpected purge error: %+v", err)
+	}
+	if a, _ := s.Find(ctx, "user1"); a != nil {
+		t.Errorf("Unexpected not purged: %v", a)
+	}
+
+	if _, err := s.RecordFailure(ctx, "user2", base, base.Add(-window)); err != nil {
+		t.Fatalf("Unexpected record error: %+v", err)
+	}
+	if err := s.Reset(ctx, "user2"); err != nil {
+		t.Fatalf("Unexpected reset error: %+v", err)
+	}
+	if a, _ := s.Find(ctx, "user2"); a != nil {
+		t.Errorf("Unexpected not reset: %v", a)
+	}
+}
@@ -0,0 +1,549 @@
+//go:build test || integration
+
+package repo
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cloudldap/cloudldap/auth"
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/cloudldap/goldap/message"
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+)
+
+// testRepositoryConformance is the conformance suite which every Repository backend must pass.
+// The newRepo must return the repository which has no entries.
+func testRepositoryConformance(t *testing.T, newRepo func(t *testing.T, sr *schema.SchemaRegistry) Repository) {
+	sr := schema.NewSchemaRegistry(&schema.SchemaConfig{
+		Suffix:       "dc=example,dc=com",
+		RootDN:       "cn=Manager,dc=example,dc=com",
+		CustomSchema: []string{},
+	})
+
+	testcases := []struct {
+		Name string
+		Run  func(c *conformance)
+	}{
+		{"CRUD", testConformanceCRUD},
+		{"Scopes", testConformanceScopes},
+		{"Associations", testConformanceAssociations},
+		{"ModifyDN", testConformanceModifyDN},
+		{"ModifyDN subtree move", testConformanceMoveSubtree},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			c := &conformance{
+				t:  t,
+				sr: sr,
+				r:  newRepo(t, sr),
+			}
+			c.mustAdd("dc=example,dc=com", map[string][]string{
+				"objectClass": {"top", "dcObject", "organization"},
+				"dc":          {"example"},
+				"o":           {"Example"},
+			})
+			c.mustAdd("ou=Users,dc=example,dc=com", organizationalUnit("Users"))
+			c.mustAdd("ou=Groups,dc=example,dc=com", organizationalUnit("Groups"))
+			c.mustAdd("uid=user1,ou=Users,dc=example,dc=com", inetOrgPerson("user1"))
+			c.mustAdd("uid=user2,ou=Users,dc=example,dc=com", inetOrgPerson("user2"))
+
+			tc.Run(c)
+		})
+	}
+}
+
+func testConformanceCRUD(c *conformance) {
+	c.assertAttr("uid=user1,ou=Users,dc=example,dc=com", "sn", "User1")
+
+	c.assertError(c.add("uid=user1,ou=Users,dc=example,dc=com", inetOrgPerson("user1")), util.NewAlreadyExists(), "add duplicate")
+	c.assertError(c.add("uid=user3,ou=Missing,dc=example,dc=com", inetOrgPerson("user3")), util.NewNoSuchObject(), "add without parent")
+
+	err := c.modify("uid=user1,ou=Users,dc=example,dc=com", func(changelog *Changelog) error {
+		return changelog.Replace(c.value("sn", "Changed"))
+	})
+	if err != nil {
+		c.t.Fatalf("Unexpected modify error: %+v", err)
+	}
+	c.assertAttr("uid=user1,ou=Users,dc=example,dc=com", "sn", "Changed")
+	c.assertAttr("uid=user2,ou=Users,dc=example,dc=com", "sn", "User2")
+
+	err = c.modify("uid=user3,ou=Users,dc=example,dc=com", func(changelog *Changelog) error {
+		return changelog.Replace(c.value("sn", "Changed"))
+	})
+	c.assertError(err, util.NewNoSuchObject(), "modify missing entry")
+
+	c.assertError(c.delete("ou=Users,dc=example,dc=com"), util.NewNotAllowedOnNonLeaf(), "delete non-leaf")
+
+	if err := c.delete("uid=user2,ou=Users,dc=example,dc=com"); err != nil {
+		c.t.Fatalf("Unexpected delete error: %+v", err)
+	}
+	_, err = c.search("uid=user2,ou=Users,dc=example,dc=com", 0)
+	c.assertError(err, util.NewNoSuchObject(), "search deleted entry")
+	c.assertDNs("ou=Users,dc=example,dc=com", 2,
+		"ou=Users,dc=example,dc=com",
+		"uid=user1,ou=Users,dc=example,dc=com",
+	)
+	c.assertError(c.delete("uid=user2,ou=Users,dc=example,dc=com"), util.NewNoSuchObject(), "delete twice")
+
+	// The container becomes a leaf
+	if err := c.delete("uid=user1,ou=Users,dc=example,dc=com"); err != nil {
+		c.t.Fatalf("Unexpected delete error: %+v", err)
+	}
+	c.assertAttr("ou=Users,dc=example,dc=com", "hasSubordinates", "FALSE")
+	if err := c.delete("ou=Users,dc=example,dc=com"); err != nil {
+		c.t.Fatalf("Unexpected delete error: %+v", err)
+	}
+}
+
+func testConformanceScopes(c *conformance) {
+	c.mustAdd("ou=Sub,ou=Users,dc=example,dc=com", organizationalUnit("Sub"))
+	c.mustAdd("uid=user3,ou=Sub,ou=Users,dc=example,dc=com", inetOrgPerson("user3"))
+
+	all := []string{
+		"dc=example,dc=com",
+		"ou=Users,dc=example,dc=com",
+		"ou=Groups,dc=example,dc=com",
+		"uid=user1,ou=Users,dc=example,dc=com",
+		"uid=user2,ou=Users,dc=example,dc=com",
+		"ou=Sub,ou=Users,dc=example,dc=com",
+		"uid=user3,ou=Sub,ou=Users,dc=example,dc=com",
+	}
+
+	c.assertDNs("dc=example,dc=com", 0, "dc=example,dc=com")
+	c.assertDNs("dc=example,dc=com", 1, "ou=Users,dc=example,dc=com", "ou=Groups,dc=example,dc=com")
+	c.assertDNs("dc=example,dc=com", 2, all...)
+	c.assertDNs("dc=example,dc=com", 3, all[1:]...)
+
+	c.assertDNs("ou=Users,dc=example,dc=com", 1,
+		"uid=user1,ou=Users,dc=example,dc=com",
+		"uid=user2,ou=Users,dc=example,dc=com",
+		"ou=Sub,ou=Users,dc=example,dc=com",
+	)
+	c.assertDNs("ou=Sub,ou=Users,dc=example,dc=com", 3, "uid=user3,ou=Sub,ou=Users,dc=example,dc=com")
+	c.assertDNs("ou=Groups,dc=example,dc=com", 2, "ou=Groups,dc=example,dc=com")
+	c.assertDNs("ou=Groups,dc=example,dc=com", 3)
+	c.assertDNs("uid=user1,ou=Users,dc=example,dc=com", 1)
+
+	c.assertAttr("ou=Users,dc=example,dc=com", "hasSubordinates", "TRUE")
+	c.assertAttr("uid=user1,ou=Users,dc=example,dc=com", "hasSubordinates", "FALSE")
+
+	_, err := c.search("ou=Missing,dc=example,dc=com", 2)
+	c.assertError(err, util.NewNoSuchObject(), "search missing base")
+}
+
+func testConformanceAssociations(c *conformance) {
+	user1 := "uid=user1,ou=Users,dc=example,dc=com"
+	user2 := "uid=user2,ou=Users,dc=example,dc=com"
+	group1 := "cn=group1,ou=Groups,dc=example,dc=com"
+	group2 := "cn=group2,ou=Groups,dc=example,dc=com"
+
+	c.mustAdd(group1, groupOfNames("group1", user1, user2))
+	c.mustAdd(group2, groupOfNames("group2", user1))
+
+	c.assertAttr(group1, "member", user1, user2)
+	c.assertAttr(user1, "memberOf", group1, group2)
+	c.assertAttr(user2, "memberOf", group1)
+
+	c.assertError(c.add("cn=group3,ou=Groups,dc=example,dc=com",
+		groupOfNames("group3", "uid=missing,ou=Users,dc=example,dc=com")), util.NewInvalidPerSyntax("member", 0), "add member of missing entry")
+
+	err := c.modify(group1, func(changelog *Changelog) error {
+		return changelog.Delete(c.value("member", user2))
+	})
+	if err != nil {
+		c.t.Fatalf("Unexpected modify error: %+v", err)
+	}
+	c.assertAttr(group1, "member", user1)
+	c.assertAttr(user2, "memberOf")
+
+	err = c.modify(group2, func(changelog *Changelog) error {
+		return changelog.Add(c.value("member", user2))
+	})
+	if err != nil {
+		c.t.Fatalf("Unexpected modify error: %+v", err)
+	}
+	c.assertAttr(group2, "member", user1, user2)
+	c.assertAttr(user2, "memberOf", group2)
+
+	err = c.modify(group2, func(changelog *Changelog) error {
+		return changelog.Replace(c.value("member", user2))
+	})
+	if err != nil {
+		c.t.Fatalf("Unexpected modify error: %+v", err)
+	}
+	c.assertAttr(group2, "member", user2)
+	c.assertAttr(user1, "memberOf", group1)
+
+	// Deleting the member removes it from the groups
+	if err := c.delete(user1); err != nil {
+		c.t.Fatalf("Unexpected delete error: %+v", err)
+	}
+	c.assertAttr(group1, "member")
+
+	// Deleting the group removes memberOf of the members
+	if err := c.delete(group2); err != nil {
+		c.t.Fatalf("Unexpected delete error: %+v", err)
+	}
+	c.assertAttr(user2, "memberOf")
+}
+
+func testConformanceModifyDN(c *conformance) {
+	group1 := "cn=group1,ou=Groups,dc=example,dc=com"
+	c.mustAdd(group1, groupOfNames("group1", "uid=user1,ou=Users,dc=example,dc=com"))
+
+	// Rename with deleting old RDN
+	if err := c.modifyDN("uid=user1,ou=Users,dc=example,dc=com", "uid=renamed", true, ""); err != nil {
+		c.t.Fatalf("Unexpected modifyDN error: %+v", err)
+	}
+	_, err := c.search("uid=user1,ou=Users,dc=example,dc=com", 0)
+	c.assertError(err, util.NewNoSuchObject(), "search old DN")
+	c.assertAttr("uid=renamed,ou=Users,dc=example,dc=com", "uid", "renamed")
+	c.assertAttr("uid=renamed,ou=Users,dc=example,dc=com", "memberOf", group1)
+	c.assertAttr(group1, "member", "uid=renamed,ou=Users,dc=example,dc=com")
+
+	// Rename with keeping old RDN
+	if err := c.modifyDN("uid=user2,ou=Users,dc=example,dc=com", "uid=second", false, ""); err != nil {
+		c.t.Fatalf("Unexpected modifyDN error: %+v", err)
+	}
+	c.assertAttr("uid=second,ou=Users,dc=example,dc=com", "uid", "user2", "second")
+
+	c.assertError(c.modifyDN("uid=second,ou=Users,dc=example,dc=com", "uid=renamed", true, ""), util.NewAlreadyExists(), "rename to existing DN")
+
+	// Move the leaf to another parent
+	if err := c.modifyDN("uid=renamed,ou=Users,dc=example,dc=com", "uid=renamed", false, "ou=Groups,dc=example,dc=com"); err != nil {
+		c.t.Fatalf("Unexpected modifyDN error: %+v", err)
+	}
+	c.assertDNs("ou=Groups,dc=example,dc=com", 1, group1, "uid=renamed,ou=Groups,dc=example,dc=com")
+	c.assertDNs("ou=Users,dc=example,dc=com", 1, "uid=second,ou=Users,dc=example,dc=com")
+	c.assertAttr(group1, "member", "uid=renamed,ou=Groups,dc=example,dc=com")
+}
+
+func testConformanceMoveSubtree(c *conformance) {
+	group1 := "cn=group1,ou=Groups,dc=example,dc=com"
+	c.mustAdd("ou=Dept,dc=example,dc=com", organizationalUnit("Dept"))
+	c.mustAdd("ou=Sub,ou=Users,dc=example,dc=com", organizationalUnit("Sub"))
+	c.mustAdd("uid=user3,ou=Sub,ou=Users,dc=example,dc=com", inetOrgPerson("user3"))
+	c.mustAdd(group1, groupOfNames("group1", "uid=user3,ou=Sub,ou=Users,dc=example,dc=com"))
+
+	// Move the subtree under the leaf
+	if err := c.modifyDN("ou=Users,dc=example,dc=com", "ou=Users", false, "ou=Dept,dc=example,dc=com"); err != nil {
+		c.t.Fatalf("Unexpected modifyDN error: %+v", err)
+	}
+	_, err := c.search("ou=Users,dc=example,dc=com", 2)
+	c.assertError(err, util.NewNoSuchObject(), "search old subtree")
+
+	c.assertDNs("ou=Dept,dc=example,dc=com", 2,
+		"ou=Dept,dc=example,dc=com",
+		"ou=Users,ou=Dept,dc=example,dc=com",
+		"uid=user1,ou=Users,ou=Dept,dc=example,dc=com",
+		"uid=user2,ou=Users,ou=Dept,dc=example,dc=com",
+		"ou=Sub,ou=Users,ou=Dept,dc=example,dc=com",
+		"uid=user3,ou=Sub,ou=Users,ou=Dept,dc=example,dc=com",
+	)
+	c.assertDNs("dc=example,dc=com", 1, "ou=Dept,dc=example,dc=com", "ou=Groups,dc=example,dc=com")
+	c.assertAttr("ou=Dept,dc=example,dc=com", "hasSubordinates", "TRUE")
+	c.assertAttr(group1, "member", "uid=user3,ou=Sub,ou=Users,ou=Dept,dc=example,dc=com")
+	c.assertAttr("uid=user3,ou=Sub,ou=Users,ou=Dept,dc=example,dc=com", "memberOf", group1)
+
+	// The moved containers accept new children
+	c.mustAdd("uid=user4,ou=Sub,ou=Users,ou=Dept,dc=example,dc=com", inetOrgPerson("user4"))
+	c.assertDNs("ou=Dept,dc=example,dc=com", 3,
+		"ou=Users,ou=Dept,dc=example,dc=com",
+		"uid=user1,ou=Users,ou=Dept,dc=example,dc=com",
+		"uid=user2,ou=Users,ou=Dept,dc=example,dc=com",
+		"ou=Sub,ou=Users,ou=Dept,dc=example,dc=com",
+		"uid=user3,ou=Sub,ou=Users,ou=Dept,dc=example,dc=com",
+		"uid=user4,ou=Sub,ou=Users,ou=Dept,dc=example,dc=com",
+	)
+
+	// Move back, then the old parent becomes a leaf
+	if err := c.modifyDN("ou=Users,ou=Dept,dc=example,dc=com", "ou=Users", false, "dc=example,dc=com"); err != nil {
+		c.t.Fatalf("Unexpected modifyDN error: %+v", err)
+	}
+	c.assertAttr("ou=Dept,dc=example,dc=com", "hasSubordinates", "FALSE")
+	c.assertDNs("ou=Users,dc=example,dc=com", 3,
+		"uid=user1,ou=Users,dc=example,dc=com",
+		"uid=user2,ou=Users,dc=example,dc=com",
+		"ou=Sub,ou=Users,dc=example,dc=com",
+		"uid=user3,ou=Sub,ou=Users,dc=example,dc=com",
+		"uid=user4,ou=Sub,ou=Users,dc=example,dc=com",
+	)
+	if err := c.delete("ou=Dept,dc=example,dc=com"); err != nil {
+		c.t.Fatalf("Unexpected delete error: %+v", err)
+	}
+}
+
+func organizationalUnit(ou string) map[string][]string {
+	return map[string][]string{
+		"objectClass": {"organizationalUnit"},
+		"ou":          {ou},
+	}
+}
+
+func inetOrgPerson(uid string) map[string][]string {
+	return map[string][]string{
+		"objectClass": {"inetOrgPerson"},
+		"uid":         {uid},
+		"cn":          {uid},
+		"sn":          {strings.ToUpper(uid[:1]) + uid[1:]},
+	}
+}
+
+func groupOfNames(cn string, members ...string) map[string][]string {
+	return map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"cn":          {cn},
+		"member":      members,
+	}
+}
+
+type conformance struct {
+	t  *testing.T
+	sr *schema.SchemaRegistry
+	r  Repository
+}
+
+// context returns new context for each operation like the server does.
+func (c *conformance) context() context.Context {
+	return auth.SetSessionContext(context.Background(), &auth.AuthSession{
+		DN: c.dn("cn=Manager,dc=example,dc=com"),
+	})
+}
+
+func (c *conformance) dn(s string) *schema.DN {
+	dn, err := schema.NormalizeDN(c.sr, s)
+	if err != nil {
+		c.t.Fatalf("Unexpected DN error: %s, err: %v", s, err)
+	}
+	return dn
+}
+
+// value returns the schema value. The association values are resolved to the IDs.
+func (c *conformance) value(name string, values ...string) *schema.SchemaValue {
+	sv, err := schema.NewSchemaValue(c.sr, name, values)
+	if err != nil {
+		c.t.Fatalf("Unexpected value error: %s, err: %v", name, err)
+	}
+	if sv.IsAssociationAttribute() {
+		sv, err = c.r.Association(c.context(), sv)
+		if err != nil {
+			c.t.Fatalf("Unexpected association error: %s, err: %v", name, err)
+		}
+	}
+	return sv
+}
+
+func (c *conformance) add(dn string, attrs map[string][]string) error {
+	ctx := c.context()
+
+	changelog, err := NewChangelog(ctx, c.sr, c.dn(dn), AttrsOrig{})
+	if err != nil {
+		return err
+	}
+	for k, v := range attrs {
+		sv, err := schema.NewSchemaValue(c.sr, k, v)
+		if err != nil {
+			return err
+		}
+		if err := changelog.Add(sv); err != nil {
+			return err
+		}
+	}
+	sv, err := schema.NewSchemaValue(c.sr, "entryUUID", []string{uuid.New().String()})
+	if err != nil {
+		return err
+	}
+	if err := changelog.AddWithouCheck(sv); err != nil {
+		return err
+	}
+	if err := changelog.Validate(); err != nil {
+		return err
+	}
+
+	_, err = c.r.Insert(ctx, changelog)
+	return err
+}
+
+func (c *conformance) mustAdd(dn string, attrs map[string][]string) {
+	if err := c.add(dn, attrs); err != nil {
+		c.t.Fatalf("Unexpected add error: %s, err: %+v", dn, err)
+	}
+}
+
+func (c *conformance) modify(dn string, apply func(changelog *Changelog) error) error {
+	ctx := c.context()
+	target := c.dn(dn)
+
+	return c.r.Update(ctx, target, func(attrsOrig AttrsOrig) (*Changelog, error) {
+		changelog, err := NewChangelog(ctx, c.sr, target, attrsOrig)
+		if err != nil {
+			return nil, err
+		}
+		if err := apply(changelog); err != nil {
+			return nil, err
+		}
+		return changelog, nil
+	})
+}
+
+// modifyDN renames the entry, and moves it if the newSuperior isn't empty. It works like MODRDN operation.
+func (c *conformance) modifyDN(dn, newRDN string, deleteOldRDN bool, newSuperior string) error {
+	ctx := c.context()
+	target := c.dn(dn)
+
+	newDN, oldRDN, hasChange, err := target.ModifyRDN(c.sr, newRDN, deleteOldRDN)
+	if err != nil {
+		return err
+	}
+	if newSuperior != "" {
+		newDN, err = newDN.Move(c.dn(newSuperior))
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.r.UpdateDN(ctx, target, newDN, oldRDN, func(attrsOrig AttrsOrig) (*Changelog, error) {
+		changelog, err := NewChangelog(ctx, c.sr, target, attrsOrig)
+		if err != nil {
+			return nil, err
+		}
+		changelog.UpdateDN(newDN)
+
+		if !hasChange {
+			return changelog, nil
+		}
+
+		for k, v := range newDN.RDN() {
+			nsv, err := schema.NewSchemaValue(c.sr, k, []string{v.Orig})
+			if err != nil {
+				return nil, err
+			}
+			old, ok := target.RDN()[nsv.Name()]
+			if !ok {
+				continue
+			}
+			if deleteOldRDN {
+				osv, err := schema.NewSchemaValue(c.sr, nsv.Name(), []string{old.Orig})
+				if err != nil {
+					return nil, err
+				}
+				if err := changelog.Delete(osv); err != nil {
+					return nil, err
+				}
+			}
+			if err := changelog.Add(nsv); err != nil {
+				var lerr *util.LDAPError
+				if !xerrors.As(err, &lerr) || !lerr.IsAttributeOrValueExists() {
+					return nil, err
+				}
+			}
+		}
+		return changelog, nil
+	})
+}
+
+func (c *conformance) delete(dn string) error {
+	return c.r.DeleteByDN(c.context(), c.dn(dn))
+}
+
+// search returns the entries keyed by the normalized DN.
+func (c *conformance) search(baseDN string, scope int) (map[string]*SearchEntry, error) {
+	entries := map[string]*SearchEntry{}
+
+	_, _, err := c.r.Search(c.context(), c.dn(baseDN), &SearchOption{
+		Scope:                      scope,
+		Filter:                     message.FilterPresent("objectClass"),
+		PageSize:                   1000,
+		RequestedAssocation:        []string{"member"},
+		IsMemberOfRequested:        true,
+		IsHasSubordinatesRequested: true,
+	}, func(entry *SearchEntry) error {
+		entries[c.dn(entry.DNOrig()).DNNormStr()] = entry
+		return nil
+	})
+	return entries, err
+}
+
+func (c *conformance) assertDNs(baseDN string, scope int, expected ...string) {
+	c.t.Helper()
+
+	entries, err := c.search(baseDN, scope)
+	if err != nil {
+		c.t.Errorf("Unexpected search error: %s, scope: %d, err: %+v", baseDN, scope, err)
+		return
+	}
+	got := []string{}
+	for k := range entries {
+		got = append(got, k)
+	}
+	if e, g := c.normDNs(expected), c.sorted(got); !equalStrings(e, g) {
+		c.t.Errorf("Unexpected search result: %s, scope: %d\nexpected: %v\ngot:      %v", baseDN, scope, e, g)
+	}
+}
+
+// assertAttr checks the values of the entry. The DN values are compared after normalizing.
+func (c *conformance) assertAttr(dn, name string, expected ...string) {
+	c.t.Helper()
+
+	entries, err := c.search(dn, 0)
+	if err != nil {
+		c.t.Errorf("Unexpected search error: %s, err: %+v", dn, err)
+		return
+	}
+	entry, ok := entries[c.dn(dn).DNNormStr()]
+	if !ok {
+		c.t.Errorf("Unexpected search result: %s is not found", dn)
+		return
+	}
+
+	_, got, _ := entry.AttrOrig(name)
+	if name == "member" || name == "memberOf" {
+		expected, got = c.normDNs(expected), c.normDNs(got)
+	} else {
+		expected, got = c.sorted(expected), c.sorted(got)
+	}
+	if !equalStrings(expected, got) {
+		c.t.Errorf("Unexpected %s of %s\nexpected: %v\ngot:      %v", name, dn, expected, got)
+	}
+}
+
+func (c *conformance) assertError(err error, expected *util.LDAPError, msg string) {
+	c.t.Helper()
+
+	var lerr *util.LDAPError
+	if !xerrors.As(err, &lerr) || lerr.Code != expected.Code {
+		c.t.Errorf("Unexpected error on %s: expected %v, got %+v", msg, expected, err)
+	}
+}
+
+func (c *conformance) normDNs(dns []string) []string {
+	norm := make([]string, len(dns))
+	for i, v := range dns {
+		norm[i] = c.dn(v).DNNormStr()
+	}
+	return c.sorted(norm)
+}
+
+func (c *conformance) sorted(s []string) []string {
+	copied := append([]string{}, s...)
+	sort.Strings(copied)
+	return copied
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
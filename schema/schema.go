@@ -25,6 +25,7 @@ func NewSchema(config *SchemaConfig) *SchemaRegistry {
 		Config:         config,
 		ObjectClasses:  map[string]*ObjectClass{},
 		AttributeTypes: map[string]*AttributeType{},
+		MatchingRules:  map[string]*MatchingRule{},
 	}
 
 	return s
@@ -34,6 +35,7 @@ type SchemaRegistry struct {
 	Config           *SchemaConfig
 	ObjectClasses    map[string]*ObjectClass
 	AttributeTypes   map[string]*AttributeType
+	MatchingRules    map[string]*MatchingRule
 	SuffixDN         *DN
 	RootDN           *DN
 	DefaultPPolicyDN *DN
@@ -61,6 +63,31 @@ func (s *SchemaRegistry) PutAttributeType(k string, attributeType *AttributeType
 	s.AttributeTypes[strings.ToLower(k)] = attributeType
 }
 
+// NamingAttributeTypes returns the attribute types which can be used in RDN, see IsNamingAttribute.
+func (s *SchemaRegistry) NamingAttributeTypes() []*AttributeType {
+	seen := map[*AttributeType]struct{}{}
+	types := []*AttributeType{}
+	for _, v := range s.AttributeTypes {
+		if _, ok := seen[v]; ok || !v.IsNamingAttribute() {
+			continue
+		}
+		seen[v] = struct{}{}
+		types = append(types, v)
+	}
+	return types
+}
+
+// MatchingRule finds the matching rule by the name or the OID.
+func (s *SchemaRegistry) MatchingRule(k string) (*MatchingRule, bool) {
+	rule, ok := s.MatchingRules[strings.ToLower(k)]
+	return rule, ok
+}
+
+func (s *SchemaRegistry) PutMatchingRule(rule *MatchingRule) {
+	s.MatchingRules[strings.ToLower(rule.Name)] = rule
+	s.MatchingRules[rule.Oid] = rule
+}
+
 func (s *SchemaRegistry) ValidateObjectClass(ocs []string, attrs map[string]*SchemaValue) *util.LDAPError {
 	stoc := []*ObjectClass{}
 	for i, v := range ocs {
@@ -204,6 +231,32 @@ func (a *AttributeType) Schema() *SchemaRegistry {
 	return a.schemaDef
 }
 
+type MatchingRule struct {
+	schemaDef *SchemaRegistry
+	Name      string
+	Oid       string
+	Syntax    string
+}
+
+func (m *MatchingRule) Schema() *SchemaRegistry {
+	return m.schemaDef
+}
+
+// IsEquality returns true if the matching rule is used as equality matching.
+func (m *MatchingRule) IsEquality() bool {
+	return !m.IsOrdering() && !m.IsSubstrings()
+}
+
+// IsOrdering returns true if the matching rule is used as ordering matching.
+func (m *MatchingRule) IsOrdering() bool {
+	return strings.HasSuffix(m.Name, "OrderingMatch")
+}
+
+// IsSubstrings returns true if the matching rule is used as substrings matching.
+func (m *MatchingRule) IsSubstrings() bool {
+	return strings.HasSuffix(m.Name, "SubstringsMatch")
+}
+
 type ObjectClass struct {
 	schemaDef  *SchemaRegistry
 	Name       string
@@ -362,6 +415,26 @@ func parseSchema(config *SchemaConfig, m *SchemaRegistry, schemaDef string) {
 			}
 
 			m.PutAttributeType(s.Name, s)
+
+		} else if strings.ToLower(stype) == "matchingrules" {
+			name := parseName(line)
+			syng := syntaxPattern.FindStringSubmatch(line)
+
+			if stype == "" || oid == "" || len(name) == 0 {
+				log.Printf("warn: Unsupported schema. %s", line)
+				continue
+			}
+
+			mr := &MatchingRule{
+				schemaDef: m,
+				Name:      name[0],
+				Oid:       oid,
+			}
+			if syng != nil {
+				mr.Syntax = syng[1]
+			}
+
+			m.PutMatchingRule(mr)
 		}
 	}
 
@@ -1025,6 +1098,12 @@ func (s *AttributeType) IsOperationalAttribute() bool {
 	return false
 }
 
+// IsNamingAttribute returns true if the attribute type can be used in RDN.
+// RDN needs the equality matching rule, and the operational attributes aren't used for naming.
+func (s *AttributeType) IsNamingAttribute() bool {
+	return s.Equality != "" && !s.IsOperationalAttribute() && !s.NoUserModification && !s.IsAssociationAttribute()
+}
+
 func (s *AttributeType) IsAssociationAttribute() bool {
 	if s.Name == "member" ||
 		s.Name == "uniqueMember" {
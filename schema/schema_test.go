@@ -233,3 +233,113 @@ func TestObjectClassNormalization(t *testing.T) {
 		}
 	}
 }
+
+func TestMatchingRule(t *testing.T) {
+	schemaDef := NewSchemaRegistry(&SchemaConfig{
+		Suffix: "dc=example,dc=com",
+	})
+
+	testcases := []struct {
+		Key          string
+		ExpectedName string
+		IsEquality   bool
+		IsOrdering   bool
+		IsSubstrings bool
+	}{
+		{
+			"2.5.13.2",
+			"caseIgnoreMatch",
+			true,
+			false,
+			false,
+		},
+		{
+			"caseignorematch",
+			"caseIgnoreMatch",
+			true,
+			false,
+			false,
+		},
+		{
+			"integerOrderingMatch",
+			"integerOrderingMatch",
+			false,
+			true,
+			false,
+		},
+		{
+			"2.5.13.4",
+			"caseIgnoreSubstringsMatch",
+			false,
+			false,
+			true,
+		},
+		{
+			"1.2.840.113556.1.4.803",
+			"integerBitAndMatch",
+			true,
+			false,
+			false,
+		},
+	}
+
+	for i, tc := range testcases {
+		rule, ok := schemaDef.MatchingRule(tc.Key)
+		if !ok {
+			t.Errorf("Unexpected error on %d: Not found matching rule %s", i, tc.Key)
+			continue
+		}
+		if rule.Name != tc.ExpectedName {
+			t.Errorf("Unexpected error on %d: MatchingRule %s -> '%s' expected, got '%s'\n", i, tc.Key, tc.ExpectedName, rule.Name)
+		}
+		if rule.IsEquality() != tc.IsEquality || rule.IsOrdering() != tc.IsOrdering || rule.IsSubstrings() != tc.IsSubstrings {
+			t.Errorf("Unexpected error on %d: MatchingRule %s -> '%v/%v/%v' expected, got '%v/%v/%v'\n", i, tc.Key,
+				tc.IsEquality, tc.IsOrdering, tc.IsSubstrings, rule.IsEquality(), rule.IsOrdering(), rule.IsSubstrings())
+		}
+	}
+
+	if _, ok := schemaDef.MatchingRule("unknownMatch"); ok {
+		t.Errorf("Unexpected matching rule: unknownMatch")
+	}
+}
+
+func TestNamingAttributeTypes(t *testing.T) {
+	sr := NewSchemaRegistry(&SchemaConfig{
+		Suffix:           "dc=example,dc=com",
+		CustomSchema:     []string{},
+		MigrationEnabled: false,
+	})
+
+	names := map[string]bool{}
+	for _, v := range sr.NamingAttributeTypes() {
+		if names[v.Name] {
+			t.Errorf("Unexpected duplicate naming attribute: %s", v.Name)
+		}
+		names[v.Name] = true
+	}
+
+	testcases := []struct {
+		Name     string
+		Expected bool
+	}{
+		{"cn", true},
+		{"uid", true},
+		{"ou", true},
+		{"dc", true},
+		{"mail", true},
+		// Operational
+		{"entryUUID", false},
+		{"modifyTimestamp", false},
+		// Association
+		{"member", false},
+		{"memberOf", false},
+		// No equality matching rule
+		{"jpegPhoto", false},
+	}
+
+	for i, tc := range testcases {
+		if names[tc.Name] != tc.Expected {
+			t.Errorf("Unexpected naming attribute on %d %s: expected %v", i, tc.Name, tc.Expected)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudldap/cloudldap/repo"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/cloudldap/goldap/message"
+	ldap "github.com/cloudldap/ldapserver"
+	"golang.org/x/xerrors"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+const (
+	// https://datatracker.ietf.org/doc/html/draft-behera-ldap-password-policy-11
+	PPolicyControlOID = "1.3.6.1.4.1.42.2.27.8.5.1"
+
+	ppolicyPasswordExpired = 0
+	ppolicyAccountLocked   = 1
+
+	secondsPerDay = 24 * 60 * 60
+)
+
+type AccountStatusConfig struct {
+	// Shadow enables the shadowAccount checks (shadowExpire, shadowLastChange + shadowMax + shadowInactive)
+	Shadow bool
+	// ValidityWindow enables the pwdStartTime and pwdEndTime checks
+	ValidityWindow bool
+	// Disabled are "<Attribute>=<Value>" which mark the account disabled (e.g. nsAccountLock=true).
+	// The value "*" matches any value.
+	Disabled []string
+	// LoginHours are the default login hours rules (e.g. "Mon-Fri 08:00-18:00") applied to all users
+	LoginHours []string
+	// LoginHoursAttribute is the attribute which has the user specific login hours rules.
+	// It overrides LoginHours if the user has it.
+	LoginHoursAttribute string
+	// TimeZone is the location name of the login hours (default: Local)
+	TimeZone string
+}
+
+// AccountStatusEvaluator evaluates the account status after the credential is validated.
+// It returns an LDAPError which is IsAccountUnusable if the account isn't allowed to bind.
+type AccountStatusEvaluator interface {
+	Evaluate(cred *repo.FetchedCredential, now time.Time) error
+}
+
+// AccountStatusChecker runs the registered evaluators in order.
+type AccountStatusChecker struct {
+	evaluators []AccountStatusEvaluator
+	clock      func() time.Time
+}
+
+func NewAccountStatusChecker(server *Server) (*AccountStatusChecker, error) {
+	c := server.config.AccountStatusConfig
+	if c == nil {
+		c = &AccountStatusConfig{}
+	}
+
+	checker := &AccountStatusChecker{
+		clock: time.Now,
+	}
+
+	if c.Shadow {
+		checker.Register(&shadowAccountEvaluator{})
+	}
+	if c.ValidityWindow {
+		checker.Register(&validityWindowEvaluator{})
+	}
+
+	for _, d := range c.Disabled {
+		e, err := newDisabledAttributeEvaluator(server, d)
+		if err != nil {
+			return nil, err
+		}
+		checker.Register(e)
+	}
+
+	if len(c.LoginHours) > 0 || c.LoginHoursAttribute != "" {
+		e, err := newLoginHoursEvaluator(server, c)
+		if err != nil {
+			return nil, err
+		}
+		checker.Register(e)
+	}
+
+	return checker, nil
+}
+
+// Register appends the evaluator.
+func (c *AccountStatusChecker) Register(e AccountStatusEvaluator) {
+	c.evaluators = append(c.evaluators, e)
+}
+
+// Check returns the first error from the evaluators.
+func (c *AccountStatusChecker) Check(cred *repo.FetchedCredential) error {
+	now := c.clock()
+	for _, e := range c.evaluators {
+		if err := e.Evaluate(cred, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shadowAccountEvaluator evaluates shadowAccount the same as pam_unix.
+// The values are the days since Jan 1, 1970.
+type shadowAccountEvaluator struct{}
+
+func (e *shadowAccountEvaluator) Evaluate(cred *repo.FetchedCredential, now time.Time) error {
+	today := now.Unix() / secondsPerDay
+
+	// 0 is ambiguous, it's treated as no expiration
+	if expire, ok := attrNormInt64(cred.Attrs, "shadowExpire"); ok && expire > 0 && today >= expire {
+		return util.NewAccountExpired("account expired")
+	}
+
+	lastChange, ok := attrNormInt64(cred.Attrs, "shadowLastChange")
+	if !ok || lastChange <= 0 {
+		return nil
+	}
+	max, ok := attrNormInt64(cred.Attrs, "shadowMax")
+	if !ok || max < 0 {
+		return nil
+	}
+	if inactive, ok := attrNormInt64(cred.Attrs, "shadowInactive"); ok && inactive >= 0 && today-lastChange > max+inactive {
+		return util.NewAccountExpired("account inactive")
+	}
+	if today-lastChange > max {
+		return util.NewPasswordExpired()
+	}
+	return nil
+}
+
+// validityWindowEvaluator evaluates pwdStartTime and pwdEndTime.
+type validityWindowEvaluator struct{}
+
+func (e *validityWindowEvaluator) Evaluate(cred *repo.FetchedCredential, now time.Time) error {
+	// The normalized value of generalizedTime is the unix time
+	if start, ok := attrNormInt64(cred.Attrs, "pwdStartTime"); ok && now.Unix() < start {
+		return util.NewAccountExpired("account not yet valid")
+	}
+	if end, ok := attrNormInt64(cred.Attrs, "pwdEndTime"); ok && now.Unix() >= end {
+		return util.NewAccountExpired("account no longer valid")
+	}
+	return nil
+}
+
+// disabledAttributeEvaluator disables the account which has the configured attribute value.
+type disabledAttributeEvaluator struct {
+	attrName string
+	value    string
+}
+
+func newDisabledAttributeEvaluator(server *Server, config string) (*disabledAttributeEvaluator, error) {
+	i := strings.Index(config, "=")
+	if i == -1 {
+		return nil, xerrors.Errorf("Invalid disabled account config. It isn't '<Attribute>=<Value>' format. config: %s", config)
+	}
+	name := strings.TrimSpace(config[:i])
+	value := strings.TrimSpace(config[i+1:])
+
+	at, ok := server.schemaRegistry.AttributeType(name)
+	if !ok {
+		return nil, xerrors.Errorf("Invalid disabled account config. The attribute isn't defined. config: %s", config)
+	}
+	if value == "" {
+		return nil, xerrors.Errorf("Invalid disabled account config. The value is empty. config: %s", config)
+	}
+
+	return &disabledAttributeEvaluator{
+		attrName: at.Name,
+		value:    value,
+	}, nil
+}
+
+func (e *disabledAttributeEvaluator) Evaluate(cred *repo.FetchedCredential, now time.Time) error {
+	for _, v := range cred.Attrs[e.attrName] {
+		if e.value == "*" || strings.EqualFold(fmt.Sprint(v), e.value) {
+			return util.NewAccountDisabled()
+		}
+	}
+	return nil
+}
+
+// loginHoursRule is "<Days> <HH:MM>-<HH:MM>". Days is "*" or the comma separated days or ranges (e.g. Mon-Fri,Sun).
+// The time range can cross midnight (e.g. 22:00-06:00), then it's applied from the day to the next day.
+type loginHoursRule struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseLoginHoursRule(rule string) (*loginHoursRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) != 2 {
+		return nil, xerrors.Errorf("Invalid login hours rule. It isn't '<Days> <HH:MM>-<HH:MM>' format. rule: %s", rule)
+	}
+
+	r := &loginHoursRule{}
+
+	if fields[0] == "*" {
+		for i := range r.days {
+			r.days[i] = true
+		}
+	} else {
+		for _, d := range strings.Split(fields[0], ",") {
+			from, to := d, d
+			if i := strings.Index(d, "-"); i != -1 {
+				from, to = d[:i], d[i+1:]
+			}
+			fw, ok1 := weekdays[strings.ToLower(from)]
+			tw, ok2 := weekdays[strings.ToLower(to)]
+			if !ok1 || !ok2 {
+				return nil, xerrors.Errorf("Invalid login hours rule. Invalid days: %s, rule: %s", d, rule)
+			}
+			for w := fw; ; w = (w + 1) % 7 {
+				r.days[w] = true
+				if w == tw {
+					break
+				}
+			}
+		}
+	}
+
+	i := strings.Index(fields[1], "-")
+	if i == -1 {
+		return nil, xerrors.Errorf("Invalid login hours rule. Invalid time range: %s, rule: %s", fields[1], rule)
+	}
+	var err error
+	if r.start, err = parseMinutes(fields[1][:i]); err != nil {
+		return nil, xerrors.Errorf("Invalid login hours rule. rule: %s, err: %w", rule, err)
+	}
+	if r.end, err = parseMinutes(fields[1][i+1:]); err != nil {
+		return nil, xerrors.Errorf("Invalid login hours rule. rule: %s, err: %w", rule, err)
+	}
+	if r.start == r.end {
+		return nil, xerrors.Errorf("Invalid login hours rule. Empty time range: %s, rule: %s", fields[1], rule)
+	}
+
+	return r, nil
+}
+
+// parseMinutes parses "HH:MM" into the minutes of the day. "24:00" is allowed as the end of the day.
+func parseMinutes(s string) (int, error) {
+	i := strings.Index(s, ":")
+	if i == -1 {
+		return 0, xerrors.Errorf("Invalid time: %s", s)
+	}
+	h, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, xerrors.Errorf("Invalid time: %s", s)
+	}
+	m, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return 0, xerrors.Errorf("Invalid time: %s", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, xerrors.Errorf("Invalid time: %s", s)
+	}
+	return h*60 + m, nil
+}
+
+func (r *loginHoursRule) allows(t time.Time) bool {
+	min := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if r.start < r.end {
+		return r.days[day] && r.start <= min && min < r.end
+	}
+	// Crossing midnight
+	prev := (day + 6) % 7
+	return (r.days[day] && r.start <= min) || (r.days[prev] && min < r.end)
+}
+
+// loginHoursEvaluator restricts the time of day when the user can bind.
+type loginHoursEvaluator struct {
+	attrName string
+	defaults []*loginHoursRule
+	location *time.Location
+}
+
+func newLoginHoursEvaluator(server *Server, c *AccountStatusConfig) (*loginHoursEvaluator, error) {
+	e := &loginHoursEvaluator{
+		location: time.Local,
+	}
+
+	if c.TimeZone != "" {
+		loc, err := time.LoadLocation(c.TimeZone)
+		if err != nil {
+			return nil, xerrors.Errorf("Invalid login hours time zone: %s, err: %w", c.TimeZone, err)
+		}
+		e.location = loc
+	}
+
+	for _, v := range c.LoginHours {
+		r, err := parseLoginHoursRule(v)
+		if err != nil {
+			return nil, err
+		}
+		e.defaults = append(e.defaults, r)
+	}
+
+	if c.LoginHoursAttribute != "" {
+		at, ok := server.schemaRegistry.AttributeType(c.LoginHoursAttribute)
+		if !ok {
+			return nil, xerrors.Errorf("Invalid login hours attribute. The attribute isn't defined. attribute: %s", c.LoginHoursAttribute)
+		}
+		e.attrName = at.Name
+	}
+
+	return e, nil
+}
+
+func (e *loginHoursEvaluator) Evaluate(cred *repo.FetchedCredential, now time.Time) error {
+	rules := e.defaults
+
+	if e.attrName != "" {
+		if values := attrNormStr(cred.Attrs, e.attrName); len(values) > 0 {
+			rules = nil
+			for _, v := range values {
+				r, err := parseLoginHoursRule(v)
+				if err != nil {
+					// Deny the invalid rule rather than allowing all the time
+					log.Printf("error: Invalid user login hours. id: %d, err: %v", cred.ID, err)
+					return util.NewLoginRestricted()
+				}
+				rules = append(rules, r)
+			}
+		}
+	}
+
+	if len(rules) == 0 {
+		return nil
+	}
+
+	t := now.In(e.location)
+	for _, r := range rules {
+		if r.allows(t) {
+			return nil
+		}
+	}
+	return util.NewLoginRestricted()
+}
+
+func attrNormInt64(attrs repo.CacheAttrsNorm, name string) (int64, bool) {
+	if len(attrs[name]) == 0 {
+		return 0, false
+	}
+	// The integer is cached as the normalized string, the association ID is cached as the number
+	switch v := attrs[name][0].(type) {
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		return i, err == nil
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// hasPPolicyControl returns true if the request has the password policy request control.
+func hasPPolicyControl(m *ldap.Message) bool {
+	if m.Controls() == nil {
+		return false
+	}
+	for _, con := range *m.Controls() {
+		if string(con.ControlType()) == PPolicyControlOID {
+			return true
+		}
+	}
+	return false
+}
+
+// ppolicyError returns the error of the password policy response control for the bind error.
+func ppolicyError(lerr *util.LDAPError) (int, bool) {
+	if lerr.IsPasswordExpired() {
+		return ppolicyPasswordExpired, true
+	}
+	if lerr.IsAccountUnusable() {
+		return ppolicyAccountLocked, true
+	}
+	return 0, false
+}
+
+func ppolicyResponseValue(errCode int) []byte {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "PasswordPolicyResponseValue")
+	value.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 1, errCode, "error"))
+	return value.Bytes()
+}
+
+// newPPolicyResponseControl builds the password policy response control with the error.
+//
+//	PasswordPolicyResponseValue ::= SEQUENCE {
+//	    warning [0] CHOICE { ... } OPTIONAL,
+//	    error   [1] ENUMERATED { ... } OPTIONAL }
+func newPPolicyResponseControl(errCode int) (message.Control, error) {
+	value := ppolicyResponseValue(errCode)
+
+	// goldap doesn't have the constructor of the control, so decode it from the response message
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "MessageID"))
+
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindResponse, nil, "Bind Response")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, ldap.LDAPResultInvalidCredentials, "Result Code"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	packet.AppendChild(res)
+
+	controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+	control := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, PPolicyControlOID, "Control Type"))
+	control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(value), "Control Value"))
+	controls.AppendChild(control)
+	packet.AppendChild(controls)
+
+	m, err := message.ReadLDAPMessage(message.NewBytes(0, packet.Bytes()))
+	if err != nil {
+		return message.Control{}, err
+	}
+	if m.Controls() == nil || len(*m.Controls()) == 0 {
+		return message.Control{}, xerrors.New("Unexpected empty controls")
+	}
+	return (*m.Controls())[0], nil
+}
+
+// responsePPolicyError writes the bind response with the password policy response control if it's requested.
+func responsePPolicyError(w ldap.ResponseWriter, m *ldap.Message, res message.BindResponse, lerr *util.LDAPError) {
+	if errCode, ok := ppolicyError(lerr); ok && hasPPolicyControl(m) {
+		control, err := newPPolicyResponseControl(errCode)
+		if err == nil {
+			var controls message.Controls = []message.Control{control}
+			w.WriteControls(res, &controls)
+			return
+		}
+		log.Printf("error: Failed to build password policy response control. err: %+v", err)
+	}
+	w.Write(res)
+}
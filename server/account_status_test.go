@@ -0,0 +1,214 @@
+//go:build test
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloudldap/cloudldap/repo"
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"golang.org/x/xerrors"
+)
+
+func TestAccountStatusCheck(t *testing.T) {
+	// Wednesday
+	now := time.Date(2022, 6, 15, 12, 0, 0, 0, time.UTC)
+	today := now.Unix() / secondsPerDay
+
+	// The integer and generalizedTime are cached as the normalized string
+	days := func(d int64) interface{} {
+		return strconv.FormatInt(today+d, 10)
+	}
+	unix := func(d time.Duration) interface{} {
+		return strconv.FormatInt(now.Add(d).Unix(), 10)
+	}
+
+	testcases := []struct {
+		Name            string
+		Attrs           repo.CacheAttrsNorm
+		ExpectedSubtype string
+		ExpectedMsg     string
+	}{
+		{
+			"no status attributes",
+			repo.CacheAttrsNorm{},
+			"", "",
+		},
+		{
+			"shadowExpire in the future",
+			repo.CacheAttrsNorm{"shadowExpire": {days(1)}},
+			"", "",
+		},
+		{
+			"shadowExpire today",
+			repo.CacheAttrsNorm{"shadowExpire": {days(0)}},
+			"Account expired", "account expired",
+		},
+		{
+			"shadowExpire 0 is no expiration",
+			repo.CacheAttrsNorm{"shadowExpire": {json.Number("0")}},
+			"", "",
+		},
+		{
+			"shadowMax not exceeded",
+			repo.CacheAttrsNorm{"shadowLastChange": {days(-10)}, "shadowMax": {"10"}},
+			"", "",
+		},
+		{
+			"shadowMax exceeded",
+			repo.CacheAttrsNorm{"shadowLastChange": {days(-11)}, "shadowMax": {"10"}},
+			"Password expired", "password expired",
+		},
+		{
+			"shadowInactive exceeded",
+			repo.CacheAttrsNorm{"shadowLastChange": {days(-16)}, "shadowMax": {"10"}, "shadowInactive": {"5"}},
+			"Account expired", "account inactive",
+		},
+		{
+			"shadowMax -1 is no expiration",
+			repo.CacheAttrsNorm{"shadowLastChange": {days(-100)}, "shadowMax": {"-1"}},
+			"", "",
+		},
+		{
+			"pwdStartTime in the future",
+			repo.CacheAttrsNorm{"pwdStartTime": {unix(time.Hour)}},
+			"Account expired", "account not yet valid",
+		},
+		{
+			"pwdEndTime in the past",
+			repo.CacheAttrsNorm{"pwdStartTime": {unix(-time.Hour)}, "pwdEndTime": {unix(-time.Second)}},
+			"Account expired", "account no longer valid",
+		},
+		{
+			"in the validity window",
+			repo.CacheAttrsNorm{"pwdStartTime": {unix(-time.Hour)}, "pwdEndTime": {unix(time.Hour)}},
+			"", "",
+		},
+		{
+			"disabled",
+			repo.CacheAttrsNorm{"description": {"disabled"}},
+			"Account disabled", "account disabled",
+		},
+		{
+			"not disabled",
+			repo.CacheAttrsNorm{"description": {"enabled"}},
+			"", "",
+		},
+		{
+			"user login hours allow",
+			repo.CacheAttrsNorm{"l": {"wed 11:00-13:00"}},
+			"", "",
+		},
+		{
+			"user login hours deny",
+			repo.CacheAttrsNorm{"l": {"mon-tue 00:00-24:00", "wed 13:00-14:00"}},
+			"Login restricted", "login not permitted at this time",
+		},
+		{
+			"invalid user login hours deny",
+			repo.CacheAttrsNorm{"l": {"always"}},
+			"Login restricted", "login not permitted at this time",
+		},
+	}
+
+	sc := &schema.SchemaConfig{
+		Suffix:       "dc=example,dc=com",
+		CustomSchema: []string{},
+	}
+	s := &Server{
+		config: &ServerConfig{
+			SchemaConfig: sc,
+			AccountStatusConfig: &AccountStatusConfig{
+				Shadow:              true,
+				ValidityWindow:      true,
+				Disabled:            []string{"description=Disabled"},
+				LoginHours:          []string{"* 00:00-24:00"},
+				LoginHoursAttribute: "l",
+				TimeZone:            "UTC",
+			},
+		},
+		schemaRegistry: schema.NewSchemaRegistry(sc),
+	}
+	checker, err := NewAccountStatusChecker(s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checker.clock = func() time.Time {
+		return now
+	}
+
+	for i, tc := range testcases {
+		err := checker.Check(&repo.FetchedCredential{Attrs: tc.Attrs})
+		if tc.ExpectedSubtype == "" {
+			if err != nil {
+				t.Errorf("Unexpected error on %d %s: %v", i, tc.Name, err)
+			}
+			continue
+		}
+		var lerr *util.LDAPError
+		if !xerrors.As(err, &lerr) {
+			t.Errorf("Unexpected error on %d %s: %v", i, tc.Name, err)
+			continue
+		}
+		if !lerr.IsInvalidCredentials() || !lerr.IsAccountUnusable() || lerr.Subtype != tc.ExpectedSubtype || lerr.Msg != tc.ExpectedMsg {
+			t.Errorf("Unexpected error on %d %s: expected %s %s, got %+v", i, tc.Name, tc.ExpectedSubtype, tc.ExpectedMsg, lerr)
+		}
+	}
+}
+
+func TestLoginHoursRule(t *testing.T) {
+	testcases := []struct {
+		Rule     string
+		Time     time.Time
+		Expected bool
+	}{
+		// 2022-06-13 is Monday
+		{"Mon-Fri 08:00-18:00", time.Date(2022, 6, 13, 8, 0, 0, 0, time.UTC), true},
+		{"Mon-Fri 08:00-18:00", time.Date(2022, 6, 13, 18, 0, 0, 0, time.UTC), false},
+		{"Mon-Fri 08:00-18:00", time.Date(2022, 6, 18, 12, 0, 0, 0, time.UTC), false},
+		{"Sat,Sun 10:00-12:00", time.Date(2022, 6, 19, 11, 59, 0, 0, time.UTC), true},
+		{"Fri-Mon 10:00-12:00", time.Date(2022, 6, 18, 11, 0, 0, 0, time.UTC), true},
+		{"Fri-Mon 10:00-12:00", time.Date(2022, 6, 15, 11, 0, 0, 0, time.UTC), false},
+		{"Mon 22:00-06:00", time.Date(2022, 6, 13, 23, 0, 0, 0, time.UTC), true},
+		{"Mon 22:00-06:00", time.Date(2022, 6, 14, 5, 59, 0, 0, time.UTC), true},
+		{"Mon 22:00-06:00", time.Date(2022, 6, 13, 5, 0, 0, 0, time.UTC), false},
+		{"* 00:00-24:00", time.Date(2022, 6, 19, 23, 59, 0, 0, time.UTC), true},
+	}
+
+	for i, tc := range testcases {
+		r, err := parseLoginHoursRule(tc.Rule)
+		if err != nil {
+			t.Fatalf("Unexpected error on %d %s: %v", i, tc.Rule, err)
+		}
+		if got := r.allows(tc.Time); got != tc.Expected {
+			t.Errorf("Unexpected result on %d %s at %v: expected %v, got %v", i, tc.Rule, tc.Time, tc.Expected, got)
+		}
+	}
+
+	for i, rule := range []string{"", "Mon", "Mon 08:00", "Xyz 08:00-18:00", "Mon 08:00-08:00", "Mon 08:60-09:00", "Mon 24:30-25:00"} {
+		if _, err := parseLoginHoursRule(rule); err == nil {
+			t.Errorf("Invalid rule must be rejected on %d: %s", i, rule)
+		}
+	}
+}
+
+func TestPPolicyResponseValue(t *testing.T) {
+	testcases := []struct {
+		Error    int
+		Expected []byte
+	}{
+		{ppolicyPasswordExpired, []byte{0x30, 0x03, 0x81, 0x01, 0x00}},
+		{ppolicyAccountLocked, []byte{0x30, 0x03, 0x81, 0x01, 0x01}},
+	}
+
+	for i, tc := range testcases {
+		if got := ppolicyResponseValue(tc.Error); !bytes.Equal(got, tc.Expected) {
+			t.Errorf("Unexpected value on %d: expected %x, got %x", i, tc.Expected, got)
+		}
+	}
+}
@@ -79,6 +79,8 @@ type SimpleACLScope int
 const (
 	ReadScope SimpleACLScope = iota
 	WriteScope
+	// Get the effective rights of other users
+	EffectiveRightsScope
 )
 
 func (c SimpleACLScope) String() string {
@@ -87,6 +89,8 @@ func (c SimpleACLScope) String() string {
 		return "R"
 	case WriteScope:
 		return "W"
+	case EffectiveRightsScope:
+		return "G"
 	default:
 		return "unknown"
 	}
@@ -109,7 +113,7 @@ func NewSimpleACL(server *Server) (*SimpleACL, error) {
 	for _, d := range server.config.SimpleACL {
 		s := strings.Split(d, ":")
 		if len(s) != 3 {
-			return nil, xerrors.Errorf("Invalid format. Need <DN(User, Group or empty(everyone))>:<Scope(R, W or RW)>:<Invisible Attributes>: %s", d)
+			return nil, xerrors.Errorf("Invalid format. Need <DN(User, Group or empty(everyone))>:<Scope(R, W, G or the combination)>:<Invisible Attributes>: %s", d)
 		}
 
 		scopeSet := SimpleACLScopeSet{}
@@ -121,8 +125,10 @@ func NewSimpleACL(server *Server) (*SimpleACL, error) {
 				scopeSet.Add(ReadScope)
 			case "W":
 				scopeSet.Add(WriteScope)
+			case "G":
+				scopeSet.Add(EffectiveRightsScope)
 			default:
-				return nil, xerrors.Errorf(`Invalid scope. Need "R", "W": %s`, d)
+				return nil, xerrors.Errorf(`Invalid scope. Need "R", "W", "G": %s`, d)
 			}
 		}
 
@@ -193,6 +199,26 @@ func (s *SimpleACL) CanWrite(session *auth.AuthSession) bool {
 	return false
 }
 
+// CanGetEffectiveRights returns true if the user can get the effective rights of other users.
+func (s *SimpleACL) CanGetEffectiveRights(session *auth.AuthSession) bool {
+	if session.IsRoot {
+		return true
+	}
+
+	if v, ok := s.list[session.DN.DNNormStr()]; ok {
+		return v.Scope.Contains(EffectiveRightsScope)
+	}
+	for _, m := range session.Groups {
+		if v, ok := s.list[m.DNNormStr()]; ok {
+			return v.Scope.Contains(EffectiveRightsScope)
+		}
+	}
+	if v, ok := s.list["_DEFAULT_"]; ok {
+		return v.Scope.Contains(EffectiveRightsScope)
+	}
+	return false
+}
+
 func (s *SimpleACL) CanVisible(session *auth.AuthSession, attrName string) bool {
 	a := strings.ToLower(attrName)
 
@@ -213,3 +239,63 @@ func (s *SimpleACL) CanVisible(session *auth.AuthSession, attrName string) bool
 	}
 	return true
 }
+
+// EntryLevelRights returns the rights for the entry in the format of Get Effective Rights control.
+// v: view, a: add, d: delete, n: rename
+func (s *SimpleACL) EntryLevelRights(session *auth.AuthSession) string {
+	if session.DN == nil {
+		return "none"
+	}
+
+	var b strings.Builder
+	if s.CanRead(session) {
+		b.WriteString("v")
+	}
+	if s.CanWrite(session) {
+		b.WriteString("adn")
+	}
+	if b.Len() == 0 {
+		return "none"
+	}
+	return b.String()
+}
+
+// AttributeLevelRights returns the rights for the attribute in the format of Get Effective Rights control.
+// r: read, s: search, c: compare, w: write, o: obliterate
+func (s *SimpleACL) AttributeLevelRights(session *auth.AuthSession, attrName string) string {
+	if session.DN == nil {
+		return "none"
+	}
+
+	var b strings.Builder
+	if s.CanRead(session) && s.CanVisible(session, attrName) {
+		b.WriteString("rsc")
+	}
+	if s.CanWrite(session) {
+		b.WriteString("wo")
+	}
+	if b.Len() == 0 {
+		return "none"
+	}
+	return b.String()
+}
+
+// IsAdmin returns true if the write is allowed for the user or the group, not by the default for everyone.
+func (s *SimpleACL) IsAdmin(session *auth.AuthSession) bool {
+	if session.IsRoot {
+		return true
+	}
+	if session.DN == nil {
+		return false
+	}
+
+	if v, ok := s.list[session.DN.DNNormStr()]; ok {
+		return v.Scope.Contains(WriteScope)
+	}
+	for _, m := range session.Groups {
+		if v, ok := s.list[m.DNNormStr()]; ok {
+			return v.Scope.Contains(WriteScope)
+		}
+	}
+	return false
+}
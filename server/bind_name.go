@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/cloudldap/cloudldap/repo"
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/cloudldap/goldap/message"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/xerrors"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// Type of the bind name which isn't a DN
+const (
+	BindNameTypeAny    = "any"    // Matches all types
+	BindNameTypeName   = "name"   // user
+	BindNameTypeUPN    = "upn"    // user@domain
+	BindNameTypeDomain = "domain" // DOMAIN\user
+)
+
+// BindNameRule maps the bind name to the DN by searching under the base DN.
+// The filter is the template which can contain the following placeholders.
+//
+//	%u: The user part of the bind name
+//	%d: The domain part of the bind name (empty if the type is "name")
+//	%s: The bind name as is
+type BindNameRule struct {
+	Type   string
+	BaseDN *schema.DN
+	Filter string
+}
+
+// BindNameResolver resolves the bind name which isn't a DN by the ordered rules.
+type BindNameResolver struct {
+	server *Server
+	rules  []*BindNameRule
+}
+
+func NewBindNameResolver(server *Server) (*BindNameResolver, error) {
+	resolver := &BindNameResolver{
+		server: server,
+	}
+
+	for _, d := range server.config.BindNameRules {
+		s := strings.SplitN(d, ":", 3)
+		if len(s) != 3 {
+			return nil, xerrors.Errorf("Invalid format. Need <Type(any, name, upn or domain)>:<Base DN>:<Filter>: %s", d)
+		}
+
+		t := strings.ToLower(strings.TrimSpace(s[0]))
+		switch t {
+		case BindNameTypeAny, BindNameTypeName, BindNameTypeUPN, BindNameTypeDomain:
+		default:
+			return nil, xerrors.Errorf(`Invalid type. Need "any", "name", "upn" or "domain": %s`, d)
+		}
+
+		baseDN, err := server.NormalizeDN(strings.TrimSpace(s[1]))
+		if err != nil {
+			return nil, xerrors.Errorf("Invalid base DN: %s, err: %w", d, err)
+		}
+
+		rule := &BindNameRule{
+			Type:   t,
+			BaseDN: baseDN,
+			Filter: strings.TrimSpace(s[2]),
+		}
+
+		// Validate the filter template
+		if _, err := rule.compile("user", "domain", "user@domain"); err != nil {
+			return nil, xerrors.Errorf("Invalid filter: %s, err: %w", d, err)
+		}
+
+		resolver.rules = append(resolver.rules, rule)
+	}
+
+	return resolver, nil
+}
+
+// Enabled returns true if the rules are configured.
+func (r *BindNameResolver) Enabled() bool {
+	return len(r.rules) > 0
+}
+
+// Resolve returns the DN of the unique entry matched by the first applicable rule.
+// It returns invalid credentials error if no entry or multiple entries are found.
+func (r *BindNameResolver) Resolve(ctx context.Context, name string) (*schema.DN, error) {
+	nameType, user, domain := parseBindName(name)
+	if user == "" {
+		return nil, util.NewInvalidCredentials()
+	}
+
+	for _, rule := range r.rules {
+		if rule.Type != BindNameTypeAny && rule.Type != nameType {
+			continue
+		}
+
+		filter, err := rule.compile(user, domain, name)
+		if err != nil {
+			return nil, xerrors.Errorf("Failed to compile the bind name filter. name: %s, err: %w", name, err)
+		}
+
+		dn, err := r.server.findUniqueDN(ctx, rule.BaseDN, filter)
+		if err != nil {
+			var lerr *util.LDAPError
+			if ok := xerrors.As(err, &lerr); ok && lerr.IsInvalidCredentials() {
+				log.Printf("warn: Bind name isn't unique. name: %s, base_dn: %s, filter: %s", name, rule.BaseDN.DNOrigStr(), rule.Filter)
+				return nil, err
+			}
+			return nil, xerrors.Errorf("Failed to search the bind name. name: %s, err: %w", name, err)
+		}
+		if dn == nil {
+			continue
+		}
+
+		log.Printf("info: Resolved bind name. name: %s, dn_norm: %s", name, dn.DNNormStr())
+
+		return dn, nil
+	}
+
+	log.Printf("info: Bind name not found. name: %s", name)
+
+	return nil, util.NewInvalidCredentials()
+}
+
+// findUniqueDN searches the entry matched by the filter under the base DN.
+// It returns nil if no entry is found, and invalid credentials error if multiple entries are found.
+func (s *Server) findUniqueDN(ctx context.Context, baseDN *schema.DN, filter message.Filter) (*schema.DN, error) {
+	option := &repo.SearchOption{
+		Scope:    2,
+		Filter:   filter,
+		PageSize: 2,
+	}
+
+	var found []string
+	_, _, err := s.Repo().Search(ctx, baseDN, option, func(entry *repo.SearchEntry) error {
+		found = append(found, entry.DNOrig())
+		return nil
+	})
+	if err != nil {
+		var lerr *util.LDAPError
+		if ok := xerrors.As(err, &lerr); ok && lerr.IsNoSuchObject() {
+			// The base DN doesn't exist
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	if len(found) > 1 {
+		return nil, util.NewInvalidCredentials()
+	}
+
+	dn, err := s.NormalizeDN(found[0])
+	if err != nil {
+		return nil, xerrors.Errorf("Unexpected DN. dn: %s, err: %w", found[0], err)
+	}
+	return dn, nil
+}
+
+// parseBindName splits the bind name into the type, user and domain.
+func parseBindName(name string) (string, string, string) {
+	if i := strings.Index(name, `\`); i != -1 {
+		return BindNameTypeDomain, name[i+1:], name[:i]
+	}
+	if i := strings.LastIndex(name, "@"); i != -1 {
+		return BindNameTypeUPN, name[:i], name[i+1:]
+	}
+	return BindNameTypeName, name, ""
+}
+
+// compile builds the search filter by replacing the placeholders with the escaped values.
+func (b *BindNameRule) compile(user, domain, name string) (message.Filter, error) {
+	replacer := strings.NewReplacer(
+		"%u", ldap.EscapeFilter(user),
+		"%d", ldap.EscapeFilter(domain),
+		"%s", ldap.EscapeFilter(name),
+	)
+	return parseFilter(replacer.Replace(b.Filter))
+}
+
+// parseFilter parses the filter string into the filter of goldap
+// by decoding the search request which contains the filter.
+func parseFilter(str string) (message.Filter, error) {
+	fp, err := ldap.CompileFilter(str)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := ber.DecodePacketErr(fp.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "MessageID"))
+
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchRequest, nil, "Search Request")
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Base DN"))
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, "Scope"))
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, "Deref Aliases"))
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Size Limit"))
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Time Limit"))
+	req.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Types Only"))
+	req.AppendChild(filter)
+	req.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes"))
+	packet.AppendChild(req)
+
+	m, err := message.ReadLDAPMessage(message.NewBytes(0, packet.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	sr, ok := m.ProtocolOp().(message.SearchRequest)
+	if !ok {
+		return nil, xerrors.Errorf("Unexpected protocol op: %T", m.ProtocolOp())
+	}
+	return sr.Filter(), nil
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/cloudldap/cloudldap/auth"
+	"github.com/cloudldap/cloudldap/repo"
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/cloudldap/goldap/message"
+	"golang.org/x/xerrors"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+const (
+	// Get Effective Rights control
+	// See: https://datatracker.ietf.org/doc/html/draft-ietf-ldapext-acl-model-08
+	GetEffectiveRightsControlOID = "1.3.6.1.4.1.42.2.27.9.5.2"
+
+	entryLevelRightsAttr     = "entryLevelRights"
+	attributeLevelRightsAttr = "attributeLevelRights"
+)
+
+// EffectiveRightsRequest is the decoded value of Get Effective Rights control.
+//
+//	GetRightsControl ::= SEQUENCE {
+//		authzId    authzId  -- Authorization identity, "dn:<DN>" or empty
+//		attributes SEQUENCE OF AttributeType
+//	}
+type EffectiveRightsRequest struct {
+	AuthzID    string
+	Attributes []string
+	Critical   bool
+}
+
+// EffectiveRights holds the subject to evaluate the rights for.
+type EffectiveRights struct {
+	Session    *auth.AuthSession
+	Attributes []string
+}
+
+func parseEffectiveRightsControl(con message.Control) (*EffectiveRightsRequest, error) {
+	req := &EffectiveRightsRequest{
+		Critical: bool(con.Criticality()),
+	}
+
+	if con.ControlValue() == nil || len(*con.ControlValue()) == 0 {
+		// Use the bound user
+		return req, nil
+	}
+
+	packet, err := ber.DecodePacketErr([]byte(*con.ControlValue()))
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to decode get effective rights control. err: %w", err)
+	}
+
+	switch packet.Tag {
+	case ber.TagOctetString:
+		// Some clients send only authzId
+		req.AuthzID = packet.Data.String()
+	case ber.TagSequence:
+		if len(packet.Children) > 0 {
+			req.AuthzID = packet.Children[0].Data.String()
+		}
+		if len(packet.Children) > 1 {
+			for _, v := range packet.Children[1].Children {
+				req.Attributes = append(req.Attributes, v.Data.String())
+			}
+		}
+	default:
+		return nil, xerrors.Errorf("Unexpected tag of get effective rights control. tag: %d", packet.Tag)
+	}
+
+	return req, nil
+}
+
+// NewEffectiveRights resolves the subject of Get Effective Rights control.
+// If authzId isn't specified, the bound user is used.
+// The authzId of other users is allowed for root and the users with G scope of the ACL.
+func (s *Server) NewEffectiveRights(ctx context.Context, session *auth.AuthSession, req *EffectiveRightsRequest) (*EffectiveRights, error) {
+	if req.AuthzID == "" {
+		return &EffectiveRights{
+			Session:    session,
+			Attributes: req.Attributes,
+		}, nil
+	}
+
+	if !strings.HasPrefix(strings.ToLower(req.AuthzID), "dn:") {
+		// TODO Support "u:" form
+		return nil, util.NewProtocolError("unsupported authzId form in get effective rights control")
+	}
+
+	dn, err := s.NormalizeDN(strings.TrimSpace(req.AuthzID[3:]))
+	if err != nil {
+		return nil, util.NewProtocolError("invalid authzId in get effective rights control")
+	}
+
+	// The rights and the groups of other users are visible only for the allowed users
+	if session.DN == nil || (!dn.Equal(session.DN) && !s.simpleACL.CanGetEffectiveRights(session)) {
+		log.Printf("warn: Not allowed to get the effective rights of other users. authzId: %s", req.AuthzID)
+		return nil, util.NewInsufficientAccess()
+	}
+
+	subject, err := s.findAuthSession(ctx, dn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EffectiveRights{
+		Session:    subject,
+		Attributes: req.Attributes,
+	}, nil
+}
+
+// findAuthSession builds the auth session for the DN with the groups
+// so that the ACL can be evaluated as the user.
+func (s *Server) findAuthSession(ctx context.Context, dn *schema.DN) (*auth.AuthSession, error) {
+	if dn.IsAnonymous() {
+		return &auth.AuthSession{}, nil
+	}
+	if dn.Equal(s.GetRootDN()) {
+		return &auth.AuthSession{
+			DN:     dn,
+			IsRoot: true,
+		}, nil
+	}
+
+	session := &auth.AuthSession{
+		DN: dn,
+	}
+
+	option := &repo.SearchOption{
+		Scope:               0,
+		Filter:              message.FilterPresent("objectClass"),
+		PageSize:            1,
+		IsMemberOfRequested: true,
+	}
+
+	_, _, err := s.Repo().Search(ctx, dn, option, func(entry *repo.SearchEntry) error {
+		for _, v := range entry.AttrsOrig()["memberOf"] {
+			group, err := s.NormalizeDN(v)
+			if err != nil {
+				return xerrors.Errorf("Unexpected memberOf value. dn_norm: %s, memberOf: %s, err: %w", dn.DNNormStr(), v, err)
+			}
+			session.Groups = append(session.Groups, group)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// annotate adds entryLevelRights and attributeLevelRights into the search result entry.
+func (e *EffectiveRights) annotate(acl *SimpleACL, entry *message.SearchResultEntry, sentAttrs map[string]struct{}) {
+	sent := make([]string, 0, len(sentAttrs))
+	for k := range sentAttrs {
+		sent = append(sent, k)
+	}
+	sort.Strings(sent)
+
+	attrs := util.NewSetString()
+	attrs.AddAll(sent)
+	for _, v := range e.Attributes {
+		if _, ok := sentAttrs[v]; !ok {
+			attrs.Add(v)
+		}
+	}
+
+	rights := make([]string, 0, len(attrs.List()))
+	for _, v := range attrs.List() {
+		rights = append(rights, v+":"+acl.AttributeLevelRights(e.Session, v))
+	}
+
+	entry.AddAttribute(message.AttributeDescription(entryLevelRightsAttr),
+		message.AttributeValue(acl.EntryLevelRights(e.Session)))
+	if len(rights) > 0 {
+		entry.AddAttribute(message.AttributeDescription(attributeLevelRightsAttr),
+			message.AttributeValue(strings.Join(rights, ", ")))
+	}
+}
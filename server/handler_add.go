@@ -56,6 +56,13 @@ func handleAdd(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 			values[i] = string(v)
 		}
 
+		// Hash the plaintext password
+		values, err = s.hashPasswordValues(auth.GetAuthSession(m), attrName, values)
+		if err != nil {
+			responseAddError(w, err)
+			return
+		}
+
 		// Reject invalid attribute name here
 		sv, err := schema.NewSchemaValue(s.schemaRegistry, attrName, values)
 		if err != nil {
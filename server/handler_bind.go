@@ -10,10 +10,8 @@ import (
 	"github.com/cloudldap/cloudldap/repo"
 	"github.com/cloudldap/cloudldap/schema"
 	"github.com/cloudldap/cloudldap/util"
+	"github.com/cloudldap/goldap/message"
 	ldap "github.com/cloudldap/ldapserver"
-	"github.com/jsimonetti/pwscheme/ssha"
-	"github.com/jsimonetti/pwscheme/ssha256"
-	"github.com/jsimonetti/pwscheme/ssha512"
 	"golang.org/x/xerrors"
 )
 
@@ -26,8 +24,39 @@ func handleBind(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 	if r.AuthenticationChoice() == "simple" {
 		name := string(r.Name())
 		input := string(r.AuthenticationSimple())
+		ip := remoteIP(m)
 
 		dn, err := s.NormalizeDN(name)
+		if err != nil && s.bindName.Enabled() {
+			// Login by uid, mail, UPN or DOMAIN\user
+			var attempt *BindRateLimitAttempt
+			attempt, err = s.bindRateLimit.Begin(ctx, ip, nil)
+			if err != nil {
+				responseBindError(w, res, name, err)
+				return
+			}
+			dn, err = s.bindName.Resolve(ctx, name)
+			if err != nil {
+				defer attempt.Release()
+
+				var lerr *util.LDAPError
+				if ok := xerrors.As(err, &lerr); ok {
+					log.Printf("info: Bind failed - Cannot resolve bind name. name: %s", name)
+					if lerr.IsInvalidCredentials() {
+						attempt.Failure(ctx)
+					}
+					res.SetResultCode(lerr.Code)
+					res.SetDiagnosticMessage(lerr.Msg)
+				} else {
+					log.Printf("error: Bind failed - System error. name: %s, err: %+v", name, err)
+					res.SetResultCode(ldap.LDAPResultUnavailable)
+				}
+				w.Write(res)
+				return
+			}
+			// The attempt of the resolved DN is checked below
+			attempt.Release()
+		}
 		if err != nil {
 			log.Printf("info: Bind failed - Invalid DN syntax. request_dn: %s err: %s", name, err)
 			res.SetResultCode(ldap.LDAPResultInvalidDNSyntax)
@@ -36,17 +65,39 @@ func handleBind(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 			return
 		}
 
+		// Brute-force protection
+		var attempt *BindRateLimitAttempt
+		if !dn.IsAnonymous() {
+			attempt, err = s.bindRateLimit.Begin(ctx, ip, dn)
+			if err != nil {
+				responseBindError(w, res, dn.DNNormStr(), err)
+				return
+			}
+			defer attempt.Release()
+		}
+
 		// For rootdn
 		if dn.Equal(s.GetRootDN()) {
+			// The network is checked before the password not to tell the password is correct
+			if !s.netRestriction.Allowed(dn, nil, nil, ip) {
+				log.Printf("warn: Security event - Bind denied by network restriction. remote: %s, dn_norm: %s", ip, dn.DNNormStr())
+				attempt.Failure(ctx)
+				res.SetResultCode(ldap.LDAPResultInvalidCredentials)
+				res.SetDiagnosticMessage("invalid credentials")
+				w.Write(res)
+				return
+			}
 			// TODO implement password policy for root user
 			if ok := validateCred(ctx, s, input, s.GetRootPW()); !ok {
 				log.Printf("info: Bind failed - Invalid credentials. dn_norm: %s", dn.DNNormStr())
+				attempt.Failure(ctx)
 				res.SetResultCode(ldap.LDAPResultInvalidCredentials)
 				res.SetDiagnosticMessage("invalid credentials")
 				w.Write(res)
 				return
 			}
 			log.Printf("info: Bind ok. dn_norm: %s", dn.DNNormStr())
+			attempt.Success(ctx)
 
 			saveAuthencatedDNAsRoot(m, dn)
 
@@ -71,12 +122,30 @@ func handleBind(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 				return util.NewInvalidCredentials()
 			}
 
+			// The network is checked before the password not to tell the password is correct
+			if !s.netRestriction.Allowed(dn, current.MemberOf, current.Attrs, ip) {
+				log.Printf("warn: Security event - Bind denied by network restriction. remote: %s, dn_norm: %s", ip, dn.DNNormStr())
+				return util.NewNetworkRestricted()
+			}
+
 			if isLocked(current) {
 				log.Printf("info: Bind failed - Account locked. dn_norm: %s", dn.DNNormStr())
 				return util.NewAccountLocked()
 			}
 
-			bindOK := validateCreds(ctx, s, input, current)
+			var bindOK bool
+			if secret, ok := s.totp.Required(current); ok {
+				// The bind password is "password+6-digit code"
+				password, code, ok := s.totp.Split(input)
+				if ok && validateCreds(ctx, s, password, current) {
+					bindOK = s.totp.Verify(dn, secret, code)
+					if !bindOK {
+						log.Printf("info: Bind failed - Invalid TOTP code. dn_norm: %s", dn.DNNormStr())
+					}
+				}
+			} else {
+				bindOK = validateCreds(ctx, s, input, current)
+			}
 
 			if !bindOK {
 				if current.PPolicy.ShouldLockout(current.PwdFailureCount) {
@@ -88,6 +157,14 @@ func handleBind(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 				return util.NewInvalidCredentials()
 			}
 
+			if err := s.accountStatus.Check(current); err != nil {
+				var lerr *util.LDAPError
+				if xerrors.As(err, &lerr) {
+					log.Printf("info: Bind failed - Account unusable. dn_norm: %s, reason: %s, msg: %s", dn.DNNormStr(), lerr.Subtype, lerr.Msg)
+				}
+				return err
+			}
+
 			saveAuthencatedDN(m, dn, current.MemberOf)
 
 			return nil
@@ -99,11 +176,13 @@ func handleBind(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 			if ok := xerrors.As(err, &lerr); ok {
 				if !lerr.IsInvalidCredentials() {
 					log.Printf("error: Bind failed - LDAP error. dn_norm: %s, err: %+v", dn.DNNormStr(), err)
+				} else if !lerr.IsAccountUnusable() {
+					attempt.Failure(ctx)
 				}
 
 				res.SetResultCode(lerr.Code)
 				res.SetDiagnosticMessage(lerr.Msg)
-				w.Write(res)
+				responsePPolicyError(w, m, res, lerr)
 				return
 			} else {
 				log.Printf("error: Bind failed - System error. dn_norm: %s, err: %+v", dn.DNNormStr(), err)
@@ -117,10 +196,15 @@ func handleBind(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 
 		// Bind success
 		log.Printf("info: Bind ok. dn_norm: %s", dn.DNNormStr())
+		attempt.Success(ctx)
 
 		w.Write(res)
 		return
 
+	} else if r.AuthenticationChoice() == "sasl" {
+		handleSASLBind(ctx, s, w, m, res)
+		return
+
 	} else {
 		res.SetResultCode(ldap.LDAPResultUnwillingToPerform)
 		res.SetDiagnosticMessage("Authentication choice not supported")
@@ -129,8 +213,26 @@ func handleBind(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 	w.Write(res)
 }
 
+func responseBindError(w ldap.ResponseWriter, res message.BindResponse, name string, err error) {
+	var lerr *util.LDAPError
+	if ok := xerrors.As(err, &lerr); ok {
+		log.Printf("info: Bind failed - Rejected. name: %s, err: %s", name, lerr.Msg)
+		res.SetResultCode(lerr.Code)
+		res.SetDiagnosticMessage(lerr.Msg)
+	} else {
+		log.Printf("error: Bind failed - System error. name: %s, err: %+v", name, err)
+		res.SetResultCode(ldap.LDAPResultUnavailable)
+	}
+	w.Write(res)
+}
+
 // isLocked checks the account is locked if the lock is enabled in the password policy
 func isLocked(cred *repo.FetchedCredential) bool {
+	// The administrator's permanent lock is applied even if the lock is disabled
+	if cred.PwdAccountLockedTime != nil && cred.PwdAccountLockedTime.Equal(pwdAccountLockedTimePermanent) {
+		log.Println("Permanent locked by administrator")
+		return true
+	}
 	if cred.PPolicy.IsLockoutEnabled() {
 		if !cred.PwdAccountLockedTime.IsZero() {
 			if cred.PPolicy.LockoutDuration() == 0 {
@@ -150,6 +252,9 @@ func isLocked(cred *repo.FetchedCredential) bool {
 	return false
 }
 
+// pwdAccountLockedTimePermanent is "000001010000Z" which means the account is locked by the administrator
+var pwdAccountLockedTimePermanent = time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)
+
 func validateCreds(ctx context.Context, s *Server, input string, cred *repo.FetchedCredential) bool {
 	for _, v := range cred.Credential {
 		if ok := validateCred(ctx, s, input, v); ok {
@@ -162,24 +267,15 @@ func validateCreds(ctx context.Context, s *Server, input string, cred *repo.Fetc
 func validateCred(ctx context.Context, s *Server, input, cred string) bool {
 	var ok bool
 	var err error
-	if len(cred) > 7 && string(cred[0:6]) == "{SSHA}" {
-		ok, err = ssha.Validate(input, cred)
-
-	} else if len(cred) > 10 && string(cred[0:9]) == "{SSHA256}" {
-		ok, err = ssha256.Validate(input, cred)
-
-	} else if len(cred) > 10 && string(cred[0:9]) == "{SSHA512}" {
-		ok, err = ssha512.Validate(input, cred)
-
-	} else if len(cred) > 7 && string(cred[0:6]) == "{SASL}" {
+	if len(cred) > 7 && string(cred[0:6]) == "{SASL}" {
 		ok, err = doPassThrough(ctx, s, input, cred[6:])
 	} else {
-		// Plain
-		ok = input == cred
+		// Hashed by the registered scheme or plain
+		ok, err = s.passwordScheme.Validate(input, cred)
 	}
 
 	if err != nil {
-		if err.Error() == "hash does not match password" {
+		if _, invalid := err.(InvalidCredentials); invalid {
 			log.Printf("info: Invalid bindDN/credential. err: %+v", err)
 		} else {
 			log.Printf("error: Failed to authenticate. err: %+v", err)
@@ -8,6 +8,7 @@ import (
 	"github.com/cloudldap/cloudldap/repo"
 	"github.com/cloudldap/cloudldap/schema"
 	"github.com/cloudldap/cloudldap/util"
+	"github.com/cloudldap/goldap/message"
 	ldap "github.com/cloudldap/ldapserver"
 	"github.com/pkg/errors"
 	"golang.org/x/xerrors"
@@ -35,10 +36,7 @@ func handleModify(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 
 	log.Printf("info: Modify entry: %s", dn.DNNormStr())
 
-	i := 0
-Retry:
-
-	err = s.Repo().Update(ctx, dn, func(attrsOrig repo.AttrsOrig) (*repo.Changelog, error) {
+	update := func(attrsOrig repo.AttrsOrig) (*repo.Changelog, error) {
 
 		changelog, err := repo.NewChangelog(ctx, s.schemaRegistry, dn, attrsOrig)
 		if err != nil {
@@ -58,6 +56,13 @@ Retry:
 				log.Printf("--> value: %s", attributeValue)
 			}
 
+			// Hash the plaintext password. The deleting values must be matched with the stored values as is.
+			if change.Operation() != ldap.ModifyRequestChangeOperationDelete {
+				if values, err = s.hashPasswordValues(auth.GetAuthSession(m), attrName, values); err != nil {
+					return nil, err
+				}
+			}
+
 			// Reject invalid attribute name here
 			sv, err := schema.NewSchemaValue(s.schemaRegistry, attrName, values)
 			if err != nil {
@@ -94,7 +99,21 @@ Retry:
 		}
 
 		return changelog, nil
-	})
+	}
+
+	// The members are added or removed in bulk if the backend supports it
+	updater, bulk := s.Repo().(repo.MembershipUpdater)
+	name, add, del, ok := s.memberChanges(r.Changes())
+	bulk = bulk && ok
+
+	i := 0
+Retry:
+
+	if bulk {
+		err = updater.UpdateMembers(ctx, dn, name, add, del)
+	} else {
+		err = s.Repo().Update(ctx, dn, update)
+	}
 
 	if err != nil {
 		var retryError *util.RetryError
@@ -119,6 +138,51 @@ Retry:
 	w.Write(res)
 }
 
+// memberChanges returns the members to be added and removed if the changes only add or remove the values of member or uniqueMember.
+// The other changes, including the deletion of all values, are applied by Update with the current members.
+func (s *Server) memberChanges(changes []message.ModifyRequestChange) (string, []*schema.DN, []*schema.DN, bool) {
+	var name string
+	var add, del []*schema.DN
+	// The same member in multiple changes depends on the order, so it's left to Update
+	seen := map[string]struct{}{}
+
+	for _, change := range changes {
+		modification := change.Modification()
+
+		at, ok := s.schemaRegistry.AttributeType(string(modification.Type_()))
+		if !ok || !at.IsAssociationAttribute() || (name != "" && name != at.Name) {
+			return "", nil, nil, false
+		}
+		name = at.Name
+
+		if len(modification.Vals()) == 0 {
+			return "", nil, nil, false
+		}
+		for _, v := range modification.Vals() {
+			// The invalid DN is reported by Update
+			dn, err := s.NormalizeDN(string(v))
+			if err != nil {
+				return "", nil, nil, false
+			}
+			if _, ok := seen[dn.DNNormStr()]; ok {
+				return "", nil, nil, false
+			}
+			seen[dn.DNNormStr()] = struct{}{}
+
+			switch change.Operation() {
+			case ldap.ModifyRequestChangeOperationAdd:
+				add = append(add, dn)
+			case ldap.ModifyRequestChangeOperationDelete:
+				del = append(del, dn)
+			default:
+				return "", nil, nil, false
+			}
+		}
+	}
+
+	return name, add, del, name != ""
+}
+
 func responseModifyError(w ldap.ResponseWriter, err error) {
 	var ldapErr *util.LDAPError
 	if ok := xerrors.As(err, &ldapErr); ok {
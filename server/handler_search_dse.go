@@ -24,7 +24,7 @@ func handleSearchDSE(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 	// e.AddAttribute("objectClass", "top")
 	// e.AddAttribute("namingContexts", "ou=system", "ou=schema", "dc=example,dc=com", "ou=config")
 
-	searchEntry := repo.NewSearchEntry(s.schemaRegistry, "", repo.CacheAttrsOrig{
+	attrs := repo.CacheAttrsOrig{
 		"objectClass":          {"top"},
 		"subschemaSubentry":    {"cn=Subschema"},
 		"namingContexts":       {s.GetSuffix()},
@@ -34,8 +34,15 @@ func handleSearchDSE(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 		},
 		"supportedControl": {
 			"1.2.840.113556.1.4.319",
+			GetEffectiveRightsControlOID,
+			PPolicyControlOID,
 		},
-	})
+	}
+	if mechanisms := s.supportedSASLMechanisms(); len(mechanisms) > 0 {
+		attrs["supportedSASLMechanisms"] = mechanisms
+	}
+
+	searchEntry := repo.NewSearchEntry(s.schemaRegistry, "", attrs)
 
 	sentAttrs := map[string]struct{}{}
 
@@ -28,6 +28,7 @@ func handleSearch(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetSearchRequest()
 
 	var pageControl *message.SimplePagedResultsControl
+	var rightsControl *EffectiveRightsRequest
 
 	if m.Controls() != nil {
 		for _, con := range *m.Controls() {
@@ -35,6 +36,15 @@ func handleSearch(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 			if pc, ok := con.PagedResultsControl(); ok {
 				pageControl = pc
 			}
+			if string(con.ControlType()) == GetEffectiveRightsControlOID {
+				rc, err := parseEffectiveRightsControl(con)
+				if err != nil {
+					log.Printf("info: Invalid get effective rights control. err: %v", err)
+					responseSearchError(w, util.NewProtocolError("invalid get effective rights control"))
+					return
+				}
+				rightsControl = rc
+			}
 		}
 
 		if pageControl != nil {
@@ -84,6 +94,17 @@ func handleSearch(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 		return
 	}
 
+	// Phase 3: resolve the subject of effective rights
+	var rights *EffectiveRights
+	if rightsControl != nil {
+		rights, err = s.NewEffectiveRights(ctx, auth.GetAuthSession(m), rightsControl)
+		if err != nil {
+			responseSearchError(w, err)
+			return
+		}
+		log.Printf("info: req effectiveRightsControl: authzId=%s, attributes=%v", rightsControl.AuthzID, rightsControl.Attributes)
+	}
+
 	// Phase 4: execute SQL and return entries
 	// TODO configurable default pageSize
 	var pageSize int32 = 500
@@ -125,7 +146,7 @@ func handleSearch(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 	}
 
 	maxCount, limittedCount, err := s.Repo().Search(ctx, baseDN, option, func(searchEntry *repo.SearchEntry) error {
-		responseEntry(s, w, m, r, searchEntry)
+		responseEntry(s, w, m, r, searchEntry, rights)
 		return nil
 	})
 	if err != nil {
@@ -165,7 +186,7 @@ func handleSearch(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 	}
 }
 
-func responseEntry(s *Server, w ldap.ResponseWriter, m *ldap.Message, r message.SearchRequest, searchEntry *repo.SearchEntry) {
+func responseEntry(s *Server, w ldap.ResponseWriter, m *ldap.Message, r message.SearchRequest, searchEntry *repo.SearchEntry, rights *EffectiveRights) {
 	log.Printf("Response Entry: %+v", searchEntry)
 
 	session := auth.GetAuthSession(m)
@@ -241,10 +262,16 @@ func responseEntry(s *Server, w ldap.ResponseWriter, m *ldap.Message, r message.
 					av[i] = message.AttributeValue(vv)
 				}
 				e.AddAttribute(message.AttributeDescription(k), av...)
+
+				sentAttrs[k] = struct{}{}
 			}
 		}
 	}
 
+	if rights != nil {
+		rights.annotate(s.simpleACL, &e, sentAttrs)
+	}
+
 	w.Write(e)
 
 	log.Printf("Response an entry. dn: %s", dnOrig)
@@ -264,6 +291,9 @@ func responseSearchError(w ldap.ResponseWriter, err error) {
 		}
 
 		res := ldap.NewSearchResultDoneResponse(ldapErr.Code)
+		if ldapErr.Msg != "" {
+			res.SetDiagnosticMessage(ldapErr.Msg)
+		}
 		w.Write(res)
 	} else {
 		log.Printf("error: Search error. err: %+v", err)
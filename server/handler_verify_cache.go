@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/cloudldap/cloudldap/auth"
+	"github.com/cloudldap/cloudldap/repo"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/cloudldap/goldap/message"
+	ldap "github.com/cloudldap/ldapserver"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// Verify cache extended operation, it compares the cache of the server with DB.
+	// cloudldap has no registered OID yet, so it's under the experimental arc of OpenLDAP.
+	// The request value is JSON of VerifyCacheRequest (optional), the response value is JSON of repo.CacheVerifyResult.
+	VerifyCacheExtendedOID = "1.3.6.1.4.1.4203.666.11.100.1"
+)
+
+type VerifyCacheRequest struct {
+	// Repair caches the different entries again
+	Repair bool `json:"repair"`
+}
+
+// VerifyCache compares the cache with the storage. It returns the empty result if the backend has no cache.
+func (s *Server) VerifyCache(ctx context.Context, repair bool) (*repo.CacheVerifyResult, error) {
+	if r, ok := s.repo.(repo.CacheVerifier); ok {
+		return r.VerifyCache(ctx, repair)
+	}
+	// The backend has no cache
+	return &repo.CacheVerifyResult{Diffs: []repo.CacheDiff{}}, nil
+}
+
+func handleVerifyCache(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
+	session := auth.GetAuthSession(m)
+	if !session.IsRoot {
+		responseVerifyCacheError(w, util.NewInsufficientAccess())
+		return
+	}
+
+	r := m.GetExtendedRequest()
+
+	var req VerifyCacheRequest
+	if v := r.RequestValue(); v != nil && len(*v) > 0 {
+		if err := json.Unmarshal([]byte(*v), &req); err != nil {
+			log.Printf("warn: Invalid verify cache request: %s, err: %v", *v, err)
+			res := ldap.NewExtendedResponse(ldap.LDAPResultProtocolError)
+			res.SetResponseName(VerifyCacheExtendedOID)
+			res.SetDiagnosticMessage("Invalid request value")
+			w.Write(res)
+			return
+		}
+	}
+
+	log.Printf("info: Verifying cache. repair: %v", req.Repair)
+
+	result, err := s.VerifyCache(m.Context(), req.Repair)
+	if err != nil {
+		responseVerifyCacheError(w, err)
+		return
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		responseVerifyCacheError(w, err)
+		return
+	}
+
+	res := ldap.NewExtendedResponse(ldap.LDAPResultSuccess)
+	res.SetResponseName(VerifyCacheExtendedOID)
+	res.SetResponseValue(message.OCTETSTRING(b))
+	w.Write(res)
+}
+
+func responseVerifyCacheError(w ldap.ResponseWriter, err error) {
+	var ldapErr *util.LDAPError
+	if ok := xerrors.As(err, &ldapErr); ok {
+		log.Printf("warn: Verify cache LDAP error. err: %v", err)
+
+		res := ldap.NewExtendedResponse(ldapErr.Code)
+		res.SetResponseName(VerifyCacheExtendedOID)
+		if ldapErr.Msg != "" {
+			res.SetDiagnosticMessage(ldapErr.Msg)
+		}
+		w.Write(res)
+	} else {
+		log.Printf("error: Verify cache error. err: %+v", err)
+
+		res := ldap.NewExtendedResponse(ldap.LDAPResultOther)
+		res.SetResponseName(VerifyCacheExtendedOID)
+		w.Write(res)
+	}
+}
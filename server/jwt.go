@@ -0,0 +1,418 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// jwksMinRefreshInterval limits the refetch triggered by the unknown key ID
+	jwksMinRefreshInterval = time.Minute
+	// jwksMaxSize is the maximum size of the JWKS document
+	jwksMaxSize = 1024 * 1024
+)
+
+// jwk is the public key of the JWKS (RFC 7517).
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	key crypto.PublicKey
+}
+
+// JWKS holds the public keys loaded from the file or the URL.
+// The keys are reloaded when the refresh interval elapsed or the unknown key ID is used.
+type JWKS struct {
+	File            string
+	URL             string
+	RefreshInterval time.Duration
+	Timeout         time.Duration
+
+	mu        sync.Mutex
+	keys      []*jwk
+	fetchedAt time.Time
+	client    *http.Client
+}
+
+// Key returns the public keys for the key ID and the key type.
+// If the kid is empty, all keys of the key type are returned.
+func (j *JWKS) Key(ctx context.Context, kid, kty string) ([]*jwk, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+
+	if j.keys == nil || now.Sub(j.fetchedAt) > j.RefreshInterval {
+		if err := j.load(ctx, now); err != nil {
+			if j.keys == nil {
+				return nil, err
+			}
+			// Use the previous keys
+			log.Printf("warn: Failed to refresh JWKS. err: %+v", err)
+		}
+	}
+
+	found := j.find(kid, kty)
+	if len(found) == 0 && kid != "" && now.Sub(j.fetchedAt) > jwksMinRefreshInterval {
+		// The key might be rotated
+		if err := j.load(ctx, now); err != nil {
+			log.Printf("warn: Failed to refresh JWKS. err: %+v", err)
+		}
+		found = j.find(kid, kty)
+	}
+
+	return found, nil
+}
+
+func (j *JWKS) find(kid, kty string) []*jwk {
+	var found []*jwk
+	for _, k := range j.keys {
+		if k.Kty != kty {
+			continue
+		}
+		if kid != "" && k.Kid != kid {
+			continue
+		}
+		found = append(found, k)
+	}
+	return found
+}
+
+func (j *JWKS) load(ctx context.Context, now time.Time) error {
+	var b []byte
+	var err error
+
+	if j.File != "" {
+		b, err = os.ReadFile(j.File)
+		if err != nil {
+			return xerrors.Errorf("Failed to read JWKS file. file: %s, err: %w", j.File, err)
+		}
+	} else {
+		b, err = j.fetch(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("info: Loaded JWKS. keys: %d", len(keys))
+
+	j.keys = keys
+	j.fetchedAt = now
+
+	return nil
+}
+
+func (j *JWKS) fetch(ctx context.Context) ([]byte, error) {
+	if j.client == nil {
+		j.client = &http.Client{
+			Timeout: j.Timeout,
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.URL, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid JWKS URL. url: %s, err: %w", j.URL, err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := j.client.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to fetch JWKS. url: %s, err: %w", j.URL, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("Failed to fetch JWKS. url: %s, status: %d", j.URL, res.StatusCode)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, jwksMaxSize))
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to read JWKS. url: %s, err: %w", j.URL, err)
+	}
+	return b, nil
+}
+
+func parseJWKS(b []byte) ([]*jwk, error) {
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, xerrors.Errorf("Invalid JWKS. err: %w", err)
+	}
+
+	keys := make([]*jwk, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var err error
+		switch k.Kty {
+		case "RSA":
+			k.key, err = parseRSAJWK(k)
+		case "EC":
+			k.key, err = parseECJWK(k)
+		default:
+			// Unsupported key type, ignore
+			continue
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("Invalid JWK. kid: %s, err: %w", k.Kid, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func parseRSAJWK(k *jwk) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+		return nil, xerrors.New("Invalid RSA key")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+func parseECJWK(k *jwk) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, xerrors.Errorf("Unsupported curve: %s", k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	pub := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, xerrors.New("Invalid EC key")
+	}
+	return pub, nil
+}
+
+// jwtAlgorithm is the signature algorithm of JWS (RFC 7518 Section 3.1).
+// Only the asymmetric algorithms are supported since the JWKS has the public keys.
+type jwtAlgorithm struct {
+	kty  string
+	hash crypto.Hash
+	pss  bool
+}
+
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {"RSA", crypto.SHA256, false},
+	"RS384": {"RSA", crypto.SHA384, false},
+	"RS512": {"RSA", crypto.SHA512, false},
+	"PS256": {"RSA", crypto.SHA256, true},
+	"PS384": {"RSA", crypto.SHA384, true},
+	"PS512": {"RSA", crypto.SHA512, true},
+	"ES256": {"EC", crypto.SHA256, false},
+	"ES384": {"EC", crypto.SHA384, false},
+	"ES512": {"EC", crypto.SHA512, false},
+}
+
+// JWTClaims is the payload of the verified JWT.
+type JWTClaims map[string]interface{}
+
+// verifyJWT verifies the signature of the compact serialized JWT and returns the claims.
+// The registered claims aren't validated here, see JWTClaims.Validate.
+func verifyJWT(ctx context.Context, jwks *JWKS, token string) (JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, xerrors.New("Malformed JWT")
+	}
+
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, xerrors.Errorf("Malformed JWT header. err: %w", err)
+	}
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Typ  string   `json:"typ"`
+		Crit []string `json:"crit"`
+	}
+	if err := json.Unmarshal(hb, &header); err != nil {
+		return nil, xerrors.Errorf("Malformed JWT header. err: %w", err)
+	}
+	if len(header.Crit) > 0 {
+		return nil, xerrors.Errorf("Unsupported critical header: %v", header.Crit)
+	}
+
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, xerrors.Errorf("Unsupported JWT algorithm: %s", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, xerrors.Errorf("Malformed JWT signature. err: %w", err)
+	}
+
+	h := alg.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	keys, err := jwks.Key(ctx, header.Kid, alg.kty)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, xerrors.Errorf("No JWK found. kid: %s, alg: %s", header.Kid, header.Alg)
+	}
+
+	verified := false
+	for _, k := range keys {
+		if k.Alg != "" && k.Alg != header.Alg {
+			continue
+		}
+		if verifyJWTSignature(alg, k.key, digest, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, xerrors.Errorf("Invalid JWT signature. kid: %s, alg: %s", header.Kid, header.Alg)
+	}
+
+	pb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, xerrors.Errorf("Malformed JWT payload. err: %w", err)
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(pb)))
+	dec.UseNumber()
+
+	var claims JWTClaims
+	if err := dec.Decode(&claims); err != nil {
+		return nil, xerrors.Errorf("Malformed JWT payload. err: %w", err)
+	}
+	return claims, nil
+}
+
+func verifyJWTSignature(alg jwtAlgorithm, key crypto.PublicKey, digest, sig []byte) bool {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg.pss {
+			return rsa.VerifyPSS(pub, alg.hash, digest, sig, nil) == nil
+		}
+		return rsa.VerifyPKCS1v15(pub, alg.hash, digest, sig) == nil
+
+	case *ecdsa.PublicKey:
+		// The signature is R || S (RFC 7518 Section 3.4)
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// Validate checks the issuer, the audience and the validity period (RFC 7519 Section 4.1).
+func (c JWTClaims) Validate(issuer, audience string, now time.Time, skew time.Duration) error {
+	if iss, _ := c["iss"].(string); iss != issuer {
+		return xerrors.Errorf("Invalid issuer: %v", c["iss"])
+	}
+
+	if !c.hasAudience(audience) {
+		return xerrors.Errorf("Invalid audience: %v", c["aud"])
+	}
+
+	exp, ok := c.time("exp")
+	if !ok {
+		return xerrors.New("No expiration time")
+	}
+	if !now.Before(exp.Add(skew)) {
+		return xerrors.Errorf("Token expired at %s", exp.Format(time.RFC3339))
+	}
+
+	if nbf, ok := c.time("nbf"); ok && now.Add(skew).Before(nbf) {
+		return xerrors.Errorf("Token not valid before %s", nbf.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func (c JWTClaims) hasAudience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c JWTClaims) time(name string) (time.Time, bool) {
+	n, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// StringClaim returns the non-empty string claim.
+func (c JWTClaims) StringClaim(name string) (string, bool) {
+	s, ok := c[name].(string)
+	return s, ok && s != ""
+}
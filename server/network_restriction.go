@@ -0,0 +1,127 @@
+package server
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/cloudldap/cloudldap/repo"
+	"github.com/cloudldap/cloudldap/schema"
+	"golang.org/x/xerrors"
+)
+
+type NetworkRestrictionConfig struct {
+	// Attribute is the attribute which has the allowed client networks (CIDR or IP address) of the entry.
+	// It must be defined by the custom schema.
+	Attribute string
+	// Rules are "<DN(User or Group)>:<CIDR>[,<CIDR>...]"
+	Rules []string
+	// ProxyProtocolTrusted are the networks of the proxies which send the PROXY protocol header
+	ProxyProtocolTrusted []string
+}
+
+type networkRestrictionRule struct {
+	dn   *schema.DN
+	nets []*net.IPNet
+}
+
+// NetworkRestriction restricts the client networks which can bind per account or group.
+// The account which has no allowed networks by the attribute and the rules isn't restricted.
+type NetworkRestriction struct {
+	attrName      string
+	rules         []*networkRestrictionRule
+	proxyProtocol []*net.IPNet
+}
+
+func NewNetworkRestriction(server *Server) (*NetworkRestriction, error) {
+	c := server.config.NetworkRestrictionConfig
+	if c == nil {
+		c = &NetworkRestrictionConfig{}
+	}
+
+	r := &NetworkRestriction{}
+
+	if c.Attribute != "" {
+		at, ok := server.schemaRegistry.AttributeType(c.Attribute)
+		if !ok {
+			return nil, xerrors.Errorf("Invalid network restriction attribute. The attribute isn't defined. attribute: %s", c.Attribute)
+		}
+		r.attrName = at.Name
+	}
+
+	for _, v := range c.Rules {
+		// IPv6 has ':', so split by the first ':'
+		i := strings.Index(v, ":")
+		if i == -1 {
+			return nil, xerrors.Errorf("Invalid format. Need <DN(User or Group)>:<CIDR>[,<CIDR>...]: %s", v)
+		}
+		dn, err := server.NormalizeDN(strings.TrimSpace(v[:i]))
+		if err != nil {
+			return nil, xerrors.Errorf("Invalid DN format: %s, err: %w", v, err)
+		}
+		nets, err := parseCIDRs(strings.Split(v[i+1:], ","))
+		if err != nil {
+			return nil, xerrors.Errorf("Invalid network restriction rule: %s, err: %w", v, err)
+		}
+		r.rules = append(r.rules, &networkRestrictionRule{
+			dn:   dn,
+			nets: nets,
+		})
+	}
+
+	nets, err := parseCIDRs(c.ProxyProtocolTrusted)
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid PROXY protocol trusted network. err: %w", err)
+	}
+	r.proxyProtocol = nets
+
+	return r, nil
+}
+
+// Listener wraps the listener to handle the PROXY protocol if the trusted proxies are configured.
+func (r *NetworkRestriction) Listener(l net.Listener) net.Listener {
+	if len(r.proxyProtocol) == 0 {
+		return l
+	}
+	return newProxyProtocolListener(l, r.proxyProtocol)
+}
+
+// Allowed returns true if the client IP is in the allowed networks of the account.
+// The attrs can be nil (e.g. the root DN).
+func (r *NetworkRestriction) Allowed(dn *schema.DN, groups []*schema.DN, attrs repo.CacheAttrsNorm, ip string) bool {
+	var nets []*net.IPNet
+	restricted := false
+
+	if r.attrName != "" {
+		for _, v := range attrNormStr(attrs, r.attrName) {
+			restricted = true
+			n, err := parseCIDR(v)
+			if err != nil {
+				// Ignore the invalid value, then it's denied if no other networks
+				log.Printf("error: Invalid allowed network of the entry. dn_norm: %s, err: %v", dn.DNNormStr(), err)
+				continue
+			}
+			nets = append(nets, n)
+		}
+	}
+
+	for _, rule := range r.rules {
+		if rule.dn.Equal(dn) {
+			restricted = true
+			nets = append(nets, rule.nets...)
+			continue
+		}
+		for _, g := range groups {
+			if rule.dn.Equal(g) {
+				restricted = true
+				nets = append(nets, rule.nets...)
+				break
+			}
+		}
+	}
+
+	if !restricted {
+		return true
+	}
+	return containsIP(nets, net.ParseIP(ip))
+}
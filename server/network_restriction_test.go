@@ -0,0 +1,210 @@
+//go:build test
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/cloudldap/cloudldap/repo"
+	"github.com/cloudldap/cloudldap/schema"
+)
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, addrs []byte) []byte {
+		b := append([]byte{}, proxyProtocolV2Signature...)
+		b = append(b, 0x20|cmd, fam, byte(len(addrs)>>8), byte(len(addrs)))
+		return append(b, addrs...)
+	}
+
+	testcases := []struct {
+		Name          string
+		Header        []byte
+		ExpectedAddr  string
+		ExpectedError bool
+	}{
+		{
+			"v1 TCP4",
+			[]byte("PROXY TCP4 192.0.2.10 198.51.100.1 56324 389\r\n"),
+			"192.0.2.10:56324",
+			false,
+		},
+		{
+			"v1 TCP6",
+			[]byte("PROXY TCP6 2001:db8::10 2001:db8::1 56324 389\r\n"),
+			"[2001:db8::10]:56324",
+			false,
+		},
+		{
+			"v1 UNKNOWN",
+			[]byte("PROXY UNKNOWN\r\n"),
+			"",
+			false,
+		},
+		{
+			"v1 address family mismatch",
+			[]byte("PROXY TCP4 2001:db8::10 2001:db8::1 56324 389\r\n"),
+			"",
+			true,
+		},
+		{
+			"v1 without CRLF",
+			[]byte("PROXY TCP4 192.0.2.10 198.51.100.1 56324 389\n"),
+			"",
+			true,
+		},
+		{
+			"v2 TCP4 with TLV",
+			v2(0x1, 0x11, []byte{192, 0, 2, 10, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0x85, 0x04, 0x00, 0x01, 0x00}),
+			"192.0.2.10:56324",
+			false,
+		},
+		{
+			"v2 TCP6",
+			v2(0x1, 0x21, append(append(net.ParseIP("2001:db8::10"), net.ParseIP("2001:db8::1")...), 0xdc, 0x04, 0x01, 0x85)),
+			"[2001:db8::10]:56324",
+			false,
+		},
+		{
+			"v2 LOCAL",
+			v2(0x0, 0x00, nil),
+			"",
+			false,
+		},
+		{
+			"v2 too short addresses",
+			v2(0x1, 0x11, []byte{192, 0, 2, 10}),
+			"",
+			true,
+		},
+		{
+			"no header",
+			[]byte{0x30, 0x0c, 0x02, 0x01, 0x01},
+			"",
+			true,
+		},
+	}
+
+	for i, tc := range testcases {
+		// The LDAP message follows the header
+		r := bufio.NewReader(bytes.NewReader(append(tc.Header, 0x30)))
+		addr, err := readProxyProtocolHeader(r)
+		if tc.ExpectedError {
+			if err == nil {
+				t.Errorf("Unexpected success on %d %s: %v", i, tc.Name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error on %d %s: %v", i, tc.Name, err)
+			continue
+		}
+		if tc.ExpectedAddr == "" {
+			if addr != nil {
+				t.Errorf("Unexpected addr on %d %s: %v", i, tc.Name, addr)
+			}
+		} else if addr == nil || addr.String() != tc.ExpectedAddr {
+			t.Errorf("Unexpected addr on %d %s: expected %s, got %v", i, tc.Name, tc.ExpectedAddr, addr)
+		}
+		if b, err := r.ReadByte(); err != nil || b != 0x30 {
+			t.Errorf("Unexpected remaining data on %d %s: %x, err: %v", i, tc.Name, b, err)
+		}
+	}
+}
+
+func TestNetworkRestriction(t *testing.T) {
+	sc := &schema.SchemaConfig{
+		Suffix:       "dc=example,dc=com",
+		CustomSchema: []string{},
+	}
+	s := &Server{
+		config: &ServerConfig{
+			SchemaConfig: sc,
+			NetworkRestrictionConfig: &NetworkRestrictionConfig{
+				Attribute: "ipHostNumber",
+				Rules: []string{
+					"cn=service,ou=Groups,dc=example,dc=com:10.0.0.0/8,2001:db8::/32",
+					"uid=batch,ou=Users,dc=example,dc=com:192.168.1.10",
+				},
+			},
+		},
+		schemaRegistry: schema.NewSchemaRegistry(sc),
+	}
+
+	r, err := NewNetworkRestriction(s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	dn := func(str string) *schema.DN {
+		d, err := s.schemaRegistry.NormalizeDN(str)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return d
+	}
+	service := []*schema.DN{dn("cn=service,ou=Groups,dc=example,dc=com")}
+
+	testcases := []struct {
+		Name     string
+		DN       string
+		Groups   []*schema.DN
+		Attrs    repo.CacheAttrsNorm
+		IP       string
+		Expected bool
+	}{
+		{"not restricted", "uid=user1,ou=Users,dc=example,dc=com", nil, nil, "203.0.113.1", true},
+		{"group allowed", "uid=user1,ou=Users,dc=example,dc=com", service, nil, "10.1.2.3", true},
+		{"group allowed IPv6", "uid=user1,ou=Users,dc=example,dc=com", service, nil, "2001:db8::1", true},
+		{"group denied", "uid=user1,ou=Users,dc=example,dc=com", service, nil, "203.0.113.1", false},
+		{"user rule allowed", "uid=batch,ou=Users,dc=example,dc=com", nil, nil, "192.168.1.10", true},
+		{"user rule denied", "uid=batch,ou=Users,dc=example,dc=com", nil, nil, "192.168.1.11", false},
+		{"attribute allowed", "uid=user1,ou=Users,dc=example,dc=com", nil, repo.CacheAttrsNorm{"ipHostNumber": {"172.16.0.0/12"}}, "172.16.5.5", true},
+		{"attribute denied", "uid=user1,ou=Users,dc=example,dc=com", nil, repo.CacheAttrsNorm{"ipHostNumber": {"172.16.0.0/12"}}, "10.1.2.3", false},
+		{"attribute and group", "uid=user1,ou=Users,dc=example,dc=com", service, repo.CacheAttrsNorm{"ipHostNumber": {"172.16.0.0/12"}}, "10.1.2.3", true},
+		{"invalid attribute denied", "uid=user1,ou=Users,dc=example,dc=com", nil, repo.CacheAttrsNorm{"ipHostNumber": {"invalid"}}, "10.1.2.3", false},
+		{"unknown client denied", "uid=batch,ou=Users,dc=example,dc=com", nil, nil, "", false},
+	}
+
+	for i, tc := range testcases {
+		if got := r.Allowed(dn(tc.DN), tc.Groups, tc.Attrs, tc.IP); got != tc.Expected {
+			t.Errorf("Unexpected result on %d %s: expected %v, got %v", i, tc.Name, tc.Expected, got)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ln.Close()
+
+	trusted, _ := parseCIDRs([]string{"127.0.0.1"})
+	l := newProxyProtocolListener(ln, trusted)
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 192.0.2.10 198.51.100.1 56324 389\r\nhello"))
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	if got := c.RemoteAddr().String(); got != "192.0.2.10:56324" {
+		t.Errorf("Unexpected remote addr: %s", got)
+	}
+	buf := make([]byte, 5)
+	if _, err := c.Read(buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Unexpected data: %s, err: %v", buf, err)
+	}
+}
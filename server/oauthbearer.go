@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cloudldap/cloudldap/repo"
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"github.com/cloudldap/goldap/message"
+	ldap "github.com/cloudldap/ldapserver"
+	"golang.org/x/xerrors"
+)
+
+const SASLMechanismOAuthBearer = "OAUTHBEARER"
+
+type OAuthBearerConfig struct {
+	// JWKSFile is the local JWKS file. Either JWKSFile or JWKSURL is required to enable OAUTHBEARER.
+	JWKSFile string
+	// JWKSURL is the JWKS endpoint of the OIDC provider
+	JWKSURL string
+	// JWKSRefreshInterval is the interval to reload the JWKS (default: 1h)
+	JWKSRefreshInterval time.Duration
+	// Issuer is the expected "iss" claim
+	Issuer string
+	// Audience is the expected "aud" claim
+	Audience string
+	// Claim is the claim mapped to the user (default: sub)
+	Claim string
+	// UserSearch is "<Base DN>:<Filter>" to find the user. %s in the filter is replaced with the claim value.
+	UserSearch string
+	// ClockSkew is the leeway for "exp" and "nbf" claims
+	ClockSkew time.Duration
+}
+
+// OAuthBearerAuthenticator authenticates the SASL OAUTHBEARER bind (RFC 7628) by the JWT access token.
+type OAuthBearerAuthenticator struct {
+	config *OAuthBearerConfig
+	server *Server
+	jwks   *JWKS
+	user   *BindNameRule
+
+	clock func() time.Time
+}
+
+func NewOAuthBearerAuthenticator(server *Server) (*OAuthBearerAuthenticator, error) {
+	c := server.config.OAuthBearerConfig
+	if c == nil || (c.JWKSFile == "" && c.JWKSURL == "") {
+		return &OAuthBearerAuthenticator{}, nil
+	}
+
+	if c.JWKSFile != "" && c.JWKSURL != "" {
+		return nil, xerrors.New("Both JWKS file and URL are specified")
+	}
+	if c.Issuer == "" || c.Audience == "" {
+		return nil, xerrors.New("Issuer and audience are required")
+	}
+	if c.Claim == "" {
+		c.Claim = "sub"
+	}
+	if c.JWKSRefreshInterval <= 0 {
+		c.JWKSRefreshInterval = time.Hour
+	}
+
+	s := strings.SplitN(c.UserSearch, ":", 2)
+	if len(s) != 2 {
+		return nil, xerrors.Errorf("Invalid user search format. Need <Base DN>:<Filter>: %s", c.UserSearch)
+	}
+	baseDN, err := server.NormalizeDN(strings.TrimSpace(s[0]))
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid base DN: %s, err: %w", c.UserSearch, err)
+	}
+
+	user := &BindNameRule{
+		Type:   BindNameTypeAny,
+		BaseDN: baseDN,
+		Filter: strings.TrimSpace(s[1]),
+	}
+	if _, err := user.compile("user", "", "user"); err != nil {
+		return nil, xerrors.Errorf("Invalid filter: %s, err: %w", c.UserSearch, err)
+	}
+
+	a := &OAuthBearerAuthenticator{
+		config: c,
+		server: server,
+		jwks: &JWKS{
+			File:            c.JWKSFile,
+			URL:             c.JWKSURL,
+			RefreshInterval: c.JWKSRefreshInterval,
+			Timeout:         10 * time.Second,
+		},
+		user:  user,
+		clock: time.Now,
+	}
+
+	// Load the keys eagerly to detect misconfiguration.
+	// The JWKS endpoint might be unavailable temporarily, it's retried on the first bind.
+	if _, err := a.jwks.Key(context.Background(), "", ""); err != nil {
+		if c.JWKSFile != "" {
+			return nil, err
+		}
+		log.Printf("warn: Failed to fetch JWKS. err: %+v", err)
+	}
+
+	return a, nil
+}
+
+// Enabled returns true if the JWKS is configured.
+func (a *OAuthBearerAuthenticator) Enabled() bool {
+	return a.config != nil
+}
+
+// Authenticate validates the bearer token in the initial client response and returns the DN of the user.
+func (a *OAuthBearerAuthenticator) Authenticate(ctx context.Context, resp []byte) (*schema.DN, error) {
+	authzid, token, err := parseOAuthBearerResponse(resp)
+	if err != nil {
+		log.Printf("info: Bind failed - Invalid OAUTHBEARER message. err: %s", err)
+		return nil, util.NewProtocolError("invalid OAUTHBEARER message")
+	}
+
+	claims, err := verifyJWT(ctx, a.jwks, token)
+	if err != nil {
+		log.Printf("info: Bind failed - Invalid bearer token. err: %s", err)
+		return nil, util.NewInvalidCredentials()
+	}
+	if err := claims.Validate(a.config.Issuer, a.config.Audience, a.clock(), a.config.ClockSkew); err != nil {
+		log.Printf("info: Bind failed - Invalid bearer token. err: %s", err)
+		return nil, util.NewInvalidCredentials()
+	}
+
+	name, ok := claims.StringClaim(a.config.Claim)
+	if !ok {
+		log.Printf("info: Bind failed - No user claim in the bearer token. claim: %s", a.config.Claim)
+		return nil, util.NewInvalidCredentials()
+	}
+
+	if authzid != "" && authzid != name {
+		// Proxy authorization isn't supported
+		log.Printf("info: Bind failed - Authorization identity mismatch. authzid: %s, %s: %s", authzid, a.config.Claim, name)
+		return nil, util.NewInvalidCredentials()
+	}
+
+	filter, err := a.user.compile(name, "", name)
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to compile the user filter. %s: %s, err: %w", a.config.Claim, name, err)
+	}
+
+	dn, err := a.server.findUniqueDN(ctx, a.user.BaseDN, filter)
+	if err != nil {
+		var lerr *util.LDAPError
+		if ok := xerrors.As(err, &lerr); ok && lerr.IsInvalidCredentials() {
+			log.Printf("warn: Bearer token user isn't unique. %s: %s", a.config.Claim, name)
+			return nil, err
+		}
+		return nil, xerrors.Errorf("Failed to search the bearer token user. %s: %s, err: %w", a.config.Claim, name, err)
+	}
+	if dn == nil {
+		log.Printf("info: Bind failed - Bearer token user not found. %s: %s", a.config.Claim, name)
+		return nil, util.NewInvalidCredentials()
+	}
+
+	log.Printf("info: Resolved bearer token user. %s: %s, dn_norm: %s", a.config.Claim, name, dn.DNNormStr())
+
+	return dn, nil
+}
+
+// parseOAuthBearerResponse parses the initial client response (RFC 7628 Section 3.1)
+// and returns the authorization identity and the bearer token.
+//
+//	gs2-header kvsep *kvpair kvsep
+//	e.g. "n,a=user@example.com,\x01host=server.example.com\x01port=389\x01auth=Bearer <token>\x01\x01"
+func parseOAuthBearerResponse(resp []byte) (string, string, error) {
+	msg := string(resp)
+
+	i := strings.Index(msg, "\x01")
+	if i == -1 || !strings.HasSuffix(msg, "\x01\x01") {
+		return "", "", xerrors.New("Malformed message")
+	}
+
+	gs2 := strings.SplitN(msg[:i], ",", 3)
+	if len(gs2) != 3 || gs2[2] != "" {
+		return "", "", xerrors.New("Malformed GS2 header")
+	}
+	if gs2[0] != "n" && gs2[0] != "y" {
+		// Channel binding isn't supported
+		return "", "", xerrors.Errorf("Unsupported channel binding: %s", gs2[0])
+	}
+
+	var authzid string
+	if gs2[1] != "" {
+		if !strings.HasPrefix(gs2[1], "a=") {
+			return "", "", xerrors.New("Malformed authzid")
+		}
+		authzid = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(gs2[1][2:])
+	}
+
+	var token string
+	for _, kv := range strings.Split(msg[i+1:len(msg)-2], "\x01") {
+		if !strings.HasPrefix(kv, "auth=") {
+			continue
+		}
+		scheme, t, ok := strings.Cut(kv[len("auth="):], " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return "", "", xerrors.New("Unsupported auth scheme")
+		}
+		token = strings.TrimSpace(t)
+	}
+	if token == "" {
+		return "", "", xerrors.New("No bearer token")
+	}
+
+	return authzid, token, nil
+}
+
+func handleSASLBind(ctx context.Context, s *Server, w ldap.ResponseWriter, m *ldap.Message, res message.BindResponse) {
+	r := m.GetBindRequest()
+	sasl := r.AuthenticationSasl()
+	mechanism := string(sasl.Mechanism())
+	ip := remoteIP(m)
+
+	if mechanism != SASLMechanismOAuthBearer || !s.oauthBearer.Enabled() {
+		log.Printf("info: Bind failed - Unsupported SASL mechanism. mechanism: %s", mechanism)
+		res.SetResultCode(ldap.LDAPResultAuthMethodNotSupported)
+		res.SetDiagnosticMessage("SASL mechanism not supported")
+		w.Write(res)
+		return
+	}
+
+	attempt, err := s.bindRateLimit.Begin(ctx, ip, nil)
+	if err != nil {
+		responseBindError(w, res, mechanism, err)
+		return
+	}
+
+	var resp []byte
+	if c := sasl.Credentials(); c != nil {
+		resp = []byte(*c)
+	}
+
+	dn, err := s.oauthBearer.Authenticate(ctx, resp)
+	if err != nil {
+		var lerr *util.LDAPError
+		if ok := xerrors.As(err, &lerr); ok && lerr.IsInvalidCredentials() {
+			attempt.Failure(ctx)
+		}
+		attempt.Release()
+		responseBindError(w, res, mechanism, err)
+		return
+	}
+	// The attempt of the authenticated DN is checked below
+	attempt.Release()
+
+	attempt, err = s.bindRateLimit.Begin(ctx, ip, dn)
+	if err != nil {
+		responseBindError(w, res, dn.DNNormStr(), err)
+		return
+	}
+	defer attempt.Release()
+
+	// Check the account and resolve the groups as same as the simple bind
+	var memberOf []*schema.DN
+	err = s.Repo().Bind(ctx, dn, func(current *repo.FetchedCredential) error {
+		if err := s.checkSASLAccount(dn, current, ip); err != nil {
+			return err
+		}
+		memberOf = current.MemberOf
+		return nil
+	})
+	if err != nil {
+		var lerr *util.LDAPError
+		if ok := xerrors.As(err, &lerr); ok {
+			log.Printf("info: Bind failed - Rejected. mechanism: %s, dn_norm: %s, err: %s", mechanism, dn.DNNormStr(), lerr.Msg)
+			res.SetResultCode(lerr.Code)
+			res.SetDiagnosticMessage(lerr.Msg)
+			responsePPolicyError(w, m, res, lerr)
+			return
+		}
+		responseBindError(w, res, dn.DNNormStr(), err)
+		return
+	}
+
+	saveAuthencatedDN(m, dn, memberOf)
+
+	log.Printf("info: Bind ok. mechanism: %s, dn_norm: %s", mechanism, dn.DNNormStr())
+	attempt.Success(ctx)
+
+	w.Write(res)
+}
+
+// checkSASLAccount checks the account and the client network of the SASL bind as same as the simple bind except the password.
+// The user who requires TOTP can't bind by SASL because the TOTP code can't be sent with the token.
+func (s *Server) checkSASLAccount(dn *schema.DN, current *repo.FetchedCredential, ip string) error {
+	if isLocked(current) {
+		log.Printf("info: Bind failed - Account locked. dn_norm: %s", dn.DNNormStr())
+		return util.NewAccountLocked()
+	}
+
+	if _, ok := s.totp.Required(current); ok {
+		log.Printf("info: Bind failed - TOTP is required. dn_norm: %s", dn.DNNormStr())
+		return util.NewInappropriateAuthentication("TOTP is required, use simple bind")
+	}
+
+	if !s.netRestriction.Allowed(dn, current.MemberOf, current.Attrs, ip) {
+		log.Printf("warn: Security event - Bind denied by network restriction. remote: %s, dn_norm: %s", ip, dn.DNNormStr())
+		return util.NewNetworkRestricted()
+	}
+
+	if err := s.accountStatus.Check(current); err != nil {
+		var lerr *util.LDAPError
+		if xerrors.As(err, &lerr) {
+			log.Printf("info: Bind failed - Account unusable. dn_norm: %s, reason: %s, msg: %s", dn.DNNormStr(), lerr.Subtype, lerr.Msg)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// supportedSASLMechanisms returns the SASL mechanisms for the root DSE.
+func (s *Server) supportedSASLMechanisms() []string {
+	var mechanisms []string
+	if s.oauthBearer.Enabled() {
+		mechanisms = append(mechanisms, SASLMechanismOAuthBearer)
+	}
+	return mechanisms
+}
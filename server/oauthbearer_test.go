@@ -0,0 +1,418 @@
+//go:build test
+
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudldap/cloudldap/repo"
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	ldap "github.com/cloudldap/ldapserver"
+	"golang.org/x/xerrors"
+)
+
+func signTestJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	h := jwtAlgorithms[alg].hash.New()
+	h.Write([]byte(input))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, jwtAlgorithms[alg].hash, digest)
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func testJWKS(rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) []byte {
+	b, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kid": "rsa1",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kid": "ec1",
+				"kty": "EC",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+			{
+				"kid": "enc1",
+				"kty": "RSA",
+				"use": "enc",
+			},
+		},
+	})
+	return b
+}
+
+func TestVerifyJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, testJWKS(rsaKey, ecKey), 0600); err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+	jwks := &JWKS{
+		File:            file,
+		RefreshInterval: time.Hour,
+	}
+
+	now := time.Unix(1700000000, 0)
+	claims := func(m map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":                "https://idp.example.com",
+			"aud":                "ldap",
+			"sub":                "user1",
+			"preferred_username": "user1@example.com",
+			"exp":                now.Add(time.Hour).Unix(),
+		}
+		for k, v := range m {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	testcases := []struct {
+		Name          string
+		Token         string
+		ExpectedValid bool
+	}{
+		{
+			"RS256",
+			signTestJWT(t, "RS256", "rsa1", rsaKey, claims(nil)),
+			true,
+		},
+		{
+			"ES256",
+			signTestJWT(t, "ES256", "ec1", ecKey, claims(nil)),
+			true,
+		},
+		{
+			"no kid",
+			signTestJWT(t, "RS256", "", rsaKey, claims(nil)),
+			true,
+		},
+		{
+			"audience array",
+			signTestJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"aud": []string{"other", "ldap"}})),
+			true,
+		},
+		{
+			"expired within skew",
+			signTestJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})),
+			true,
+		},
+		{
+			"expired",
+			signTestJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})),
+			false,
+		},
+		{
+			"no exp",
+			signTestJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"exp": nil})),
+			false,
+		},
+		{
+			"not yet valid",
+			signTestJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+			false,
+		},
+		{
+			"invalid issuer",
+			signTestJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+			false,
+		},
+		{
+			"invalid audience",
+			signTestJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"aud": "other"})),
+			false,
+		},
+		{
+			"unknown signer",
+			signTestJWT(t, "RS256", "rsa1", otherKey, claims(nil)),
+			false,
+		},
+		{
+			"key type mismatch",
+			signTestJWT(t, "RS256", "ec1", rsaKey, claims(nil)),
+			false,
+		},
+		{
+			"alg none",
+			base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+				base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"https://idp.example.com","aud":"ldap","sub":"user1","exp":9999999999}`)) + ".",
+			false,
+		},
+		{
+			"malformed",
+			"not-a-jwt",
+			false,
+		},
+	}
+
+	for i, tc := range testcases {
+		c, err := verifyJWT(context.Background(), jwks, tc.Token)
+		if err == nil {
+			err = c.Validate("https://idp.example.com", "ldap", now, time.Minute)
+		}
+		if valid := err == nil; valid != tc.ExpectedValid {
+			t.Errorf("Unexpected result on %d %s: expected %v, got %v, err: %v", i, tc.Name, tc.ExpectedValid, valid, err)
+		}
+	}
+}
+
+func TestJWKSURLRotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	var current atomic.Value
+	current.Store(testJWKS(rsaKey, oldKey))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(current.Load().([]byte))
+	}))
+	defer ts.Close()
+
+	jwks := &JWKS{
+		URL:             ts.URL,
+		RefreshInterval: time.Hour,
+		Timeout:         time.Second,
+	}
+
+	claims := map[string]interface{}{"sub": "user1"}
+
+	if _, err := verifyJWT(context.Background(), jwks, signTestJWT(t, "ES256", "ec1", oldKey, claims)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The rotated key with the new kid is fetched
+	current.Store([]byte(strings.Replace(string(testJWKS(rsaKey, newKey)), `"ec1"`, `"ec2"`, 1)))
+	jwks.fetchedAt = jwks.fetchedAt.Add(-2 * jwksMinRefreshInterval)
+
+	if _, err := verifyJWT(context.Background(), jwks, signTestJWT(t, "ES256", "ec2", newKey, claims)); err != nil {
+		t.Errorf("Unexpected error for the rotated key: %v", err)
+	}
+	if _, err := verifyJWT(context.Background(), jwks, signTestJWT(t, "ES256", "ec1", oldKey, claims)); err == nil {
+		t.Errorf("The removed key must be rejected")
+	}
+}
+
+func TestParseOAuthBearerResponse(t *testing.T) {
+	testcases := []struct {
+		Input           string
+		ExpectedAuthzid string
+		ExpectedToken   string
+		ExpectedOK      bool
+	}{
+		{
+			"n,,\x01auth=Bearer token1\x01\x01",
+			"",
+			"token1",
+			true,
+		},
+		{
+			"n,a=user=2C1=3D@example.com,\x01host=ldap.example.com\x01port=389\x01auth=bearer token1\x01\x01",
+			"user,1=@example.com",
+			"token1",
+			true,
+		},
+		{
+			"p=tls-unique,,\x01auth=Bearer token1\x01\x01",
+			"",
+			"",
+			false,
+		},
+		{
+			"n,,\x01auth=Basic dXNlcjpwYXNz\x01\x01",
+			"",
+			"",
+			false,
+		},
+		{
+			"n,,\x01host=ldap.example.com\x01\x01",
+			"",
+			"",
+			false,
+		},
+		{
+			"\x01",
+			"",
+			"",
+			false,
+		},
+	}
+
+	for i, tc := range testcases {
+		authzid, token, err := parseOAuthBearerResponse([]byte(tc.Input))
+		if ok := err == nil; ok != tc.ExpectedOK || authzid != tc.ExpectedAuthzid || token != tc.ExpectedToken {
+			t.Errorf("Unexpected result on %d: expected (%s, %s, %v), got (%s, %s, %v), err: %v", i,
+				tc.ExpectedAuthzid, tc.ExpectedToken, tc.ExpectedOK, authzid, token, ok, err)
+		}
+	}
+}
+
+func TestCheckSASLAccount(t *testing.T) {
+	sc := &schema.SchemaConfig{
+		Suffix:       "dc=example,dc=com",
+		CustomSchema: []string{},
+	}
+	s := &Server{
+		config: &ServerConfig{
+			SchemaConfig: sc,
+			TOTPConfig: &TOTPConfig{
+				Enabled: true,
+			},
+			AccountStatusConfig: &AccountStatusConfig{
+				Disabled: []string{"description=Disabled"},
+			},
+			NetworkRestrictionConfig: &NetworkRestrictionConfig{
+				Rules: []string{"uid=user1,ou=Users,dc=example,dc=com:192.168.1.0/24"},
+			},
+		},
+		schemaRegistry: schema.NewSchemaRegistry(sc),
+	}
+
+	var err error
+	if s.totp, err = NewTOTPVerifier(s); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.accountStatus, err = NewAccountStatusChecker(s); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.netRestriction, err = NewNetworkRestriction(s); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	dn, err := s.schemaRegistry.NormalizeDN("uid=user1,ou=Users,dc=example,dc=com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	unlocked := time.Time{}
+
+	testcases := []struct {
+		Name            string
+		LockedTime      time.Time
+		Attrs           repo.CacheAttrsNorm
+		IP              string
+		ExpectedCode    int
+		ExpectedSubtype string
+	}{
+		{
+			"valid",
+			unlocked,
+			repo.CacheAttrsNorm{},
+			"192.168.1.1",
+			ldap.LDAPResultSuccess,
+			"",
+		},
+		{
+			"locked by administrator",
+			pwdAccountLockedTimePermanent,
+			repo.CacheAttrsNorm{},
+			"192.168.1.1",
+			ldap.LDAPResultInvalidCredentials,
+			"Account locked",
+		},
+		{
+			"TOTP required",
+			unlocked,
+			repo.CacheAttrsNorm{"totpSecret": {"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"}},
+			"192.168.1.1",
+			ldap.LDAPResultInappropriateAuthentication,
+			"",
+		},
+		{
+			"disabled",
+			unlocked,
+			repo.CacheAttrsNorm{"description": {"disabled"}},
+			"192.168.1.1",
+			ldap.LDAPResultInvalidCredentials,
+			"Account disabled",
+		},
+		{
+			"disallowed network",
+			unlocked,
+			repo.CacheAttrsNorm{},
+			"10.0.0.1",
+			ldap.LDAPResultInvalidCredentials,
+			"Network restricted",
+		},
+	}
+
+	for i, tc := range testcases {
+		lockedTime := tc.LockedTime
+		err := s.checkSASLAccount(dn, &repo.FetchedCredential{
+			PPolicy:              schema.NewDefaultPPolicy(),
+			PwdAccountLockedTime: &lockedTime,
+			Attrs:                tc.Attrs,
+		}, tc.IP)
+
+		if tc.ExpectedCode == ldap.LDAPResultSuccess {
+			if err != nil {
+				t.Errorf("Unexpected error on %d %s: %v", i, tc.Name, err)
+			}
+			continue
+		}
+		var lerr *util.LDAPError
+		if !xerrors.As(err, &lerr) || lerr.Code != tc.ExpectedCode || lerr.Subtype != tc.ExpectedSubtype {
+			t.Errorf("Unexpected error on %d %s: expected %d %s, got %v", i, tc.Name, tc.ExpectedCode, tc.ExpectedSubtype, err)
+		}
+	}
+}
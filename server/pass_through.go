@@ -4,30 +4,13 @@ import (
 	"context"
 	"log"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-ldap/ldap/v3"
 	"golang.org/x/xerrors"
 )
 
-type PassThroughConfig map[string]PassThroughClient
-
-func (p PassThroughConfig) Add(domain string, client PassThroughClient) {
-	p[strings.ToLower(domain)] = client
-}
-
-func (p PassThroughConfig) Has(domain string) bool {
-	_, ok := p[strings.ToLower(domain)]
-	return ok
-}
-
-func (p PassThroughConfig) Get(domain string) (PassThroughClient, bool) {
-	c, ok := p[strings.ToLower(domain)]
-	if ok {
-		return c, true
-	}
-	return nil, false
-}
-
 type PassThroughClient interface {
 	Authenticate(ctx context.Context, domain, user, password string) (bool, error)
 }
@@ -40,16 +23,72 @@ type LDAPPassThroughClient struct {
 	BindDN     string
 	Password   string
 	Scope      string
+
+	// Servers are the URLs (ldap://host:port, ldaps://host:port or host:port) of the pass-through LDAP servers.
+	// Server is used if it's empty.
+	Servers []string
+	// Strategy is the order to try the servers, "failover" (default) or "round-robin".
+	Strategy string
+	// StartTLS upgrades ldap:// connection with StartTLS
+	StartTLS           bool
+	CACertFile         string
+	ClientCertFile     string
+	ClientKeyFile      string
+	TLSServerName      string
+	InsecureSkipVerify bool
+	// MaxIdleConns is the number of the pooled connections per server
+	MaxIdleConns int
+	// HealthCheckInterval is the interval to check the servers (0: disabled)
+	HealthCheckInterval time.Duration
+	// CircuitBreakerThreshold is the number of the consecutive failures to stop using the server (0: disabled)
+	CircuitBreakerThreshold int
+	// CircuitBreakerTimeout is the period to stop using the server
+	CircuitBreakerTimeout time.Duration
+
+	initOnce sync.Once
+	pool     *ldapConnPool
+	initErr  error
+}
+
+func (c *LDAPPassThroughClient) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// Close releases the pooled connections.
+func (c *LDAPPassThroughClient) Close() {
+	if c.pool != nil {
+		c.pool.Close()
+	}
 }
 
 func (c *LDAPPassThroughClient) Authenticate(ctx context.Context, domain, user, password string) (bool, error) {
-	l, err := ldap.Dial("tcp", c.Server)
+	c.initOnce.Do(func() {
+		c.pool, c.initErr = newLDAPConnPool(c)
+	})
+	if c.initErr != nil {
+		return false, xerrors.Errorf("Invalid pass-through LDAP configuration. domain: %s, err: %w", domain, c.initErr)
+	}
+
+	var ok bool
+	err := c.pool.Do(ctx, func(l *ldap.Conn) error {
+		var err error
+		ok, err = c.authenticate(l, domain, user, password)
+		return err
+	})
 	if err != nil {
-		return false, xerrors.Errorf("Failed to connect pass-through LDAP server. domain: %s, err: %w", domain, err)
+		if xerrors.Is(err, errPassThroughUnavailable) {
+			return false, xerrors.Errorf("Failed to connect pass-through LDAP server. domain: %s, err: %w", domain, err)
+		}
+		return false, err
 	}
-	defer l.Close()
+	return ok, nil
+}
 
-	err = l.Bind(c.BindDN, c.Password)
+func (c *LDAPPassThroughClient) authenticate(l *ldap.Conn, domain, user, password string) (bool, error) {
+	err := l.Bind(c.BindDN, c.Password)
 	if err != nil {
 		return false, xerrors.Errorf("Failed to bind pass-through LDAP. Check your configuration. domain: %s, BindDN: %s. err: %w", domain, c.BindDN, err)
 	}
@@ -68,7 +107,7 @@ func (c *LDAPPassThroughClient) Authenticate(ctx context.Context, domain, user,
 	}
 
 	// Resolve filter
-	filter := strings.ReplaceAll(c.Filter, "%u", user)
+	filter := strings.ReplaceAll(c.Filter, "%u", ldap.EscapeFilter(user))
 
 	search := ldap.NewSearchRequest(
 		c.SearchBase,
@@ -0,0 +1,407 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// PassThroughConfig holds the pass-through clients keyed by domain.
+// The domains from the config file can be reloaded at runtime.
+type PassThroughConfig struct {
+	mu      sync.RWMutex
+	clients map[string]PassThroughClient
+	// static is the domains added by Add. They are kept on reloading.
+	static map[string]PassThroughClient
+	// file is the path of the config file
+	file string
+	// sources is the definition of the domains loaded from the config file
+	sources map[string]string
+}
+
+func (p *PassThroughConfig) Add(domain string, client PassThroughClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.clients == nil {
+		p.clients = map[string]PassThroughClient{}
+	}
+	if p.static == nil {
+		p.static = map[string]PassThroughClient{}
+	}
+	p.clients[strings.ToLower(domain)] = client
+	p.static[strings.ToLower(domain)] = client
+}
+
+func (p *PassThroughConfig) Has(domain string) bool {
+	_, ok := p.Get(domain)
+	return ok
+}
+
+func (p *PassThroughConfig) Get(domain string) (PassThroughClient, bool) {
+	if p == nil {
+		return nil, false
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	c, ok := p.clients[strings.ToLower(domain)]
+	if ok {
+		return c, true
+	}
+	return nil, false
+}
+
+// PassThroughFile is the format of the pass-through config file.
+//
+//	{
+//	  "domains": [
+//	    {
+//	      "domain": "corp.example.com",
+//	      "ldap": {
+//	        "servers": ["ldaps://dc1.corp.example.com:636", "ldaps://dc2.corp.example.com:636"],
+//	        "searchBase": "dc=corp,dc=example,dc=com",
+//	        "filter": "(sAMAccountName=%u)",
+//	        "bindDN": "cn=svc,dc=corp,dc=example,dc=com",
+//	        "password": "secret",
+//	        "timeout": 10
+//	      }
+//	    }
+//	  ]
+//	}
+type PassThroughFile struct {
+	Domains []*PassThroughDomainConfig `json:"domains"`
+}
+
+type PassThroughDomainConfig struct {
+	Domain string                   `json:"domain"`
+	LDAP   *LDAPPassThroughConfig   `json:"ldap,omitempty"`
+	HTTP   *HTTPPassThroughConfig   `json:"http,omitempty"`
+	RADIUS *RADIUSPassThroughConfig `json:"radius,omitempty"`
+}
+
+type LDAPPassThroughConfig struct {
+	Servers                 []string `json:"servers"`
+	Strategy                string   `json:"strategy,omitempty"`
+	SearchBase              string   `json:"searchBase"`
+	Filter                  string   `json:"filter"`
+	Scope                   string   `json:"scope,omitempty"`
+	BindDN                  string   `json:"bindDN,omitempty"`
+	Password                string   `json:"password,omitempty"`
+	Timeout                 int      `json:"timeout,omitempty"`
+	StartTLS                bool     `json:"startTLS,omitempty"`
+	CACertFile              string   `json:"caCert,omitempty"`
+	ClientCertFile          string   `json:"clientCert,omitempty"`
+	ClientKeyFile           string   `json:"clientKey,omitempty"`
+	TLSServerName           string   `json:"tlsServerName,omitempty"`
+	InsecureSkipVerify      bool     `json:"insecureSkipVerify,omitempty"`
+	MaxIdleConns            int      `json:"maxIdleConns,omitempty"`
+	HealthCheckInterval     string   `json:"healthCheckInterval,omitempty"`
+	CircuitBreakerThreshold int      `json:"circuitBreakerThreshold,omitempty"`
+	CircuitBreakerTimeout   string   `json:"circuitBreakerTimeout,omitempty"`
+}
+
+func (c *LDAPPassThroughConfig) NewClient() (*LDAPPassThroughClient, error) {
+	if len(c.Servers) == 0 {
+		return nil, xerrors.Errorf("Need servers")
+	}
+	switch c.Strategy {
+	case "", PassThroughStrategyFailover, PassThroughStrategyRoundRobin:
+	default:
+		return nil, xerrors.Errorf(`Invalid strategy. Need "failover" or "round-robin": %s`, c.Strategy)
+	}
+
+	client := &LDAPPassThroughClient{
+		Servers:                 c.Servers,
+		Strategy:                c.Strategy,
+		SearchBase:              c.SearchBase,
+		Filter:                  c.Filter,
+		Scope:                   c.Scope,
+		BindDN:                  c.BindDN,
+		Password:                c.Password,
+		Timeout:                 c.Timeout,
+		StartTLS:                c.StartTLS,
+		CACertFile:              c.CACertFile,
+		ClientCertFile:          c.ClientCertFile,
+		ClientKeyFile:           c.ClientKeyFile,
+		TLSServerName:           c.TLSServerName,
+		InsecureSkipVerify:      c.InsecureSkipVerify,
+		MaxIdleConns:            c.MaxIdleConns,
+		CircuitBreakerThreshold: c.CircuitBreakerThreshold,
+	}
+
+	var err error
+	if c.HealthCheckInterval != "" {
+		if client.HealthCheckInterval, err = time.ParseDuration(c.HealthCheckInterval); err != nil {
+			return nil, xerrors.Errorf("Invalid healthCheckInterval: %s, err: %w", c.HealthCheckInterval, err)
+		}
+	}
+	if c.CircuitBreakerTimeout != "" {
+		if client.CircuitBreakerTimeout, err = time.ParseDuration(c.CircuitBreakerTimeout); err != nil {
+			return nil, xerrors.Errorf("Invalid circuitBreakerTimeout: %s, err: %w", c.CircuitBreakerTimeout, err)
+		}
+	}
+
+	// Validate TLS settings before using
+	if _, err := client.newTLSConfig(); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+type HTTPPassThroughConfig struct {
+	Mode               string            `json:"mode,omitempty"`
+	URL                string            `json:"url"`
+	Username           string            `json:"username,omitempty"`
+	ClientID           string            `json:"clientID,omitempty"`
+	ClientSecret       string            `json:"clientSecret,omitempty"`
+	Scope              string            `json:"scope,omitempty"`
+	Body               map[string]string `json:"body,omitempty"`
+	Headers            map[string]string `json:"headers,omitempty"`
+	SuccessStatus      []int             `json:"successStatus,omitempty"`
+	Claims             map[string]string `json:"claims,omitempty"`
+	Timeout            string            `json:"timeout,omitempty"`
+	CACertFile         string            `json:"caCert,omitempty"`
+	ClientCertFile     string            `json:"clientCert,omitempty"`
+	ClientKeyFile      string            `json:"clientKey,omitempty"`
+	InsecureSkipVerify bool              `json:"insecureSkipVerify,omitempty"`
+	CacheTTL           string            `json:"cacheTTL,omitempty"`
+	NegativeCacheTTL   string            `json:"negativeCacheTTL,omitempty"`
+	CacheSize          int               `json:"cacheSize,omitempty"`
+}
+
+func (c *HTTPPassThroughConfig) NewClient() (*HTTPPassThroughClient, error) {
+	if c.URL == "" {
+		return nil, xerrors.Errorf("Need url")
+	}
+	switch c.Mode {
+	case "", HTTPPassThroughModeOAuth2, HTTPPassThroughModeJSON:
+	default:
+		return nil, xerrors.Errorf(`Invalid mode. Need "oauth2" or "json": %s`, c.Mode)
+	}
+
+	client := &HTTPPassThroughClient{
+		Mode:               c.Mode,
+		URL:                c.URL,
+		Username:           c.Username,
+		ClientID:           c.ClientID,
+		ClientSecret:       c.ClientSecret,
+		Scope:              c.Scope,
+		Body:               c.Body,
+		Headers:            c.Headers,
+		SuccessStatus:      c.SuccessStatus,
+		Claims:             c.Claims,
+		CACertFile:         c.CACertFile,
+		ClientCertFile:     c.ClientCertFile,
+		ClientKeyFile:      c.ClientKeyFile,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		CacheSize:          c.CacheSize,
+	}
+
+	for _, v := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"timeout", c.Timeout, &client.Timeout},
+		{"cacheTTL", c.CacheTTL, &client.CacheTTL},
+		{"negativeCacheTTL", c.NegativeCacheTTL, &client.NegativeCacheTTL},
+	} {
+		if v.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v.value)
+		if err != nil {
+			return nil, xerrors.Errorf("Invalid %s: %s, err: %w", v.name, v.value, err)
+		}
+		*v.dest = d
+	}
+
+	// Validate TLS settings before using
+	if err := client.init(); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+type RADIUSPassThroughConfig struct {
+	Servers            []string `json:"servers"`
+	Secret             string   `json:"secret"`
+	Timeout            string   `json:"timeout,omitempty"`
+	Retries            int      `json:"retries,omitempty"`
+	Username           string   `json:"username,omitempty"`
+	NASIdentifier      string   `json:"nasIdentifier,omitempty"`
+	ChallengeSeparator string   `json:"challengeSeparator,omitempty"`
+	// MessageAuthenticator is required if it's omitted. Set false only for the legacy servers.
+	MessageAuthenticator *bool `json:"messageAuthenticator,omitempty"`
+}
+
+func (c *RADIUSPassThroughConfig) NewClient() (*RADIUSPassThroughClient, error) {
+	if len(c.Servers) == 0 {
+		return nil, xerrors.Errorf("Need servers")
+	}
+	if c.Secret == "" {
+		return nil, xerrors.Errorf("Need secret")
+	}
+
+	client := &RADIUSPassThroughClient{
+		Servers:                c.Servers,
+		Secret:                 c.Secret,
+		Retries:                c.Retries,
+		Username:               c.Username,
+		NASIdentifier:          c.NASIdentifier,
+		ChallengeSeparator:     c.ChallengeSeparator,
+		NoMessageAuthenticator: c.MessageAuthenticator != nil && !*c.MessageAuthenticator,
+	}
+
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, xerrors.Errorf("Invalid timeout: %s, err: %w", c.Timeout, err)
+		}
+		client.Timeout = d
+	}
+
+	return client, nil
+}
+
+func (d *PassThroughDomainConfig) newClient() (PassThroughClient, error) {
+	n := 0
+	for _, v := range []bool{d.LDAP != nil, d.HTTP != nil, d.RADIUS != nil} {
+		if v {
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, xerrors.Errorf("Multiple pass-through backends")
+	}
+	if d.LDAP != nil {
+		return d.LDAP.NewClient()
+	}
+	if d.HTTP != nil {
+		return d.HTTP.NewClient()
+	}
+	if d.RADIUS != nil {
+		return d.RADIUS.NewClient()
+	}
+	return nil, xerrors.Errorf("No pass-through backend")
+}
+
+// LoadFile loads the domains from the config file.
+// The clients of the unchanged domains are reused to keep their connections.
+func (p *PassThroughConfig) LoadFile(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return xerrors.Errorf("Failed to read pass-through config file. file: %s, err: %w", file, err)
+	}
+
+	var f PassThroughFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return xerrors.Errorf("Failed to parse pass-through config file. file: %s, err: %w", file, err)
+	}
+
+	p.mu.RLock()
+	current := p.clients
+	currentSources := p.sources
+	p.mu.RUnlock()
+
+	clients := map[string]PassThroughClient{}
+	sources := map[string]string{}
+
+	for _, d := range f.Domains {
+		domain := strings.ToLower(strings.TrimSpace(d.Domain))
+		if domain == "" {
+			return xerrors.Errorf("Invalid pass-through config file. Need domain. file: %s", file)
+		}
+		if _, ok := sources[domain]; ok {
+			return xerrors.Errorf("Invalid pass-through config file. Duplicate domain. file: %s, domain: %s", file, domain)
+		}
+
+		src, _ := json.Marshal(d)
+		sources[domain] = string(src)
+
+		if currentSources[domain] == string(src) {
+			if c, ok := current[domain]; ok {
+				clients[domain] = c
+				continue
+			}
+		}
+
+		c, err := d.newClient()
+		if err != nil {
+			return xerrors.Errorf("Invalid pass-through config file. file: %s, domain: %s, err: %w", file, domain, err)
+		}
+		clients[domain] = c
+	}
+
+	p.mu.Lock()
+	old := p.clients
+	for k, v := range p.static {
+		if _, ok := clients[k]; ok {
+			log.Printf("warn: Pass-through domain is defined by both the flags and the config file. Use the flags. domain: %s", k)
+		}
+		clients[k] = v
+	}
+	p.clients = clients
+	p.sources = sources
+	p.file = file
+	p.mu.Unlock()
+
+	// Release the clients which are removed or replaced
+	for k, v := range old {
+		if c, ok := clients[k]; ok && c == v {
+			continue
+		}
+		if closer, ok := v.(interface{ Close() }); ok {
+			closer.Close()
+		}
+	}
+
+	log.Printf("info: Loaded pass-through config file. file: %s, domains: %d", file, len(f.Domains))
+
+	return nil
+}
+
+// Reload reloads the domains from the config file loaded before.
+func (p *PassThroughConfig) Reload() error {
+	p.mu.RLock()
+	file := p.file
+	p.mu.RUnlock()
+
+	if file == "" {
+		return nil
+	}
+	return p.LoadFile(file)
+}
+
+// WatchSignal reloads the domains whenever the signal (e.g. SIGHUP) is received until the context is done.
+// The current config is kept if the reloading fails.
+func (p *PassThroughConfig) WatchSignal(ctx context.Context, sig ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig...)
+
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+				log.Printf("info: Reloading pass-through config...")
+				if err := p.Reload(); err != nil {
+					log.Printf("error: Failed to reload pass-through config. Keep the current config. err: %+v", err)
+				}
+			}
+		}
+	}()
+}
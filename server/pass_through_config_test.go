@@ -0,0 +1,296 @@
+//go:build test
+
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+const passThroughConfigFile = `{
+  "domains": [
+    {
+      "domain": "Corp.Example.com",
+      "ldap": {
+        "servers": ["ldap://127.0.0.1:10389"],
+        "searchBase": "dc=corp,dc=example,dc=com",
+        "filter": "(sAMAccountName=%u)"
+      }
+    },
+    {
+      "domain": "radius.example.com",
+      "radius": {
+        "servers": ["127.0.0.1:1812"],
+        "secret": "secret"
+      }
+    }
+  ]
+}`
+
+// The LDAP domain is changed, the RADIUS domain isn't changed and the HTTP domain is added
+const passThroughConfigFileChanged = `{
+  "domains": [
+    {
+      "domain": "corp.example.com",
+      "ldap": {
+        "servers": ["ldap://127.0.0.1:20389"],
+        "searchBase": "dc=corp,dc=example,dc=com",
+        "filter": "(sAMAccountName=%u)"
+      }
+    },
+    {
+      "domain": "radius.example.com",
+      "radius": {
+        "servers": ["127.0.0.1:1812"],
+        "secret": "secret"
+      }
+    },
+    {
+      "domain": "http.example.com",
+      "http": {
+        "url": "http://127.0.0.1:8080/token"
+      }
+    }
+  ]
+}`
+
+func writePassThroughConfigFile(t *testing.T, file, content string) {
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+}
+
+func TestPassThroughConfigLoadFile(t *testing.T) {
+	dir := t.TempDir()
+
+	testcases := []struct {
+		Name            string
+		Content         string
+		ExpectedDomains []string
+		ExpectedError   bool
+	}{
+		{
+			"valid",
+			passThroughConfigFile,
+			[]string{"corp.example.com", "CORP.EXAMPLE.COM", "radius.example.com"},
+			false,
+		},
+		{
+			"empty",
+			`{"domains": []}`,
+			nil,
+			false,
+		},
+		{
+			"invalid JSON",
+			`{"domains": [`,
+			nil,
+			true,
+		},
+		{
+			"no domain",
+			`{"domains": [{"radius": {"servers": ["127.0.0.1:1812"], "secret": "secret"}}]}`,
+			nil,
+			true,
+		},
+		{
+			"duplicate domain",
+			`{"domains": [{"domain": "a.example.com", "radius": {"servers": ["127.0.0.1:1812"], "secret": "secret"}},` +
+				`{"domain": "A.example.com", "radius": {"servers": ["127.0.0.1:1812"], "secret": "secret"}}]}`,
+			nil,
+			true,
+		},
+		{
+			"no backend",
+			`{"domains": [{"domain": "a.example.com"}]}`,
+			nil,
+			true,
+		},
+		{
+			"multiple backends",
+			`{"domains": [{"domain": "a.example.com", "radius": {"servers": ["127.0.0.1:1812"], "secret": "secret"}, "http": {"url": "http://127.0.0.1"}}]}`,
+			nil,
+			true,
+		},
+		{
+			"invalid strategy",
+			`{"domains": [{"domain": "a.example.com", "ldap": {"servers": ["ldap://127.0.0.1"], "strategy": "random"}}]}`,
+			nil,
+			true,
+		},
+	}
+
+	for i, tc := range testcases {
+		file := filepath.Join(dir, "pass-through.json")
+		writePassThroughConfigFile(t, file, tc.Content)
+
+		p := &PassThroughConfig{}
+		err := p.LoadFile(file)
+		if tc.ExpectedError {
+			if err == nil {
+				t.Errorf("Expected error on %d %s", i, tc.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error on %d %s: %+v", i, tc.Name, err)
+			continue
+		}
+		for _, domain := range tc.ExpectedDomains {
+			if !p.Has(domain) {
+				t.Errorf("Expected domain on %d %s: %s", i, tc.Name, domain)
+			}
+		}
+	}
+
+	p := &PassThroughConfig{}
+	if err := p.LoadFile(filepath.Join(dir, "not-found.json")); err == nil {
+		t.Errorf("Expected error of the missing file")
+	}
+}
+
+func TestPassThroughConfigReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pass-through.json")
+	writePassThroughConfigFile(t, file, passThroughConfigFile)
+
+	p := &PassThroughConfig{}
+
+	// Reload does nothing before loading the file
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if err := p.LoadFile(file); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	ldapClient, _ := p.Get("corp.example.com")
+	radiusClient, _ := p.Get("radius.example.com")
+
+	// Reloading the same file reuses all clients
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if c, _ := p.Get("corp.example.com"); c != ldapClient {
+		t.Errorf("Expected the LDAP client is reused")
+	}
+	if c, _ := p.Get("radius.example.com"); c != radiusClient {
+		t.Errorf("Expected the RADIUS client is reused")
+	}
+
+	// Only the changed domain is replaced
+	writePassThroughConfigFile(t, file, passThroughConfigFileChanged)
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	c, _ := p.Get("corp.example.com")
+	if c == ldapClient {
+		t.Errorf("Expected the changed LDAP client is replaced")
+	}
+	if c, ok := c.(*LDAPPassThroughClient); !ok || c.Servers[0] != "ldap://127.0.0.1:20389" {
+		t.Errorf("Unexpected LDAP client: %v", c)
+	}
+	if c, _ := p.Get("radius.example.com"); c != radiusClient {
+		t.Errorf("Expected the unchanged RADIUS client is reused")
+	}
+	if !p.Has("http.example.com") {
+		t.Errorf("Expected the added domain")
+	}
+	ldapClient = c
+
+	// The invalid file keeps the current config
+	for _, content := range []string{
+		`{"domains": [`,
+		`{"domains": [{"domain": "corp.example.com", "ldap": {"servers": []}}]}`,
+	} {
+		writePassThroughConfigFile(t, file, content)
+		if err := p.Reload(); err == nil {
+			t.Errorf("Expected error of the invalid file: %s", content)
+		}
+		if c, _ := p.Get("corp.example.com"); c != ldapClient {
+			t.Errorf("Expected the current LDAP client is kept: %s", content)
+		}
+		if !p.Has("http.example.com") || !p.Has("radius.example.com") {
+			t.Errorf("Expected the current domains are kept: %s", content)
+		}
+	}
+
+	// The removed domain is released
+	writePassThroughConfigFile(t, file, `{"domains": []}`)
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if p.Has("corp.example.com") || p.Has("radius.example.com") || p.Has("http.example.com") {
+		t.Errorf("Expected all domains are removed")
+	}
+}
+
+func TestPassThroughConfigStaticDomain(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pass-through.json")
+	writePassThroughConfigFile(t, file, passThroughConfigFile)
+
+	static := &LDAPPassThroughClient{Server: "ldap://127.0.0.1:30389"}
+
+	p := &PassThroughConfig{}
+	p.Add("CORP.example.com", static)
+
+	if err := p.LoadFile(file); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if c, _ := p.Get("corp.example.com"); c != static {
+		t.Errorf("Expected the domain by the flags is used: %v", c)
+	}
+	if !p.Has("radius.example.com") {
+		t.Errorf("Expected the domain by the file")
+	}
+
+	// The domain by the flags is kept after it's removed from the file
+	writePassThroughConfigFile(t, file, `{"domains": []}`)
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if c, _ := p.Get("corp.example.com"); c != static {
+		t.Errorf("Expected the domain by the flags is kept: %v", c)
+	}
+	if p.Has("radius.example.com") {
+		t.Errorf("Expected the domain by the file is removed")
+	}
+}
+
+func TestPassThroughConfigWatchSignal(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pass-through.json")
+	writePassThroughConfigFile(t, file, passThroughConfigFile)
+
+	p := &PassThroughConfig{}
+	if err := p.LoadFile(file); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.WatchSignal(ctx, syscall.SIGHUP)
+
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The invalid file is ignored
+	writePassThroughConfigFile(t, file, `{"domains": [`)
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Failed to send SIGHUP: %v", err)
+	}
+
+	writePassThroughConfigFile(t, file, passThroughConfigFileChanged)
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Failed to send SIGHUP: %v", err)
+	}
+	waitFor(t, "reloading by SIGHUP", func() bool {
+		return p.Has("http.example.com")
+	})
+	if !p.Has("corp.example.com") || !p.Has("radius.example.com") {
+		t.Errorf("Expected the domains after reloading")
+	}
+}
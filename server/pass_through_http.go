@@ -0,0 +1,383 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// OAuth2 resource owner password credentials grant (RFC 6749 Section 4.3)
+	HTTPPassThroughModeOAuth2 = "oauth2"
+	// Generic JSON POST
+	HTTPPassThroughModeJSON = "json"
+)
+
+// HTTPPassThroughClient verifies the credentials against the HTTP endpoint.
+type HTTPPassThroughClient struct {
+	// Mode is "oauth2" (default) or "json"
+	Mode string
+	// URL is the token endpoint for "oauth2" or the endpoint to POST for "json"
+	URL string
+	// Username is the template of the username sent to the endpoint. %u: user, %d: domain (default: %u)
+	Username string
+
+	// For "oauth2"
+	ClientID     string
+	ClientSecret string
+	Scope        string
+
+	// For "json". Body is the template of the JSON body.
+	// The values can contain the placeholders %u(username), %d(domain) and %p(password).
+	// The default is {"username": "%u", "password": "%p"}
+	Body    map[string]string
+	Headers map[string]string
+	// SuccessStatus is the status codes for the success (default: 200)
+	SuccessStatus []int
+
+	// Claims are the expected values in the JSON response. The key is the dot separated path (e.g. "user.active").
+	Claims map[string]string
+
+	Timeout            time.Duration
+	CACertFile         string
+	ClientCertFile     string
+	ClientKeyFile      string
+	InsecureSkipVerify bool
+
+	// CacheTTL is the period to cache the successful result (0: disabled)
+	CacheTTL time.Duration
+	// NegativeCacheTTL is the period to cache the invalid credentials result (0: disabled)
+	NegativeCacheTTL time.Duration
+	// CacheSize is the max number of the cached results (default: 10000).
+	// The least recently used result is evicted when it's full.
+	CacheSize int
+
+	initOnce   sync.Once
+	httpClient *http.Client
+	initErr    error
+	cache      *httpPassThroughCache
+}
+
+// httpPassThroughCache is the LRU cache of the results with the expiration.
+// It's bounded by the size, so the attempts with many passwords can't grow it.
+type httpPassThroughCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type httpPassThroughCacheEntry struct {
+	key     string
+	ok      bool
+	expires time.Time
+}
+
+func newHTTPPassThroughCache(size int) *httpPassThroughCache {
+	if size <= 0 {
+		size = 10000
+	}
+	return &httpPassThroughCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// Get returns the cached result. The expired result is removed.
+func (c *httpPassThroughCache) Get(key string, now time.Time) (*httpPassThroughCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*httpPassThroughCacheEntry)
+	if !now.Before(e.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return e, true
+}
+
+// Put caches the result. The least recently used result is evicted if the cache is full.
+func (c *httpPassThroughCache) Put(key string, ok bool, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		elem.Value = &httpPassThroughCacheEntry{key, ok, expires}
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	for c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*httpPassThroughCacheEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(&httpPassThroughCacheEntry{key, ok, expires})
+}
+
+func (c *httpPassThroughCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *HTTPPassThroughClient) init() error {
+	c.initOnce.Do(func() {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: c.InsecureSkipVerify,
+		}
+
+		if c.CACertFile != "" {
+			pem, err := os.ReadFile(c.CACertFile)
+			if err != nil {
+				c.initErr = xerrors.Errorf("Failed to read CA certificate for pass-through. file: %s, err: %w", c.CACertFile, err)
+				return
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				c.initErr = xerrors.Errorf("Invalid CA certificate for pass-through. file: %s", c.CACertFile)
+				return
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		if c.ClientCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+			if err != nil {
+				c.initErr = xerrors.Errorf("Failed to load client certificate for pass-through. file: %s, err: %w", c.ClientCertFile, err)
+				return
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		timeout := c.Timeout
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+
+		c.httpClient = &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		}
+		c.cache = newHTTPPassThroughCache(c.CacheSize)
+	})
+	return c.initErr
+}
+
+// Close releases the idle connections.
+func (c *HTTPPassThroughClient) Close() {
+	if c.httpClient != nil {
+		c.httpClient.CloseIdleConnections()
+	}
+}
+
+func (c *HTTPPassThroughClient) Authenticate(ctx context.Context, domain, user, password string) (bool, error) {
+	if err := c.init(); err != nil {
+		return false, xerrors.Errorf("Invalid pass-through HTTP configuration. domain: %s, err: %w", domain, err)
+	}
+
+	key := c.cacheKey(domain, user, password)
+	if e, ok := c.cache.Get(key, time.Now()); ok {
+		log.Printf("info: Use cached pass-through result. domain: %s, uid: %s", domain, user)
+		if e.ok {
+			return true, nil
+		}
+		return false, InvalidCredentials{xerrors.Errorf("Invalid credentials (cached). domain: %s, uid: %s", domain, user)}
+	}
+
+	ok, err := c.authenticate(ctx, domain, user, password)
+	if err != nil {
+		if _, invalid := err.(InvalidCredentials); invalid && c.NegativeCacheTTL > 0 {
+			c.cache.Put(key, false, time.Now().Add(c.NegativeCacheTTL))
+		}
+		return false, err
+	}
+
+	if ok && c.CacheTTL > 0 {
+		c.cache.Put(key, true, time.Now().Add(c.CacheTTL))
+	}
+	return ok, nil
+}
+
+func (c *HTTPPassThroughClient) cacheKey(domain, user, password string) string {
+	h := sha256.Sum256([]byte(domain + "\x00" + user + "\x00" + password))
+	return hex.EncodeToString(h[:])
+}
+
+func (c *HTTPPassThroughClient) username(domain, user string) string {
+	if c.Username == "" {
+		return user
+	}
+	return strings.NewReplacer("%u", user, "%d", domain).Replace(c.Username)
+}
+
+func (c *HTTPPassThroughClient) authenticate(ctx context.Context, domain, user, password string) (bool, error) {
+	var req *http.Request
+	var err error
+
+	username := c.username(domain, user)
+
+	switch c.Mode {
+	case "", HTTPPassThroughModeOAuth2:
+		form := url.Values{}
+		form.Set("grant_type", "password")
+		form.Set("username", username)
+		form.Set("password", password)
+		if c.Scope != "" {
+			form.Set("scope", c.Scope)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.URL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return false, xerrors.Errorf("Failed to create pass-through HTTP request. domain: %s, err: %w", domain, err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if c.ClientID != "" {
+			req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+		}
+
+	case HTTPPassThroughModeJSON:
+		tmpl := c.Body
+		if len(tmpl) == 0 {
+			tmpl = map[string]string{
+				"username": "%u",
+				"password": "%p",
+			}
+		}
+		replacer := strings.NewReplacer("%u", username, "%d", domain, "%p", password)
+		body := map[string]string{}
+		for k, v := range tmpl {
+			body[k] = replacer.Replace(v)
+		}
+		b, err := json.Marshal(body)
+		if err != nil {
+			return false, xerrors.Errorf("Failed to create pass-through HTTP request. domain: %s, err: %w", domain, err)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(b))
+		if err != nil {
+			return false, xerrors.Errorf("Failed to create pass-through HTTP request. domain: %s, err: %w", domain, err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+	default:
+		return false, xerrors.Errorf("Invalid pass-through HTTP mode. domain: %s, mode: %s", domain, c.Mode)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, xerrors.Errorf("Failed to request pass-through HTTP endpoint. domain: %s, url: %s, err: %w", domain, c.URL, err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(io.LimitReader(res.Body, 1024*1024))
+	if err != nil {
+		return false, xerrors.Errorf("Failed to read pass-through HTTP response. domain: %s, url: %s, err: %w", domain, c.URL, err)
+	}
+
+	if !c.isSuccess(res.StatusCode) {
+		switch res.StatusCode {
+		case http.StatusBadRequest:
+			// OAuth2 returns 400 with "invalid_grant" for the invalid credentials
+			var oauthErr struct {
+				Error string `json:"error"`
+			}
+			if json.Unmarshal(resBody, &oauthErr) == nil && oauthErr.Error == "invalid_grant" {
+				return false, InvalidCredentials{xerrors.Errorf("Invalid credentials. domain: %s, uid: %s", domain, user)}
+			}
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return false, InvalidCredentials{xerrors.Errorf("Invalid credentials. domain: %s, uid: %s, status: %d", domain, user, res.StatusCode)}
+		}
+		return false, xerrors.Errorf("Unexpected pass-through HTTP response. domain: %s, url: %s, status: %d", domain, c.URL, res.StatusCode)
+	}
+
+	if c.Mode == "" || c.Mode == HTTPPassThroughModeOAuth2 || len(c.Claims) > 0 {
+		var claims map[string]interface{}
+		if err := json.Unmarshal(resBody, &claims); err != nil {
+			return false, xerrors.Errorf("Invalid pass-through HTTP response. domain: %s, url: %s, err: %w", domain, c.URL, err)
+		}
+
+		if c.Mode == "" || c.Mode == HTTPPassThroughModeOAuth2 {
+			if token, ok := claims["access_token"].(string); !ok || token == "" {
+				return false, xerrors.Errorf("Invalid pass-through HTTP response. No access_token. domain: %s, url: %s", domain, c.URL)
+			}
+		}
+
+		for path, expected := range c.Claims {
+			v, ok := lookupClaim(claims, path)
+			if !ok || v != expected {
+				return false, InvalidCredentials{xerrors.Errorf("Claim mismatch. domain: %s, uid: %s, claim: %s", domain, user, path)}
+			}
+		}
+	}
+
+	return true, nil
+}
+
+func (c *HTTPPassThroughClient) isSuccess(status int) bool {
+	if len(c.SuccessStatus) == 0 {
+		return status == http.StatusOK
+	}
+	for _, v := range c.SuccessStatus {
+		if v == status {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupClaim returns the string representation of the value by the dot separated path.
+func lookupClaim(claims map[string]interface{}, path string) (string, bool) {
+	var cur interface{} = claims
+	for _, k := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		cur, ok = m[k]
+		if !ok {
+			return "", false
+		}
+	}
+
+	switch v := cur.(type) {
+	case string:
+		return v, true
+	case nil:
+		return "", false
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
@@ -0,0 +1,262 @@
+//go:build test
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newOAuth2TestServer(t *testing.T, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("Unexpected request: %v", err)
+		}
+		if r.PostForm.Get("grant_type") != "password" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unsupported_grant_type"})
+			return
+		}
+		if id, secret, ok := r.BasicAuth(); !ok || id != "cloudldap" || secret != "client-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.PostForm.Get("username") == "user1@example.com" && r.PostForm.Get("password") == "password1":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "token1",
+				"token_type":   "Bearer",
+				"user":         map[string]interface{}{"active": true},
+			})
+		case r.PostForm.Get("username") == "user2@example.com" && r.PostForm.Get("password") == "password2":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "token2",
+				"token_type":   "Bearer",
+				"user":         map[string]interface{}{"active": false},
+			})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		}
+	}))
+}
+
+func TestHTTPPassThroughOAuth2(t *testing.T) {
+	var calls int32
+	ts := newOAuth2TestServer(t, &calls)
+	defer ts.Close()
+
+	client := &HTTPPassThroughClient{
+		Mode:         HTTPPassThroughModeOAuth2,
+		URL:          ts.URL,
+		Username:     "%u@%d",
+		ClientID:     "cloudldap",
+		ClientSecret: "client-secret",
+		Claims: map[string]string{
+			"user.active": "true",
+		},
+		Timeout: time.Second,
+	}
+
+	testcases := []struct {
+		Name            string
+		User            string
+		Password        string
+		ExpectedOK      bool
+		ExpectedInvalid bool
+	}{
+		{
+			"valid",
+			"user1",
+			"password1",
+			true,
+			false,
+		},
+		{
+			"invalid password",
+			"user1",
+			"invalid",
+			false,
+			true,
+		},
+		{
+			"claim mismatch",
+			"user2",
+			"password2",
+			false,
+			true,
+		},
+		{
+			"unknown user",
+			"user3",
+			"password3",
+			false,
+			true,
+		},
+	}
+
+	for i, tc := range testcases {
+		ok, err := client.Authenticate(context.Background(), "example.com", tc.User, tc.Password)
+		if ok != tc.ExpectedOK {
+			t.Errorf("Unexpected result on %d %s: expected %v, got %v, err: %v", i, tc.Name, tc.ExpectedOK, ok, err)
+		}
+		_, invalid := err.(InvalidCredentials)
+		if invalid != tc.ExpectedInvalid {
+			t.Errorf("Unexpected error on %d %s: %v", i, tc.Name, err)
+		}
+	}
+}
+
+func TestHTTPPassThroughJSON(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("X-Api-Key") != "key" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if body["login"] == `user"1` && body["secret"] == "password1" && body["tenant"] == "example.com" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	client := &HTTPPassThroughClient{
+		Mode: HTTPPassThroughModeJSON,
+		URL:  ts.URL,
+		Body: map[string]string{
+			"login":  "%u",
+			"secret": "%p",
+			"tenant": "%d",
+		},
+		Headers: map[string]string{
+			"X-Api-Key": "key",
+		},
+		SuccessStatus: []int{http.StatusNoContent},
+	}
+
+	ok, err := client.Authenticate(context.Background(), "example.com", `user"1`, "password1")
+	if !ok || err != nil {
+		t.Errorf("Unexpected result: %v, err: %v", ok, err)
+	}
+
+	ok, err = client.Authenticate(context.Background(), "example.com", `user"1`, "invalid")
+	if _, invalid := err.(InvalidCredentials); ok || !invalid {
+		t.Errorf("Unexpected result: %v, err: %v", ok, err)
+	}
+
+	client.Headers = nil
+	ok, err = client.Authenticate(context.Background(), "example.com", `user"1`, "password1")
+	if _, invalid := err.(InvalidCredentials); ok || err == nil || invalid {
+		t.Errorf("Unexpected result for system error: %v, err: %v", ok, err)
+	}
+}
+
+func TestHTTPPassThroughCache(t *testing.T) {
+	var calls int32
+	ts := newOAuth2TestServer(t, &calls)
+	defer ts.Close()
+
+	client := &HTTPPassThroughClient{
+		URL:              ts.URL,
+		Username:         "%u@%d",
+		ClientID:         "cloudldap",
+		ClientSecret:     "client-secret",
+		CacheTTL:         time.Minute,
+		NegativeCacheTTL: time.Minute,
+	}
+
+	for i := 0; i < 3; i++ {
+		if ok, err := client.Authenticate(context.Background(), "example.com", "user1", "password1"); !ok {
+			t.Fatalf("Unexpected result: %v, err: %v", ok, err)
+		}
+		if ok, _ := client.Authenticate(context.Background(), "example.com", "user1", "invalid"); ok {
+			t.Fatalf("Unexpected result for invalid password")
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Unexpected number of requests: expected 2, got %d", n)
+	}
+}
+
+func TestHTTPPassThroughTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	client := &HTTPPassThroughClient{
+		URL: ts.URL,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	ok, err := client.Authenticate(ctx, "example.com", "user1", "password1")
+	if ok || err == nil {
+		t.Errorf("Unexpected result: %v, err: %v", ok, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("The context timeout isn't enforced: %s", d)
+	}
+}
+
+func TestHTTPPassThroughCacheSize(t *testing.T) {
+	c := newHTTPPassThroughCache(3)
+	now := time.Now()
+
+	for _, key := range []string{"a", "b", "c"} {
+		c.Put(key, true, now.Add(time.Minute))
+	}
+
+	// "a" is used recently, then "b" is evicted
+	if _, ok := c.Get("a", now); !ok {
+		t.Fatalf("Expected cached result")
+	}
+	c.Put("d", false, now.Add(time.Minute))
+
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := c.Get(key, now); ok != expected {
+			t.Errorf("Unexpected cached result of %s: expected %v, got %v", key, expected, ok)
+		}
+	}
+
+	// The expired result is removed
+	if _, ok := c.Get("c", now.Add(time.Minute)); ok {
+		t.Errorf("Unexpected expired result")
+	}
+	if n := c.Len(); n != 2 {
+		t.Errorf("Unexpected size: expected 2, got %d", n)
+	}
+
+	// The cache doesn't grow beyond the size
+	for i := 0; i < 100; i++ {
+		c.Put(strconv.Itoa(i), false, now.Add(time.Minute))
+	}
+	if n := c.Len(); n != 3 {
+		t.Errorf("Unexpected size: expected 3, got %d", n)
+	}
+}
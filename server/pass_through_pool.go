@@ -0,0 +1,359 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/xerrors"
+)
+
+const (
+	PassThroughStrategyFailover   = "failover"
+	PassThroughStrategyRoundRobin = "round-robin"
+)
+
+var errPassThroughUnavailable = xerrors.New("No available pass-through LDAP server")
+
+// ldapUpstream is the pass-through LDAP server with the idle connections.
+type ldapUpstream struct {
+	url  string
+	idle chan *ldap.Conn
+
+	mu sync.Mutex
+	// healthy is updated by the health check
+	healthy bool
+	// failures is the number of the consecutive failures
+	failures int
+	// openUntil is the time until the circuit breaker is open
+	openUntil time.Time
+}
+
+// available returns true if the server is healthy and the circuit breaker is closed.
+func (u *ldapUpstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy && !now.Before(u.openUntil)
+}
+
+func (u *ldapUpstream) recordSuccess() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures = 0
+	u.healthy = true
+}
+
+func (u *ldapUpstream) recordFailure(threshold int, timeout time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures++
+	if threshold > 0 && u.failures >= threshold {
+		log.Printf("warn: Open circuit breaker of pass-through LDAP server. server: %s, failures: %d, until: %s",
+			u.url, u.failures, time.Now().Add(timeout).Format(time.RFC3339))
+		u.openUntil = time.Now().Add(timeout)
+		u.failures = 0
+	}
+}
+
+func (u *ldapUpstream) setHealthy(healthy bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.healthy != healthy {
+		if healthy {
+			log.Printf("info: Pass-through LDAP server is healthy. server: %s", u.url)
+		} else {
+			log.Printf("warn: Pass-through LDAP server is unhealthy. server: %s", u.url)
+		}
+	}
+	u.healthy = healthy
+}
+
+// ldapConnPool is the connection pool for the pass-through LDAP servers.
+type ldapConnPool struct {
+	client    *LDAPPassThroughClient
+	upstreams []*ldapUpstream
+	tlsConfig *tls.Config
+	next      uint32
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLDAPConnPool(c *LDAPPassThroughClient) (*ldapConnPool, error) {
+	servers := c.Servers
+	if len(servers) == 0 && c.Server != "" {
+		servers = []string{c.Server}
+	}
+	if len(servers) == 0 {
+		return nil, xerrors.Errorf("No pass-through LDAP server")
+	}
+
+	tlsConfig, err := c.newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	maxIdle := c.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = 2
+	}
+
+	p := &ldapConnPool{
+		client:    c,
+		tlsConfig: tlsConfig,
+		stop:      make(chan struct{}),
+	}
+	for _, v := range servers {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "://") {
+			v = "ldap://" + v
+		}
+		p.upstreams = append(p.upstreams, &ldapUpstream{
+			url:     v,
+			idle:    make(chan *ldap.Conn, maxIdle),
+			healthy: true,
+		})
+	}
+
+	if c.HealthCheckInterval > 0 {
+		go p.healthCheck(c.HealthCheckInterval)
+	}
+
+	return p, nil
+}
+
+func (c *LDAPPassThroughClient) newTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.TLSServerName,
+	}
+
+	if c.CACertFile != "" {
+		pem, err := os.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, xerrors.Errorf("Failed to read CA certificate for pass-through. file: %s, err: %w", c.CACertFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, xerrors.Errorf("Invalid CA certificate for pass-through. file: %s", c.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, xerrors.Errorf("Failed to load client certificate for pass-through. file: %s, err: %w", c.ClientCertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// candidates returns the available servers in order of the strategy.
+func (p *ldapConnPool) candidates() []*ldapUpstream {
+	now := time.Now()
+
+	start := 0
+	if p.client.Strategy == PassThroughStrategyRoundRobin {
+		start = int(atomic.AddUint32(&p.next, 1)-1) % len(p.upstreams)
+	}
+
+	var candidates []*ldapUpstream
+	for i := range p.upstreams {
+		u := p.upstreams[(start+i)%len(p.upstreams)]
+		if u.available(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	return candidates
+}
+
+func (p *ldapConnPool) dial(ctx context.Context, u *ldapUpstream) (*ldap.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: p.client.timeout(),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+
+	conn, err := ldap.DialURL(u.url, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(p.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	if p.client.StartTLS && !strings.HasPrefix(strings.ToLower(u.url), "ldaps://") {
+		if err := conn.StartTLS(p.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (p *ldapConnPool) get(ctx context.Context, u *ldapUpstream) (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-u.idle:
+			if conn.IsClosing() {
+				continue
+			}
+			return conn, nil
+		default:
+			return p.dial(ctx, u)
+		}
+	}
+}
+
+func (p *ldapConnPool) put(u *ldapUpstream, conn *ldap.Conn) {
+	if conn.IsClosing() {
+		return
+	}
+	select {
+	case <-p.stop:
+		conn.Close()
+	case u.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Do executes the callback with the connection of the available server.
+// The next server is tried if the network error or the timeout occurs.
+// The LDAP error from the server is returned as is without trying the next server.
+func (p *ldapConnPool) Do(ctx context.Context, callback func(conn *ldap.Conn) error) error {
+	var lastErr error = errPassThroughUnavailable
+
+	for _, u := range p.candidates() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		conn, err := p.get(ctx, u)
+		if err != nil {
+			log.Printf("warn: Failed to connect pass-through LDAP server. server: %s, err: %v", u.url, err)
+			u.recordFailure(p.client.CircuitBreakerThreshold, p.client.CircuitBreakerTimeout)
+			lastErr = err
+			continue
+		}
+
+		err = p.doWithContext(ctx, conn, callback)
+		if ctxErr := passThroughContextErr(ctx); err != nil && ctxErr != nil {
+			conn.Close()
+			if xerrors.Is(ctxErr, context.DeadlineExceeded) {
+				u.recordFailure(p.client.CircuitBreakerThreshold, p.client.CircuitBreakerTimeout)
+			}
+			return err
+		}
+		// The pooled connection may be closed by the server
+		if err != nil && (conn.IsClosing() || isPassThroughNetworkError(err)) {
+			conn.Close()
+			log.Printf("warn: Failed to request pass-through LDAP server. server: %s, err: %v", u.url, err)
+			u.recordFailure(p.client.CircuitBreakerThreshold, p.client.CircuitBreakerTimeout)
+			lastErr = err
+			continue
+		}
+
+		u.recordSuccess()
+		p.put(u, conn)
+		return err
+	}
+
+	return lastErr
+}
+
+// doWithContext enforces the context to the request. The connection is closed to abort the request
+// if the context is done.
+func (p *ldapConnPool) doWithContext(ctx context.Context, conn *ldap.Conn, callback func(conn *ldap.Conn) error) error {
+	timeout := p.client.timeout()
+	if deadline, ok := ctx.Deadline(); ok {
+		if d := time.Until(deadline); d < timeout {
+			timeout = d
+		}
+	}
+	conn.SetTimeout(timeout)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	err := callback(conn)
+	if ctxErr := passThroughContextErr(ctx); err != nil && ctxErr != nil {
+		return xerrors.Errorf("Pass-through LDAP request is canceled. err: %w", ctxErr)
+	}
+	return err
+}
+
+// passThroughContextErr returns the error of the context. The deadline is checked by the time too,
+// because the connection timeout can be fired slightly before the context is done.
+func passThroughContextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+func (p *ldapConnPool) healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			for _, u := range p.upstreams {
+				ctx, cancel := context.WithTimeout(context.Background(), p.client.timeout())
+				conn, err := p.dial(ctx, u)
+				cancel()
+				if err != nil {
+					u.setHealthy(false)
+					continue
+				}
+				conn.Close()
+				u.setHealthy(true)
+			}
+		}
+	}
+}
+
+// Close stops the health check and closes the idle connections.
+func (p *ldapConnPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		for _, u := range p.upstreams {
+			for len(u.idle) > 0 {
+				conn := <-u.idle
+				conn.Close()
+			}
+		}
+	})
+}
+
+func isPassThroughNetworkError(err error) bool {
+	// ldap.IsErrorWithCode doesn't unwrap the error
+	var ldapErr *ldap.Error
+	if xerrors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.ErrorNetwork {
+		return true
+	}
+	var netErr net.Error
+	return xerrors.As(err, &netErr)
+}
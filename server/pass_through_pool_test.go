@@ -0,0 +1,399 @@
+//go:build test
+
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// fakeLDAPServer is the in-process LDAP responder for the pass-through.
+// It accepts the simple bind of "cn=admin,dc=example,dc=com" with "secret" and
+// "uid=user1,ou=Users,dc=example,dc=com" with "password1", and returns the user1 entry for any search.
+type fakeLDAPServer struct {
+	listener net.Listener
+	addr     string
+	// hang doesn't respond any request
+	hang bool
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	accepted int
+	searches int
+}
+
+func newFakeLDAPServer(t *testing.T, addr string, hang bool) *fakeLDAPServer {
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &fakeLDAPServer{
+		listener: listener,
+		addr:     listener.Addr().String(),
+		hang:     hang,
+	}
+	go s.serve()
+	return s
+}
+
+// deadLDAPServerURL returns the URL which refuses the connection.
+func deadLDAPServerURL(t *testing.T) string {
+	s := newFakeLDAPServer(t, "", false)
+	s.Close()
+	return s.URL()
+}
+
+func (s *fakeLDAPServer) URL() string {
+	return "ldap://" + s.addr
+}
+
+func (s *fakeLDAPServer) Accepted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+func (s *fakeLDAPServer) Searches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.searches
+}
+
+// Close stops listening and closes the accepted connections.
+func (s *fakeLDAPServer) Close() {
+	s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeLDAPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.accepted++
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeLDAPServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		if s.hang {
+			continue
+		}
+
+		id, _ := p.Children[0].Value.(int64)
+		op := p.Children[1]
+
+		switch op.Tag {
+		case 0: // BindRequest
+			var name, password string
+			if len(op.Children) >= 3 {
+				name, _ = op.Children[1].Value.(string)
+				password = op.Children[2].Data.String()
+			}
+			code := int64(49)
+			if (name == "cn=admin,dc=example,dc=com" && password == "secret") ||
+				(name == "uid=user1,ou=Users,dc=example,dc=com" && password == "password1") {
+				code = 0
+			}
+			conn.Write(fakeLDAPResult(id, 1, code))
+
+		case 2: // UnbindRequest
+			return
+
+		case 3: // SearchRequest
+			s.mu.Lock()
+			s.searches++
+			s.mu.Unlock()
+
+			entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "SearchResultEntry")
+			entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "uid=user1,ou=Users,dc=example,dc=com", "objectName"))
+			entry.AppendChild(ber.NewSequence("attributes"))
+			conn.Write(fakeLDAPMessage(id, entry).Bytes())
+			conn.Write(fakeLDAPResult(id, 5, 0))
+		}
+	}
+}
+
+func fakeLDAPMessage(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.NewSequence("LDAPMessage")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "messageID"))
+	p.AppendChild(op)
+	return p
+}
+
+func fakeLDAPResult(id int64, tag ber.Tag, code int64) []byte {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "LDAPResult")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return fakeLDAPMessage(id, op).Bytes()
+}
+
+func newTestLDAPPassThroughClient(servers ...string) *LDAPPassThroughClient {
+	return &LDAPPassThroughClient{
+		Servers:    servers,
+		SearchBase: "dc=example,dc=com",
+		Timeout:    1,
+		Filter:     "(uid=%u)",
+		BindDN:     "cn=admin,dc=example,dc=com",
+		Password:   "secret",
+	}
+}
+
+// waitFor polls the condition until it's satisfied or timed out.
+func waitFor(t *testing.T, name string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLDAPPassThrough(t *testing.T) {
+	server := newFakeLDAPServer(t, "", false)
+	defer server.Close()
+
+	client := newTestLDAPPassThroughClient(server.URL())
+	defer client.Close()
+
+	testcases := []struct {
+		Name            string
+		Password        string
+		ExpectedOK      bool
+		ExpectedInvalid bool
+	}{
+		{
+			"valid",
+			"password1",
+			true,
+			false,
+		},
+		{
+			"invalid password",
+			"invalid",
+			false,
+			true,
+		},
+		{
+			"valid again",
+			"password1",
+			true,
+			false,
+		},
+	}
+
+	for i, tc := range testcases {
+		ok, err := client.Authenticate(context.Background(), "example.com", "user1", tc.Password)
+		if ok != tc.ExpectedOK {
+			t.Errorf("Unexpected result on %d %s: expected %v, got %v, err: %v", i, tc.Name, tc.ExpectedOK, ok, err)
+		}
+		_, invalid := err.(InvalidCredentials)
+		if invalid != tc.ExpectedInvalid {
+			t.Errorf("Unexpected error on %d %s: %v", i, tc.Name, err)
+		}
+	}
+
+	// The connection is reused
+	if n := server.Accepted(); n != 1 {
+		t.Errorf("Unexpected number of the connections: %d", n)
+	}
+}
+
+func TestLDAPPassThroughFailover(t *testing.T) {
+	primary := newFakeLDAPServer(t, "", false)
+	defer primary.Close()
+	secondary := newFakeLDAPServer(t, "", false)
+	defer secondary.Close()
+
+	client := newTestLDAPPassThroughClient(deadLDAPServerURL(t), primary.URL(), secondary.URL())
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		ok, err := client.Authenticate(context.Background(), "example.com", "user1", "password1")
+		if !ok || err != nil {
+			t.Fatalf("Unexpected result on %d: %v, err: %v", i, ok, err)
+		}
+	}
+
+	// The first available server is always used
+	if primary.Searches() != 3 || secondary.Searches() != 0 {
+		t.Errorf("Unexpected searches. primary: %d, secondary: %d", primary.Searches(), secondary.Searches())
+	}
+
+	// The next server is used when the connection is lost
+	primary.Close()
+
+	ok, err := client.Authenticate(context.Background(), "example.com", "user1", "password1")
+	if !ok || err != nil {
+		t.Fatalf("Unexpected result after the primary is down: %v, err: %v", ok, err)
+	}
+	if secondary.Searches() != 1 {
+		t.Errorf("Unexpected searches of the secondary: %d", secondary.Searches())
+	}
+}
+
+func TestLDAPPassThroughRoundRobin(t *testing.T) {
+	servers := []*fakeLDAPServer{
+		newFakeLDAPServer(t, "", false),
+		newFakeLDAPServer(t, "", false),
+		newFakeLDAPServer(t, "", false),
+	}
+	var urls []string
+	for _, s := range servers {
+		defer s.Close()
+		urls = append(urls, s.URL())
+	}
+
+	client := newTestLDAPPassThroughClient(urls...)
+	client.Strategy = PassThroughStrategyRoundRobin
+	defer client.Close()
+
+	for i := 0; i < 6; i++ {
+		ok, err := client.Authenticate(context.Background(), "example.com", "user1", "password1")
+		if !ok || err != nil {
+			t.Fatalf("Unexpected result on %d: %v, err: %v", i, ok, err)
+		}
+	}
+
+	for i, s := range servers {
+		if s.Searches() != 2 {
+			t.Errorf("Unexpected searches of the server %d: %d", i, s.Searches())
+		}
+	}
+}
+
+func TestLDAPPassThroughCircuitBreaker(t *testing.T) {
+	dead := deadLDAPServerURL(t)
+	server := newFakeLDAPServer(t, "", false)
+	defer server.Close()
+
+	client := newTestLDAPPassThroughClient(dead, server.URL())
+	client.CircuitBreakerThreshold = 2
+	client.CircuitBreakerTimeout = time.Minute
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		ok, err := client.Authenticate(context.Background(), "example.com", "user1", "password1")
+		if !ok || err != nil {
+			t.Fatalf("Unexpected result on %d: %v, err: %v", i, ok, err)
+		}
+	}
+
+	// The dead server is skipped after the consecutive failures
+	now := time.Now()
+	if client.pool.upstreams[0].available(now) {
+		t.Errorf("Expected the circuit breaker of the dead server is open")
+	}
+	if !client.pool.upstreams[1].available(now) {
+		t.Errorf("Expected the server is available")
+	}
+
+	// No available server while all circuit breakers are open
+	server.Close()
+	client.Authenticate(context.Background(), "example.com", "user1", "password1")
+	client.Authenticate(context.Background(), "example.com", "user1", "password1")
+
+	_, err := client.Authenticate(context.Background(), "example.com", "user1", "password1")
+	if !xerrors.Is(err, errPassThroughUnavailable) {
+		t.Errorf("Expected no available server, got: %v", err)
+	}
+}
+
+func TestLDAPPassThroughHealthCheck(t *testing.T) {
+	server := newFakeLDAPServer(t, "", false)
+
+	client := newTestLDAPPassThroughClient(server.URL())
+	client.HealthCheckInterval = 20 * time.Millisecond
+	defer client.Close()
+
+	ok, err := client.Authenticate(context.Background(), "example.com", "user1", "password1")
+	if !ok || err != nil {
+		t.Fatalf("Unexpected result: %v, err: %v", ok, err)
+	}
+	u := client.pool.upstreams[0]
+
+	server.Close()
+	waitFor(t, "unhealthy", func() bool {
+		return !u.available(time.Now())
+	})
+
+	_, err = client.Authenticate(context.Background(), "example.com", "user1", "password1")
+	if !xerrors.Is(err, errPassThroughUnavailable) {
+		t.Errorf("Expected the unhealthy server is skipped, got: %v", err)
+	}
+
+	// The server is used again after recovery
+	server = newFakeLDAPServer(t, server.addr, false)
+	defer server.Close()
+	waitFor(t, "healthy", func() bool {
+		return u.available(time.Now())
+	})
+
+	ok, err = client.Authenticate(context.Background(), "example.com", "user1", "password1")
+	if !ok || err != nil {
+		t.Errorf("Unexpected result after recovery: %v, err: %v", ok, err)
+	}
+}
+
+func TestLDAPPassThroughContext(t *testing.T) {
+	server := newFakeLDAPServer(t, "", true)
+	defer server.Close()
+
+	client := newTestLDAPPassThroughClient(server.URL())
+	client.Timeout = 10
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	ok, err := client.Authenticate(ctx, "example.com", "user1", "password1")
+	if ok || !xerrors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got: %v, err: %v", ok, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("The request isn't aborted by the context: %s", d)
+	}
+
+	// The canceled context isn't sent to the server
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	accepted := server.Accepted()
+	ok, err = client.Authenticate(ctx, "example.com", "user1", "password1")
+	if ok || !xerrors.Is(err, context.Canceled) {
+		t.Errorf("Expected canceled, got: %v, err: %v", ok, err)
+	}
+	if server.Accepted() != accepted {
+		t.Errorf("Unexpected connection with the canceled context")
+	}
+}
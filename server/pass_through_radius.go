@@ -0,0 +1,402 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// RADIUS packet codes (RFC 2865)
+const (
+	radiusAccessRequest   = 1
+	radiusAccessAccept    = 2
+	radiusAccessReject    = 3
+	radiusAccessChallenge = 11
+)
+
+// RADIUS attribute types (RFC 2865, RFC 3579)
+const (
+	radiusAttrUserName             = 1
+	radiusAttrUserPassword         = 2
+	radiusAttrReplyMessage         = 18
+	radiusAttrState                = 24
+	radiusAttrNASIdentifier        = 32
+	radiusAttrMessageAuthenticator = 80
+)
+
+// RADIUSPassThroughClient verifies the credentials against the RADIUS servers with PAP.
+// If the server responds Access-Challenge (e.g. OTP), the client answers it with the OTP
+// which is appended to the password with ChallengeSeparator (e.g. "password,123456").
+type RADIUSPassThroughClient struct {
+	// Servers are the addresses of the RADIUS servers (host or host:port). They are tried in order.
+	Servers []string
+	Secret  string
+	// Timeout is the timeout per request (default: 5s)
+	Timeout time.Duration
+	// Retries is the number of the retransmission per server (default: 0)
+	Retries int
+	// Username is the template of User-Name. %u: user, %d: domain (default: %u)
+	Username      string
+	NASIdentifier string
+	// ChallengeSeparator splits the bind password into the password and the OTP for Access-Challenge.
+	// If it's empty, Access-Challenge is treated as failure.
+	ChallengeSeparator string
+	// NoMessageAuthenticator doesn't add Message-Authenticator into Access-Request nor require it in the response.
+	// It's required by default against the forged responses (BlastRADIUS, CVE-2024-3596).
+	NoMessageAuthenticator bool
+
+	id uint32
+}
+
+type radiusPacket struct {
+	code          byte
+	id            byte
+	authenticator [16]byte
+	attrs         []radiusAttr
+}
+
+type radiusAttr struct {
+	typ   byte
+	value []byte
+}
+
+func (p *radiusPacket) attr(typ byte) ([]byte, bool) {
+	for _, v := range p.attrs {
+		if v.typ == typ {
+			return v.value, true
+		}
+	}
+	return nil, false
+}
+
+func (p *radiusPacket) encode() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 4096))
+	buf.WriteByte(p.code)
+	buf.WriteByte(p.id)
+	buf.Write([]byte{0, 0})
+	buf.Write(p.authenticator[:])
+	for _, a := range p.attrs {
+		if len(a.value) > 253 {
+			return nil, xerrors.Errorf("Too long RADIUS attribute. type: %d", a.typ)
+		}
+		buf.WriteByte(a.typ)
+		buf.WriteByte(byte(len(a.value) + 2))
+		buf.Write(a.value)
+	}
+	b := buf.Bytes()
+	if len(b) > 4096 {
+		return nil, xerrors.Errorf("Too long RADIUS packet")
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b, nil
+}
+
+func decodeRADIUSPacket(b []byte) (*radiusPacket, error) {
+	if len(b) < 20 {
+		return nil, xerrors.Errorf("Too short RADIUS packet")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < 20 || length > len(b) {
+		return nil, xerrors.Errorf("Invalid RADIUS packet length: %d", length)
+	}
+	p := &radiusPacket{
+		code: b[0],
+		id:   b[1],
+	}
+	copy(p.authenticator[:], b[4:20])
+
+	attrs := b[20:length]
+	for len(attrs) > 0 {
+		if len(attrs) < 2 || int(attrs[1]) < 2 || int(attrs[1]) > len(attrs) {
+			return nil, xerrors.Errorf("Invalid RADIUS attribute")
+		}
+		p.attrs = append(p.attrs, radiusAttr{attrs[0], append([]byte{}, attrs[2:attrs[1]]...)})
+		attrs = attrs[attrs[1]:]
+	}
+	return p, nil
+}
+
+// encryptRADIUSPassword hides User-Password (RFC 2865 Section 5.2).
+func encryptRADIUSPassword(password []byte, secret string, authenticator [16]byte) ([]byte, error) {
+	if len(password) > 128 {
+		return nil, xerrors.Errorf("Too long password for RADIUS")
+	}
+	n := (len(password) + 15) / 16 * 16
+	if n == 0 {
+		n = 16
+	}
+	padded := make([]byte, n)
+	copy(padded, password)
+
+	result := make([]byte, n)
+	last := authenticator[:]
+	for i := 0; i < n; i += 16 {
+		h := md5.New()
+		h.Write([]byte(secret))
+		h.Write(last)
+		b := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			result[i+j] = padded[i+j] ^ b[j]
+		}
+		last = result[i : i+16]
+	}
+	return result, nil
+}
+
+// radiusResponseAuthenticator calculates Response Authenticator (RFC 2865 Section 3).
+func radiusResponseAuthenticator(raw []byte, requestAuthenticator [16]byte, secret string) []byte {
+	h := md5.New()
+	h.Write(raw[0:4])
+	h.Write(requestAuthenticator[:])
+	h.Write(raw[20:])
+	h.Write([]byte(secret))
+	return h.Sum(nil)
+}
+
+// radiusMessageAuthenticator calculates Message-Authenticator (RFC 3579 Section 3.2).
+// raw must contain Message-Authenticator attribute at offset with zero value and the request authenticator.
+func radiusMessageAuthenticator(raw []byte, offset int, requestAuthenticator [16]byte, secret string) []byte {
+	b := append([]byte{}, raw...)
+	copy(b[4:20], requestAuthenticator[:])
+	for i := 0; i < 16; i++ {
+		b[offset+i] = 0
+	}
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+func (c *RADIUSPassThroughClient) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 5 * time.Second
+}
+
+func (c *RADIUSPassThroughClient) username(domain, user string) string {
+	if c.Username == "" {
+		return user
+	}
+	return strings.NewReplacer("%u", user, "%d", domain).Replace(c.Username)
+}
+
+func (c *RADIUSPassThroughClient) Authenticate(ctx context.Context, domain, user, password string) (bool, error) {
+	if len(c.Servers) == 0 {
+		return false, xerrors.Errorf("Invalid pass-through RADIUS configuration. No servers. domain: %s", domain)
+	}
+
+	// Split the OTP for Access-Challenge
+	otp := ""
+	if c.ChallengeSeparator != "" {
+		if i := strings.LastIndex(password, c.ChallengeSeparator); i != -1 {
+			otp = password[i+len(c.ChallengeSeparator):]
+			password = password[:i]
+		}
+	}
+
+	username := c.username(domain, user)
+
+	res, err := c.exchange(ctx, username, password, nil)
+	if err != nil {
+		return false, xerrors.Errorf("Failed to request pass-through RADIUS. domain: %s, uid: %s, err: %w", domain, user, err)
+	}
+
+	if res.code == radiusAccessChallenge {
+		if otp == "" {
+			msg, _ := res.attr(radiusAttrReplyMessage)
+			return false, InvalidCredentials{xerrors.Errorf("RADIUS challenge requested but no OTP. domain: %s, uid: %s, message: %s", domain, user, msg)}
+		}
+		state, _ := res.attr(radiusAttrState)
+
+		res, err = c.exchange(ctx, username, otp, state)
+		if err != nil {
+			return false, xerrors.Errorf("Failed to request pass-through RADIUS challenge. domain: %s, uid: %s, err: %w", domain, user, err)
+		}
+	}
+
+	switch res.code {
+	case radiusAccessAccept:
+		return true, nil
+	case radiusAccessReject:
+		return false, InvalidCredentials{xerrors.Errorf("RADIUS Access-Reject. domain: %s, uid: %s", domain, user)}
+	case radiusAccessChallenge:
+		return false, InvalidCredentials{xerrors.Errorf("RADIUS challenge is repeated. domain: %s, uid: %s", domain, user)}
+	default:
+		return false, xerrors.Errorf("Unexpected RADIUS response. domain: %s, uid: %s, code: %d", domain, user, res.code)
+	}
+}
+
+// exchange sends Access-Request to the servers in order until receiving the valid response.
+func (c *RADIUSPassThroughClient) exchange(ctx context.Context, username, password string, state []byte) (*radiusPacket, error) {
+	var lastErr error
+
+	for _, server := range c.Servers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		addr := strings.TrimSpace(server)
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "1812")
+		}
+
+		req, raw, err := c.newRequest(username, password, state)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := c.request(ctx, addr, req, raw)
+		if err == nil {
+			return res, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (c *RADIUSPassThroughClient) newRequest(username, password string, state []byte) (*radiusPacket, []byte, error) {
+	req := &radiusPacket{
+		code: radiusAccessRequest,
+		id:   byte(atomic.AddUint32(&c.id, 1)),
+	}
+	if _, err := rand.Read(req.authenticator[:]); err != nil {
+		return nil, nil, err
+	}
+
+	encrypted, err := encryptRADIUSPassword([]byte(password), c.Secret, req.authenticator)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req.attrs = append(req.attrs, radiusAttr{radiusAttrUserName, []byte(username)})
+	req.attrs = append(req.attrs, radiusAttr{radiusAttrUserPassword, encrypted})
+	if c.NASIdentifier != "" {
+		req.attrs = append(req.attrs, radiusAttr{radiusAttrNASIdentifier, []byte(c.NASIdentifier)})
+	}
+	if state != nil {
+		req.attrs = append(req.attrs, radiusAttr{radiusAttrState, state})
+	}
+	if !c.NoMessageAuthenticator {
+		req.attrs = append(req.attrs, radiusAttr{radiusAttrMessageAuthenticator, make([]byte, 16)})
+	}
+
+	raw, err := req.encode()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !c.NoMessageAuthenticator {
+		// Message-Authenticator is the last attribute
+		offset := len(raw) - 16
+		copy(raw[offset:], radiusMessageAuthenticator(raw, offset, req.authenticator, c.Secret))
+	}
+	return req, raw, nil
+}
+
+// request sends the packet to the server, then waits for the valid response.
+// The retransmission sends the same packet (the same identifier and authenticator) from the same port,
+// so the server can detect the duplicate request (RFC 5080 Section 2.2.1).
+func (c *RADIUSPassThroughClient) request(ctx context.Context, addr string, req *radiusPacket, raw []byte) (*radiusPacket, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var lastErr error
+	buf := make([]byte, 4096)
+
+	for i := 0; i <= c.Retries; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(c.timeout())
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+
+		if _, err := conn.Write(raw); err != nil {
+			return nil, err
+		}
+
+		res, err := c.read(conn, buf, req)
+		if err == nil {
+			return res, nil
+		}
+		log.Printf("warn: Failed to request RADIUS server. server: %s, err: %v", addr, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// read waits for the valid response until the deadline of the connection.
+func (c *RADIUSPassThroughClient) read(conn net.Conn, buf []byte, req *radiusPacket) (*radiusPacket, error) {
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.verifyResponse(buf[:n], req)
+		if err != nil {
+			// Ignore the invalid response then wait for the valid one
+			log.Printf("warn: Invalid RADIUS response. server: %s, err: %v", conn.RemoteAddr(), err)
+			continue
+		}
+		return res, nil
+	}
+}
+
+func (c *RADIUSPassThroughClient) verifyResponse(raw []byte, req *radiusPacket) (*radiusPacket, error) {
+	res, err := decodeRADIUSPacket(raw)
+	if err != nil {
+		return nil, err
+	}
+	if res.id != req.id {
+		return nil, xerrors.Errorf("Unexpected identifier: %d", res.id)
+	}
+
+	length := int(binary.BigEndian.Uint16(raw[2:4]))
+	raw = raw[:length]
+
+	if !hmac.Equal(res.authenticator[:], radiusResponseAuthenticator(raw, req.authenticator, c.Secret)) {
+		return nil, xerrors.Errorf("Invalid response authenticator. Check the shared secret")
+	}
+
+	if !c.NoMessageAuthenticator {
+		offset := 20
+		found := false
+		for _, a := range res.attrs {
+			if a.typ == radiusAttrMessageAuthenticator {
+				if len(a.value) != 16 {
+					return nil, xerrors.Errorf("Invalid Message-Authenticator length: %d", len(a.value))
+				}
+				found = true
+				break
+			}
+			offset += len(a.value) + 2
+		}
+		if !found {
+			return nil, xerrors.Errorf("No Message-Authenticator")
+		}
+		offset += 2
+		if !hmac.Equal(raw[offset:offset+16], radiusMessageAuthenticator(raw, offset, req.authenticator, c.Secret)) {
+			return nil, xerrors.Errorf("Invalid Message-Authenticator")
+		}
+	}
+
+	return res, nil
+}
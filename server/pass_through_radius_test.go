@@ -0,0 +1,396 @@
+//go:build test
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRADIUSServer is the in-process RADIUS responder.
+// It accepts "user1" with "password1", and "user2" with "password2" then OTP "123456" by Access-Challenge.
+type fakeRADIUSServer struct {
+	conn   net.PacketConn
+	secret string
+	// silent doesn't respond any request
+	silent bool
+	// drop is the number of the requests to drop before responding
+	drop int
+	// noMessageAuthenticator doesn't add Message-Authenticator into the response
+	noMessageAuthenticator bool
+
+	mu       sync.Mutex
+	received []fakeRADIUSRequest
+}
+
+type fakeRADIUSRequest struct {
+	addr          string
+	id            byte
+	authenticator [16]byte
+	// messageAuthenticator is true if the request has the valid Message-Authenticator
+	messageAuthenticator bool
+}
+
+func newFakeRADIUSServer(t *testing.T, secret string, silent bool, options ...func(s *fakeRADIUSServer)) *fakeRADIUSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &fakeRADIUSServer{
+		conn:   conn,
+		secret: secret,
+		silent: silent,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeRADIUSServer) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *fakeRADIUSServer) Close() {
+	s.conn.Close()
+}
+
+func (s *fakeRADIUSServer) Received() []fakeRADIUSRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeRADIUSRequest{}, s.received...)
+}
+
+func (s *fakeRADIUSServer) decryptPassword(encrypted []byte, authenticator [16]byte) string {
+	result := make([]byte, len(encrypted))
+	last := authenticator[:]
+	for i := 0; i+16 <= len(encrypted); i += 16 {
+		h := md5.New()
+		h.Write([]byte(s.secret))
+		h.Write(last)
+		b := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			result[i+j] = encrypted[i+j] ^ b[j]
+		}
+		last = encrypted[i : i+16]
+	}
+	return string(bytes.TrimRight(result, "\x00"))
+}
+
+func (s *fakeRADIUSServer) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if s.silent {
+			continue
+		}
+
+		req, err := decodeRADIUSPacket(buf[:n])
+		if err != nil || req.code != radiusAccessRequest {
+			continue
+		}
+
+		_, hasMessageAuthenticator := req.attr(radiusAttrMessageAuthenticator)
+		if hasMessageAuthenticator {
+			// Message-Authenticator is the last attribute of the client
+			offset := n - 16
+			hasMessageAuthenticator = bytes.Equal(buf[offset:n], radiusMessageAuthenticator(buf[:n], offset, req.authenticator, s.secret))
+		}
+
+		s.mu.Lock()
+		s.received = append(s.received, fakeRADIUSRequest{addr.String(), req.id, req.authenticator, hasMessageAuthenticator})
+		drop := len(s.received) <= s.drop
+		s.mu.Unlock()
+		if drop {
+			continue
+		}
+
+		user, _ := req.attr(radiusAttrUserName)
+		encrypted, _ := req.attr(radiusAttrUserPassword)
+		password := s.decryptPassword(encrypted, req.authenticator)
+		state, hasState := req.attr(radiusAttrState)
+
+		res := &radiusPacket{
+			code: radiusAccessReject,
+			id:   req.id,
+		}
+		switch {
+		case string(user) == "user1" && password == "password1":
+			res.code = radiusAccessAccept
+		case string(user) == "user2" && !hasState && password == "password2":
+			res.code = radiusAccessChallenge
+			res.attrs = append(res.attrs, radiusAttr{radiusAttrState, []byte("challenge-1")})
+			res.attrs = append(res.attrs, radiusAttr{radiusAttrReplyMessage, []byte("Enter OTP")})
+		case string(user) == "user2" && string(state) == "challenge-1" && password == "123456":
+			res.code = radiusAccessAccept
+		}
+
+		if !s.noMessageAuthenticator {
+			res.attrs = append(res.attrs, radiusAttr{radiusAttrMessageAuthenticator, make([]byte, 16)})
+		}
+
+		res.authenticator = req.authenticator
+		raw, _ := res.encode()
+		if !s.noMessageAuthenticator {
+			offset := len(raw) - 16
+			copy(raw[offset:], radiusMessageAuthenticator(raw, offset, req.authenticator, s.secret))
+		}
+		copy(raw[4:20], radiusResponseAuthenticator(raw, req.authenticator, s.secret))
+		s.conn.WriteTo(raw, addr)
+	}
+}
+
+func TestRADIUSPassThrough(t *testing.T) {
+	server := newFakeRADIUSServer(t, "shared-secret", false)
+	defer server.Close()
+
+	client := &RADIUSPassThroughClient{
+		Servers:            []string{server.Addr()},
+		Secret:             "shared-secret",
+		Timeout:            time.Second,
+		ChallengeSeparator: ",",
+	}
+
+	testcases := []struct {
+		Name            string
+		User            string
+		Password        string
+		ExpectedOK      bool
+		ExpectedInvalid bool
+	}{
+		{
+			"valid",
+			"user1",
+			"password1",
+			true,
+			false,
+		},
+		{
+			"invalid password",
+			"user1",
+			"invalid",
+			false,
+			true,
+		},
+		{
+			"valid with OTP",
+			"user2",
+			"password2,123456",
+			true,
+			false,
+		},
+		{
+			"invalid OTP",
+			"user2",
+			"password2,000000",
+			false,
+			true,
+		},
+		{
+			"no OTP",
+			"user2",
+			"password2",
+			false,
+			true,
+		},
+	}
+
+	for i, tc := range testcases {
+		ok, err := client.Authenticate(context.Background(), "example.com", tc.User, tc.Password)
+		if ok != tc.ExpectedOK {
+			t.Errorf("Unexpected result on %d %s: expected %v, got %v, err: %v", i, tc.Name, tc.ExpectedOK, ok, err)
+		}
+		_, invalid := err.(InvalidCredentials)
+		if invalid != tc.ExpectedInvalid {
+			t.Errorf("Unexpected error on %d %s: %v", i, tc.Name, err)
+		}
+	}
+}
+
+func TestRADIUSPassThroughFailover(t *testing.T) {
+	silent := newFakeRADIUSServer(t, "shared-secret", true)
+	defer silent.Close()
+	server := newFakeRADIUSServer(t, "shared-secret", false)
+	defer server.Close()
+
+	client := &RADIUSPassThroughClient{
+		Servers: []string{silent.Addr(), server.Addr()},
+		Secret:  "shared-secret",
+		Timeout: 100 * time.Millisecond,
+	}
+
+	ok, err := client.Authenticate(context.Background(), "example.com", "user1", "password1")
+	if !ok || err != nil {
+		t.Errorf("Unexpected result: %v, err: %v", ok, err)
+	}
+}
+
+func TestRADIUSPassThroughInvalidSecret(t *testing.T) {
+	server := newFakeRADIUSServer(t, "shared-secret", false)
+	defer server.Close()
+
+	client := &RADIUSPassThroughClient{
+		Servers: []string{server.Addr()},
+		Secret:  "wrong-secret",
+		Timeout: 100 * time.Millisecond,
+	}
+
+	ok, err := client.Authenticate(context.Background(), "example.com", "user1", "password1")
+	if _, invalid := err.(InvalidCredentials); ok || err == nil || invalid {
+		t.Errorf("Unexpected result: %v, err: %v", ok, err)
+	}
+}
+
+func TestRADIUSPassThroughRetransmission(t *testing.T) {
+	server := newFakeRADIUSServer(t, "shared-secret", false, func(s *fakeRADIUSServer) {
+		s.drop = 2
+	})
+	defer server.Close()
+
+	client := &RADIUSPassThroughClient{
+		Servers: []string{server.Addr()},
+		Secret:  "shared-secret",
+		Timeout: 100 * time.Millisecond,
+		Retries: 2,
+	}
+
+	ok, err := client.Authenticate(context.Background(), "example.com", "user1", "password1")
+	if !ok || err != nil {
+		t.Fatalf("Unexpected result: %v, err: %v", ok, err)
+	}
+
+	received := server.Received()
+	if len(received) != 3 {
+		t.Fatalf("Unexpected number of the requests: %d", len(received))
+	}
+	for i, r := range received {
+		if r != received[0] {
+			t.Errorf("The retransmission %d isn't same as the first request: %+v, %+v", i, r, received[0])
+		}
+		if !r.messageAuthenticator {
+			t.Errorf("Expected the valid Message-Authenticator on %d", i)
+		}
+	}
+}
+
+func TestRADIUSPassThroughMessageAuthenticator(t *testing.T) {
+	legacy := newFakeRADIUSServer(t, "shared-secret", false, func(s *fakeRADIUSServer) {
+		s.noMessageAuthenticator = true
+	})
+	defer legacy.Close()
+
+	// The response without Message-Authenticator is rejected by default
+	client := &RADIUSPassThroughClient{
+		Servers: []string{legacy.Addr()},
+		Secret:  "shared-secret",
+		Timeout: 100 * time.Millisecond,
+	}
+	ok, err := client.Authenticate(context.Background(), "example.com", "user1", "password1")
+	if _, invalid := err.(InvalidCredentials); ok || err == nil || invalid {
+		t.Errorf("Unexpected result without Message-Authenticator: %v, err: %v", ok, err)
+	}
+
+	client = &RADIUSPassThroughClient{
+		Servers:                []string{legacy.Addr()},
+		Secret:                 "shared-secret",
+		Timeout:                100 * time.Millisecond,
+		NoMessageAuthenticator: true,
+	}
+	ok, err = client.Authenticate(context.Background(), "example.com", "user1", "password1")
+	if !ok || err != nil {
+		t.Errorf("Unexpected result with NoMessageAuthenticator: %v, err: %v", ok, err)
+	}
+
+	// The config requires Message-Authenticator unless it's disabled explicitly
+	disabled := false
+	for _, tc := range []struct {
+		Value    *bool
+		Expected bool
+	}{
+		{nil, false},
+		{&disabled, true},
+	} {
+		c, err := (&RADIUSPassThroughConfig{Servers: []string{"127.0.0.1"}, Secret: "secret", MessageAuthenticator: tc.Value}).NewClient()
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		if c.NoMessageAuthenticator != tc.Expected {
+			t.Errorf("Unexpected NoMessageAuthenticator: %v", c.NoMessageAuthenticator)
+		}
+	}
+}
+
+func TestRADIUSVerifyResponse(t *testing.T) {
+	client := &RADIUSPassThroughClient{
+		Secret: "shared-secret",
+	}
+	req := &radiusPacket{
+		code:          radiusAccessRequest,
+		id:            1,
+		authenticator: [16]byte{1, 2, 3},
+	}
+
+	response := func(attrs ...radiusAttr) []byte {
+		res := &radiusPacket{
+			code:          radiusAccessAccept,
+			id:            req.id,
+			authenticator: req.authenticator,
+			attrs:         attrs,
+		}
+		raw, err := res.encode()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for _, a := range attrs {
+			if a.typ == radiusAttrMessageAuthenticator && len(a.value) == 16 {
+				offset := len(raw) - 16
+				copy(raw[offset:], radiusMessageAuthenticator(raw, offset, req.authenticator, client.Secret))
+			}
+		}
+		copy(raw[4:20], radiusResponseAuthenticator(raw, req.authenticator, client.Secret))
+		return raw
+	}
+
+	testcases := []struct {
+		Name          string
+		Raw           []byte
+		ExpectedError bool
+	}{
+		{
+			"valid",
+			response(radiusAttr{radiusAttrMessageAuthenticator, make([]byte, 16)}),
+			false,
+		},
+		{
+			"no Message-Authenticator",
+			response(radiusAttr{radiusAttrReplyMessage, []byte("ok")}),
+			true,
+		},
+		{
+			"short Message-Authenticator",
+			response(radiusAttr{radiusAttrMessageAuthenticator, []byte{0, 0, 0}}),
+			true,
+		},
+		{
+			"long Message-Authenticator",
+			response(radiusAttr{radiusAttrMessageAuthenticator, make([]byte, 32)}),
+			true,
+		},
+	}
+
+	for i, tc := range testcases {
+		_, err := client.verifyResponse(tc.Raw, req)
+		if (err != nil) != tc.ExpectedError {
+			t.Errorf("Unexpected result on %d %s: %v", i, tc.Name, err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// SHA-crypt ($5$ and $6$) by Ulrich Drepper, which is used by glibc crypt(3) and Linux shadow files.
+// https://www.akkadia.org/drepper/SHA-crypt.txt
+
+const (
+	shaCryptRoundsDefault = 5000
+	shaCryptRoundsMin     = 1000
+	shaCryptRoundsMax     = 999999999
+	shaCryptSaltMax       = 16
+	cryptAlphabet         = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+type shaCryptVariant struct {
+	id   string
+	hash func() hash.Hash
+	// perm is the byte order of the encoded digest per 3 bytes
+	perm [][3]int
+	// tail is the last group which has less than 3 bytes
+	tail    [3]int
+	tailLen int
+}
+
+var sha256Crypt = &shaCryptVariant{
+	id:   "5",
+	hash: sha256.New,
+	perm: [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	},
+	tail:    [3]int{-1, 31, 30},
+	tailLen: 3,
+}
+
+var sha512Crypt = &shaCryptVariant{
+	id:   "6",
+	hash: sha512.New,
+	perm: [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	},
+	tail:    [3]int{-1, -1, 63},
+	tailLen: 2,
+}
+
+// parseSHACrypt splits "$<id>$[rounds=<N>$]<salt>$<hash>" into the rounds and the salt.
+// The rounds is 0 if it isn't specified.
+func parseSHACrypt(setting string) (string, int, string, error) {
+	if len(setting) < 3 || setting[0] != '$' || setting[2] != '$' {
+		return "", 0, "", xerrors.New("Invalid crypt format")
+	}
+	id := setting[1:2]
+	s := setting[3:]
+
+	rounds := 0
+	if strings.HasPrefix(s, "rounds=") {
+		i := strings.Index(s, "$")
+		if i == -1 {
+			return "", 0, "", xerrors.New("Invalid crypt format")
+		}
+		n, err := strconv.Atoi(s[len("rounds="):i])
+		if err != nil {
+			return "", 0, "", xerrors.Errorf("Invalid crypt rounds. err: %w", err)
+		}
+		rounds = n
+		s = s[i+1:]
+	}
+
+	if i := strings.Index(s, "$"); i != -1 {
+		s = s[:i]
+	}
+	if len(s) > shaCryptSaltMax {
+		s = s[:shaCryptSaltMax]
+	}
+
+	return id, rounds, s, nil
+}
+
+// crypt computes the SHA-crypt string. If rounds is 0, the default rounds is used and omitted from the output.
+func (v *shaCryptVariant) crypt(password, salt []byte, rounds int) string {
+	custom := rounds != 0
+	if !custom {
+		rounds = shaCryptRoundsDefault
+	} else if rounds < shaCryptRoundsMin {
+		rounds = shaCryptRoundsMin
+	} else if rounds > shaCryptRoundsMax {
+		rounds = shaCryptRoundsMax
+	}
+	if len(salt) > shaCryptSaltMax {
+		salt = salt[:shaCryptSaltMax]
+	}
+
+	// Digest B
+	h := v.hash()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+	size := len(b)
+
+	// Digest A
+	h = v.hash()
+	h.Write(password)
+	h.Write(salt)
+	cnt := len(password)
+	for ; cnt > size; cnt -= size {
+		h.Write(b)
+	}
+	h.Write(b[:cnt])
+	for cnt = len(password); cnt > 0; cnt >>= 1 {
+		if cnt&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	// Byte sequence P
+	h = v.hash()
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	p := repeatBytes(h.Sum(nil), len(password))
+
+	// Byte sequence S
+	h = v.hash()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeatBytes(h.Sum(nil), len(salt))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h = v.hash()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("$" + v.id + "$")
+	if custom {
+		sb.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	sb.Write(salt)
+	sb.WriteString("$")
+	for _, g := range v.perm {
+		encodeCrypt24(&sb, c[g[0]], c[g[1]], c[g[2]], 4)
+	}
+	var t [3]byte
+	for i, j := range v.tail {
+		if j >= 0 {
+			t[i] = c[j]
+		}
+	}
+	encodeCrypt24(&sb, t[0], t[1], t[2], v.tailLen)
+
+	return sb.String()
+}
+
+func repeatBytes(src []byte, length int) []byte {
+	dst := make([]byte, 0, length)
+	for len(dst) < length {
+		n := length - len(dst)
+		if n > len(src) {
+			n = len(src)
+		}
+		dst = append(dst, src[:n]...)
+	}
+	return dst
+}
+
+func encodeCrypt24(sb *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for i := 0; i < n; i++ {
+		sb.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
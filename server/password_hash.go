@@ -0,0 +1,63 @@
+package server
+
+import (
+	"log"
+	"strings"
+
+	"github.com/cloudldap/cloudldap/auth"
+	"github.com/cloudldap/cloudldap/util"
+	"golang.org/x/xerrors"
+)
+
+// hashPasswordValues hashes the plaintext values of userPassword by the default password scheme
+// before storing them. The already hashed values are kept as is for the admins and the migration mode.
+// For other users, they are rejected unless they are allowed by the config.
+func (s *Server) hashPasswordValues(session *auth.AuthSession, attrName string, values []string) ([]string, error) {
+	at, ok := s.schemaRegistry.AttributeType(attrName)
+	if !ok || at.Name != "userPassword" {
+		return values, nil
+	}
+
+	hashed := make([]string, len(values))
+	for i, v := range values {
+		if v == "" {
+			// Rejected by the schema validation
+			hashed[i] = v
+			continue
+		}
+
+		if s.isPreHashedPassword(v) {
+			if !s.simpleACL.IsAdmin(session) && !s.config.MigrationEnabled && !s.config.PasswordSchemeConfig.AllowPreHashed {
+				log.Printf("warn: Rejected pre-hashed password from non-admin user. dn: %s", sessionDNStr(session))
+				return nil, util.NewConstraintViolation("userPassword: pre-hashed password not allowed")
+			}
+			// Also for the admins and the migration mode, the stored hash must be verifiable by bind
+			if err := s.passwordScheme.CheckCost(v); err != nil {
+				log.Printf("warn: Rejected pre-hashed password. dn: %s, err: %v", sessionDNStr(session), err)
+				return nil, util.NewConstraintViolation("userPassword: invalid hash or hash cost over the limit")
+			}
+			hashed[i] = v
+			continue
+		}
+
+		h, err := s.passwordScheme.Generate(v)
+		if err != nil {
+			return nil, xerrors.Errorf("Failed to hash the password. err: %w", err)
+		}
+		hashed[i] = h
+	}
+
+	return hashed, nil
+}
+
+// isPreHashedPassword returns true if the value has the registered scheme prefix or the pass-through prefix.
+func (s *Server) isPreHashedPassword(value string) bool {
+	return s.passwordScheme.IsHashed(value) || strings.HasPrefix(value, "{SASL}")
+}
+
+func sessionDNStr(session *auth.AuthSession) string {
+	if session.DN == nil {
+		return ""
+	}
+	return session.DN.DNNormStr()
+}
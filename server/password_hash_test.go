@@ -0,0 +1,201 @@
+//go:build test
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloudldap/cloudldap/auth"
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"golang.org/x/xerrors"
+)
+
+func TestHashPasswordValues(t *testing.T) {
+	testcases := []struct {
+		Name           string
+		Root           bool
+		Admin          bool
+		Migration      bool
+		AllowPreHashed bool
+		AttrName       string
+		Values         []string
+		ExpectedHashed []bool
+		ExpectedError  bool
+	}{
+		{
+			"plaintext",
+			false, false, false, false,
+			"userPassword",
+			[]string{"password1", "password2"},
+			[]bool{true, true},
+			false,
+		},
+		{
+			"attribute name is case-insensitive",
+			false, false, false, false,
+			"userpassword",
+			[]string{"password1"},
+			[]bool{true},
+			false,
+		},
+		{
+			"other attribute",
+			false, false, false, false,
+			"description",
+			[]string{"password1"},
+			[]bool{false},
+			false,
+		},
+		{
+			"pre-hashed by root",
+			true, false, false, false,
+			"userPassword",
+			[]string{"{SSHA}xxx", "{SASL}user1@example.com", "password1"},
+			[]bool{false, false, true},
+			false,
+		},
+		{
+			"pre-hashed by root in migration mode",
+			true, false, true, false,
+			"userPassword",
+			[]string{"{CRYPT}$6$xxx"},
+			[]bool{false},
+			false,
+		},
+		{
+			"pre-hashed over the cost limit by root",
+			true, false, false, false,
+			"userPassword",
+			[]string{"{PBKDF2-SHA512}100000000$c2FsdHNhbHQ$ZGVyaXZlZGtleQ"},
+			nil,
+			true,
+		},
+		{
+			"invalid pre-hashed by root",
+			true, false, false, false,
+			"userPassword",
+			[]string{"{ARGON2}xxx"},
+			nil,
+			true,
+		},
+		{
+			"pre-hashed by non-root",
+			false, false, false, false,
+			"userPassword",
+			[]string{"password1", "{ARGON2}xxx"},
+			nil,
+			true,
+		},
+		{
+			"pre-hashed in migration mode",
+			false, false, true, false,
+			"userPassword",
+			[]string{"{CRYPT}$6$xxx"},
+			[]bool{false},
+			false,
+		},
+		{
+			"pre-hashed by admin",
+			false, true, false, false,
+			"userPassword",
+			[]string{"{SSHA}xxx", "{SASL}user1@example.com", "password1"},
+			[]bool{false, false, true},
+			false,
+		},
+		{
+			"pre-hashed over the cost limit by admin",
+			false, true, false, false,
+			"userPassword",
+			[]string{"{PBKDF2-SHA512}100000000$c2FsdHNhbHQ$ZGVyaXZlZGtleQ"},
+			nil,
+			true,
+		},
+		{
+			"pass-through by non-root",
+			false, false, false, false,
+			"userPassword",
+			[]string{"{SASL}user1@example.com"},
+			nil,
+			true,
+		},
+		{
+			"pre-hashed by non-root if allowed",
+			false, false, false, true,
+			"userPassword",
+			[]string{"{PBKDF2-SHA512}10000$c2FsdHNhbHQ$ZGVyaXZlZGtleQ", "{SASL}user1@example.com"},
+			[]bool{false, false},
+			false,
+		},
+		{
+			"unknown scheme is plaintext",
+			false, false, false, false,
+			"userPassword",
+			[]string{"{UNKNOWN}password1"},
+			[]bool{true},
+			false,
+		},
+	}
+
+	for i, tc := range testcases {
+		sc := &schema.SchemaConfig{
+			Suffix:           "dc=example,dc=com",
+			CustomSchema:     []string{},
+			MigrationEnabled: tc.Migration,
+		}
+		pc := &PasswordSchemeConfig{
+			AllowPreHashed: tc.AllowPreHashed,
+		}
+		ps, err := NewPasswordSchemeRegistry(pc)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		s := &Server{
+			config: &ServerConfig{
+				SchemaConfig:         sc,
+				PasswordSchemeConfig: pc,
+				// The write by everyone doesn't make the admin
+				SimpleACL: []string{"uid=admin,ou=Users,dc=example,dc=com:RW:", ":RW:"},
+			},
+			schemaRegistry: schema.NewSchemaRegistry(sc),
+			passwordScheme: ps,
+		}
+		s.simpleACL, err = NewSimpleACL(s)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		session := &auth.AuthSession{IsRoot: tc.Root}
+		if tc.Admin {
+			session.DN, _ = s.NormalizeDN("uid=admin,ou=Users,dc=example,dc=com")
+		} else if !tc.Root {
+			session.DN, _ = s.NormalizeDN("uid=user1,ou=Users,dc=example,dc=com")
+		}
+
+		values, err := s.hashPasswordValues(session, tc.AttrName, tc.Values)
+		if tc.ExpectedError {
+			var lerr *util.LDAPError
+			if !xerrors.As(err, &lerr) || lerr.Code != 19 {
+				t.Errorf("Unexpected error on %d %s: %v", i, tc.Name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error on %d %s: %v", i, tc.Name, err)
+		}
+
+		for j, v := range values {
+			if tc.ExpectedHashed[j] {
+				if !strings.HasPrefix(v, "{SSHA512}") {
+					t.Errorf("Unexpected value on %d %s: expected hashed, got %s", i, tc.Name, v)
+				}
+				if ok, _ := ps.Validate(tc.Values[j], v); !ok {
+					t.Errorf("Unexpected hash on %d %s: %s", i, tc.Name, v)
+				}
+			} else if v != tc.Values[j] {
+				t.Errorf("Unexpected value on %d %s: expected %s, got %s", i, tc.Name, tc.Values[j], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,549 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jsimonetti/pwscheme/md5crypt"
+	"github.com/jsimonetti/pwscheme/ssha"
+	"github.com/jsimonetti/pwscheme/ssha256"
+	"github.com/jsimonetti/pwscheme/ssha512"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/xerrors"
+)
+
+const (
+	passwordSaltLength = 16
+	// passwordMaxCostFactorDefault is the default multiple of the configured cost accepted in the stored hash
+	passwordMaxCostFactorDefault = 4
+)
+
+type PasswordSchemeConfig struct {
+	// Default is the scheme to hash new passwords (default: SSHA512)
+	Default string
+	// BcryptCost is the cost of BCRYPT
+	BcryptCost int
+	// CryptRounds is the rounds of CRYPT (SHA-512 crypt). 0 means the default 5000 rounds.
+	CryptRounds int
+	// PBKDF2Iterations is the iteration count of PBKDF2-*
+	PBKDF2Iterations int
+	// Argon2Time is the number of passes of ARGON2 (argon2id)
+	Argon2Time uint32
+	// Argon2Memory is the memory size in KiB of ARGON2 (argon2id)
+	Argon2Memory uint32
+	// Argon2Threads is the degree of parallelism of ARGON2 (argon2id)
+	Argon2Threads uint8
+	// MaxCostFactor is the multiple of the configured cost accepted in the hashed values of CRYPT, PBKDF2-* and ARGON2.
+	// The values with the larger cost are rejected on both write and bind to prevent DoS. (default: 4)
+	MaxCostFactor int
+	// AllowPreHashed accepts the already hashed userPassword and the "{SASL}" pass-through value from non-admin users.
+	// They are rejected by default because the user can bypass the password policy by them.
+	AllowPreHashed bool
+}
+
+// PasswordScheme hashes and validates the password for the userPassword "{SCHEME}" prefix (RFC 3112).
+type PasswordScheme interface {
+	// Generate returns the hashed password with "{SCHEME}" prefix
+	Generate(password string) (string, error)
+	// Validate compares the password with the hashed value without "{SCHEME}" prefix.
+	// It returns false without error if the password doesn't match.
+	Validate(password, hashed string) (bool, error)
+}
+
+// PasswordSchemeRegistry is the set of the password schemes keyed by the scheme name.
+type PasswordSchemeRegistry struct {
+	schemes       map[string]PasswordScheme
+	defaultScheme string
+}
+
+func NewPasswordSchemeRegistry(c *PasswordSchemeConfig) (*PasswordSchemeRegistry, error) {
+	if c == nil {
+		c = &PasswordSchemeConfig{}
+	}
+	if c.Default == "" {
+		c.Default = "SSHA512"
+	}
+	if c.BcryptCost == 0 {
+		c.BcryptCost = bcrypt.DefaultCost
+	}
+	if c.PBKDF2Iterations == 0 {
+		c.PBKDF2Iterations = 100000
+	}
+	if c.Argon2Time == 0 {
+		c.Argon2Time = 2
+	}
+	if c.Argon2Memory == 0 {
+		c.Argon2Memory = 19 * 1024
+	}
+	if c.Argon2Threads == 0 {
+		c.Argon2Threads = 1
+	}
+	if c.MaxCostFactor == 0 {
+		c.MaxCostFactor = passwordMaxCostFactorDefault
+	}
+
+	if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+		return nil, xerrors.Errorf("Invalid bcrypt cost: %d", c.BcryptCost)
+	}
+	if c.CryptRounds != 0 && (c.CryptRounds < shaCryptRoundsMin || c.CryptRounds > shaCryptRoundsMax) {
+		return nil, xerrors.Errorf("Invalid crypt rounds: %d", c.CryptRounds)
+	}
+	if c.PBKDF2Iterations < 1 {
+		return nil, xerrors.Errorf("Invalid PBKDF2 iterations: %d", c.PBKDF2Iterations)
+	}
+	if c.MaxCostFactor < 1 {
+		return nil, xerrors.Errorf("Invalid max cost factor: %d", c.MaxCostFactor)
+	}
+
+	r := &PasswordSchemeRegistry{
+		schemes: map[string]PasswordScheme{},
+	}
+
+	r.Register("SSHA", &pwSchemePassword{"SSHA", ssha.Generate, ssha.Validate})
+	r.Register("SSHA256", &pwSchemePassword{"SSHA256", ssha256.Generate, ssha256.Validate})
+	r.Register("SSHA512", &pwSchemePassword{"SSHA512", ssha512.Generate, ssha512.Validate})
+	r.Register("SHA", &digestPassword{"SHA", sha1.New, 0})
+	r.Register("SHA256", &digestPassword{"SHA256", sha256.New, 0})
+	r.Register("SHA512", &digestPassword{"SHA512", sha512.New, 0})
+	r.Register("MD5", &digestPassword{"MD5", md5.New, 0})
+	r.Register("SMD5", &digestPassword{"SMD5", md5.New, passwordSaltLength})
+	crypt := newCryptPassword(c)
+	r.Register("CRYPT", crypt)
+	r.Register("BCRYPT", &cryptPassword{crypt.rounds, crypt.cost, true, crypt.maxRounds, crypt.maxCost})
+	r.Register("PBKDF2", newPBKDF2Password("PBKDF2", sha1.New, c))
+	r.Register("PBKDF2-SHA1", newPBKDF2Password("PBKDF2-SHA1", sha1.New, c))
+	r.Register("PBKDF2-SHA256", newPBKDF2Password("PBKDF2-SHA256", sha256.New, c))
+	r.Register("PBKDF2-SHA512", newPBKDF2Password("PBKDF2-SHA512", sha512.New, c))
+	r.Register("ARGON2", newArgon2Password(c))
+
+	name := strings.ToUpper(c.Default)
+	if _, ok := r.schemes[name]; !ok {
+		return nil, xerrors.Errorf("Unsupported password scheme: %s, supported: %v", c.Default, r.Names())
+	}
+	r.defaultScheme = name
+
+	return r, nil
+}
+
+// Register adds the password scheme. The name is case-insensitive.
+func (r *PasswordSchemeRegistry) Register(name string, scheme PasswordScheme) {
+	r.schemes[strings.ToUpper(name)] = scheme
+}
+
+// Names returns the registered scheme names.
+func (r *PasswordSchemeRegistry) Names() []string {
+	names := make([]string, 0, len(r.schemes))
+	for k := range r.schemes {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the password scheme and the hashed value without the prefix
+// if the value starts with the registered "{SCHEME}" prefix.
+func (r *PasswordSchemeRegistry) Lookup(value string) (PasswordScheme, string, bool) {
+	if len(value) < 3 || value[0] != '{' {
+		return nil, "", false
+	}
+	i := strings.Index(value, "}")
+	if i == -1 {
+		return nil, "", false
+	}
+	scheme, ok := r.schemes[strings.ToUpper(value[1:i])]
+	if !ok {
+		return nil, "", false
+	}
+	return scheme, value[i+1:], true
+}
+
+// IsHashed returns true if the value has the registered "{SCHEME}" prefix.
+func (r *PasswordSchemeRegistry) IsHashed(value string) bool {
+	_, _, ok := r.Lookup(value)
+	return ok
+}
+
+// Generate hashes the password by the default scheme.
+func (r *PasswordSchemeRegistry) Generate(password string) (string, error) {
+	return r.schemes[r.defaultScheme].Generate(password)
+}
+
+// passwordCostChecker is implemented by the password schemes which have the cost parameters in the hashed value.
+type passwordCostChecker interface {
+	// CheckCost returns error if the hashed value without "{SCHEME}" prefix is invalid or its cost exceeds the limit.
+	CheckCost(hashed string) error
+}
+
+// CheckCost returns error if the hashed value has the cost parameters over the limit.
+// The plain password and the schemes without the cost parameters are always accepted.
+func (r *PasswordSchemeRegistry) CheckCost(value string) error {
+	scheme, hashed, ok := r.Lookup(value)
+	if !ok {
+		return nil
+	}
+	if c, ok := scheme.(passwordCostChecker); ok {
+		return c.CheckCost(hashed)
+	}
+	return nil
+}
+
+// multiplyCost returns the cost multiplied by the factor without overflow.
+func multiplyCost(cost uint64, factor int, limit uint64) uint64 {
+	if cost > limit/uint64(factor) {
+		return limit
+	}
+	return cost * uint64(factor)
+}
+
+// Validate compares the password with the stored value.
+// The value without the registered "{SCHEME}" prefix is treated as the plain password.
+func (r *PasswordSchemeRegistry) Validate(password, value string) (bool, error) {
+	scheme, hashed, ok := r.Lookup(value)
+	if !ok {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(value)) == 1, nil
+	}
+	return scheme.Validate(password, hashed)
+}
+
+// pwSchemePassword adapts the salted SHA schemes of github.com/jsimonetti/pwscheme.
+type pwSchemePassword struct {
+	name     string
+	generate func(password string, length uint8) (string, error)
+	validate func(password string, hash string) (bool, error)
+}
+
+func (p *pwSchemePassword) Generate(password string) (string, error) {
+	return p.generate(password, 20)
+}
+
+func (p *pwSchemePassword) Validate(password, hashed string) (bool, error) {
+	ok, err := p.validate(password, "{"+p.name+"}"+hashed)
+	if err == ssha.ErrNotMatching || err == ssha256.ErrNotMatching || err == ssha512.ErrNotMatching {
+		return false, nil
+	}
+	return ok, err
+}
+
+// digestPassword is the base64 encoded digest of the password with the optional trailing salt (RFC 2307).
+type digestPassword struct {
+	name       string
+	hash       func() hash.Hash
+	saltLength int
+}
+
+func (d *digestPassword) sum(password string, salt []byte) []byte {
+	h := d.hash()
+	h.Write([]byte(password))
+	h.Write(salt)
+	return append(h.Sum(nil), salt...)
+}
+
+func (d *digestPassword) Generate(password string) (string, error) {
+	salt := make([]byte, d.saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return "{" + d.name + "}" + base64.StdEncoding.EncodeToString(d.sum(password, salt)), nil
+}
+
+func (d *digestPassword) Validate(password, hashed string) (bool, error) {
+	b, err := base64.StdEncoding.DecodeString(hashed)
+	if err != nil {
+		return false, xerrors.Errorf("Invalid %s password. err: %w", d.name, err)
+	}
+	size := d.hash().Size()
+	if len(b) < size || (d.saltLength == 0 && len(b) != size) {
+		return false, xerrors.Errorf("Invalid %s password length: %d", d.name, len(b))
+	}
+	return subtle.ConstantTimeCompare(d.sum(password, b[size:]), b) == 1, nil
+}
+
+// cryptPassword is crypt(3) format: MD5-crypt ($1$), SHA-crypt ($5$, $6$) and bcrypt ($2a$, $2b$, $2y$).
+// New passwords are hashed by SHA-512 crypt or bcrypt.
+type cryptPassword struct {
+	rounds int
+	cost   int
+	bcrypt bool
+
+	maxRounds int
+	maxCost   int
+}
+
+func newCryptPassword(c *PasswordSchemeConfig) *cryptPassword {
+	rounds := c.CryptRounds
+	if rounds == 0 {
+		rounds = shaCryptRoundsDefault
+	}
+	// The bcrypt cost is log2 of the rounds
+	maxCost := c.BcryptCost + bits.Len(uint(c.MaxCostFactor)) - 1
+	if maxCost > bcrypt.MaxCost {
+		maxCost = bcrypt.MaxCost
+	}
+	return &cryptPassword{
+		rounds:    c.CryptRounds,
+		cost:      c.BcryptCost,
+		maxRounds: int(multiplyCost(uint64(rounds), c.MaxCostFactor, shaCryptRoundsMax)),
+		maxCost:   maxCost,
+	}
+}
+
+func (c *cryptPassword) Generate(password string) (string, error) {
+	if c.bcrypt {
+		b, err := bcrypt.GenerateFromPassword([]byte(password), c.cost)
+		if err != nil {
+			return "", err
+		}
+		return "{CRYPT}" + string(b), nil
+	}
+
+	salt := make([]byte, shaCryptSaltMax)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	for i := range salt {
+		salt[i] = cryptAlphabet[int(salt[i])%len(cryptAlphabet)]
+	}
+	return "{CRYPT}" + sha512Crypt.crypt([]byte(password), salt, c.rounds), nil
+}
+
+func (c *cryptPassword) CheckCost(hashed string) error {
+	switch {
+	case strings.HasPrefix(hashed, "$2"):
+		cost, err := bcrypt.Cost([]byte(hashed))
+		if err != nil {
+			return xerrors.Errorf("Invalid bcrypt password. err: %w", err)
+		}
+		if cost > c.maxCost {
+			return xerrors.Errorf("bcrypt cost exceeds the limit %d: %d", c.maxCost, cost)
+		}
+
+	case strings.HasPrefix(hashed, "$5$"), strings.HasPrefix(hashed, "$6$"):
+		_, rounds, _, err := parseSHACrypt(hashed)
+		if err != nil {
+			return err
+		}
+		if rounds > c.maxRounds {
+			return xerrors.Errorf("crypt rounds exceeds the limit %d: %d", c.maxRounds, rounds)
+		}
+	}
+	return nil
+}
+
+func (c *cryptPassword) Validate(password, hashed string) (bool, error) {
+	if err := c.CheckCost(hashed); err != nil {
+		return false, err
+	}
+
+	switch {
+	case strings.HasPrefix(hashed, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+
+	case strings.HasPrefix(hashed, "$1$"):
+		ok, err := md5crypt.Validate(password, "{MD5-CRYPT}"+hashed)
+		if err == md5crypt.ErrNotMatching {
+			return false, nil
+		}
+		return ok, err
+
+	case strings.HasPrefix(hashed, "$5$"), strings.HasPrefix(hashed, "$6$"):
+		id, rounds, salt, err := parseSHACrypt(hashed)
+		if err != nil {
+			return false, err
+		}
+		v := sha256Crypt
+		if id == "6" {
+			v = sha512Crypt
+		}
+		computed := v.crypt([]byte(password), []byte(salt), rounds)
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1, nil
+	}
+
+	return false, xerrors.Errorf("Unsupported crypt format: %.3s", hashed)
+}
+
+// pbkdf2Password is the format of OpenLDAP pw-pbkdf2 and passlib.
+//
+//	{PBKDF2-SHA512}<iterations>$<adapted base64 salt>$<adapted base64 derived key>
+type pbkdf2Password struct {
+	name          string
+	hash          func() hash.Hash
+	iterations    int
+	maxIterations int
+}
+
+func newPBKDF2Password(name string, hash func() hash.Hash, c *PasswordSchemeConfig) *pbkdf2Password {
+	return &pbkdf2Password{
+		name:          name,
+		hash:          hash,
+		iterations:    c.PBKDF2Iterations,
+		maxIterations: int(multiplyCost(uint64(c.PBKDF2Iterations), c.MaxCostFactor, math.MaxInt32)),
+	}
+}
+
+// ab64 is the base64 encoding which uses "." instead of "+" without the padding.
+var ab64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+func (p *pbkdf2Password) Generate(password string) (string, error) {
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	dk := pbkdf2.Key([]byte(password), salt, p.iterations, p.hash().Size(), p.hash)
+	return fmt.Sprintf("{%s}%d$%s$%s", p.name, p.iterations, ab64.EncodeToString(salt), ab64.EncodeToString(dk)), nil
+}
+
+// parse splits the hashed value into the iterations, the salt and the derived key.
+func (p *pbkdf2Password) parse(hashed string) (int, []byte, []byte, error) {
+	s := strings.Split(hashed, "$")
+	if len(s) != 3 {
+		return 0, nil, nil, xerrors.Errorf("Invalid %s format", p.name)
+	}
+	iterations, err := strconv.Atoi(s[0])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, xerrors.Errorf("Invalid %s iterations: %s", p.name, s[0])
+	}
+	if iterations > p.maxIterations {
+		return 0, nil, nil, xerrors.Errorf("%s iterations exceeds the limit %d: %d", p.name, p.maxIterations, iterations)
+	}
+	salt, err := ab64.DecodeString(strings.TrimRight(s[1], "="))
+	if err != nil {
+		return 0, nil, nil, xerrors.Errorf("Invalid %s salt. err: %w", p.name, err)
+	}
+	dk, err := ab64.DecodeString(strings.TrimRight(s[2], "="))
+	if err != nil || len(dk) == 0 {
+		return 0, nil, nil, xerrors.Errorf("Invalid %s derived key. err: %v", p.name, err)
+	}
+	return iterations, salt, dk, nil
+}
+
+func (p *pbkdf2Password) CheckCost(hashed string) error {
+	_, _, _, err := p.parse(hashed)
+	return err
+}
+
+func (p *pbkdf2Password) Validate(password, hashed string) (bool, error) {
+	iterations, salt, dk, err := p.parse(hashed)
+	if err != nil {
+		return false, err
+	}
+	computed := pbkdf2.Key([]byte(password), salt, iterations, len(dk), p.hash)
+	return subtle.ConstantTimeCompare(computed, dk) == 1, nil
+}
+
+// argon2Password is the PHC string format of OpenLDAP pw-argon2.
+//
+//	{ARGON2}$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<base64 salt>$<base64 hash>
+type argon2Password struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+
+	maxTime    uint32
+	maxMemory  uint32
+	maxThreads uint8
+}
+
+func newArgon2Password(c *PasswordSchemeConfig) *argon2Password {
+	return &argon2Password{
+		time:       c.Argon2Time,
+		memory:     c.Argon2Memory,
+		threads:    c.Argon2Threads,
+		maxTime:    uint32(multiplyCost(uint64(c.Argon2Time), c.MaxCostFactor, math.MaxUint32)),
+		maxMemory:  uint32(multiplyCost(uint64(c.Argon2Memory), c.MaxCostFactor, math.MaxUint32)),
+		maxThreads: uint8(multiplyCost(uint64(c.Argon2Threads), c.MaxCostFactor, math.MaxUint8)),
+	}
+}
+
+// argon2Params are the parameters in the hashed value of ARGON2.
+type argon2Params struct {
+	variant string
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func (a *argon2Password) Generate(password string) (string, error) {
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.time, a.memory, a.threads, 32)
+	return fmt.Sprintf("{ARGON2}$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.memory, a.time, a.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a *argon2Password) parse(hashed string) (*argon2Params, error) {
+	s := strings.Split(hashed, "$")
+	if len(s) != 6 || s[0] != "" {
+		return nil, xerrors.New("Invalid ARGON2 format")
+	}
+	if s[1] != "argon2id" && s[1] != "argon2i" {
+		return nil, xerrors.Errorf("Unsupported ARGON2 type: %s", s[1])
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(s[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, xerrors.Errorf("Unsupported ARGON2 version: %s", s[2])
+	}
+	p := &argon2Params{variant: s[1]}
+	if _, err := fmt.Sscanf(s[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return nil, xerrors.Errorf("Invalid ARGON2 parameters: %s", s[3])
+	}
+	if p.time == 0 || p.threads == 0 {
+		return nil, xerrors.Errorf("Invalid ARGON2 parameters: %s", s[3])
+	}
+	if p.time > a.maxTime || p.memory > a.maxMemory || p.threads > a.maxThreads {
+		return nil, xerrors.Errorf("ARGON2 parameters exceed the limit m=%d,t=%d,p=%d: %s", a.maxMemory, a.maxTime, a.maxThreads, s[3])
+	}
+
+	var err error
+	p.salt, err = base64.RawStdEncoding.DecodeString(s[4])
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid ARGON2 salt. err: %w", err)
+	}
+	p.key, err = base64.RawStdEncoding.DecodeString(s[5])
+	if err != nil || len(p.key) == 0 {
+		return nil, xerrors.Errorf("Invalid ARGON2 hash. err: %v", err)
+	}
+	return p, nil
+}
+
+func (a *argon2Password) CheckCost(hashed string) error {
+	_, err := a.parse(hashed)
+	return err
+}
+
+func (a *argon2Password) Validate(password, hashed string) (bool, error) {
+	p, err := a.parse(hashed)
+	if err != nil {
+		return false, err
+	}
+
+	var computed []byte
+	if p.variant == "argon2id" {
+		computed = argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	} else {
+		computed = argon2.Key([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	}
+	return subtle.ConstantTimeCompare(computed, p.key) == 1, nil
+}
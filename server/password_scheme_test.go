@@ -0,0 +1,257 @@
+//go:build test
+
+package server
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestPasswordSchemeValidate(t *testing.T) {
+	r, err := NewPasswordSchemeRegistry(&PasswordSchemeConfig{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// RFC 6070 test vector: P = "password", S = "salt", c = 4096, dkLen = 20
+	dk, _ := hex.DecodeString("4b007901b765489abead49d926f721d065a429c1")
+	pbkdf2SHA1 := "{PBKDF2-SHA1}4096$" + ab64.EncodeToString([]byte("salt")) + "$" + ab64.EncodeToString(dk)
+
+	testcases := []struct {
+		Name     string
+		Password string
+		Hashed   string
+	}{
+		{
+			"plain",
+			"password",
+			"password",
+		},
+		{
+			"SSHA512",
+			"test123",
+			"{SSHA512}xPUl/px+1cG55rUH4rzcwxdOIPSB2TingLpiJJumN2xyDWN4Ix1WQG3ihnvHaWUE8MYNkvMi5rf0C9NYixHsE6Yh59M=",
+		},
+		{
+			"SHA",
+			"password",
+			"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		},
+		{
+			"MD5",
+			"password",
+			"{MD5}X03MO1qnZdYdgyfeuILPmQ==",
+		},
+		{
+			"lower case scheme",
+			"password",
+			"{sha}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		},
+		{
+			// Test vectors of SHA-crypt
+			"CRYPT SHA-512",
+			"Hello world!",
+			"{CRYPT}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		},
+		{
+			"CRYPT SHA-512 with rounds",
+			"Hello world!",
+			"{CRYPT}$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+		},
+		{
+			"CRYPT SHA-256",
+			"Hello world!",
+			"{CRYPT}$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		},
+		{
+			"CRYPT MD5",
+			"Hello world!",
+			"{CRYPT}$1$saltstr$QM9HTGmcCulEKt42JFhZ/.",
+		},
+		{
+			"PBKDF2-SHA1",
+			"password",
+			pbkdf2SHA1,
+		},
+	}
+
+	for i, tc := range testcases {
+		ok, err := r.Validate(tc.Password, tc.Hashed)
+		if !ok || err != nil {
+			t.Errorf("Unexpected result on %d %s: expected true, got %v, err: %v", i, tc.Name, ok, err)
+		}
+		ok, err = r.Validate(tc.Password+"x", tc.Hashed)
+		if ok || err != nil {
+			t.Errorf("Unexpected result for invalid password on %d %s: expected false, got %v, err: %v", i, tc.Name, ok, err)
+		}
+	}
+}
+
+func TestPasswordSchemeGenerate(t *testing.T) {
+	testcases := []struct {
+		Scheme         string
+		ExpectedPrefix string
+	}{
+		{"SSHA", "{SSHA}"},
+		{"SSHA256", "{SSHA256}"},
+		{"SSHA512", "{SSHA512}"},
+		{"SMD5", "{SMD5}"},
+		{"CRYPT", "{CRYPT}$6$rounds=1000$"},
+		{"BCRYPT", "{CRYPT}$2a$04$"},
+		{"PBKDF2-SHA256", "{PBKDF2-SHA256}1000$"},
+		{"PBKDF2-SHA512", "{PBKDF2-SHA512}1000$"},
+		{"argon2", "{ARGON2}$argon2id$v=19$m=64,t=1,p=1$"},
+	}
+
+	for i, tc := range testcases {
+		r, err := NewPasswordSchemeRegistry(&PasswordSchemeConfig{
+			Default:          tc.Scheme,
+			BcryptCost:       4,
+			CryptRounds:      1000,
+			PBKDF2Iterations: 1000,
+			Argon2Time:       1,
+			Argon2Memory:     64,
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error on %d %s: %v", i, tc.Scheme, err)
+		}
+
+		hashed, err := r.Generate("secret")
+		if err != nil {
+			t.Fatalf("Unexpected error on %d %s: %v", i, tc.Scheme, err)
+		}
+		if !strings.HasPrefix(hashed, tc.ExpectedPrefix) {
+			t.Errorf("Unexpected hash on %d %s: %s", i, tc.Scheme, hashed)
+		}
+		if !r.IsHashed(hashed) {
+			t.Errorf("Generated hash isn't detected as hashed on %d %s: %s", i, tc.Scheme, hashed)
+		}
+		if ok, err := r.Validate("secret", hashed); !ok || err != nil {
+			t.Errorf("Unexpected result on %d %s: %v, err: %v", i, tc.Scheme, ok, err)
+		}
+		if ok, _ := r.Validate("invalid", hashed); ok {
+			t.Errorf("Invalid password must be rejected on %d %s", i, tc.Scheme)
+		}
+	}
+}
+
+func TestPasswordSchemeConfig(t *testing.T) {
+	if _, err := NewPasswordSchemeRegistry(&PasswordSchemeConfig{Default: "UNKNOWN"}); err == nil {
+		t.Errorf("Unknown default scheme must be rejected")
+	}
+	if _, err := NewPasswordSchemeRegistry(&PasswordSchemeConfig{BcryptCost: 99}); err == nil {
+		t.Errorf("Invalid bcrypt cost must be rejected")
+	}
+
+	r, _ := NewPasswordSchemeRegistry(nil)
+	if r.IsHashed("{UNKNOWN}password") || r.IsHashed("password") {
+		t.Errorf("Unknown scheme must be treated as plain")
+	}
+}
+
+func TestPasswordSchemeMaxCost(t *testing.T) {
+	r, err := NewPasswordSchemeRegistry(&PasswordSchemeConfig{
+		BcryptCost:       4,
+		CryptRounds:      1000,
+		PBKDF2Iterations: 1000,
+		Argon2Time:       1,
+		Argon2Memory:     64,
+		MaxCostFactor:    4,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	salt := ab64.EncodeToString([]byte("saltsalt"))
+	key := ab64.EncodeToString([]byte("derivedkey"))
+
+	testcases := []struct {
+		Name          string
+		Hashed        string
+		ExpectedError bool
+	}{
+		{
+			"plain",
+			"password",
+			false,
+		},
+		{
+			"no cost parameters",
+			"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+			false,
+		},
+		{
+			"PBKDF2 at the limit",
+			"{PBKDF2-SHA256}4000$" + salt + "$" + key,
+			false,
+		},
+		{
+			"PBKDF2 over the limit",
+			"{PBKDF2-SHA256}4001$" + salt + "$" + key,
+			true,
+		},
+		{
+			"ARGON2 at the limit",
+			"{ARGON2}$argon2id$v=19$m=256,t=4,p=4$c2FsdHNhbHQ$ZGVyaXZlZGtleQ",
+			false,
+		},
+		{
+			"ARGON2 memory over the limit",
+			"{ARGON2}$argon2id$v=19$m=4194304,t=1,p=1$c2FsdHNhbHQ$ZGVyaXZlZGtleQ",
+			true,
+		},
+		{
+			"ARGON2 time over the limit",
+			"{ARGON2}$argon2id$v=19$m=64,t=4294967295,p=1$c2FsdHNhbHQ$ZGVyaXZlZGtleQ",
+			true,
+		},
+		{
+			"ARGON2 threads over the limit",
+			"{ARGON2}$argon2i$v=19$m=64,t=1,p=255$c2FsdHNhbHQ$ZGVyaXZlZGtleQ",
+			true,
+		},
+		{
+			"ARGON2 invalid format",
+			"{ARGON2}xxx",
+			true,
+		},
+		{
+			"CRYPT SHA-512 at the limit",
+			"{CRYPT}$6$rounds=4000$saltstring$xxx",
+			false,
+		},
+		{
+			"CRYPT SHA-512 over the limit",
+			"{CRYPT}$6$rounds=999999999$saltstring$xxx",
+			true,
+		},
+		{
+			"bcrypt at the limit",
+			"{CRYPT}$2a$06$WHTHkCOu5IMmkFDSaE2mKOnvBxCwq3LThlnKPSN2XAgYy.Fzw8NQW",
+			false,
+		},
+		{
+			"bcrypt over the limit",
+			"{CRYPT}$2a$31$WHTHkCOu5IMmkFDSaE2mKOnvBxCwq3LThlnKPSN2XAgYy.Fzw8NQW",
+			true,
+		},
+	}
+
+	for i, tc := range testcases {
+		err := r.CheckCost(tc.Hashed)
+		if tc.ExpectedError != (err != nil) {
+			t.Errorf("Unexpected result on %d %s: %v", i, tc.Name, err)
+		}
+		// The bind doesn't compute the hash over the limit
+		if tc.ExpectedError {
+			if ok, err := r.Validate("password", tc.Hashed); ok || err == nil {
+				t.Errorf("Expected error on validation on %d %s", i, tc.Name)
+			}
+		}
+	}
+
+	if _, err := NewPasswordSchemeRegistry(&PasswordSchemeConfig{MaxCostFactor: -1}); err == nil {
+		t.Errorf("Invalid max cost factor must be rejected")
+	}
+}
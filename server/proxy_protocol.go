@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// PROXY protocol version 1 and 2 by HAProxy.
+// https://www.haproxy.org/download/2.6/doc/proxy-protocol.txt
+
+const (
+	proxyProtocolTimeout = 10 * time.Second
+	proxyProtocolV1Max   = 107
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener accepts the connections which have the PROXY protocol header from the trusted proxies.
+// The connections from other addresses are served as is, so the clients can't spoof their addresses.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+func newProxyProtocolListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyProtocolListener{
+		Listener: l,
+		trusted:  trusted,
+		timeout:  proxyProtocolTimeout,
+	}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !containsIP(l.trusted, addrIP(c.RemoteAddr())) {
+		return c, nil
+	}
+	// The header is read lazily not to block the accept loop by the slow proxy
+	return &proxyProtocolConn{
+		Conn:    c,
+		r:       bufio.NewReader(c),
+		timeout: l.timeout,
+	}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address in the header. It returns the proxy address for the LOCAL command.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remote, c.err = readProxyProtocolHeader(c.r)
+	if c.err != nil {
+		c.err = xerrors.Errorf("Invalid PROXY protocol header from %s. err: %w", c.Conn.RemoteAddr(), c.err)
+		c.Conn.Close()
+	}
+}
+
+// readProxyProtocolHeader reads the header and returns the source address. It returns nil for UNKNOWN or LOCAL.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtocolV2Signature))
+	if err == nil && bytes.Equal(sig, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(r)
+	}
+	if p, err := r.Peek(6); err == nil && string(p) == "PROXY " {
+		return readProxyProtocolV1(r)
+	}
+	return nil, xerrors.New("No PROXY protocol header")
+}
+
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyProtocolV1Max {
+			return nil, xerrors.New("Too long v1 header")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, xerrors.New("Invalid v1 header terminator")
+	}
+
+	// PROXY <TCP4|TCP6|UNKNOWN> <src> <dst> <sport> <dport>
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, xerrors.Errorf("Invalid v1 header: %s", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, xerrors.Errorf("Invalid v1 source address: %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid v1 source port: %s", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, xerrors.Errorf("Invalid v2 version: %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0:
+		// LOCAL (e.g. health check by the proxy)
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, xerrors.Errorf("Invalid v2 command: %d", header[12]&0x0f)
+	}
+
+	// The TLVs after the addresses are ignored
+	switch header[13] {
+	case 0x11:
+		// TCP over IPv4
+		if len(payload) < 12 {
+			return nil, xerrors.New("Too short v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21:
+		// TCP over IPv6
+		if len(payload) < 36 {
+			return nil, xerrors.New("Too short v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// UNSPEC, UDP or UNIX
+	return nil, nil
+}
+
+// parseCIDRs parses the CIDRs or the IP addresses.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		n, err := parseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func parseCIDR(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, xerrors.Errorf("Invalid IP address: %s", value)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid CIDR: %s", value)
+	}
+	return n, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,465 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudldap/cloudldap/repo"
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	ldap "github.com/cloudldap/ldapserver"
+	"golang.org/x/xerrors"
+)
+
+// Metrics of the bind rate limiter. They are exposed at /debug/vars on the pprof server.
+var bindRateLimitMetrics = expvar.NewMap("bind_rate_limit")
+
+// defaultBindRateLimitMaxDelay is the upper bound of the back-off delay if max-delay isn't configured.
+// It's short because the delay of the failed binds doesn't stop the attacker who doesn't wait for the response.
+const defaultBindRateLimitMaxDelay = 5 * time.Second
+
+const (
+	bindRateLimitKeyIP     = "ip"
+	bindRateLimitKeyDN     = "dn"
+	bindRateLimitKeyGlobal = "global"
+)
+
+// BindRateLimit is the limit of the failed bind attempts.
+type BindRateLimit struct {
+	// MaxFailures is the number of the failures within the window to ban (0: never ban)
+	MaxFailures int
+	// Window is the period to count the failures
+	Window time.Duration
+	// Delay is the back-off delay of the failed bind response after the first failure.
+	// It's doubled by each failure (0: no back-off)
+	Delay time.Duration
+	// MaxDelay is the upper bound of the back-off delay (default: 5s or Delay if it's longer)
+	MaxDelay time.Duration
+	// Ban is the period to reject all bind attempts after reaching MaxFailures
+	Ban time.Duration
+}
+
+// ParseBindRateLimit parses the bind rate limit config.
+// The format is "failures=<n>,window=<duration>,delay=<duration>,max-delay=<duration>,ban=<duration>"
+// (e.g. failures=10,window=10m,delay=1s,max-delay=1m,ban=15m). It returns nil if the config is empty.
+func ParseBindRateLimit(str string) (*BindRateLimit, error) {
+	if strings.TrimSpace(str) == "" {
+		return nil, nil
+	}
+
+	l := &BindRateLimit{
+		Window: 10 * time.Minute,
+		Ban:    15 * time.Minute,
+	}
+
+	for _, v := range strings.Split(str, ",") {
+		kv := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(kv) != 2 {
+			return nil, xerrors.Errorf("Invalid format. Need <key>=<value>: %s", v)
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		value := strings.TrimSpace(kv[1])
+
+		if key == "failures" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, xerrors.Errorf("Invalid failures: %s", v)
+			}
+			l.MaxFailures = n
+			continue
+		}
+
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, xerrors.Errorf("Invalid duration: %s", v)
+		}
+		switch key {
+		case "window":
+			l.Window = d
+		case "delay":
+			l.Delay = d
+		case "max-delay":
+			l.MaxDelay = d
+		case "ban":
+			l.Ban = d
+		default:
+			return nil, xerrors.Errorf(`Invalid key. Need "failures", "window", "delay", "max-delay" or "ban": %s`, v)
+		}
+	}
+
+	if l.MaxDelay == 0 {
+		l.MaxDelay = defaultBindRateLimitMaxDelay
+		if l.Delay > l.MaxDelay {
+			l.MaxDelay = l.Delay
+		}
+	}
+
+	return l, nil
+}
+
+// backoff returns the back-off delay after the failures.
+func (l *BindRateLimit) backoff(failures int) time.Duration {
+	if l.Delay == 0 || failures == 0 {
+		return 0
+	}
+	d := l.Delay
+	for i := 1; i < failures; i++ {
+		d *= 2
+		if d >= l.MaxDelay {
+			return l.MaxDelay
+		}
+	}
+	return d
+}
+
+type BindRateLimitConfig struct {
+	PerIP *BindRateLimit
+	PerDN *BindRateLimit
+	// Global only delays the failed bind responses. It never bans,
+	// otherwise the failures by an attacker would lock out all users
+	Global *BindRateLimit
+	// TrustedNetworks are the CIDRs which aren't limited
+	TrustedNetworks []string
+	// Shared stores the state into DB to share it across the instances
+	Shared bool
+}
+
+// BindRateLimiter limits the failed bind attempts per source IP, per bind DN and globally.
+// The attempts of the same source IP or bind DN are serialized in the instance,
+// so the concurrent attempts can't exceed the limit.
+type BindRateLimiter struct {
+	config  *BindRateLimitConfig
+	trusted []*net.IPNet
+	store   repo.BindAttemptStore
+	locks   *keyedMutex
+	// sleep waits for the back-off delay, it's replaced in the tests
+	sleep func(ctx context.Context, d time.Duration)
+}
+
+func NewBindRateLimiter(server *Server) (*BindRateLimiter, error) {
+	c := server.config.BindRateLimitConfig
+	if c == nil {
+		c = &BindRateLimitConfig{}
+	}
+
+	if c.Global != nil && c.Global.MaxFailures > 0 {
+		return nil, xerrors.Errorf("The global bind rate limit doesn't support failures, it supports the back-off delay only")
+	}
+
+	limiter := &BindRateLimiter{
+		config: c,
+		locks:  newKeyedMutex(),
+		sleep:  sleepContext,
+	}
+
+	for _, v := range c.TrustedNetworks {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, xerrors.Errorf("Invalid trusted network: %s, err: %w", v, err)
+		}
+		limiter.trusted = append(limiter.trusted, ipNet)
+	}
+
+	if c.Shared {
+		limiter.store = server.Repo().BindAttemptStore()
+	} else {
+		limiter.store = repo.NewMemoryBindAttemptStore()
+	}
+
+	return limiter, nil
+}
+
+// Enabled returns true if any limit is configured.
+func (l *BindRateLimiter) Enabled() bool {
+	return l.config.PerIP != nil || l.config.PerDN != nil || l.config.Global != nil
+}
+
+// Start purges the expired states periodically until the context is done.
+func (l *BindRateLimiter) Start(ctx context.Context) {
+	if !l.Enabled() {
+		return
+	}
+
+	var window time.Duration
+	for _, v := range []*BindRateLimit{l.config.PerIP, l.config.PerDN, l.config.Global} {
+		if v != nil && v.Window > window {
+			window = v.Window
+		}
+		if v != nil && v.MaxDelay > window {
+			window = v.MaxDelay
+		}
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.store.Purge(ctx, time.Now().Add(-window)); err != nil {
+				log.Printf("warn: Failed to purge bind attempts. err: %+v", err)
+			}
+		}
+	}
+}
+
+func (l *BindRateLimiter) isTrusted(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, v := range l.trusted {
+		if v.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type bindRateLimitTarget struct {
+	kind  string
+	key   string
+	limit *BindRateLimit
+}
+
+func (l *BindRateLimiter) targets(ip string, dn *schema.DN) []bindRateLimitTarget {
+	var targets []bindRateLimitTarget
+	if l.isTrusted(ip) {
+		return targets
+	}
+	if l.config.Global != nil {
+		targets = append(targets, bindRateLimitTarget{bindRateLimitKeyGlobal, "global", l.config.Global})
+	}
+	if l.config.PerIP != nil && ip != "" {
+		targets = append(targets, bindRateLimitTarget{bindRateLimitKeyIP, "ip:" + ip, l.config.PerIP})
+	}
+	if l.config.PerDN != nil && dn != nil {
+		targets = append(targets, bindRateLimitTarget{bindRateLimitKeyDN, "dn:" + dn.DNNormStr(), l.config.PerDN})
+	}
+	return targets
+}
+
+// BindRateLimitAttempt is the bind attempt which is checked by the limiter.
+// It holds the locks of the source IP and the bind DN until the result is recorded or it's released.
+type BindRateLimitAttempt struct {
+	l      *BindRateLimiter
+	ip     string
+	dn     *schema.DN
+	unlock []func()
+}
+
+// Begin returns unwillingToPerform error if the source IP or the bind DN is banned.
+// Otherwise it returns the attempt, the caller must record the result or release it.
+// The bind DN can be nil to check the source IP only.
+func (l *BindRateLimiter) Begin(ctx context.Context, ip string, dn *schema.DN) (*BindRateLimitAttempt, error) {
+	a := &BindRateLimitAttempt{
+		l:  l,
+		ip: ip,
+		dn: dn,
+	}
+	if !l.Enabled() {
+		return a, nil
+	}
+
+	// The locks are always acquired in the order of the targets, the source IP then the bind DN
+	for _, t := range l.targets(ip, dn) {
+		if t.kind == bindRateLimitKeyGlobal {
+			continue
+		}
+		unlock, err := l.locks.Lock(ctx, t.key)
+		if err != nil {
+			a.Release()
+			return nil, xerrors.Errorf("Failed to wait for the previous bind attempt. key: %s, err: %w", t.key, err)
+		}
+		a.unlock = append(a.unlock, unlock)
+	}
+
+	now := time.Now()
+
+	for _, t := range l.targets(ip, dn) {
+		if t.kind == bindRateLimitKeyGlobal {
+			continue
+		}
+		state, err := l.store.Find(ctx, t.key)
+		if err != nil {
+			a.Release()
+			return nil, err
+		}
+		if state != nil && state.IsBanned(now) {
+			l.reportBlocked(t, ip, dn, "banned")
+			a.Release()
+			return nil, util.NewUnwillingToPerform("too many failed bind attempts, try again later")
+		}
+	}
+	return a, nil
+}
+
+// Failure records the failed bind attempt, then bans the targets if the failures reach the limit.
+// It waits for the back-off delay after releasing the locks,
+// otherwise the failures of an attacker would block the other attempts from the same source IP or to the same bind DN.
+func (a *BindRateLimitAttempt) Failure(ctx context.Context) {
+	l := a.l
+	if !l.Enabled() {
+		a.Release()
+		return
+	}
+
+	now := time.Now()
+	var delay time.Duration
+
+	for _, t := range l.targets(a.ip, a.dn) {
+		state, err := l.store.RecordFailure(ctx, t.key, now, now.Add(-t.limit.Window))
+		if err != nil {
+			log.Printf("error: Failed to record bind failure. key: %s, err: %+v", t.key, err)
+			continue
+		}
+
+		if d := t.limit.backoff(state.Failures); d > delay {
+			delay = d
+		}
+
+		if t.kind != bindRateLimitKeyGlobal && t.limit.MaxFailures > 0 && state.Failures >= t.limit.MaxFailures && !state.IsBanned(now) {
+			if err := l.store.Ban(ctx, t.key, now.Add(t.limit.Ban)); err != nil {
+				log.Printf("error: Failed to ban. key: %s, err: %+v", t.key, err)
+				continue
+			}
+			bindRateLimitMetrics.Add("banned_"+t.kind, 1)
+			log.Printf("warn: Bind rate limit - Banned. key: %s, failures: %d, until: %s, remote: %s",
+				t.key, state.Failures, now.Add(t.limit.Ban).Format(time.RFC3339), a.ip)
+		}
+	}
+
+	a.Release()
+
+	if delay > 0 {
+		bindRateLimitMetrics.Add("delayed", 1)
+		l.sleep(ctx, delay)
+	}
+}
+
+// Success resets the failures of the bind DN.
+func (a *BindRateLimitAttempt) Success(ctx context.Context) {
+	defer a.Release()
+
+	l := a.l
+	if !l.Enabled() || l.config.PerDN == nil || a.dn == nil || l.isTrusted(a.ip) {
+		return
+	}
+
+	if err := l.store.Reset(ctx, "dn:"+a.dn.DNNormStr()); err != nil {
+		log.Printf("error: Failed to reset bind failures. dn_norm: %s, err: %+v", a.dn.DNNormStr(), err)
+	}
+}
+
+// Release releases the locks without recording the result. It can be called multiple times.
+func (a *BindRateLimitAttempt) Release() {
+	for i := len(a.unlock) - 1; i >= 0; i-- {
+		a.unlock[i]()
+	}
+	a.unlock = nil
+}
+
+func (l *BindRateLimiter) reportBlocked(t bindRateLimitTarget, ip string, dn *schema.DN, reason string) {
+	bindRateLimitMetrics.Add("blocked_"+t.kind, 1)
+
+	dnNorm := ""
+	if dn != nil {
+		dnNorm = dn.DNNormStr()
+	}
+	log.Printf("warn: Bind rate limit - Blocked by %s. key: %s, dn_norm: %s, remote: %s", reason, t.key, dnNorm, ip)
+}
+
+// remoteIP returns the IP address of the client.
+func remoteIP(m *ldap.Message) string {
+	addr := m.Client.GetConn().RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// keyedMutex is the mutex per key. The entry of the key is removed when no one holds or waits for it.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{
+		locks: map[string]*keyedLock{},
+	}
+}
+
+// Lock locks the key, then returns the unlock function. It returns error if the context is done while waiting.
+func (k *keyedMutex) Lock(ctx context.Context, key string) (func(), error) {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{ch: make(chan struct{}, 1)}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	release := func() {
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+
+	select {
+	case l.ch <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.ch
+			release()
+		})
+	}, nil
+}
@@ -0,0 +1,381 @@
+//go:build test
+
+package server
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudldap/cloudldap/schema"
+	"github.com/cloudldap/cloudldap/util"
+	"golang.org/x/xerrors"
+)
+
+func TestParseBindRateLimit(t *testing.T) {
+	testcases := []struct {
+		Name          string
+		Value         string
+		Expected      *BindRateLimit
+		ExpectedError bool
+	}{
+		{
+			"empty",
+			"",
+			nil,
+			false,
+		},
+		{
+			"all keys",
+			"failures=10, window=5m,delay=1s,max-delay=30s,ban=1h",
+			&BindRateLimit{10, 5 * time.Minute, time.Second, 30 * time.Second, time.Hour},
+			false,
+		},
+		{
+			"defaults",
+			"delay=1s",
+			&BindRateLimit{0, 10 * time.Minute, time.Second, 5 * time.Second, 15 * time.Minute},
+			false,
+		},
+		{
+			"default max delay is the delay if it's longer",
+			"delay=10s",
+			&BindRateLimit{0, 10 * time.Minute, 10 * time.Second, 10 * time.Second, 15 * time.Minute},
+			false,
+		},
+		{
+			"invalid failures",
+			"failures=-1",
+			nil,
+			true,
+		},
+		{
+			"invalid duration",
+			"window=10",
+			nil,
+			true,
+		},
+		{
+			"unknown key",
+			"lock=1m",
+			nil,
+			true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			l, err := ParseBindRateLimit(tc.Value)
+			if tc.ExpectedError {
+				if err == nil {
+					t.Errorf("Expected error, got: %v", l)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(l, tc.Expected) {
+				t.Errorf("Unexpected result. expected: %v, got: %v", tc.Expected, l)
+			}
+		})
+	}
+}
+
+func TestBindRateLimitBackoff(t *testing.T) {
+	l := &BindRateLimit{Delay: time.Second, MaxDelay: 10 * time.Second}
+
+	expected := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, e := range expected {
+		if d := l.backoff(i); d != e {
+			t.Errorf("Unexpected back-off on %d failures. expected: %s, got: %s", i, e, d)
+		}
+	}
+
+	if d := (&BindRateLimit{MaxDelay: time.Minute}).backoff(3); d != 0 {
+		t.Errorf("Unexpected back-off without delay: %s", d)
+	}
+}
+
+type bindRateLimitTest struct {
+	limiter *BindRateLimiter
+	mu      sync.Mutex
+	delays  []time.Duration
+}
+
+func newBindRateLimitTest(t *testing.T, c *BindRateLimitConfig) (*bindRateLimitTest, func(str string) *schema.DN) {
+	sc := &schema.SchemaConfig{
+		Suffix:       "dc=example,dc=com",
+		CustomSchema: []string{},
+	}
+	s := &Server{
+		config: &ServerConfig{
+			SchemaConfig:        sc,
+			BindRateLimitConfig: c,
+		},
+		schemaRegistry: schema.NewSchemaRegistry(sc),
+	}
+
+	l, err := NewBindRateLimiter(s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	lt := &bindRateLimitTest{limiter: l}
+	l.sleep = func(ctx context.Context, d time.Duration) {
+		lt.mu.Lock()
+		defer lt.mu.Unlock()
+		lt.delays = append(lt.delays, d)
+	}
+
+	dn := func(str string) *schema.DN {
+		d, err := s.schemaRegistry.NormalizeDN(str)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return d
+	}
+	return lt, dn
+}
+
+func (lt *bindRateLimitTest) fail(ip string, dn *schema.DN) error {
+	a, err := lt.limiter.Begin(context.Background(), ip, dn)
+	if err != nil {
+		return err
+	}
+	a.Failure(context.Background())
+	return nil
+}
+
+func isUnwillingToPerform(err error) bool {
+	var lerr *util.LDAPError
+	return xerrors.As(err, &lerr) && lerr.Code == util.NewUnwillingToPerform("").Code
+}
+
+func TestBindRateLimiterBan(t *testing.T) {
+	lt, dn := newBindRateLimitTest(t, &BindRateLimitConfig{
+		PerIP: &BindRateLimit{MaxFailures: 3, Window: time.Minute, Ban: time.Minute},
+		PerDN: &BindRateLimit{MaxFailures: 2, Window: time.Minute, Ban: time.Minute},
+	})
+	user1 := dn("uid=user1,ou=Users,dc=example,dc=com")
+	user2 := dn("uid=user2,ou=Users,dc=example,dc=com")
+	ctx := context.Background()
+
+	// user1 is banned by the second failure
+	for i := 0; i < 2; i++ {
+		if err := lt.fail("192.168.1.1", user1); err != nil {
+			t.Fatalf("Unexpected error on %d: %+v", i, err)
+		}
+	}
+	if _, err := lt.limiter.Begin(ctx, "192.168.1.2", user1); !isUnwillingToPerform(err) {
+		t.Errorf("Expected the banned DN is rejected from the other IP, got: %v", err)
+	}
+
+	// The source IP is banned by the third failure
+	if err := lt.fail("192.168.1.1", user2); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if _, err := lt.limiter.Begin(ctx, "192.168.1.1", nil); !isUnwillingToPerform(err) {
+		t.Errorf("Expected the banned IP is rejected, got: %v", err)
+	}
+
+	// The other IP and the other DN aren't affected
+	a, err := lt.limiter.Begin(ctx, "192.168.1.2", user2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	a.Success(ctx)
+
+	if len(lt.delays) != 0 {
+		t.Errorf("Unexpected delays without back-off: %v", lt.delays)
+	}
+}
+
+func TestBindRateLimiterBackoff(t *testing.T) {
+	lt, dn := newBindRateLimitTest(t, &BindRateLimitConfig{
+		PerDN: &BindRateLimit{Window: time.Minute, Delay: time.Second, MaxDelay: 4 * time.Second},
+	})
+	user1 := dn("uid=user1,ou=Users,dc=example,dc=com")
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if err := lt.fail("192.168.1.1", user1); err != nil {
+			t.Fatalf("Back-off must not reject the attempt on %d: %+v", i, err)
+		}
+	}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, 4 * time.Second}
+	if !reflect.DeepEqual(lt.delays, expected) {
+		t.Errorf("Unexpected delays. expected: %v, got: %v", expected, lt.delays)
+	}
+
+	// The success isn't delayed, then it resets the failures
+	a, err := lt.limiter.Begin(ctx, "192.168.1.1", user1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	a.Success(ctx)
+	if err := lt.fail("192.168.1.1", user1); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	expected = append(expected, time.Second)
+	if !reflect.DeepEqual(lt.delays, expected) {
+		t.Errorf("Unexpected delays after success. expected: %v, got: %v", expected, lt.delays)
+	}
+}
+
+func TestBindRateLimiterGlobal(t *testing.T) {
+	lt, dn := newBindRateLimitTest(t, &BindRateLimitConfig{
+		Global: &BindRateLimit{Window: time.Minute, Delay: time.Second, MaxDelay: time.Second},
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		if err := lt.fail("192.168.1.1", dn("uid=attacker,ou=Users,dc=example,dc=com")); err != nil {
+			t.Fatalf("Global limit must not reject the attempt on %d: %+v", i, err)
+		}
+	}
+
+	// The other users can still bind
+	a, err := lt.limiter.Begin(ctx, "192.168.1.2", dn("uid=user1,ou=Users,dc=example,dc=com"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	a.Success(ctx)
+
+	if len(lt.delays) != 100 {
+		t.Errorf("Unexpected number of delays: %d", len(lt.delays))
+	}
+
+	// The global limit doesn't support the ban
+	s := &Server{config: &ServerConfig{BindRateLimitConfig: &BindRateLimitConfig{
+		Global: &BindRateLimit{MaxFailures: 10, Window: time.Minute, Ban: time.Minute},
+	}}}
+	_, err = NewBindRateLimiter(s)
+	if err == nil {
+		t.Errorf("Expected error of the global failures")
+	}
+}
+
+func TestBindRateLimiterTrustedNetworks(t *testing.T) {
+	lt, dn := newBindRateLimitTest(t, &BindRateLimitConfig{
+		PerIP:           &BindRateLimit{MaxFailures: 1, Window: time.Minute, Delay: time.Second, MaxDelay: time.Second, Ban: time.Minute},
+		PerDN:           &BindRateLimit{MaxFailures: 1, Window: time.Minute, Delay: time.Second, MaxDelay: time.Second, Ban: time.Minute},
+		TrustedNetworks: []string{"10.0.0.0/8", "192.168.1.1"},
+	})
+	user1 := dn("uid=user1,ou=Users,dc=example,dc=com")
+	ctx := context.Background()
+
+	for _, ip := range []string{"10.1.2.3", "192.168.1.1"} {
+		for i := 0; i < 3; i++ {
+			if err := lt.fail(ip, user1); err != nil {
+				t.Fatalf("Unexpected error of the trusted IP %s: %+v", ip, err)
+			}
+		}
+	}
+	if len(lt.delays) != 0 {
+		t.Errorf("Unexpected delays of the trusted networks: %v", lt.delays)
+	}
+
+	// The failures from the trusted networks aren't counted
+	if err := lt.fail("192.168.1.2", user1); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if _, err := lt.limiter.Begin(ctx, "192.168.1.3", user1); !isUnwillingToPerform(err) {
+		t.Errorf("Expected the banned DN is rejected, got: %v", err)
+	}
+
+	// The banned DN is still allowed from the trusted networks
+	a, err := lt.limiter.Begin(ctx, "10.1.2.3", user1)
+	if err != nil {
+		t.Fatalf("Unexpected error of the trusted IP: %+v", err)
+	}
+	a.Release()
+}
+
+func TestBindRateLimiterReleaseBeforeDelay(t *testing.T) {
+	lt, dn := newBindRateLimitTest(t, &BindRateLimitConfig{
+		PerIP: &BindRateLimit{Window: time.Minute, Delay: time.Second, MaxDelay: time.Second},
+		PerDN: &BindRateLimit{Window: time.Minute, Delay: time.Second, MaxDelay: time.Second},
+	})
+	user1 := dn("uid=user1,ou=Users,dc=example,dc=com")
+
+	// The other attempts from the same IP and to the same DN aren't blocked while delaying
+	var blocked error
+	lt.limiter.sleep = func(ctx context.Context, d time.Duration) {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		a, err := lt.limiter.Begin(ctx, "192.168.1.1", user1)
+		if err != nil {
+			blocked = err
+			return
+		}
+		a.Release()
+	}
+
+	if err := lt.fail("192.168.1.1", user1); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if blocked != nil {
+		t.Errorf("Unexpected blocked attempt while delaying: %v", blocked)
+	}
+}
+
+func TestBindRateLimiterConcurrent(t *testing.T) {
+	lt, dn := newBindRateLimitTest(t, &BindRateLimitConfig{
+		PerDN: &BindRateLimit{MaxFailures: 5, Window: time.Minute, Ban: time.Minute},
+	})
+	user1 := dn("uid=user1,ou=Users,dc=example,dc=com")
+
+	var mu sync.Mutex
+	var attempts int
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := lt.fail("192.168.1.1", user1); err == nil {
+				mu.Lock()
+				attempts++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if attempts != 5 {
+		t.Errorf("Unexpected number of the allowed attempts. expected: 5, got: %d", attempts)
+	}
+}
+
+func TestKeyedMutexContext(t *testing.T) {
+	k := newKeyedMutex()
+
+	unlock, err := k.Lock(context.Background(), "ip:192.168.1.1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := k.Lock(ctx, "ip:192.168.1.1"); err == nil {
+		t.Errorf("Expected error while the key is locked")
+	}
+
+	unlock()
+	unlock()
+
+	unlock, err = k.Lock(context.Background(), "ip:192.168.1.1")
+	if err != nil {
+		t.Fatalf("Unexpected error after unlock: %+v", err)
+	}
+	unlock()
+
+	if len(k.locks) != 0 {
+		t.Errorf("Unexpected remaining locks: %v", k.locks)
+	}
+}
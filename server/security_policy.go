@@ -0,0 +1,268 @@
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/cloudldap/cloudldap/auth"
+	ldap "github.com/cloudldap/ldapserver"
+	"golang.org/x/xerrors"
+)
+
+// SecurityPolicy is the server-wide security policies.
+// They are enforced before the handlers run.
+type SecurityPolicy struct {
+	// DisallowAnonymousBind rejects anonymous simple bind
+	DisallowAnonymousBind bool
+	// DisallowAnonymousSearch rejects search by anonymous user except Root DSE
+	DisallowAnonymousSearch bool
+	// RequireAuthentication rejects all operations by anonymous user except bind, StartTLS and Root DSE
+	RequireAuthentication bool
+	// ConfidentialityRequired rejects simple and SASL bind without TLS (StartTLS or LDAPS)
+	ConfidentialityRequired bool
+	// MinSSF is the minimum security strength factor (TLS cipher key bits) per operation type.
+	// The key is one of "ssf" (all operations), "bind", "search", "update", "compare" and "extended".
+	MinSSF map[string]int
+}
+
+// ParseMinSSF parses the minimum security strength factor config.
+// The format is "<operation type>=<bits>,..." (e.g. bind=128,update=256).
+func ParseMinSSF(str string) (map[string]int, error) {
+	m := map[string]int{}
+	if strings.TrimSpace(str) == "" {
+		return m, nil
+	}
+
+	for _, v := range strings.Split(str, ",") {
+		kv := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(kv) != 2 {
+			return nil, xerrors.Errorf("Invalid format. Need <operation type>=<bits>: %s", v)
+		}
+		op := strings.ToLower(strings.TrimSpace(kv[0]))
+		switch op {
+		case "ssf", "bind", "search", "update", "compare", "extended":
+		default:
+			return nil, xerrors.Errorf(`Invalid operation type. Need "ssf", "bind", "search", "update", "compare" or "extended": %s`, v)
+		}
+		bits, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || bits < 0 {
+			return nil, xerrors.Errorf("Invalid bits: %s", v)
+		}
+		m[op] = bits
+	}
+	return m, nil
+}
+
+func (p *SecurityPolicy) minSSF(opType string) int {
+	if p.MinSSF == nil {
+		return 0
+	}
+	min := p.MinSSF["ssf"]
+	if v, ok := p.MinSSF[opType]; ok && v > min {
+		min = v
+	}
+	return min
+}
+
+// securityStrengthFactor returns the key bits of the TLS cipher for the connection.
+// It returns 0 if the connection isn't protected by TLS.
+func securityStrengthFactor(m *ldap.Message) int {
+	tlsConn, ok := m.Client.GetConn().(*tls.Conn)
+	if !ok {
+		return 0
+	}
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete {
+		return 0
+	}
+
+	name := tls.CipherSuiteName(state.CipherSuite)
+	switch {
+	case strings.Contains(name, "AES_256"), strings.Contains(name, "CHACHA20"):
+		return 256
+	case strings.Contains(name, "AES_128"), strings.Contains(name, "RC4_128"):
+		return 128
+	case strings.Contains(name, "3DES"):
+		return 112
+	}
+	return 0
+}
+
+func isRootDSESearch(m *ldap.Message) bool {
+	r := m.GetSearchRequest()
+	return string(r.BaseObject()) == "" && int(r.Scope()) == 0
+}
+
+func isStartTLS(m *ldap.Message) bool {
+	r := m.GetExtendedRequest()
+	return string(r.RequestName()) == ldap.NoticeOfStartTLS
+}
+
+func securityOperationType(m *ldap.Message) string {
+	switch m.ProtocolOpType() {
+	case ldap.ApplicationBindRequest:
+		return "bind"
+	case ldap.ApplicationSearchRequest:
+		return "search"
+	case ldap.ApplicationAddRequest, ldap.ApplicationModifyRequest,
+		ldap.ApplicationDelRequest, ldap.ApplicationModifyDNRequest:
+		return "update"
+	case ldap.ApplicationCompareRequest:
+		return "compare"
+	case ldap.ApplicationExtendedRequest:
+		return "extended"
+	}
+	return ""
+}
+
+// securityRequest is the part of the request which the security policies are evaluated for.
+type securityRequest struct {
+	// One of "bind", "search", "update", "compare" and "extended"
+	opType string
+	// The authentication choice and the name of the bind request
+	authChoice string
+	bindName   string
+	anonymous  bool
+	rootDSE    bool
+	startTLS   bool
+	ssf        int
+	remote     string
+}
+
+// CheckSecurityPolicy enforces the security policies for the request.
+// If the request violates the policies, it writes the error response and returns false.
+func (s *Server) CheckSecurityPolicy(w ldap.ResponseWriter, m *ldap.Message) bool {
+	p := s.config.SecurityPolicy
+	if p == nil {
+		return true
+	}
+
+	opType := securityOperationType(m)
+	if opType == "" {
+		// Abandon, Unbind
+		return true
+	}
+
+	req := &securityRequest{
+		opType:    opType,
+		anonymous: auth.GetAuthSession(m).DN == nil,
+		ssf:       securityStrengthFactor(m),
+		remote:    m.Client.GetConn().RemoteAddr().String(),
+	}
+	switch opType {
+	case "bind":
+		r := m.GetBindRequest()
+		req.authChoice = r.AuthenticationChoice()
+		req.bindName = string(r.Name())
+	case "search":
+		req.rootDSE = isRootDSESearch(m)
+	case "extended":
+		req.startTLS = isStartTLS(m)
+	}
+
+	if code, msg := p.check(req); code != ldap.LDAPResultSuccess {
+		responsePolicyError(w, m, code, msg)
+		return false
+	}
+	return true
+}
+
+// check returns the result code and the diagnostic message if the request violates the policies.
+func (p *SecurityPolicy) check(req *securityRequest) (int, string) {
+	switch req.opType {
+	case "bind":
+		if req.authChoice == "simple" && req.bindName == "" {
+			if p.DisallowAnonymousBind {
+				log.Printf("warn: Security policy violation - anonymous bind disallowed. remote: %s", req.remote)
+				return ldap.LDAPResultInappropriateAuthentication, "anonymous bind disallowed"
+			}
+			// Anonymous bind doesn't send any credentials
+			return ldap.LDAPResultSuccess, ""
+		}
+		// The bearer token of SASL OAUTHBEARER is also a credential
+		if p.ConfidentialityRequired && req.ssf == 0 {
+			log.Printf("warn: Security policy violation - %s bind without TLS. remote: %s, dn: %s", req.authChoice, req.remote, req.bindName)
+			return ldap.LDAPResultConfidentialityRequired, "confidentiality required"
+		}
+
+	case "extended":
+		if req.startTLS {
+			// StartTLS is always allowed to establish the confidentiality
+			return ldap.LDAPResultSuccess, ""
+		}
+		if p.RequireAuthentication && req.anonymous {
+			log.Printf("warn: Security policy violation - authentication required. op: %s, remote: %s", req.opType, req.remote)
+			return ldap.LDAPResultStrongAuthRequired, "authentication required"
+		}
+
+	case "search":
+		if req.rootDSE {
+			return ldap.LDAPResultSuccess, ""
+		}
+		if p.RequireAuthentication && req.anonymous {
+			log.Printf("warn: Security policy violation - authentication required. op: %s, remote: %s", req.opType, req.remote)
+			return ldap.LDAPResultStrongAuthRequired, "authentication required"
+		}
+		if p.DisallowAnonymousSearch && req.anonymous {
+			log.Printf("warn: Security policy violation - anonymous search disallowed. remote: %s", req.remote)
+			return ldap.LDAPResultInsufficientAccessRights, "anonymous search disallowed"
+		}
+
+	default:
+		if p.RequireAuthentication && req.anonymous {
+			log.Printf("warn: Security policy violation - authentication required. op: %s, remote: %s", req.opType, req.remote)
+			return ldap.LDAPResultStrongAuthRequired, "authentication required"
+		}
+	}
+
+	if min := p.minSSF(req.opType); req.ssf < min {
+		log.Printf("warn: Security policy violation - stronger confidentiality required. op: %s, ssf: %d, required: %d, remote: %s",
+			req.opType, req.ssf, min, req.remote)
+		return ldap.LDAPResultConfidentialityRequired, "stronger confidentiality required"
+	}
+
+	return ldap.LDAPResultSuccess, ""
+}
+
+func responsePolicyError(w ldap.ResponseWriter, m *ldap.Message, code int, msg string) {
+	switch m.ProtocolOpType() {
+	case ldap.ApplicationBindRequest:
+		res := ldap.NewBindResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	case ldap.ApplicationSearchRequest:
+		res := ldap.NewSearchResultDoneResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	case ldap.ApplicationAddRequest:
+		res := ldap.NewAddResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	case ldap.ApplicationModifyRequest:
+		res := ldap.NewModifyResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	case ldap.ApplicationDelRequest:
+		res := ldap.NewDeleteResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	case ldap.ApplicationModifyDNRequest:
+		res := ldap.NewModifyDNResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	case ldap.ApplicationCompareRequest:
+		res := ldap.NewCompareResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	case ldap.ApplicationExtendedRequest:
+		res := ldap.NewExtendedResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	default:
+		res := ldap.NewResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	}
+}
@@ -0,0 +1,208 @@
+//go:build test
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	ldap "github.com/cloudldap/ldapserver"
+)
+
+func TestParseMinSSF(t *testing.T) {
+	testcases := []struct {
+		Name          string
+		Value         string
+		Expected      map[string]int
+		ExpectedError bool
+	}{
+		{
+			"empty",
+			" ",
+			map[string]int{},
+			false,
+		},
+		{
+			"operation types",
+			"ssf=64, Bind=128,update=256",
+			map[string]int{"ssf": 64, "bind": 128, "update": 256},
+			false,
+		},
+		{
+			"all operation types",
+			"search=1,compare=2,extended=3",
+			map[string]int{"search": 1, "compare": 2, "extended": 3},
+			false,
+		},
+		{
+			"without bits",
+			"bind",
+			nil,
+			true,
+		},
+		{
+			"unknown operation type",
+			"delete=128",
+			nil,
+			true,
+		},
+		{
+			"not number",
+			"bind=strong",
+			nil,
+			true,
+		},
+		{
+			"negative bits",
+			"bind=-1",
+			nil,
+			true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			m, err := ParseMinSSF(tc.Value)
+			if tc.ExpectedError {
+				if err == nil {
+					t.Errorf("Expected error, got: %v", m)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(m, tc.Expected) {
+				t.Errorf("Unexpected result. expected: %v, got: %v", tc.Expected, m)
+			}
+		})
+	}
+}
+
+func TestSecurityPolicyCheck(t *testing.T) {
+	bind := func(name string, ssf int) *securityRequest {
+		return &securityRequest{opType: "bind", authChoice: "simple", bindName: name, anonymous: true, ssf: ssf}
+	}
+	op := func(opType string, anonymous bool, ssf int) *securityRequest {
+		return &securityRequest{opType: opType, anonymous: anonymous, ssf: ssf}
+	}
+
+	testcases := []struct {
+		Name         string
+		Policy       *SecurityPolicy
+		Request      *securityRequest
+		ExpectedCode int
+	}{
+		{
+			"no policy",
+			&SecurityPolicy{},
+			op("update", true, 0),
+			ldap.LDAPResultSuccess,
+		},
+		{
+			"anonymous bind disallowed",
+			&SecurityPolicy{DisallowAnonymousBind: true},
+			bind("", 0),
+			ldap.LDAPResultInappropriateAuthentication,
+		},
+		{
+			"anonymous bind without TLS",
+			&SecurityPolicy{ConfidentialityRequired: true, MinSSF: map[string]int{"bind": 128}},
+			bind("", 0),
+			ldap.LDAPResultSuccess,
+		},
+		{
+			"simple bind without TLS",
+			&SecurityPolicy{ConfidentialityRequired: true},
+			bind("cn=Manager,dc=example,dc=com", 0),
+			ldap.LDAPResultConfidentialityRequired,
+		},
+		{
+			"simple bind with TLS",
+			&SecurityPolicy{ConfidentialityRequired: true},
+			bind("cn=Manager,dc=example,dc=com", 128),
+			ldap.LDAPResultSuccess,
+		},
+		{
+			"SASL bind without TLS",
+			&SecurityPolicy{ConfidentialityRequired: true},
+			&securityRequest{opType: "bind", authChoice: "sasl", anonymous: true},
+			ldap.LDAPResultConfidentialityRequired,
+		},
+		{
+			"bind with weak TLS",
+			&SecurityPolicy{MinSSF: map[string]int{"bind": 256}},
+			bind("cn=Manager,dc=example,dc=com", 128),
+			ldap.LDAPResultConfidentialityRequired,
+		},
+		{
+			"ssf applies to all operations",
+			&SecurityPolicy{MinSSF: map[string]int{"ssf": 128}},
+			op("compare", false, 112),
+			ldap.LDAPResultConfidentialityRequired,
+		},
+		{
+			"stronger of ssf and operation type",
+			&SecurityPolicy{MinSSF: map[string]int{"ssf": 256, "update": 128}},
+			op("update", false, 128),
+			ldap.LDAPResultConfidentialityRequired,
+		},
+		{
+			"other operation type isn't affected",
+			&SecurityPolicy{MinSSF: map[string]int{"update": 256}},
+			op("search", false, 0),
+			ldap.LDAPResultSuccess,
+		},
+		{
+			"anonymous search disallowed",
+			&SecurityPolicy{DisallowAnonymousSearch: true},
+			op("search", true, 0),
+			ldap.LDAPResultInsufficientAccessRights,
+		},
+		{
+			"authenticated search",
+			&SecurityPolicy{DisallowAnonymousSearch: true, RequireAuthentication: true},
+			op("search", false, 0),
+			ldap.LDAPResultSuccess,
+		},
+		{
+			"Root DSE is exempted",
+			&SecurityPolicy{DisallowAnonymousSearch: true, RequireAuthentication: true, MinSSF: map[string]int{"ssf": 128}},
+			&securityRequest{opType: "search", anonymous: true, rootDSE: true},
+			ldap.LDAPResultSuccess,
+		},
+		{
+			"authentication required for update",
+			&SecurityPolicy{RequireAuthentication: true},
+			op("update", true, 0),
+			ldap.LDAPResultStrongAuthRequired,
+		},
+		{
+			"authentication required for extended",
+			&SecurityPolicy{RequireAuthentication: true},
+			op("extended", true, 0),
+			ldap.LDAPResultStrongAuthRequired,
+		},
+		{
+			"StartTLS is exempted",
+			&SecurityPolicy{RequireAuthentication: true, MinSSF: map[string]int{"extended": 128}},
+			&securityRequest{opType: "extended", anonymous: true, startTLS: true},
+			ldap.LDAPResultSuccess,
+		},
+		{
+			"bind is allowed for authentication",
+			&SecurityPolicy{RequireAuthentication: true},
+			bind("cn=Manager,dc=example,dc=com", 0),
+			ldap.LDAPResultSuccess,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			code, msg := tc.Policy.check(tc.Request)
+			if code != tc.ExpectedCode {
+				t.Errorf("Unexpected code. expected: %d, got: %d, msg: %s", tc.ExpectedCode, code, msg)
+			}
+		})
+	}
+}
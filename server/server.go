@@ -14,7 +14,6 @@ import (
 	_ "net/http/pprof"
 
 	"github.com/comail/colog"
-	"github.com/jsimonetti/pwscheme/ssha512"
 
 	//"github.com/hashicorp/logutils"
 
@@ -31,35 +30,61 @@ var (
 type ServerConfig struct {
 	*repo.DBRepositoryConfig
 	*schema.SchemaConfig
-	RootPW            string
-	PassThroughConfig *PassThroughConfig
-	BindAddress       string
-	LogLevel          string
-	PProfServer       string
-	GoMaxProcs        int
-	SimpleACL         []string
+	RootPW                   string
+	PassThroughConfig        *PassThroughConfig
+	BindAddress              string
+	LDAPSBindAddress         string
+	TLSCertFile              string
+	TLSKeyFile               string
+	SecurityPolicy           *SecurityPolicy
+	LogLevel                 string
+	PProfServer              string
+	GoMaxProcs               int
+	SimpleACL                []string
+	BindNameRules            []string
+	BindRateLimitConfig      *BindRateLimitConfig
+	TOTPConfig               *TOTPConfig
+	OAuthBearerConfig        *OAuthBearerConfig
+	PasswordSchemeConfig     *PasswordSchemeConfig
+	AccountStatusConfig      *AccountStatusConfig
+	NetworkRestrictionConfig *NetworkRestrictionConfig
 }
 
 type Server struct {
 	config         *ServerConfig
 	rootDN         *schema.DN
 	internal       *ldap.Server
+	internalTLS    *ldap.Server
 	suffixOrig     []string
 	suffixNorm     []string
 	Suffix         *schema.DN
 	repo           repo.Repository
 	schemaRegistry *schema.SchemaRegistry
 	simpleACL      *SimpleACL
+	bindName       *BindNameResolver
+	bindRateLimit  *BindRateLimiter
+	totp           *TOTPVerifier
+	oauthBearer    *OAuthBearerAuthenticator
+	passwordScheme *PasswordSchemeRegistry
+	accountStatus  *AccountStatusChecker
+	netRestriction *NetworkRestriction
+	cancel         context.CancelFunc
 }
 
 func NewServer(c *ServerConfig) *Server {
-	if len(c.RootPW) > 7 && string(c.RootPW[0:6]) == "{SSHA}" ||
-		len(c.RootPW) > 10 && string(c.RootPW[0:9]) == "{SSHA256}" ||
-		len(c.RootPW) > 10 && string(c.RootPW[0:9]) == "{SSHA512}" {
+	if c.PasswordSchemeConfig == nil {
+		c.PasswordSchemeConfig = &PasswordSchemeConfig{}
+	}
+	passwordScheme, err := NewPasswordSchemeRegistry(c.PasswordSchemeConfig)
+	if err != nil {
+		log.Fatalf("alert: Invalid password scheme config: %+v, err: %s", c.PasswordSchemeConfig, err)
+	}
+
+	if passwordScheme.IsHashed(c.RootPW) {
 		// Use hashed password
 	} else {
 		// Plain
-		hashedRootPW, err := ssha512.Generate(c.RootPW, 20)
+		hashedRootPW, err := passwordScheme.Generate(c.RootPW)
 		if err != nil {
 			log.Fatalf("Initialize rootPW error: %+v", err)
 		}
@@ -75,9 +100,10 @@ func NewServer(c *ServerConfig) *Server {
 	}
 
 	return &Server{
-		config:     c,
-		suffixOrig: s,
-		suffixNorm: sn,
+		config:         c,
+		suffixOrig:     s,
+		suffixNorm:     sn,
+		passwordScheme: passwordScheme,
 	}
 }
 
@@ -154,7 +180,7 @@ func (s *Server) Start() {
 	// Init DB
 	repo, err := repo.NewRepository(s.config.DBRepositoryConfig, s.schemaRegistry)
 	if err != nil {
-		log.Fatalf("alert: Prepare statement error:  %+v", err)
+		log.Fatalf("alert: Invalid repository config: %+v", err)
 	}
 	s.repo = repo // TODO Remove bidirectional dependency
 
@@ -170,28 +196,67 @@ func (s *Server) Start() {
 		log.Fatalf("alert: Invalid acl format: %v, err: %s", s.config.SimpleACL, err)
 	}
 
+	// Init bind name resolver
+	s.bindName, err = NewBindNameResolver(s)
+	if err != nil {
+		log.Fatalf("alert: Invalid bind name rule format: %v, err: %s", s.config.BindNameRules, err)
+	}
+
+	// Init bind rate limiter
+	s.bindRateLimit, err = NewBindRateLimiter(s)
+	if err != nil {
+		log.Fatalf("alert: Invalid bind rate limit config: %+v, err: %s", s.config.BindRateLimitConfig, err)
+	}
+	// Init TOTP
+	s.totp, err = NewTOTPVerifier(s)
+	if err != nil {
+		log.Fatalf("alert: Invalid TOTP config: %+v, err: %s", s.config.TOTPConfig, err)
+	}
+	// Init SASL OAUTHBEARER
+	s.oauthBearer, err = NewOAuthBearerAuthenticator(s)
+	if err != nil {
+		log.Fatalf("alert: Invalid OAUTHBEARER config: %+v, err: %s", s.config.OAuthBearerConfig, err)
+	}
+	// Init account status evaluators
+	s.accountStatus, err = NewAccountStatusChecker(s)
+	if err != nil {
+		log.Fatalf("alert: Invalid account status config: %+v, err: %s", s.config.AccountStatusConfig, err)
+	}
+	// Init network restriction
+	s.netRestriction, err = NewNetworkRestriction(s)
+	if err != nil {
+		log.Fatalf("alert: Invalid network restriction config: %+v, err: %s", s.config.NetworkRestrictionConfig, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.bindRateLimit.Start(ctx)
+
 	//Create a new LDAP Server
 	server := ldap.NewServer()
 	s.internal = server
 
 	//Create routes bindings
 	routes := ldap.NewRouteMux()
-	routes.NotFound(handleNotFound)
+	routes.NotFound(WithSecurityPolicy(s, handleNotFound))
 	routes.Abandon(handleAbandon)
 	routes.Bind(NewHandler(s, handleBind))
-	routes.Compare(handleCompare)
+	routes.Compare(WithSecurityPolicy(s, handleCompare))
 	routes.Add(NewHandler(s, handleAdd))
 	routes.Delete(NewHandler(s, handleDelete))
 	routes.Modify(NewHandler(s, handleModify))
 	routes.ModifyDN(NewHandler(s, handleModifyDN))
 
-	routes.Extended(handleStartTLS).
+	routes.Extended(NewHandler(s, handleStartTLS)).
 		RequestName(ldap.NoticeOfStartTLS).Label("StartTLS")
 
-	routes.Extended(handleWhoAmI).
+	routes.Extended(WithSecurityPolicy(s, handleWhoAmI)).
 		RequestName(ldap.NoticeOfWhoAmI).Label("Ext - WhoAmI")
 
-	routes.Extended(handleExtended).Label("Ext - Generic")
+	routes.Extended(NewHandler(s, handleVerifyCache)).
+		RequestName(VerifyCacheExtendedOID).Label("Ext - Verify Cache")
+
+	routes.Extended(WithSecurityPolicy(s, handleExtended)).Label("Ext - Generic")
 
 	routes.Search(NewHandler(s, handleSearchDSE)).
 		BaseDn("").
@@ -218,14 +283,40 @@ func (s *Server) Start() {
 	// Optional config
 	server.MaxRequestSize = 5 * 1024 * 1024 // 5MB
 
+	// LDAPS
+	if s.config.LDAPSBindAddress != "" {
+		tlsConfig, err := s.getTLSconfig()
+		if err != nil {
+			log.Fatalf("alert: Invalid TLS certificate: %s, err: %+v", s.config.TLSCertFile, err)
+		}
+
+		tlsServer := ldap.NewServer()
+		tlsServer.Handle(routes)
+		tlsServer.MaxRequestSize = server.MaxRequestSize
+		s.internalTLS = tlsServer
+
+		log.Printf("info: Starting cloudldap (LDAPS) on %s", s.config.LDAPSBindAddress)
+
+		go tlsServer.ListenAndServe(s.config.LDAPSBindAddress, func(ls *ldap.Server) {
+			// The PROXY protocol header is sent before the TLS handshake
+			ls.Listener = tls.NewListener(s.netRestriction.Listener(ls.Listener), tlsConfig)
+		})
+	}
+
 	log.Printf("info: Starting cloudldap on %s", s.config.BindAddress)
 
 	// listen and serve
-	server.ListenAndServe(s.config.BindAddress)
+	server.ListenAndServe(s.config.BindAddress, func(ls *ldap.Server) {
+		ls.Listener = s.netRestriction.Listener(ls.Listener)
+	})
 }
 
 func (s *Server) RefreshCache(ctx context.Context) error {
-	return s.repo.(*repo.DefaultRepository).RefreshCache(ctx)
+	if r, ok := s.repo.(repo.CacheRefresher); ok {
+		return r.RefreshCache(ctx)
+	}
+	// The backend has no cache
+	return nil
 }
 
 func (s *Server) LoadSchema() {
@@ -233,6 +324,12 @@ func (s *Server) LoadSchema() {
 }
 
 func (s *Server) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.internalTLS != nil {
+		s.internalTLS.Stop()
+	}
 	s.internal.Stop()
 }
 
@@ -250,10 +347,23 @@ func (s *Server) SuffixNorm() []string {
 
 func NewHandler(s *Server, handler func(s *Server, w ldap.ResponseWriter, r *ldap.Message)) func(w ldap.ResponseWriter, r *ldap.Message) {
 	return func(w ldap.ResponseWriter, r *ldap.Message) {
+		if !s.CheckSecurityPolicy(w, r) {
+			return
+		}
 		handler(s, w, r)
 	}
 }
 
+// WithSecurityPolicy wraps the handler which doesn't depend on the server with the security policy check.
+func WithSecurityPolicy(s *Server, handler func(w ldap.ResponseWriter, r *ldap.Message)) func(w ldap.ResponseWriter, r *ldap.Message) {
+	return func(w ldap.ResponseWriter, r *ldap.Message) {
+		if !s.CheckSecurityPolicy(w, r) {
+			return
+		}
+		handler(w, r)
+	}
+}
+
 func handleNotFound(w ldap.ResponseWriter, r *ldap.Message) {
 	switch r.ProtocolOpType() {
 	case ldap.ApplicationBindRequest:
@@ -319,8 +429,14 @@ AM65XAOw8Dsg9Kq78aYXiOEDc5DL0sbFUu/SlmRcCg93
 
 // getTLSconfig returns a tls configuration used
 // to build a TLSlistener for TLS or StartTLS
-func getTLSconfig() (*tls.Config, error) {
-	cert, err := tls.X509KeyPair(localhostCert, localhostKey)
+func (s *Server) getTLSconfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if s.config.TLSCertFile != "" {
+		cert, err = tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
+	} else {
+		cert, err = tls.X509KeyPair(localhostCert, localhostKey)
+	}
 	if err != nil {
 		return &tls.Config{}, err
 	}
@@ -333,8 +449,23 @@ func getTLSconfig() (*tls.Config, error) {
 	}, nil
 }
 
-func handleStartTLS(w ldap.ResponseWriter, m *ldap.Message) {
-	tlsconfig, _ := getTLSconfig()
+func handleStartTLS(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
+	if _, ok := m.Client.GetConn().(*tls.Conn); ok {
+		res := ldap.NewExtendedResponse(ldap.LDAPResultOperationsError)
+		res.SetResponseName(ldap.NoticeOfStartTLS)
+		res.SetDiagnosticMessage("TLS already started")
+		w.Write(res)
+		return
+	}
+
+	tlsconfig, err := s.getTLSconfig()
+	if err != nil {
+		log.Printf("error: StartTLS failed to load the certificate. err: %+v", err)
+		res := ldap.NewExtendedResponse(ldap.LDAPResultUnavailable)
+		res.SetResponseName(ldap.NoticeOfStartTLS)
+		w.Write(res)
+		return
+	}
 	tlsConn := tls.Server(m.Client.GetConn(), tlsconfig)
 	res := ldap.NewExtendedResponse(ldap.LDAPResultSuccess)
 	res.SetResponseName(ldap.NoticeOfStartTLS)
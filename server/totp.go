@@ -0,0 +1,199 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudldap/cloudldap/repo"
+	"github.com/cloudldap/cloudldap/schema"
+	"golang.org/x/xerrors"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+)
+
+type TOTPConfig struct {
+	// Enabled enables TOTP second factor
+	Enabled bool
+	// SecretAttribute is the attribute which has the base32 encoded TOTP secret (default: totpSecret)
+	SecretAttribute string
+	// ObjectClass is the objectClass of the TOTP users. If it's empty, only the secret attribute is checked.
+	ObjectClass string
+	// Skew is the number of the time steps allowed before and after the current time
+	Skew int
+	// ExemptGroups are the groups (e.g. service accounts) which don't require TOTP
+	ExemptGroups []string
+}
+
+// TOTPVerifier verifies the TOTP code (RFC 6238) appended to the bind password.
+type TOTPVerifier struct {
+	config       *TOTPConfig
+	server       *Server
+	exemptGroups []*schema.DN
+
+	// used is the last accepted time step per DN to prevent replay
+	mu   sync.Mutex
+	used map[string]int64
+
+	clock func() time.Time
+}
+
+func NewTOTPVerifier(server *Server) (*TOTPVerifier, error) {
+	c := server.config.TOTPConfig
+	if c == nil {
+		c = &TOTPConfig{}
+	}
+	if c.SecretAttribute == "" {
+		c.SecretAttribute = "totpSecret"
+	}
+	if c.Skew < 0 {
+		c.Skew = 0
+	}
+
+	v := &TOTPVerifier{
+		config: c,
+		server: server,
+		used:   map[string]int64{},
+		clock:  time.Now,
+	}
+
+	for _, g := range c.ExemptGroups {
+		dn, err := server.NormalizeDN(strings.TrimSpace(g))
+		if err != nil {
+			return nil, xerrors.Errorf("Invalid TOTP exempt group: %s, err: %w", g, err)
+		}
+		v.exemptGroups = append(v.exemptGroups, dn)
+	}
+
+	return v, nil
+}
+
+// Required returns the TOTP secret if the user requires TOTP.
+func (v *TOTPVerifier) Required(cred *repo.FetchedCredential) (string, bool) {
+	if !v.config.Enabled {
+		return "", false
+	}
+
+	secretName := v.config.SecretAttribute
+	if at, ok := v.server.schemaRegistry.AttributeType(secretName); ok {
+		secretName = at.Name
+	}
+	secrets := attrNormStr(cred.Attrs, secretName)
+	if len(secrets) == 0 {
+		return "", false
+	}
+
+	if v.config.ObjectClass != "" {
+		found := false
+		for _, oc := range attrNormStr(cred.Attrs, "objectClass") {
+			if strings.EqualFold(oc, v.config.ObjectClass) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+
+	for _, g := range cred.MemberOf {
+		for _, e := range v.exemptGroups {
+			if g.Equal(e) {
+				return "", false
+			}
+		}
+	}
+
+	return secrets[0], true
+}
+
+// Split splits the bind password into the password and the TOTP code.
+func (v *TOTPVerifier) Split(input string) (string, string, bool) {
+	if len(input) <= totpDigits {
+		return "", "", false
+	}
+	code := input[len(input)-totpDigits:]
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return "", "", false
+		}
+	}
+	return input[:len(input)-totpDigits], code, true
+}
+
+// Verify checks the TOTP code within the skew windows. The accepted time step can't be used again.
+func (v *TOTPVerifier) Verify(dn *schema.DN, secret, code string) bool {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		log.Printf("error: Invalid TOTP secret. dn_norm: %s, err: %v", dn.DNNormStr(), err)
+		return false
+	}
+
+	now := v.clock().Unix() / totpPeriod
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	last := v.used[dn.DNNormStr()]
+
+	for i := -v.config.Skew; i <= v.config.Skew; i++ {
+		step := now + int64(i)
+		if !hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			continue
+		}
+		if step <= last {
+			log.Printf("warn: TOTP code is replayed. dn_norm: %s", dn.DNNormStr())
+			return false
+		}
+		v.used[dn.DNNormStr()] = step
+
+		// Remove the expired steps
+		for k, s := range v.used {
+			if s < now-int64(v.config.Skew) {
+				delete(v.used, k)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	s := strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	s = strings.TrimRight(s, "=")
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+}
+
+// totpCode generates the code for the time step (RFC 4226 Section 5.3).
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, bin%1000000)
+}
+
+func attrNormStr(attrs repo.CacheAttrsNorm, name string) []string {
+	var rtn []string
+	for _, v := range attrs[name] {
+		if s, ok := v.(string); ok {
+			rtn = append(rtn, s)
+		}
+	}
+	return rtn
+}
@@ -0,0 +1,104 @@
+//go:build test
+
+package server
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/cloudldap/cloudldap/schema"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors of RFC 6238 Appendix B (SHA1), truncated to 6 digits
+	key := []byte("12345678901234567890")
+
+	testcases := []struct {
+		Time         int64
+		ExpectedCode string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for i, tc := range testcases {
+		code := totpCode(key, tc.Time/totpPeriod)
+		if code != tc.ExpectedCode {
+			t.Errorf("Unexpected code on %d: expected %s, got %s", i, tc.ExpectedCode, code)
+		}
+	}
+}
+
+func TestTOTPSplit(t *testing.T) {
+	v := &TOTPVerifier{}
+
+	testcases := []struct {
+		Input            string
+		ExpectedPassword string
+		ExpectedCode     string
+		ExpectedOK       bool
+	}{
+		{"password123456", "password", "123456", true},
+		{"pass123word000111", "pass123word", "000111", true},
+		{"password", "", "", false},
+		{"123456", "", "", false},
+		{"password12345a", "", "", false},
+	}
+
+	for i, tc := range testcases {
+		password, code, ok := v.Split(tc.Input)
+		if password != tc.ExpectedPassword || code != tc.ExpectedCode || ok != tc.ExpectedOK {
+			t.Errorf("Unexpected result on %d: expected (%s, %s, %v), got (%s, %s, %v)", i,
+				tc.ExpectedPassword, tc.ExpectedCode, tc.ExpectedOK, password, code, ok)
+		}
+	}
+}
+
+func TestTOTPVerify(t *testing.T) {
+	sr := schema.NewSchemaRegistry(&schema.SchemaConfig{
+		Suffix:           "dc=example,dc=com",
+		CustomSchema:     []string{},
+		MigrationEnabled: false,
+	})
+	dn, err := schema.NormalizeDN(sr, "uid=user1,ou=Users,dc=example,dc=com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	key := []byte("12345678901234567890")
+	secret := base32.StdEncoding.EncodeToString(key)
+
+	v := &TOTPVerifier{
+		config: &TOTPConfig{
+			Enabled: true,
+			Skew:    1,
+		},
+		used: map[string]int64{},
+		clock: func() time.Time {
+			return time.Unix(1234567890, 0)
+		},
+	}
+
+	now := int64(1234567890 / totpPeriod)
+
+	if v.Verify(dn, secret, totpCode(key, now-5)) {
+		t.Errorf("The code out of the skew window must be rejected")
+	}
+	if !v.Verify(dn, secret, totpCode(key, now-1)) {
+		t.Errorf("The code in the skew window must be accepted")
+	}
+	if v.Verify(dn, secret, totpCode(key, now-1)) {
+		t.Errorf("The replayed code must be rejected")
+	}
+	if !v.Verify(dn, secret, totpCode(key, now)) {
+		t.Errorf("The current code must be accepted")
+	}
+	if v.Verify(dn, secret, totpCode(key, now-1)) {
+		t.Errorf("The older code than the used one must be rejected")
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"os"
 	"testing"
 
+	"github.com/cloudldap/cloudldap/repo"
 	"github.com/cloudldap/cloudldap/server"
 	"github.com/go-ldap/ldap/v3"
+	ber "gopkg.in/asn1-ber.v1"
 )
 
 var testServer *server.Server
@@ -270,7 +272,13 @@ func TestBind(t *testing.T) {
 				"sn":           A{"user4"},
 				"userPassword": A{"password4"},
 			},
-			&AssertEntry{},
+			// The plaintext password is stored as hashed
+			&AssertEntry{
+				expectAttrs: M{
+					"cn": A{"user4"},
+					"sn": A{"user4"},
+				},
+			},
 		},
 		Bind{
 			"uid=user1,ou=Users",
@@ -317,6 +325,100 @@ func TestBind(t *testing.T) {
 	runTestCases(t, tcs)
 }
 
+func TestBindByName(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"cn":           A{"user1"},
+				"sn":           A{"user1"},
+				"mail":         A{"user1@example.com"},
+				"userPassword": A{SSHA("password1")},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"uid=user2", "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"cn":           A{"user2"},
+				"sn":           A{"user2"},
+				"mail":         A{"shared@example.com"},
+				"userPassword": A{SSHA("password2")},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"uid=user3", "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"cn":           A{"user3"},
+				"sn":           A{"user3"},
+				"mail":         A{"shared@example.com"},
+				"userPassword": A{SSHA("password3")},
+			},
+			&AssertEntry{},
+		},
+		// uid
+		BindName{
+			"user1",
+			"password1",
+			&AssertResponse{},
+		},
+		BindName{
+			"user1",
+			"invalid",
+			&AssertResponse{49},
+		},
+		// mail
+		BindName{
+			"user1@example.com",
+			"password1",
+			&AssertResponse{},
+		},
+		// Fallback to uid by the next rule
+		BindName{
+			"user2@other.example.com",
+			"password2",
+			&AssertResponse{},
+		},
+		// DOMAIN\user
+		BindName{
+			`EXAMPLE\user3`,
+			"password3",
+			&AssertResponse{},
+		},
+		// Not unique
+		BindName{
+			"shared@example.com",
+			"password2",
+			&AssertResponse{49},
+		},
+		// Not found
+		BindName{
+			"nobody",
+			"password1",
+			&AssertResponse{49},
+		},
+		// Filter injection
+		BindName{
+			"*",
+			"password1",
+			&AssertResponse{49},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
+
 func TestSearchSpecialCharacters(t *testing.T) {
 	type A []string
 	type M map[string][]string
@@ -2289,3 +2391,619 @@ func TestSearchByAssociation(t *testing.T) {
 
 	runTestCases(t, tcs)
 }
+
+func TestSearchByInChainAssociation(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("example", "dc=com"),
+		AddOU("Groups"),
+		AddOU("Users"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"cn":           A{"user1"},
+				"sn":           A{"user1"},
+				"userPassword": A{SSHA("password1")},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"uid=user2", "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"cn":           A{"user2"},
+				"sn":           A{"user2"},
+				"userPassword": A{SSHA("password1")},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"cn=A1", "ou=Groups",
+			M{
+				"objectClass": A{"groupOfNames"},
+				"member": A{
+					"uid=user1,ou=Users," + testServer.GetSuffix(),
+				},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"cn=A2", "ou=Groups",
+			M{
+				"objectClass": A{"groupOfNames"},
+				"member": A{
+					"cn=A1,ou=Groups," + testServer.GetSuffix(),
+					"uid=user2,ou=Users," + testServer.GetSuffix(),
+				},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"cn=A3", "ou=Groups",
+			M{
+				"objectClass": A{"groupOfNames"},
+				"member": A{
+					"cn=A2,ou=Groups," + testServer.GetSuffix(),
+				},
+			},
+			&AssertEntry{},
+		},
+		// memberOf in chain
+		Search{
+			"ou=Users," + testServer.GetSuffix(),
+			"memberOf:1.2.840.113556.1.4.1941:=cn=A3,ou=Groups," + testServer.GetSuffix(),
+			ldap.ScopeWholeSubtree,
+			A{"cn"},
+			&AssertEntries{
+				ExpectEntry{
+					"uid=user1",
+					"ou=Users",
+					M{
+						"cn": A{"user1"},
+					},
+				},
+				ExpectEntry{
+					"uid=user2",
+					"ou=Users",
+					M{
+						"cn": A{"user2"},
+					},
+				},
+			},
+		},
+		// member in chain
+		Search{
+			"ou=Groups," + testServer.GetSuffix(),
+			"member:1.2.840.113556.1.4.1941:=uid=user1,ou=Users," + testServer.GetSuffix(),
+			ldap.ScopeWholeSubtree,
+			A{"cn"},
+			&AssertEntries{
+				ExpectEntry{
+					"cn=A1",
+					"ou=Groups",
+					M{
+						"cn": A{"A1"},
+					},
+				},
+				ExpectEntry{
+					"cn=A2",
+					"ou=Groups",
+					M{
+						"cn": A{"A2"},
+					},
+				},
+				ExpectEntry{
+					"cn=A3",
+					"ou=Groups",
+					M{
+						"cn": A{"A3"},
+					},
+				},
+			},
+		},
+		// dn attributes
+		Search{
+			testServer.GetSuffix(),
+			"ou:dn:=Users",
+			ldap.ScopeWholeSubtree,
+			A{"cn"},
+			&AssertEntries{
+				ExpectEntry{
+					"ou=Users",
+					"",
+					M{},
+				},
+				ExpectEntry{
+					"uid=user1",
+					"ou=Users",
+					M{
+						"cn": A{"user1"},
+					},
+				},
+				ExpectEntry{
+					"uid=user2",
+					"ou=Users",
+					M{
+						"cn": A{"user2"},
+					},
+				},
+			},
+		},
+		// matching rule
+		Search{
+			"ou=Users," + testServer.GetSuffix(),
+			"cn:caseIgnoreMatch:=USER1",
+			ldap.ScopeWholeSubtree,
+			A{"cn"},
+			&AssertEntries{
+				ExpectEntry{
+					"uid=user1",
+					"ou=Users",
+					M{
+						"cn": A{"user1"},
+					},
+				},
+			},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestGetEffectiveRights(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"cn":           A{"user1"},
+				"sn":           A{"user1"},
+				"userPassword": A{SSHA("password1")},
+			},
+			&AssertEntry{},
+		},
+		SearchWithControls{
+			"ou=Users," + testServer.GetSuffix(),
+			"uid=user1",
+			ldap.ScopeWholeSubtree,
+			A{"cn", "sn"},
+			[]ldap.Control{
+				ldap.NewControlString("1.3.6.1.4.1.42.2.27.9.5.2", false, ""),
+			},
+			&AssertEntries{
+				ExpectEntry{
+					"uid=user1",
+					"ou=Users",
+					M{
+						"cn":                   A{"user1"},
+						"entryLevelRights":     A{"vadn"},
+						"attributeLevelRights": A{"cn:rscwo, sn:rscwo"},
+					},
+				},
+			},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
+
+// getEffectiveRightsControl returns Get Effective Rights control with the authzId.
+func getEffectiveRightsControl(authzID string) ldap.Control {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "GetRightsControl")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, authzID, "authzId"))
+	packet.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes"))
+	return ldap.NewControlString("1.3.6.1.4.1.42.2.27.9.5.2", false, string(packet.Bytes()))
+}
+
+func TestGetEffectiveRightsAuthzID(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	user := func(uid string) Add {
+		return Add{
+			"uid=" + uid, "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"cn":           A{uid},
+				"sn":           A{uid},
+				"userPassword": A{SSHA("password1")},
+			},
+			&AssertEntry{},
+		}
+	}
+	dn := func(uid string) string {
+		return "dn:uid=" + uid + ",ou=Users," + testServer.GetSuffix()
+	}
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		user("user1"),
+		// The users are allowed by the ACL of the test server
+		user("reader"),
+		user("auditor"),
+		// Root gets the rights of the user
+		SearchWithControls{
+			"ou=Users," + testServer.GetSuffix(),
+			"uid=user1",
+			ldap.ScopeWholeSubtree,
+			A{"cn", "sn"},
+			[]ldap.Control{getEffectiveRightsControl(dn("reader"))},
+			&AssertEntries{
+				ExpectEntry{
+					"uid=user1",
+					"ou=Users",
+					M{
+						"cn":                   A{"user1"},
+						"entryLevelRights":     A{"v"},
+						"attributeLevelRights": A{"cn:rsc, sn:rsc"},
+					},
+				},
+			},
+		},
+		// Non-admin user can't get the rights of other users
+		Conn{},
+		Bind{"uid=reader,ou=Users", "password1", &AssertResponse{}},
+		SearchWithControlsError{
+			"ou=Users," + testServer.GetSuffix(),
+			"uid=user1",
+			ldap.ScopeWholeSubtree,
+			[]ldap.Control{getEffectiveRightsControl(dn("user1"))},
+			&AssertResponse{ldap.LDAPResultInsufficientAccessRights},
+		},
+		// The own rights are allowed
+		SearchWithControls{
+			"ou=Users," + testServer.GetSuffix(),
+			"uid=user1",
+			ldap.ScopeWholeSubtree,
+			A{"cn"},
+			[]ldap.Control{getEffectiveRightsControl(dn("reader"))},
+			&AssertEntries{
+				ExpectEntry{
+					"uid=user1",
+					"ou=Users",
+					M{
+						"cn":                   A{"user1"},
+						"entryLevelRights":     A{"v"},
+						"attributeLevelRights": A{"cn:rsc"},
+					},
+				},
+			},
+		},
+		// The user with G scope gets the rights of other users
+		Conn{},
+		Bind{"uid=auditor,ou=Users", "password1", &AssertResponse{}},
+		SearchWithControls{
+			"ou=Users," + testServer.GetSuffix(),
+			"uid=user1",
+			ldap.ScopeWholeSubtree,
+			A{"cn"},
+			[]ldap.Control{getEffectiveRightsControl(dn("user1"))},
+			&AssertEntries{
+				ExpectEntry{
+					"uid=user1",
+					"ou=Users",
+					M{
+						"cn":                   A{"user1"},
+						"entryLevelRights":     A{"none"},
+						"attributeLevelRights": A{"cn:none"},
+					},
+				},
+			},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestSecurityPolicy(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	setSecurityPolicy(t, &server.SecurityPolicy{
+		DisallowAnonymousBind:   true,
+		DisallowAnonymousSearch: true,
+		MinSSF:                  map[string]int{"bind": 128},
+	})
+
+	tcs := []Command{
+		Conn{},
+		AnonymousBind{&AssertResponse{ldap.LDAPResultInappropriateAuthentication}},
+		// The bind requires TLS
+		Bind{"cn=Manager", "secret", &AssertResponse{ldap.LDAPResultConfidentialityRequired}},
+		SearchWithControlsError{
+			testServer.GetSuffix(),
+			"objectClass=*",
+			ldap.ScopeBaseObject,
+			nil,
+			&AssertResponse{ldap.LDAPResultInsufficientAccessRights},
+		},
+		// Root DSE is visible for anonymous
+		Search{
+			"",
+			"objectClass=*",
+			ldap.ScopeBaseObject,
+			A{"namingContexts"},
+			&AssertEntries{
+				ExpectEntry{
+					"",
+					"",
+					M{
+						"namingContexts": A{testServer.GetSuffix()},
+					},
+				},
+			},
+		},
+		StartTLS{&AssertResponse{}},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestSecurityPolicyRequireAuthentication(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	setSecurityPolicy(t, &server.SecurityPolicy{
+		RequireAuthentication: true,
+		// Stronger than any cipher suite, but StartTLS is exempted
+		MinSSF: map[string]int{"extended": 512, "update": 512},
+	})
+
+	tcs := []Command{
+		Conn{},
+		SearchWithControlsError{
+			testServer.GetSuffix(),
+			"objectClass=*",
+			ldap.ScopeBaseObject,
+			nil,
+			&AssertResponse{ldap.LDAPResultStrongAuthRequired},
+		},
+		Search{
+			"",
+			"objectClass=*",
+			ldap.ScopeBaseObject,
+			A{"namingContexts"},
+			&AssertEntries{
+				ExpectEntry{
+					"",
+					"",
+					M{
+						"namingContexts": A{testServer.GetSuffix()},
+					},
+				},
+			},
+		},
+		StartTLS{&AssertResponse{}},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("example", "dc=com").SetAssert(&AssertLDAPError{ldap.LDAPResultConfidentialityRequired}),
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestOAuthBearerNetworkRestriction(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	user := func(uid string) Add {
+		return Add{
+			"uid=" + uid, "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"cn":           A{uid},
+				"sn":           A{uid},
+				"userPassword": A{SSHA("password1")},
+			},
+			&AssertEntry{},
+		}
+	}
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		user("user1"),
+		// The restricted user is allowed only from 10.0.0.0/8 by the test server
+		user("restricted"),
+		OAuthBearerBind{"user1", &AssertResponse{}},
+		OAuthBearerBind{"restricted", &AssertResponse{ldap.LDAPResultInvalidCredentials}},
+		// Simple bind is restricted too, the correct password gets the same response as the wrong one
+		Bind{"uid=restricted,ou=Users", "password1", &AssertResponse{ldap.LDAPResultInvalidCredentials}},
+		Bind{"uid=restricted,ou=Users", "wrong", &AssertResponse{ldap.LDAPResultInvalidCredentials}},
+		Bind{"uid=user1,ou=Users", "password1", &AssertResponse{}},
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestVerifyCache(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"cn":           A{"user1"},
+				"sn":           A{"user1"},
+				"userPassword": A{SSHA("password1")},
+			},
+			&AssertEntry{},
+		},
+		// Only root can verify the cache
+		VerifyCache{"uid=user1,ou=Users", "password1", false, &AssertVerifyCache{expect: ldap.LDAPResultInsufficientAccessRights}},
+		VerifyCache{"uid=user1,ou=Users", "password1", true, &AssertVerifyCache{expect: ldap.LDAPResultInsufficientAccessRights}},
+		VerifyCache{"cn=Manager", "secret", false, &AssertVerifyCache{}},
+	}
+
+	if _, ok := testServer.Repo().(*repo.DefaultRepository); ok {
+		tcs = append(tcs,
+			// Break the cache by updating DB without the changelog
+			ExecSQL{`UPDATE entry SET attrs_orig = jsonb_set(attrs_orig, '{sn}', '["changed"]'),
+				attrs_norm = jsonb_set(attrs_norm, '{sn}', '["changed"]') WHERE rdn_norm = 'uid=user1'`},
+			VerifyCache{"cn=Manager", "secret", false, &AssertVerifyCache{diffs: []repo.CacheDiffKind{repo.CacheDiffMismatch}}},
+			VerifyCache{"cn=Manager", "secret", true, &AssertVerifyCache{diffs: []repo.CacheDiffKind{repo.CacheDiffMismatch}, repaired: 1}},
+			VerifyCache{"cn=Manager", "secret", false, &AssertVerifyCache{}},
+			Search{
+				"ou=Users," + testServer.GetSuffix(),
+				"sn=changed",
+				ldap.ScopeWholeSubtree,
+				A{"sn"},
+				&AssertEntries{
+					ExpectEntry{
+						"uid=user1",
+						"ou=Users",
+						M{
+							"sn": A{"changed"},
+						},
+					},
+				},
+			},
+		)
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestModifyMembers(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	user := func(uid string) Add {
+		return Add{
+			"uid=" + uid, "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"cn":           A{uid},
+				"sn":           A{uid},
+				"userPassword": A{SSHA("password1")},
+			},
+			&AssertEntry{},
+		}
+	}
+	userDN := func(uid string) string {
+		return "uid=" + uid + ",ou=Users," + testServer.GetSuffix()
+	}
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		AddOU("Groups"),
+		user("user1"),
+		user("user2"),
+		user("user3"),
+		user("reader"),
+		Add{
+			"cn=group1", "ou=Groups",
+			M{
+				"objectClass": A{"groupOfNames"},
+				"member":      A{userDN("user1")},
+			},
+			&AssertEntry{},
+		},
+		ModifyAdd{
+			"cn=group1", "ou=Groups",
+			M{
+				"member": A{userDN("user2")},
+			},
+			&AssertEntry{
+				M{
+					"member": A{userDN("user1"), userDN("user2")},
+				},
+			},
+		},
+		// Same as the modification of the other attributes
+		ModifyAdd{
+			"cn=group1", "ou=Groups",
+			M{
+				"member": A{userDN("user1")},
+			},
+			&AssertLDAPError{ldap.LDAPResultAttributeOrValueExists},
+		},
+		ModifyDelete{
+			"cn=group1", "ou=Groups",
+			M{
+				"member": A{userDN("user3")},
+			},
+			&AssertLDAPError{ldap.LDAPResultNoSuchAttribute},
+		},
+		ModifyDelete{
+			"cn=group1", "ou=Groups",
+			M{
+				"member": A{userDN("missing")},
+			},
+			&AssertLDAPError{ldap.LDAPResultNoSuchAttribute},
+		},
+		// groupOfNames requires member
+		ModifyDelete{
+			"cn=group1", "ou=Groups",
+			M{
+				"member": A{userDN("user1"), userDN("user2")},
+			},
+			&AssertLDAPError{ldap.LDAPResultObjectClassViolation},
+		},
+		ModifyDelete{
+			"cn=group1", "ou=Groups",
+			M{
+				"member": A{userDN("user1")},
+			},
+			&AssertEntry{
+				M{
+					"member": A{userDN("user2")},
+				},
+			},
+		},
+		Search{
+			"ou=Users," + testServer.GetSuffix(),
+			"memberOf=cn=group1,ou=Groups," + testServer.GetSuffix(),
+			ldap.ScopeWholeSubtree,
+			A{"memberOf"},
+			&AssertEntries{
+				ExpectEntry{
+					"uid=user2",
+					"ou=Users",
+					M{
+						"memberOf": A{"cn=group1,ou=Groups," + testServer.GetSuffix()},
+					},
+				},
+			},
+		},
+		// The reader isn't allowed to modify the group
+		Bind{"uid=reader,ou=Users", "password1", &AssertResponse{}},
+		ModifyAdd{
+			"cn=group1", "ou=Groups",
+			M{
+				"member": A{userDN("user3")},
+			},
+			&AssertLDAPError{ldap.LDAPResultInsufficientAccessRights},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
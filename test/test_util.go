@@ -4,9 +4,18 @@ package test
 
 import (
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math/big"
+	"net"
 	"os"
 	"reflect"
 	"strings"
@@ -24,6 +33,7 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/pkg/errors"
 	"golang.org/x/xerrors"
+	ber "gopkg.in/asn1-ber.v1"
 )
 
 func IntegrationTestRunner(m *testing.M) int {
@@ -130,6 +140,288 @@ func (c Bind) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
 	return conn, err
 }
 
+type BindName struct {
+	name     string
+	password string
+	assert   *AssertResponse
+}
+
+func (c BindName) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	err := conn.Bind(c.name, c.password)
+	err = c.assert.AssertResponse(conn, err)
+	return conn, err
+}
+
+// AnonymousBind sends the simple bind without the name and the password.
+type AnonymousBind struct {
+	assert *AssertResponse
+}
+
+func (c AnonymousBind) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	err := conn.UnauthenticatedBind("")
+	err = c.assert.AssertResponse(conn, err)
+	return conn, err
+}
+
+type StartTLS struct {
+	assert *AssertResponse
+}
+
+func (c StartTLS) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	err := conn.StartTLS(&tls.Config{InsecureSkipVerify: true})
+	err = c.assert.AssertResponse(conn, err)
+	return conn, err
+}
+
+// OAuthBearerBind binds by SASL OAUTHBEARER with the bearer token of the uid.
+// It uses another connection because go-ldap doesn't support OAUTHBEARER.
+type OAuthBearerBind struct {
+	uid    string
+	assert *AssertResponse
+}
+
+func (c OAuthBearerBind) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	raw, err := net.Dial("tcp", "127.0.0.1:8389")
+	if err != nil {
+		return conn, err
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(10 * time.Second))
+
+	sasl := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "SaslCredentials")
+	sasl.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "OAUTHBEARER", "mechanism"))
+	sasl.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString,
+		"n,,\x01auth=Bearer "+oauthBearerToken(c.uid)+"\x01\x01", "credentials"))
+
+	bind := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 0, nil, "BindRequest")
+	bind.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "version"))
+	bind.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "name"))
+	bind.AppendChild(sasl)
+
+	msg := ber.NewSequence("LDAPMessage")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "messageID"))
+	msg.AppendChild(bind)
+
+	if _, err := raw.Write(msg.Bytes()); err != nil {
+		return conn, err
+	}
+
+	res, err := ber.ReadPacket(raw)
+	if err != nil {
+		return conn, err
+	}
+	if len(res.Children) < 2 || len(res.Children[1].Children) < 3 {
+		return conn, errors.Errorf("Unexpected bind response")
+	}
+	code, _ := res.Children[1].Children[0].Value.(int64)
+	diag, _ := res.Children[1].Children[2].Value.(string)
+
+	if code != ldap.LDAPResultSuccess {
+		err = ldap.NewError(uint16(code), errors.New(diag))
+	}
+	err = c.assert.AssertResponse(conn, err)
+	return conn, err
+}
+
+// VerifyCache sends the verify cache extended operation after the simple bind.
+// It uses another connection because go-ldap doesn't support the arbitrary extended operation.
+type VerifyCache struct {
+	rdn      string
+	password string
+	repair   bool
+	assert   *AssertVerifyCache
+}
+
+func (c VerifyCache) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	raw, err := net.Dial("tcp", "127.0.0.1:8389")
+	if err != nil {
+		return conn, err
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(30 * time.Second))
+
+	bind := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 0, nil, "BindRequest")
+	bind.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "version"))
+	bind.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, c.rdn+","+testServer.GetSuffix(), "name"))
+	bind.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, c.password, "password"))
+
+	res, err := sendRawRequest(raw, 1, bind)
+	if err != nil {
+		return conn, err
+	}
+	if code, _ := res.Children[0].Value.(int64); code != ldap.LDAPResultSuccess {
+		return conn, errors.Errorf("Unexpected bind response code. got: %d", code)
+	}
+
+	value, _ := json.Marshal(server.VerifyCacheRequest{Repair: c.repair})
+
+	ext := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 23, nil, "ExtendedRequest")
+	ext.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, server.VerifyCacheExtendedOID, "requestName"))
+	ext.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, string(value), "requestValue"))
+
+	res, err = sendRawRequest(raw, 2, ext)
+	if err != nil {
+		return conn, err
+	}
+	code, _ := res.Children[0].Value.(int64)
+
+	var result *repo.CacheVerifyResult
+	for _, child := range res.Children[3:] {
+		// responseValue [11]
+		if child.ClassType == ber.ClassContext && child.Tag == 11 {
+			result = &repo.CacheVerifyResult{}
+			if err := json.Unmarshal(child.Data.Bytes(), result); err != nil {
+				return conn, errors.Wrapf(err, "Unexpected response value: %s", child.Data.String())
+			}
+		}
+	}
+
+	err = c.assert.AssertVerifyCache(uint16(code), result)
+	return conn, err
+}
+
+// sendRawRequest sends the protocol op with the message ID, then returns the protocol op of the response.
+func sendRawRequest(raw net.Conn, id int64, op *ber.Packet) (*ber.Packet, error) {
+	msg := ber.NewSequence("LDAPMessage")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "messageID"))
+	msg.AppendChild(op)
+
+	if _, err := raw.Write(msg.Bytes()); err != nil {
+		return nil, err
+	}
+
+	res, err := ber.ReadPacket(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Children) < 2 || len(res.Children[1].Children) < 3 {
+		return nil, errors.Errorf("Unexpected response: %s", op.Description)
+	}
+	return res.Children[1], nil
+}
+
+type AssertVerifyCache struct {
+	expect   uint16
+	diffs    []repo.CacheDiffKind
+	repaired int
+}
+
+func (a AssertVerifyCache) AssertVerifyCache(code uint16, result *repo.CacheVerifyResult) error {
+	if code != a.expect {
+		return errors.Errorf("Unexpected verify cache response code. want: %d got: %d", a.expect, code)
+	}
+	if a.expect != ldap.LDAPResultSuccess {
+		if result != nil {
+			return errors.Errorf("Unexpected verify cache result. want: no result got: %v", result)
+		}
+		return nil
+	}
+	if result == nil {
+		return errors.Errorf("Unexpected verify cache result. want: result got: no result")
+	}
+
+	kinds := []repo.CacheDiffKind{}
+	for _, d := range result.Diffs {
+		kinds = append(kinds, d.Kind)
+	}
+	if a.diffs == nil {
+		a.diffs = []repo.CacheDiffKind{}
+	}
+	if !reflect.DeepEqual(kinds, a.diffs) {
+		return errors.Errorf("Unexpected verify cache diffs. want: %v got: %v", a.diffs, result.Diffs)
+	}
+	if result.Repaired != a.repaired {
+		return errors.Errorf("Unexpected verify cache repaired. want: %d got: %d", a.repaired, result.Repaired)
+	}
+	return nil
+}
+
+// ExecSQL executes the query to PostgreSQL directly, e.g. to break the cache.
+type ExecSQL struct {
+	query string
+}
+
+func (e ExecSQL) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	db, err := sql.Open("postgres", fmt.Sprintf("host=127.0.0.1 port=%d user=dev password=dev dbname=ldap sslmode=disable search_path=public", testPGPort))
+	if err != nil {
+		return conn, err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(e.query)
+	return conn, err
+}
+
+// testOAuthBearerKey signs the bearer tokens for OAUTHBEARER bind of the test server
+var testOAuthBearerKey *rsa.PrivateKey
+
+const (
+	testOAuthBearerIssuer   = "https://idp.example.com"
+	testOAuthBearerAudience = "cloudldap"
+)
+
+func setupOAuthBearer() *server.OAuthBearerConfig {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("Failed to generate OAUTHBEARER key: %v", err)
+	}
+	testOAuthBearerKey = key
+
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kid": "test",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			},
+		},
+	})
+	f, err := os.CreateTemp("", "cloudldap-jwks-*.json")
+	if err != nil {
+		log.Fatalf("Failed to create JWKS file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(jwks); err != nil {
+		log.Fatalf("Failed to write JWKS file: %v", err)
+	}
+
+	return &server.OAuthBearerConfig{
+		JWKSFile:   f.Name(),
+		Issuer:     testOAuthBearerIssuer,
+		Audience:   testOAuthBearerAudience,
+		UserSearch: "ou=Users,dc=example,dc=com:(uid=%s)",
+	}
+}
+
+func oauthBearerToken(sub string) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(map[string]interface{}{
+		"iss": testOAuthBearerIssuer,
+		"aud": testOAuthBearerAudience,
+		"sub": sub,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, testOAuthBearerKey, crypto.SHA256, digest[:])
+	if err != nil {
+		log.Fatalf("Failed to sign bearer token: %v", err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// setSecurityPolicy enables the security policy of the test server during the test.
+func setSecurityPolicy(t *testing.T, p *server.SecurityPolicy) {
+	testServer.Config().SecurityPolicy = p
+	t.Cleanup(func() {
+		testServer.Config().SecurityPolicy = nil
+	})
+}
+
 func AddDC(dc string, parents ...string) Add {
 	type A []string
 	type M map[string][]string
@@ -179,7 +471,7 @@ type ModifyAdd struct {
 	rdn    string
 	baseDN string
 	attrs  map[string][]string
-	assert *AssertEntry
+	assert Assert
 }
 
 type ModifyReplace struct {
@@ -193,7 +485,7 @@ type ModifyDelete struct {
 	rdn    string
 	baseDN string
 	attrs  map[string][]string
-	assert *AssertEntry
+	assert Assert
 }
 
 type ModifyDN struct {
@@ -247,6 +539,67 @@ func (s Search) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
 	return conn, nil
 }
 
+type SearchWithControls struct {
+	baseDN   string
+	filter   string
+	scope    int
+	attrs    []string
+	controls []ldap.Control
+	assert   *AssertEntries
+}
+
+func (s SearchWithControls) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	search := ldap.NewSearchRequest(
+		s.baseDN,
+		s.scope,
+		ldap.NeverDerefAliases,
+		0, // Size Limit
+		0, // Time Limit
+		false,
+		"("+s.filter+")", // The filter to apply
+		s.attrs,          // A list attributes to retrieve
+		s.controls,
+	)
+	sr, err := conn.Search(search)
+	if err != nil {
+		return conn, err
+	}
+
+	if s.assert != nil {
+		err = s.assert.AssertEntries(conn, err, sr)
+		if err != nil {
+			return conn, err
+		}
+	}
+
+	return conn, nil
+}
+
+// SearchWithControlsError expects the error response of the search with the controls.
+type SearchWithControlsError struct {
+	baseDN   string
+	filter   string
+	scope    int
+	controls []ldap.Control
+	assert   *AssertResponse
+}
+
+func (s SearchWithControlsError) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	search := ldap.NewSearchRequest(
+		s.baseDN,
+		s.scope,
+		ldap.NeverDerefAliases,
+		0, // Size Limit
+		0, // Time Limit
+		false,
+		"("+s.filter+")", // The filter to apply
+		nil,
+		s.controls,
+	)
+	_, err := conn.Search(search)
+	return conn, s.assert.AssertResponse(conn, err)
+}
+
 func resolveDN(rdn, baseDN string) string {
 	dn := rdn
 	if baseDN != "" {
@@ -684,6 +1037,8 @@ func setupLDAPServer() *server.Server {
 	hostname, _ := os.Hostname()
 	testServer = server.NewServer(&server.ServerConfig{
 		DBRepositoryConfig: &repo.DBRepositoryConfig{
+			// e.g. memory:// runs the tests without PostgreSQL
+			URL:            os.Getenv("CLOUDLDAP_TEST_DB_URL"),
 			DBHostName:     "localhost",
 			DBPort:         testPGPort,
 			DBName:         "ldap",
@@ -692,7 +1047,11 @@ func setupLDAPServer() *server.Server {
 			DBPassword:     "dev",
 			DBMaxOpenConns: 2,
 			DBMaxIdleConns: 1,
-			ServerID:       fmt.Sprintf("%s:%d", hostname, testPGPort),
+			// e.g. native runs the tests without Reindexer
+			CacheIndex: os.Getenv("CLOUDLDAP_TEST_CACHE_INDEX"),
+			// e.g. sql runs the tests with the search by SQL
+			SearchMode: os.Getenv("CLOUDLDAP_TEST_SEARCH_MODE"),
+			ServerID:   fmt.Sprintf("%s:%d", hostname, testPGPort),
 		},
 		SchemaConfig: &schema.SchemaConfig{
 			Suffix: "dc=example,dc=com",
@@ -703,6 +1062,19 @@ func setupLDAPServer() *server.Server {
 		LogLevel:    "warn",
 		PProfServer: "127.0.0.1:10000",
 		GoMaxProcs:  0,
+		SimpleACL: []string{
+			"uid=reader,ou=Users,dc=example,dc=com:R:",
+			"uid=auditor,ou=Users,dc=example,dc=com:RG:",
+		},
+		BindNameRules: []string{
+			"upn:ou=Users,dc=example,dc=com:(mail=%s)",
+			"any:ou=Users,dc=example,dc=com:(uid=%u)",
+		},
+		OAuthBearerConfig: setupOAuthBearer(),
+		NetworkRestrictionConfig: &server.NetworkRestrictionConfig{
+			// The tests connect from 127.0.0.1
+			Rules: []string{"uid=restricted,ou=Users,dc=example,dc=com:10.0.0.0/8"},
+		},
 	})
 	go testServer.Start()
 
@@ -725,13 +1097,20 @@ func setupLDAPServer() *server.Server {
 func truncateTables() {
 	log.Printf("info: Truncate tables")
 
+	if r, ok := testServer.Repo().(*repo.LocalRepository); ok {
+		if err := r.Reset(context.Background()); err != nil {
+			log.Fatal("reset repository error:", err)
+		}
+		return
+	}
+
 	db, err := sql.Open("postgres", fmt.Sprintf("host=127.0.0.1 port=%d user=dev password=dev dbname=ldap sslmode=disable search_path=public", testPGPort))
 	if err != nil {
 		log.Fatal("db connection error:", err)
 	}
 	defer db.Close()
 
-	_, err = db.Exec("TRUNCATE entry")
+	_, err = db.Exec("TRUNCATE entry, association")
 	if err != nil {
 		log.Fatal("truncate table error:", err)
 	}
@@ -47,6 +47,27 @@ func (e *LDAPError) IsAccountLocking() bool {
 	return e.Code == ldap.LDAPResultInvalidCredentials && e.Subtype == "Account locking"
 }
 
+// IsAccountUnusable returns true if the credential is valid but the account status doesn't allow to bind.
+func (e *LDAPError) IsAccountUnusable() bool {
+	if e.Code != ldap.LDAPResultInvalidCredentials {
+		return false
+	}
+	switch e.Subtype {
+	case "Account locked", "Account expired", "Password expired", "Account disabled", "Login restricted":
+		return true
+	}
+	return false
+}
+
+// IsNetworkRestricted returns true if the bind is refused by the client address before checking the credential.
+func (e *LDAPError) IsNetworkRestricted() bool {
+	return e.Code == ldap.LDAPResultInvalidCredentials && e.Subtype == "Network restricted"
+}
+
+func (e *LDAPError) IsPasswordExpired() bool {
+	return e.Code == ldap.LDAPResultInvalidCredentials && e.Subtype == "Password expired"
+}
+
 func (e *LDAPError) IsAttributeOrValueExists() bool {
 	return e.Code == ldap.LDAPResultAttributeOrValueExists
 }
@@ -92,6 +113,13 @@ func NewNoUserModificationAllowedConstraintViolation(attr string) *LDAPError {
 	}
 }
 
+func NewConstraintViolation(msg string) *LDAPError {
+	return &LDAPError{
+		Code: 19,
+		Msg:  msg,
+	}
+}
+
 func NewTypeOrValueExists(op, attr string, valueidx int) *LDAPError {
 	return &LDAPError{
 		Code: 20,
@@ -153,6 +181,54 @@ func NewAccountLocked() *LDAPError {
 	}
 }
 
+func NewAccountExpired(msg string) *LDAPError {
+	return &LDAPError{
+		Code:    ldap.LDAPResultInvalidCredentials,
+		Msg:     msg,
+		Subtype: "Account expired",
+	}
+}
+
+func NewPasswordExpired() *LDAPError {
+	return &LDAPError{
+		Code:    ldap.LDAPResultInvalidCredentials,
+		Msg:     "password expired",
+		Subtype: "Password expired",
+	}
+}
+
+func NewAccountDisabled() *LDAPError {
+	return &LDAPError{
+		Code:    ldap.LDAPResultInvalidCredentials,
+		Msg:     "account disabled",
+		Subtype: "Account disabled",
+	}
+}
+
+func NewLoginRestricted() *LDAPError {
+	return &LDAPError{
+		Code:    ldap.LDAPResultInvalidCredentials,
+		Msg:     "login not permitted at this time",
+		Subtype: "Login restricted",
+	}
+}
+
+// NewNetworkRestricted returns the same response as the invalid credentials,
+// the client outside the allowed networks can't know whether the password is correct.
+func NewNetworkRestricted() *LDAPError {
+	return &LDAPError{
+		Code:    ldap.LDAPResultInvalidCredentials,
+		Subtype: "Network restricted",
+	}
+}
+
+func NewInappropriateAuthentication(msg string) *LDAPError {
+	return &LDAPError{
+		Code: ldap.LDAPResultInappropriateAuthentication,
+		Msg:  msg,
+	}
+}
+
 func NewInsufficientAccess() *LDAPError {
 	return &LDAPError{
 		Code: 50,
@@ -247,6 +323,20 @@ func NewOperationsError() *LDAPError {
 	}
 }
 
+func NewProtocolError(msg string) *LDAPError {
+	return &LDAPError{
+		Code: ldap.LDAPResultProtocolError,
+		Msg:  msg,
+	}
+}
+
+func NewUnwillingToPerform(msg string) *LDAPError {
+	return &LDAPError{
+		Code: ldap.LDAPResultUnwillingToPerform,
+		Msg:  msg,
+	}
+}
+
 type RetryError struct {
 	err error
 }